@@ -0,0 +1,138 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"log/slog"
+	"strings"
+	"time"
+
+	"github.com/gwuah/accounts/internal/repos"
+	"github.com/gwuah/accounts/internal/services"
+)
+
+const usage = `usage:
+  accounts                                     run the http server
+  accounts interest accrue [-until 2006-01-02]  accrue interest up to a day, yesterday by default
+  accounts interest capitalize [-month 2006-01] post the interest accrued up to the end of a month, last month by default
+  accounts verify                              verify the accounts' hash chains, failing at the first broken link
+  accounts integrity                           print a trial balance & the ledger's inconsistencies, failing if there are any
+  accounts apikey create -name admin -scopes '*' [-signed] create an api key, eg. the first one`
+
+// runCommand runs the subcommand given in args, instead of the http server.
+func runCommand(ctx context.Context, logger *slog.Logger, db *sql.DB, args []string) error {
+	tr := repos.NewTransactions(logger, db)
+
+	if len(args) == 1 && args[0] == "verify" {
+		result, err := services.VerifyLedger(ctx, tr)
+		if err != nil {
+			return err
+		}
+		if result.BrokenAt != nil {
+			return fmt.Errorf("ledger chain broken at line %d after %d verified lines: %s", *result.BrokenAt, result.Verified, result.Reason)
+		}
+		fmt.Printf("verified %d lines\n", result.Verified)
+		return nil
+	}
+
+	if len(args) == 1 && args[0] == "integrity" {
+		report, err := services.CheckIntegrity(ctx, tr)
+		if err != nil {
+			return err
+		}
+		out, err := json.MarshalIndent(report, "", "  ")
+		if err != nil {
+			return err
+		}
+		fmt.Println(string(out))
+		if !report.OK {
+			return errors.New("the ledger is inconsistent")
+		}
+		return nil
+	}
+
+	if len(args) > 1 && args[0] == "apikey" && args[1] == "create" {
+		flags := flag.NewFlagSet("apikey create", flag.ContinueOnError)
+		name := flags.String("name", "", "what the key is for")
+		scopes := flags.String("scopes", "", "comma separated scopes, eg. accounts:read,transactions:write")
+		signed := flags.Bool("signed", false, "whether the key's requests must be signed")
+		if err := flags.Parse(args[2:]); err != nil {
+			return err
+		}
+		if *name == "" {
+			return errors.New("-name is required")
+		}
+
+		kr := repos.NewAPIKeys(logger, db)
+		tx, err := kr.GetTx(ctx)
+		if err != nil {
+			return err
+		}
+		key, err := services.CreateAPIKey(ctx, tx, kr, *name, strings.Split(*scopes, ","), *signed)
+		if err != nil {
+			tx.Rollback()
+			return err
+		}
+		if err := tx.Commit(); err != nil {
+			return err
+		}
+		fmt.Printf("created api key %d, it won't be shown again: %s\n", key.ID, key.Key)
+		if key.Signed {
+			fmt.Printf("its requests must be signed with: %s\n", key.SigningSecret)
+		}
+		return nil
+	}
+
+	if len(args) < 2 || args[0] != "interest" {
+		return errors.New(usage)
+	}
+
+	ar := repos.NewAccount(logger, db)
+	ir := repos.NewInterest(logger, db)
+	wr := repos.NewWebhooks(logger, db)
+	today := time.Now().UTC().Truncate(24 * time.Hour)
+
+	switch args[1] {
+	case "accrue":
+		flags := flag.NewFlagSet("interest accrue", flag.ContinueOnError)
+		until := flags.String("until", today.AddDate(0, 0, -1).Format(time.DateOnly), "last day to accrue")
+		if err := flags.Parse(args[2:]); err != nil {
+			return err
+		}
+		day, err := time.Parse(time.DateOnly, *until)
+		if err != nil {
+			return fmt.Errorf("-until must be a date (2006-01-02). %w", err)
+		}
+
+		n, err := services.AccrueInterest(ctx, logger, tr, ir, day)
+		if err != nil {
+			return err
+		}
+		fmt.Printf("created %d accruals\n", n)
+		return nil
+
+	case "capitalize":
+		flags := flag.NewFlagSet("interest capitalize", flag.ContinueOnError)
+		month := flags.String("month", today.AddDate(0, -1, 0).Format("2006-01"), "last month to capitalize")
+		if err := flags.Parse(args[2:]); err != nil {
+			return err
+		}
+		start, err := time.Parse("2006-01", *month)
+		if err != nil {
+			return fmt.Errorf("-month must be a month (2006-01). %w", err)
+		}
+
+		n, err := services.CapitalizeInterest(ctx, logger, ar, tr, ir, wr, start.AddDate(0, 1, 0))
+		if err != nil {
+			return err
+		}
+		fmt.Printf("posted %d interest transactions\n", n)
+		return nil
+	}
+
+	return errors.New(usage)
+}
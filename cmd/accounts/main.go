@@ -2,7 +2,6 @@ package main
 
 import (
 	"context"
-	"database/sql"
 	"fmt"
 	"log/slog"
 	"net"
@@ -17,6 +16,7 @@ import (
 	"github.com/gwuah/accounts/internal/database"
 	"github.com/gwuah/accounts/internal/repos"
 	"github.com/gwuah/accounts/internal/services"
+	"github.com/gwuah/accounts/pkg"
 )
 
 func requestLogger(next http.Handler, logger *slog.Logger) http.Handler {
@@ -24,38 +24,24 @@ func requestLogger(next http.Handler, logger *slog.Logger) http.Handler {
 		start := time.Now()
 		next.ServeHTTP(w, r)
 		path, _ := mux.CurrentRoute(r).GetPathTemplate()
+		apiKey, userID := "", 0
+		if principal := services.PrincipalFromContext(r.Context()); principal != nil {
+			if principal.APIKey != nil {
+				apiKey = principal.APIKey.Prefix
+			}
+			userID = principal.UserID
+		}
 		logger.Info("new request",
 			"method", r.Method,
 			"path", path,
+			"api_key", apiKey,
+			"user_id", userID,
 			"timestamp", start,
 			"duration", time.Since(start).String(),
 		)
 	})
 }
 
-func runSeeds(db *sql.DB) error {
-	// create 1 user for the bank
-	// create 1 account for the banks user
-	tx, err := db.Begin()
-	if err != nil {
-		return err
-	}
-
-	_, err = tx.Exec("insert into users (email) values ($1) on conflict do nothing;", "primary@accounts.com")
-	if err != nil {
-		tx.Rollback()
-		return err
-	}
-
-	_, err = tx.Exec("insert into accounts (user_id, account_number) values ($1,$2) on conflict do nothing;", 1, "000000000")
-	if err != nil {
-		tx.Rollback()
-		return err
-	}
-
-	return tx.Commit()
-}
-
 func main() {
 	doneCh := make(chan os.Signal, 1)
 	signal.Notify(doneCh, syscall.SIGHUP, syscall.SIGTERM, syscall.SIGQUIT, syscall.SIGINT)
@@ -74,16 +60,65 @@ func main() {
 		os.Exit(1)
 	}
 
-	err = runSeeds(db.Instance())
+	err = database.RunSeeds(db.Instance())
 	if err != nil {
 		logger.Error("failed to run seeds", "err", err)
 		os.Exit(1)
 	}
+
+	if len(os.Args) > 1 {
+		if err := runCommand(ctx, logger, db.Instance(), os.Args[1:]); err != nil {
+			logger.Error("command failed", "err", err)
+			os.Exit(1)
+		}
+		os.Exit(0)
+	}
+
 	ar := repos.NewAccount(logger, db.Instance())
 	ur := repos.NewUsers(logger, db.Instance())
 	tr := repos.NewTransactions(logger, db.Instance())
+	fr := repos.NewFX(logger, db.Instance())
+	hr := repos.NewHolds(logger, db.Instance())
+	fer := repos.NewFees(logger, db.Instance())
+	ir := repos.NewInterest(logger, db.Instance())
+	wr := repos.NewWebhooks(logger, db.Instance())
+	kr := repos.NewAPIKeys(logger, db.Instance())
+	rr := repos.NewRBAC(logger, db.Instance())
+	apr := repos.NewApprovals(logger, db.Instance())
+
+	go services.ExpireHolds(ctx, logger, hr, time.Minute)
+	go services.VerifyBalances(ctx, logger, tr, time.Hour)
+	go services.SnapshotBalances(ctx, logger, tr, time.Hour)
+	go services.RunInterest(ctx, logger, ar, tr, ir, wr, time.Hour)
+	go services.RunWebhooks(ctx, logger, wr, &http.Client{Timeout: 10 * time.Second}, 5*time.Second)
+
+	// users authenticate with tokens from the identity provider, whose keys are in a local copy of its jwks.
+	var verifier *pkg.JWTVerifier
+	if cfg.JWKS_FILE != "" {
+		verifier, err = pkg.LoadJWTVerifier(cfg.JWKS_FILE, cfg.JWT_ISSUER, cfg.JWT_AUDIENCE)
+		if err != nil {
+			logger.Error("failed to load jwks", "err", err)
+			os.Exit(1)
+		}
+	}
+
+	// buckets are kept in postgres when several instances of the service share the limits.
+	var limiter services.RateLimitStore = services.NewMemoryRateLimitStore()
+	if cfg.RATE_LIMIT_STORE == config.RATE_LIMIT_STORE_POSTGRES {
+		limiter = repos.NewRateLimits(logger, db.Instance())
+	}
+	limits := services.RateLimits{
+		Default:      pkg.RateLimit{PerMinute: cfg.RATE_LIMIT_PER_MINUTE, Burst: cfg.RATE_LIMIT_BURST},
+		Transactions: pkg.RateLimit{PerMinute: cfg.TRANSACTION_RATE_LIMIT_PER_MINUTE, Burst: cfg.TRANSACTION_RATE_LIMIT_BURST},
+		IP:           pkg.RateLimit{PerMinute: cfg.IP_RATE_LIMIT_PER_MINUTE, Burst: cfg.IP_RATE_LIMIT_BURST},
+	}
 
 	r := mux.NewRouter()
+	r.Use(services.RateLimitIPs(logger, limiter, limits))
+	r.Use(services.Authenticate(logger, kr, rr, verifier))
+	r.Use(services.RateLimit(logger, limiter, limits))
+	r.Use(services.VerifySignatures(logger, repos.NewNonces(logger, db.Instance())))
+	r.Use(services.Idempotency(logger, repos.NewIdempotency(logger, db.Instance())))
 	r.Use(func(h http.Handler) http.Handler {
 		return requestLogger(h, logger)
 	})
@@ -91,9 +126,20 @@ func main() {
 		w.Write([]byte("ok"))
 	})
 
-	services.AddUserRoutes(logger, r, ar, ur)
-	services.AddAccountRoutes(logger, r, ar, ur, tr)
-	services.AddTransactionRoutes(logger, r, ar, ur, tr)
+	services.AddUserRoutes(logger, r, ar, ur, wr)
+	services.AddAccountRoutes(logger, r, ar, ur, tr, wr)
+	services.AddAccountStatusRoutes(logger, r, ar, tr, ir, wr)
+	services.AddTransactionRoutes(logger, r, ar, ur, tr, fr, fer, wr, apr)
+	services.AddFXRoutes(logger, r, fr)
+	services.AddHoldRoutes(logger, r, ar, tr, hr, wr)
+	services.AddJournalEntryRoutes(logger, r, ar, tr, wr)
+	services.AddFeeRoutes(logger, r, fer)
+	services.AddInterestRoutes(logger, r, ar, ir)
+	services.AddWebhookRoutes(logger, r, wr)
+	services.AddLedgerRoutes(logger, r, tr)
+	services.AddAPIKeyRoutes(logger, r, kr)
+	services.AddRBACRoutes(logger, r, rr, ur)
+	services.AddApprovalRoutes(logger, r, ar, tr, fr, fer, wr, apr)
 
 	server := &http.Server{
 		Handler: r,
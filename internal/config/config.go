@@ -1,16 +1,34 @@
 package config
 
-import "os"
+import (
+	"os"
+	"strconv"
+)
 
 const (
 	ENV_LOCAL = "local"
 )
 
+const (
+	RATE_LIMIT_STORE_MEMORY   = "memory"
+	RATE_LIMIT_STORE_POSTGRES = "postgres"
+)
+
 func New() *Config {
 	return &Config{
-		DB_URL: os.Getenv("DB_URL"),
-		PORT:   os.Getenv("PORT"),
-		ENV:    os.Getenv("ENV"),
+		DB_URL:                            os.Getenv("DB_URL"),
+		PORT:                              os.Getenv("PORT"),
+		ENV:                               os.Getenv("ENV"),
+		JWKS_FILE:                         os.Getenv("JWKS_FILE"),
+		JWT_ISSUER:                        os.Getenv("JWT_ISSUER"),
+		JWT_AUDIENCE:                      os.Getenv("JWT_AUDIENCE"),
+		RATE_LIMIT_STORE:                  getEnv("RATE_LIMIT_STORE", RATE_LIMIT_STORE_MEMORY),
+		RATE_LIMIT_PER_MINUTE:             getEnvInt("RATE_LIMIT_PER_MINUTE", 600),
+		RATE_LIMIT_BURST:                  getEnvInt("RATE_LIMIT_BURST", 100),
+		TRANSACTION_RATE_LIMIT_PER_MINUTE: getEnvInt("TRANSACTION_RATE_LIMIT_PER_MINUTE", 60),
+		TRANSACTION_RATE_LIMIT_BURST:      getEnvInt("TRANSACTION_RATE_LIMIT_BURST", 10),
+		IP_RATE_LIMIT_PER_MINUTE:          getEnvInt("IP_RATE_LIMIT_PER_MINUTE", 1200),
+		IP_RATE_LIMIT_BURST:               getEnvInt("IP_RATE_LIMIT_BURST", 200),
 	}
 }
 
@@ -18,4 +36,33 @@ type Config struct {
 	DB_URL string `json:"db_url"`
 	PORT   string `json:"port"`
 	ENV    string `json:"env"`
+	// JWKS_FILE is the keys end user tokens are verified with. Only api keys are accepted when it's unset.
+	JWKS_FILE    string `json:"jwks_file"`
+	JWT_ISSUER   string `json:"jwt_issuer"`
+	JWT_AUDIENCE string `json:"jwt_audience"`
+	// RATE_LIMIT_STORE is where the rate limits' buckets are kept, in memory or in postgres when there are several instances.
+	// The limits are per client, ie. api key or user, on top of a limit per ip applied before requests are authenticated.
+	// Limits of 0 turn rate limiting off.
+	RATE_LIMIT_STORE                  string `json:"rate_limit_store"`
+	RATE_LIMIT_PER_MINUTE             int    `json:"rate_limit_per_minute"`
+	RATE_LIMIT_BURST                  int    `json:"rate_limit_burst"`
+	TRANSACTION_RATE_LIMIT_PER_MINUTE int    `json:"transaction_rate_limit_per_minute"`
+	TRANSACTION_RATE_LIMIT_BURST      int    `json:"transaction_rate_limit_burst"`
+	IP_RATE_LIMIT_PER_MINUTE          int    `json:"ip_rate_limit_per_minute"`
+	IP_RATE_LIMIT_BURST               int    `json:"ip_rate_limit_burst"`
+}
+
+func getEnv(name, fallback string) string {
+	if v := os.Getenv(name); v != "" {
+		return v
+	}
+	return fallback
+}
+
+func getEnvInt(name string, fallback int) int {
+	v, err := strconv.Atoi(os.Getenv(name))
+	if err != nil {
+		return fallback
+	}
+	return v
 }
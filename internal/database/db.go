@@ -4,6 +4,7 @@ import (
 	"context"
 	"database/sql"
 	"errors"
+	"strings"
 
 	"github.com/gwuah/accounts/internal/config"
 	_ "github.com/lib/pq"
@@ -65,6 +66,14 @@ func pqconn(ctx context.Context, url string, opts ...migrator.Option) (*sql.DB,
 }
 
 func liteconn(ctx context.Context, url string, opts ...migrator.Option) (*sql.DB, error) {
+	// sqlite has no row locks, so transactions take the write lock as soon as they begin (instead of on their first write)
+	// and wait for it rather than failing. This serializes balance checks the same way row locks do on postgres.
+	separator := "?"
+	if strings.Contains(url, "?") {
+		separator = "&"
+	}
+	url += separator + "_txlock=immediate&_busy_timeout=10000"
+
 	db, err := sql.Open("sqlite3", url)
 	if err != nil {
 		return nil, err
@@ -2,7 +2,10 @@ package database
 
 import (
 	"database/sql"
+	"encoding/json"
+	"time"
 
+	"github.com/gwuah/accounts/pkg"
 	"github.com/lopezator/migrator"
 )
 
@@ -61,6 +64,498 @@ var (
 		// execsql(
 		// 	"disable_deletes_on_transaction_lines", "CREATE RULE no_deletes_on_transaction_lines AS ON DELETE TO transaction_lines DO INSTEAD NOTHING;",
 		// ),
+		execsql(
+			"add_currency_to_accounts",
+			"alter table accounts add column currency VARCHAR(3) NOT NULL DEFAULT 'USD';",
+		),
+		execsql(
+			"create_fx_rates",
+			`create table if not exists fx_rates (
+				id SERIAL PRIMARY KEY,
+				base_currency VARCHAR(3) NOT NULL,
+				quote_currency VARCHAR(3) NOT NULL,
+				rate NUMERIC(24, 12) NOT NULL,
+				spread_bps INTEGER NOT NULL DEFAULT 0,
+				effective_at TIMESTAMP WITH TIME ZONE NOT NULL,
+				created_at TIMESTAMP WITH TIME ZONE DEFAULT CURRENT_TIMESTAMP,
+				updated_at TIMESTAMP WITH TIME ZONE DEFAULT CURRENT_TIMESTAMP
+			);`,
+		),
+		execsql(
+			"create_fx_rates_pair_index",
+			"create index fx_rates_pair_idx on fx_rates(base_currency, quote_currency, effective_at);",
+		),
+		execsql(
+			"create_fx_conversions",
+			`create table if not exists fx_conversions (
+				id SERIAL PRIMARY KEY,
+				transaction_id INTEGER UNIQUE NOT NULL,
+				rate_id INTEGER NOT NULL,
+				base_currency VARCHAR(3) NOT NULL,
+				quote_currency VARCHAR(3) NOT NULL,
+				rate NUMERIC(24, 12) NOT NULL,
+				spread_bps INTEGER NOT NULL,
+				source_amount BIGINT NOT NULL,
+				destination_amount BIGINT NOT NULL,
+				spread_amount BIGINT NOT NULL,
+				created_at TIMESTAMP WITH TIME ZONE DEFAULT CURRENT_TIMESTAMP,
+				updated_at TIMESTAMP WITH TIME ZONE DEFAULT CURRENT_TIMESTAMP,
+				FOREIGN KEY (transaction_id) REFERENCES transactions(id) ON DELETE CASCADE,
+				FOREIGN KEY (rate_id) REFERENCES fx_rates(id)
+			);`,
+		),
+		execsql(
+			"create_holds",
+			`create table if not exists holds (
+				id SERIAL PRIMARY KEY,
+				reference VARCHAR(100) UNIQUE NOT NULL,
+				account_id INTEGER NOT NULL,
+				destination_account_id INTEGER NOT NULL,
+				amount BIGINT NOT NULL,
+				captured_amount BIGINT NOT NULL DEFAULT 0,
+				status VARCHAR(20) NOT NULL,
+				expires_at TIMESTAMP WITH TIME ZONE NOT NULL,
+				transaction_id INTEGER,
+				created_at TIMESTAMP WITH TIME ZONE DEFAULT CURRENT_TIMESTAMP,
+				updated_at TIMESTAMP WITH TIME ZONE DEFAULT CURRENT_TIMESTAMP,
+				FOREIGN KEY (account_id) REFERENCES accounts(id) ON DELETE CASCADE,
+				FOREIGN KEY (destination_account_id) REFERENCES accounts(id) ON DELETE CASCADE,
+				FOREIGN KEY (transaction_id) REFERENCES transactions(id)
+			);`,
+		),
+		execsql(
+			"create_holds_account_index",
+			"create index holds_account_idx on holds(account_id, status);",
+		),
+		execsql(
+			"add_type_to_transactions",
+			"alter table transactions add column type VARCHAR(20) NOT NULL DEFAULT 'transfer';",
+		),
+		execsql(
+			"add_amount_to_transactions",
+			"alter table transactions add column amount BIGINT;",
+		),
+		execsql(
+			"add_source_account_to_transactions",
+			"alter table transactions add column source_account_id INTEGER REFERENCES accounts(id);",
+		),
+		execsql(
+			"add_destination_account_to_transactions",
+			"alter table transactions add column destination_account_id INTEGER REFERENCES accounts(id);",
+		),
+		execsql(
+			"add_original_transaction_to_transactions",
+			"alter table transactions add column original_transaction_id INTEGER REFERENCES transactions(id);",
+		),
+		execsql(
+			"create_transactions_original_index",
+			"create index transactions_original_idx on transactions(original_transaction_id);",
+		),
+		execsql(
+			// transactions with a single debit/credit pair are deposits (funded by a genesis account), transfers or hold captures.
+			"backfill_transactions_principal",
+			`update transactions set
+				amount = (select amount from transaction_lines where transaction_id = transactions.id and purpose = 'debit'),
+				source_account_id = (select account_id from transaction_lines where transaction_id = transactions.id and purpose = 'debit'),
+				destination_account_id = (select account_id from transaction_lines where transaction_id = transactions.id and purpose = 'credit'),
+				type = case
+					when id in (select transaction_id from holds where transaction_id is not null) then 'capture'
+					when exists (
+						select 1 from transaction_lines l join accounts a on a.id = l.account_id
+						where l.transaction_id = transactions.id and l.purpose = 'debit' and a.account_number like '000000%'
+					) then 'deposit'
+					else 'transfer' end
+			where (select count(*) from transaction_lines where transaction_id = transactions.id) = 2;`,
+		),
+		execsql(
+			// fx transfers have their principal in fx_conversions, their customer legs are the ones outside the system account range.
+			"backfill_fx_transactions_principal",
+			`update transactions set
+				type = 'fx_transfer',
+				amount = (select source_amount from fx_conversions where transaction_id = transactions.id),
+				source_account_id = (
+					select l.account_id from transaction_lines l join accounts a on a.id = l.account_id
+					where l.transaction_id = transactions.id and l.purpose = 'debit' and a.account_number not like '000%'
+				),
+				destination_account_id = (
+					select l.account_id from transaction_lines l join accounts a on a.id = l.account_id
+					where l.transaction_id = transactions.id and l.purpose = 'credit' and a.account_number not like '000%'
+				)
+			where id in (select transaction_id from fx_conversions);`,
+		),
+		execsql(
+			"create_balances",
+			`create table if not exists balances (
+				account_id INTEGER PRIMARY KEY,
+				balance BIGINT NOT NULL DEFAULT 0,
+				version BIGINT NOT NULL DEFAULT 0,
+				updated_at TIMESTAMP WITH TIME ZONE DEFAULT CURRENT_TIMESTAMP,
+				FOREIGN KEY (account_id) REFERENCES accounts(id) ON DELETE CASCADE
+			);`,
+		),
+		execsql(
+			"backfill_balances",
+			`insert into balances (account_id, balance, version)
+				select a.id, coalesce(sum(case when l.purpose = 'credit' then l.amount else -l.amount end), 0), count(l.id)
+				from accounts a
+				left join transaction_lines l on l.account_id = a.id
+				group by a.id;`,
+		),
+		execsql(
+			"create_balance_snapshots",
+			`create table if not exists balance_snapshots (
+				id SERIAL PRIMARY KEY,
+				account_id INTEGER NOT NULL,
+				balance BIGINT NOT NULL,
+				snapshot_at TIMESTAMP WITH TIME ZONE NOT NULL,
+				created_at TIMESTAMP WITH TIME ZONE DEFAULT CURRENT_TIMESTAMP,
+				FOREIGN KEY (account_id) REFERENCES accounts(id) ON DELETE CASCADE
+			);`,
+		),
+		execsql(
+			"create_balance_snapshots_account_index",
+			"create unique index balance_snapshots_account_idx on balance_snapshots(account_id, snapshot_at);",
+		),
+		execsql(
+			"create_transaction_lines_account_index",
+			"create index transaction_lines_account_idx on transaction_lines(account_id, created_at);",
+		),
+		execsql(
+			"drop_unique_transaction_lines_index",
+			"drop index transaction_lines_unique_idx;",
+		),
+		execsql(
+			"create_transaction_lines_transaction_index",
+			"create index transaction_lines_transaction_idx on transaction_lines(transaction_id);",
+		),
+		execsql(
+			"add_tier_to_accounts",
+			"alter table accounts add column tier VARCHAR(50) NOT NULL DEFAULT 'standard';",
+		),
+		execsql(
+			"create_fee_rules",
+			`create table if not exists fee_rules (
+				id SERIAL PRIMARY KEY,
+				transaction_type VARCHAR(50) NOT NULL,
+				account_tier VARCHAR(50) NOT NULL,
+				currency VARCHAR(3) NOT NULL,
+				min_amount BIGINT NOT NULL DEFAULT 0,
+				flat_fee BIGINT NOT NULL DEFAULT 0,
+				percentage_bps BIGINT NOT NULL DEFAULT 0,
+				min_fee BIGINT NOT NULL DEFAULT 0,
+				max_fee BIGINT NOT NULL DEFAULT 0,
+				created_at TIMESTAMP WITH TIME ZONE DEFAULT CURRENT_TIMESTAMP,
+				updated_at TIMESTAMP WITH TIME ZONE DEFAULT CURRENT_TIMESTAMP
+			);`,
+		),
+		execsql(
+			"create_fee_rules_band_index",
+			"create unique index fee_rules_band_idx on fee_rules(transaction_type, account_tier, currency, min_amount);",
+		),
+		execsql(
+			"create_interest_configs",
+			`create table if not exists interest_configs (
+				account_id INTEGER PRIMARY KEY,
+				apr NUMERIC NOT NULL,
+				day_count VARCHAR(10) NOT NULL,
+				effective_from TIMESTAMP WITH TIME ZONE NOT NULL,
+				created_at TIMESTAMP WITH TIME ZONE DEFAULT CURRENT_TIMESTAMP,
+				updated_at TIMESTAMP WITH TIME ZONE DEFAULT CURRENT_TIMESTAMP,
+				FOREIGN KEY (account_id) REFERENCES accounts(id) ON DELETE CASCADE
+			);`,
+		),
+		execsql(
+			"create_interest_accruals",
+			`create table if not exists interest_accruals (
+				id SERIAL PRIMARY KEY,
+				account_id INTEGER NOT NULL,
+				accrual_date TIMESTAMP WITH TIME ZONE NOT NULL,
+				balance BIGINT NOT NULL,
+				apr NUMERIC NOT NULL,
+				day_count VARCHAR(10) NOT NULL,
+				amount NUMERIC NOT NULL,
+				transaction_id INTEGER,
+				created_at TIMESTAMP WITH TIME ZONE DEFAULT CURRENT_TIMESTAMP,
+				FOREIGN KEY (account_id) REFERENCES accounts(id) ON DELETE CASCADE,
+				FOREIGN KEY (transaction_id) REFERENCES transactions(id)
+			);`,
+		),
+		execsql(
+			"create_interest_accruals_account_index",
+			"create unique index interest_accruals_account_idx on interest_accruals(account_id, accrual_date);",
+		),
+		execsql(
+			"add_type_to_accounts",
+			"alter table accounts add column type VARCHAR(50) NOT NULL DEFAULT 'deposit';",
+		),
+		execsql(
+			"add_overdraft_limit_to_accounts",
+			"alter table accounts add column overdraft_limit BIGINT NOT NULL DEFAULT 0 CHECK (overdraft_limit >= 0);",
+		),
+		execsql(
+			"create_account_limit_changes",
+			`create table if not exists account_limit_changes (
+				id SERIAL PRIMARY KEY,
+				account_id INTEGER NOT NULL,
+				previous_limit BIGINT NOT NULL,
+				new_limit BIGINT NOT NULL,
+				reason TEXT NOT NULL,
+				changed_by VARCHAR(255) NOT NULL,
+				created_at TIMESTAMP WITH TIME ZONE DEFAULT CURRENT_TIMESTAMP,
+				FOREIGN KEY (account_id) REFERENCES accounts(id) ON DELETE CASCADE
+			);`,
+		),
+		execsql(
+			"create_account_limit_changes_account_index",
+			"create index account_limit_changes_account_idx on account_limit_changes(account_id, created_at);",
+		),
+		execsql(
+			"add_status_to_accounts",
+			"alter table accounts add column status VARCHAR(50) NOT NULL DEFAULT 'active';",
+		),
+		execsql(
+			"create_account_status_changes",
+			`create table if not exists account_status_changes (
+				id SERIAL PRIMARY KEY,
+				account_id INTEGER NOT NULL,
+				previous_status VARCHAR(50) NOT NULL,
+				new_status VARCHAR(50) NOT NULL,
+				reason TEXT NOT NULL,
+				created_at TIMESTAMP WITH TIME ZONE DEFAULT CURRENT_TIMESTAMP,
+				FOREIGN KEY (account_id) REFERENCES accounts(id) ON DELETE CASCADE
+			);`,
+		),
+		execsql(
+			"create_account_status_changes_account_index",
+			"create index account_status_changes_account_idx on account_status_changes(account_id, created_at);",
+		),
+		execsql(
+			"add_deleted_at_to_users",
+			"alter table users add column deleted_at TIMESTAMP WITH TIME ZONE;",
+		),
+		execsql(
+			"add_erased_at_to_users",
+			"alter table users add column erased_at TIMESTAMP WITH TIME ZONE;",
+		),
+		execsql(
+			"add_deleted_at_to_accounts",
+			"alter table accounts add column deleted_at TIMESTAMP WITH TIME ZONE;",
+		),
+		execsql(
+			"create_outbox_events",
+			`create table if not exists outbox_events (
+				id SERIAL PRIMARY KEY,
+				type VARCHAR(100) NOT NULL,
+				payload TEXT NOT NULL,
+				dispatched_at TIMESTAMP WITH TIME ZONE,
+				created_at TIMESTAMP WITH TIME ZONE DEFAULT CURRENT_TIMESTAMP
+			);`,
+		),
+		execsql(
+			"create_outbox_events_undispatched_index",
+			"create index outbox_events_undispatched_idx on outbox_events(id) where dispatched_at is null;",
+		),
+		execsql(
+			"create_webhook_endpoints",
+			`create table if not exists webhook_endpoints (
+				id SERIAL PRIMARY KEY,
+				url TEXT NOT NULL,
+				secret VARCHAR(255) NOT NULL,
+				events TEXT NOT NULL,
+				created_at TIMESTAMP WITH TIME ZONE DEFAULT CURRENT_TIMESTAMP,
+				updated_at TIMESTAMP WITH TIME ZONE DEFAULT CURRENT_TIMESTAMP
+			);`,
+		),
+		execsql(
+			"create_webhook_deliveries",
+			`create table if not exists webhook_deliveries (
+				id SERIAL PRIMARY KEY,
+				event_id INTEGER NOT NULL,
+				endpoint_id INTEGER NOT NULL,
+				status VARCHAR(50) NOT NULL,
+				attempts INTEGER NOT NULL DEFAULT 0,
+				next_attempt_at TIMESTAMP WITH TIME ZONE NOT NULL,
+				last_error TEXT NOT NULL DEFAULT '',
+				delivered_at TIMESTAMP WITH TIME ZONE,
+				created_at TIMESTAMP WITH TIME ZONE DEFAULT CURRENT_TIMESTAMP,
+				updated_at TIMESTAMP WITH TIME ZONE DEFAULT CURRENT_TIMESTAMP,
+				FOREIGN KEY (event_id) REFERENCES outbox_events(id),
+				FOREIGN KEY (endpoint_id) REFERENCES webhook_endpoints(id) ON DELETE CASCADE
+			);`,
+		),
+		execsql(
+			"create_webhook_deliveries_unique_index",
+			"create unique index webhook_deliveries_unique_idx on webhook_deliveries(event_id, endpoint_id);",
+		),
+		execsql(
+			"create_webhook_deliveries_due_index",
+			"create index webhook_deliveries_due_idx on webhook_deliveries(status, next_attempt_at);",
+		),
+		execsql(
+			"add_prev_hash_to_transaction_lines",
+			"alter table transaction_lines add column prev_hash VARCHAR(64);",
+		),
+		execsql(
+			"add_hash_to_transaction_lines",
+			"alter table transaction_lines add column hash VARCHAR(64);",
+		),
+		// lines are chained per account rather than in one ledger wide chain: postings already lock the accounts they
+		// touch, so appending to their chains adds no contention, where a single head would serialize every posting.
+		execsql(
+			"create_account_chains",
+			`create table if not exists account_chains (
+				account_id INTEGER PRIMARY KEY,
+				line_id INTEGER NOT NULL,
+				hash VARCHAR(64) NOT NULL,
+				FOREIGN KEY (account_id) REFERENCES accounts(id)
+			);`,
+		),
+		execsql(
+			"enable_updates_on_transaction_lines", "DROP RULE no_updates_on_transaction_lines ON transaction_lines;",
+		),
+		backfillLineHashes(),
+		execsql(
+			"disable_updates_on_transaction_lines_again", "CREATE RULE no_updates_on_transaction_lines AS ON UPDATE TO transaction_lines DO INSTEAD NOTHING;",
+		),
+		// deletes fail rather than being ignored, so attempts at tampering with the ledger don't go unnoticed.
+		execsql(
+			"create_prevent_transaction_lines_delete_function",
+			`CREATE FUNCTION prevent_transaction_lines_delete() RETURNS trigger AS $$
+				BEGIN
+					RAISE EXCEPTION 'Deletes from transaction_lines are not allowed.';
+				END;
+			$$ LANGUAGE plpgsql;`,
+		),
+		execsql(
+			"create_transaction_lines_delete_trigger",
+			`CREATE TRIGGER prevent_transaction_lines_delete
+				BEFORE DELETE ON transaction_lines
+				FOR EACH ROW EXECUTE FUNCTION prevent_transaction_lines_delete();`,
+		),
+		execsql(
+			"create_transaction_lines_account_prev_hash_index",
+			"create unique index transaction_lines_account_prev_hash_idx on transaction_lines(account_id, prev_hash);",
+		),
+		execsql(
+			"create_api_keys",
+			`create table if not exists api_keys (
+				id SERIAL PRIMARY KEY,
+				name VARCHAR(100) NOT NULL,
+				prefix VARCHAR(20) NOT NULL,
+				key_hash VARCHAR(64) UNIQUE NOT NULL,
+				scopes TEXT NOT NULL,
+				expires_at TIMESTAMP WITH TIME ZONE,
+				revoked_at TIMESTAMP WITH TIME ZONE,
+				created_at TIMESTAMP WITH TIME ZONE DEFAULT CURRENT_TIMESTAMP,
+				updated_at TIMESTAMP WITH TIME ZONE DEFAULT CURRENT_TIMESTAMP
+			);`,
+		),
+		execsql(
+			"create_roles",
+			`create table if not exists roles (
+				id SERIAL PRIMARY KEY,
+				name VARCHAR(50) UNIQUE NOT NULL,
+				created_at TIMESTAMP WITH TIME ZONE DEFAULT CURRENT_TIMESTAMP,
+				updated_at TIMESTAMP WITH TIME ZONE DEFAULT CURRENT_TIMESTAMP
+			);`,
+		),
+		execsql(
+			"create_role_permissions",
+			`create table if not exists role_permissions (
+				id SERIAL PRIMARY KEY,
+				role_id INTEGER NOT NULL,
+				permission VARCHAR(50) NOT NULL,
+				created_at TIMESTAMP WITH TIME ZONE DEFAULT CURRENT_TIMESTAMP,
+				UNIQUE (role_id, permission),
+				FOREIGN KEY (role_id) REFERENCES roles(id) ON DELETE CASCADE
+			);`,
+		),
+		execsql(
+			"create_role_bindings",
+			`create table if not exists role_bindings (
+				id SERIAL PRIMARY KEY,
+				role_id INTEGER NOT NULL,
+				user_id INTEGER NOT NULL,
+				created_at TIMESTAMP WITH TIME ZONE DEFAULT CURRENT_TIMESTAMP,
+				UNIQUE (role_id, user_id),
+				FOREIGN KEY (role_id) REFERENCES roles(id) ON DELETE CASCADE,
+				FOREIGN KEY (user_id) REFERENCES users(id)
+			);`,
+		),
+		execsql(
+			"create_approvals",
+			`create table if not exists approvals (
+				id SERIAL PRIMARY KEY,
+				action VARCHAR(50) NOT NULL,
+				payload TEXT NOT NULL,
+				status VARCHAR(20) NOT NULL,
+				maker VARCHAR(50) NOT NULL,
+				checker VARCHAR(50) NOT NULL DEFAULT '',
+				decided_at TIMESTAMP WITH TIME ZONE,
+				created_at TIMESTAMP WITH TIME ZONE DEFAULT CURRENT_TIMESTAMP,
+				updated_at TIMESTAMP WITH TIME ZONE DEFAULT CURRENT_TIMESTAMP
+			);`,
+		),
+		execsql(
+			"create_rate_limits",
+			`create table if not exists rate_limits (
+				key VARCHAR(200) PRIMARY KEY,
+				tokens DOUBLE PRECISION NOT NULL,
+				updated_at TIMESTAMP WITH TIME ZONE NOT NULL
+			);`,
+		),
+		execsql(
+			"add_signing_secret_to_api_keys",
+			"alter table api_keys add column signing_secret VARCHAR(100) NOT NULL DEFAULT '';",
+		),
+		execsql(
+			"create_request_nonces",
+			`create table if not exists request_nonces (
+				nonce VARCHAR(200) PRIMARY KEY,
+				expires_at TIMESTAMP WITH TIME ZONE NOT NULL
+			);`,
+		),
+		execsql(
+			"create_request_nonces_expiry_index",
+			"create index request_nonces_expires_at_idx on request_nonces(expires_at);",
+		),
+		execsql(
+			"create_idempotency_keys",
+			`create table if not exists idempotency_keys (
+				id SERIAL PRIMARY KEY,
+				client VARCHAR(50) NOT NULL,
+				idempotency_key VARCHAR(255) NOT NULL,
+				fingerprint VARCHAR(64) NOT NULL,
+				status VARCHAR(20) NOT NULL,
+				response_code INTEGER NOT NULL DEFAULT 0,
+				response_body TEXT NOT NULL DEFAULT '',
+				created_at TIMESTAMP WITH TIME ZONE DEFAULT CURRENT_TIMESTAMP,
+				updated_at TIMESTAMP WITH TIME ZONE DEFAULT CURRENT_TIMESTAMP,
+				UNIQUE (client, idempotency_key)
+			);`,
+		),
+		execsql(
+			"add_lineage_to_api_keys",
+			"alter table api_keys add column lineage TEXT NOT NULL DEFAULT '';",
+		),
+		execsql(
+			"backfill_api_keys_lineage",
+			"update api_keys set lineage = 'api_key:' || prefix where lineage = '';",
+		),
+		// principals are named after api keys' lineages, which grow with every key issuing another.
+		execsql(
+			"widen_approvals_principals",
+			"alter table approvals alter column maker type TEXT, alter column checker type TEXT;",
+		),
+		execsql(
+			"widen_rate_limits_key",
+			"alter table rate_limits alter column key type TEXT;",
+		),
+		execsql(
+			"widen_idempotency_keys_client",
+			"alter table idempotency_keys alter column client type TEXT;",
+		),
+		redactUserEvents(),
 	)
 	sqliteMigrations = migrator.Migrations(
 
@@ -124,6 +619,545 @@ var (
 					SELECT RAISE(FAIL, 'Updates to transaction_lines are not allowed.');
 				END;`,
 		),
+
+		execsql(
+			"add_currency_to_accounts",
+			"alter table accounts add column currency VARCHAR(3) NOT NULL DEFAULT 'USD';",
+		),
+
+		execsql(
+			"create_fx_rates",
+			`create table if not exists fx_rates (
+				id INTEGER PRIMARY KEY AUTOINCREMENT,
+				base_currency VARCHAR(3) NOT NULL,
+				quote_currency VARCHAR(3) NOT NULL,
+				rate TEXT NOT NULL,
+				spread_bps INTEGER NOT NULL DEFAULT 0,
+				effective_at DATETIME NOT NULL,
+				created_at DATETIME DEFAULT CURRENT_TIMESTAMP,
+				updated_at DATETIME DEFAULT CURRENT_TIMESTAMP
+			);`,
+		),
+
+		execsql(
+			"create_fx_rates_pair_index",
+			"create index fx_rates_pair_idx on fx_rates(base_currency, quote_currency, effective_at);",
+		),
+
+		execsql(
+			"create_fx_conversions",
+			`create table if not exists fx_conversions (
+				id INTEGER PRIMARY KEY AUTOINCREMENT,
+				transaction_id INTEGER UNIQUE NOT NULL,
+				rate_id INTEGER NOT NULL,
+				base_currency VARCHAR(3) NOT NULL,
+				quote_currency VARCHAR(3) NOT NULL,
+				rate TEXT NOT NULL,
+				spread_bps INTEGER NOT NULL,
+				source_amount INTEGER NOT NULL,
+				destination_amount INTEGER NOT NULL,
+				spread_amount INTEGER NOT NULL,
+				created_at DATETIME DEFAULT CURRENT_TIMESTAMP,
+				updated_at DATETIME DEFAULT CURRENT_TIMESTAMP,
+				FOREIGN KEY (transaction_id) REFERENCES transactions(id) ON DELETE CASCADE,
+				FOREIGN KEY (rate_id) REFERENCES fx_rates(id)
+			);`,
+		),
+
+		execsql(
+			"create_holds",
+			`create table if not exists holds (
+				id INTEGER PRIMARY KEY AUTOINCREMENT,
+				reference VARCHAR(100) UNIQUE NOT NULL,
+				account_id INTEGER NOT NULL,
+				destination_account_id INTEGER NOT NULL,
+				amount INTEGER NOT NULL,
+				captured_amount INTEGER NOT NULL DEFAULT 0,
+				status VARCHAR(20) NOT NULL,
+				expires_at DATETIME NOT NULL,
+				transaction_id INTEGER,
+				created_at DATETIME DEFAULT CURRENT_TIMESTAMP,
+				updated_at DATETIME DEFAULT CURRENT_TIMESTAMP,
+				FOREIGN KEY (account_id) REFERENCES accounts(id) ON DELETE CASCADE,
+				FOREIGN KEY (destination_account_id) REFERENCES accounts(id) ON DELETE CASCADE,
+				FOREIGN KEY (transaction_id) REFERENCES transactions(id)
+			);`,
+		),
+
+		execsql(
+			"create_holds_account_index",
+			"create index holds_account_idx on holds(account_id, status);",
+		),
+
+		execsql(
+			"add_type_to_transactions",
+			"alter table transactions add column type VARCHAR(20) NOT NULL DEFAULT 'transfer';",
+		),
+
+		execsql(
+			"add_amount_to_transactions",
+			"alter table transactions add column amount INTEGER;",
+		),
+
+		execsql(
+			"add_source_account_to_transactions",
+			"alter table transactions add column source_account_id INTEGER REFERENCES accounts(id);",
+		),
+
+		execsql(
+			"add_destination_account_to_transactions",
+			"alter table transactions add column destination_account_id INTEGER REFERENCES accounts(id);",
+		),
+
+		execsql(
+			"add_original_transaction_to_transactions",
+			"alter table transactions add column original_transaction_id INTEGER REFERENCES transactions(id);",
+		),
+
+		execsql(
+			"create_transactions_original_index",
+			"create index transactions_original_idx on transactions(original_transaction_id);",
+		),
+
+		execsql(
+			// transactions with a single debit/credit pair are deposits (funded by a genesis account), transfers or hold captures.
+			"backfill_transactions_principal",
+			`update transactions set
+				amount = (select amount from transaction_lines where transaction_id = transactions.id and purpose = 'debit'),
+				source_account_id = (select account_id from transaction_lines where transaction_id = transactions.id and purpose = 'debit'),
+				destination_account_id = (select account_id from transaction_lines where transaction_id = transactions.id and purpose = 'credit'),
+				type = case
+					when id in (select transaction_id from holds where transaction_id is not null) then 'capture'
+					when exists (
+						select 1 from transaction_lines l join accounts a on a.id = l.account_id
+						where l.transaction_id = transactions.id and l.purpose = 'debit' and a.account_number like '000000%'
+					) then 'deposit'
+					else 'transfer' end
+			where (select count(*) from transaction_lines where transaction_id = transactions.id) = 2;`,
+		),
+		execsql(
+			// fx transfers have their principal in fx_conversions, their customer legs are the ones outside the system account range.
+			"backfill_fx_transactions_principal",
+			`update transactions set
+				type = 'fx_transfer',
+				amount = (select source_amount from fx_conversions where transaction_id = transactions.id),
+				source_account_id = (
+					select l.account_id from transaction_lines l join accounts a on a.id = l.account_id
+					where l.transaction_id = transactions.id and l.purpose = 'debit' and a.account_number not like '000%'
+				),
+				destination_account_id = (
+					select l.account_id from transaction_lines l join accounts a on a.id = l.account_id
+					where l.transaction_id = transactions.id and l.purpose = 'credit' and a.account_number not like '000%'
+				)
+			where id in (select transaction_id from fx_conversions);`,
+		),
+
+		execsql(
+			"create_balances",
+			`create table if not exists balances (
+				account_id INTEGER PRIMARY KEY,
+				balance INTEGER NOT NULL DEFAULT 0,
+				version INTEGER NOT NULL DEFAULT 0,
+				updated_at DATETIME DEFAULT CURRENT_TIMESTAMP,
+				FOREIGN KEY (account_id) REFERENCES accounts(id) ON DELETE CASCADE
+			);`,
+		),
+
+		execsql(
+			"backfill_balances",
+			`insert into balances (account_id, balance, version)
+				select a.id, coalesce(sum(case when l.purpose = 'credit' then l.amount else -l.amount end), 0), count(l.id)
+				from accounts a
+				left join transaction_lines l on l.account_id = a.id
+				group by a.id;`,
+		),
+
+		execsql(
+			"create_balance_snapshots",
+			`create table if not exists balance_snapshots (
+				id INTEGER PRIMARY KEY AUTOINCREMENT,
+				account_id INTEGER NOT NULL,
+				balance INTEGER NOT NULL,
+				snapshot_at DATETIME NOT NULL,
+				created_at DATETIME DEFAULT CURRENT_TIMESTAMP,
+				FOREIGN KEY (account_id) REFERENCES accounts(id) ON DELETE CASCADE
+			);`,
+		),
+
+		execsql(
+			"create_balance_snapshots_account_index",
+			"create unique index balance_snapshots_account_idx on balance_snapshots(account_id, snapshot_at);",
+		),
+
+		execsql(
+			"create_transaction_lines_account_index",
+			"create index transaction_lines_account_idx on transaction_lines(account_id, created_at);",
+		),
+
+		execsql(
+			"drop_unique_transaction_lines_index",
+			"drop index transaction_lines_unique_idx;",
+		),
+
+		execsql(
+			"create_transaction_lines_transaction_index",
+			"create index transaction_lines_transaction_idx on transaction_lines(transaction_id);",
+		),
+
+		execsql(
+			"add_tier_to_accounts",
+			"alter table accounts add column tier TEXT NOT NULL DEFAULT 'standard';",
+		),
+
+		execsql(
+			"create_fee_rules",
+			`create table if not exists fee_rules (
+				id INTEGER PRIMARY KEY AUTOINCREMENT,
+				transaction_type TEXT NOT NULL,
+				account_tier TEXT NOT NULL,
+				currency TEXT NOT NULL,
+				min_amount INTEGER NOT NULL DEFAULT 0,
+				flat_fee INTEGER NOT NULL DEFAULT 0,
+				percentage_bps INTEGER NOT NULL DEFAULT 0,
+				min_fee INTEGER NOT NULL DEFAULT 0,
+				max_fee INTEGER NOT NULL DEFAULT 0,
+				created_at DATETIME DEFAULT CURRENT_TIMESTAMP,
+				updated_at DATETIME DEFAULT CURRENT_TIMESTAMP
+			);`,
+		),
+
+		execsql(
+			"create_fee_rules_band_index",
+			"create unique index fee_rules_band_idx on fee_rules(transaction_type, account_tier, currency, min_amount);",
+		),
+
+		execsql(
+			"create_interest_configs",
+			`create table if not exists interest_configs (
+				account_id INTEGER PRIMARY KEY,
+				apr TEXT NOT NULL,
+				day_count TEXT NOT NULL,
+				effective_from DATETIME NOT NULL,
+				created_at DATETIME DEFAULT CURRENT_TIMESTAMP,
+				updated_at DATETIME DEFAULT CURRENT_TIMESTAMP,
+				FOREIGN KEY (account_id) REFERENCES accounts(id) ON DELETE CASCADE
+			);`,
+		),
+
+		execsql(
+			"create_interest_accruals",
+			`create table if not exists interest_accruals (
+				id INTEGER PRIMARY KEY AUTOINCREMENT,
+				account_id INTEGER NOT NULL,
+				accrual_date DATETIME NOT NULL,
+				balance INTEGER NOT NULL,
+				apr TEXT NOT NULL,
+				day_count TEXT NOT NULL,
+				amount TEXT NOT NULL,
+				transaction_id INTEGER,
+				created_at DATETIME DEFAULT CURRENT_TIMESTAMP,
+				FOREIGN KEY (account_id) REFERENCES accounts(id) ON DELETE CASCADE,
+				FOREIGN KEY (transaction_id) REFERENCES transactions(id)
+			);`,
+		),
+
+		execsql(
+			"create_interest_accruals_account_index",
+			"create unique index interest_accruals_account_idx on interest_accruals(account_id, accrual_date);",
+		),
+
+		execsql(
+			"add_type_to_accounts",
+			"alter table accounts add column type TEXT NOT NULL DEFAULT 'deposit';",
+		),
+
+		execsql(
+			"add_overdraft_limit_to_accounts",
+			"alter table accounts add column overdraft_limit INTEGER NOT NULL DEFAULT 0 CHECK (overdraft_limit >= 0);",
+		),
+
+		execsql(
+			"create_account_limit_changes",
+			`create table if not exists account_limit_changes (
+				id INTEGER PRIMARY KEY AUTOINCREMENT,
+				account_id INTEGER NOT NULL,
+				previous_limit INTEGER NOT NULL,
+				new_limit INTEGER NOT NULL,
+				reason TEXT NOT NULL,
+				changed_by TEXT NOT NULL,
+				created_at DATETIME DEFAULT CURRENT_TIMESTAMP,
+				FOREIGN KEY (account_id) REFERENCES accounts(id) ON DELETE CASCADE
+			);`,
+		),
+
+		execsql(
+			"create_account_limit_changes_account_index",
+			"create index account_limit_changes_account_idx on account_limit_changes(account_id, created_at);",
+		),
+
+		execsql(
+			"add_status_to_accounts",
+			"alter table accounts add column status TEXT NOT NULL DEFAULT 'active';",
+		),
+
+		execsql(
+			"create_account_status_changes",
+			`create table if not exists account_status_changes (
+				id INTEGER PRIMARY KEY AUTOINCREMENT,
+				account_id INTEGER NOT NULL,
+				previous_status TEXT NOT NULL,
+				new_status TEXT NOT NULL,
+				reason TEXT NOT NULL,
+				created_at DATETIME DEFAULT CURRENT_TIMESTAMP,
+				FOREIGN KEY (account_id) REFERENCES accounts(id) ON DELETE CASCADE
+			);`,
+		),
+
+		execsql(
+			"create_account_status_changes_account_index",
+			"create index account_status_changes_account_idx on account_status_changes(account_id, created_at);",
+		),
+
+		execsql(
+			"add_deleted_at_to_users",
+			"alter table users add column deleted_at DATETIME;",
+		),
+
+		execsql(
+			"add_erased_at_to_users",
+			"alter table users add column erased_at DATETIME;",
+		),
+
+		execsql(
+			"add_deleted_at_to_accounts",
+			"alter table accounts add column deleted_at DATETIME;",
+		),
+
+		execsql(
+			"create_outbox_events",
+			`create table if not exists outbox_events (
+				id INTEGER PRIMARY KEY AUTOINCREMENT,
+				type TEXT NOT NULL,
+				payload TEXT NOT NULL,
+				dispatched_at DATETIME,
+				created_at DATETIME DEFAULT CURRENT_TIMESTAMP
+			);`,
+		),
+
+		execsql(
+			"create_outbox_events_undispatched_index",
+			"create index outbox_events_undispatched_idx on outbox_events(id) where dispatched_at is null;",
+		),
+
+		execsql(
+			"create_webhook_endpoints",
+			`create table if not exists webhook_endpoints (
+				id INTEGER PRIMARY KEY AUTOINCREMENT,
+				url TEXT NOT NULL,
+				secret TEXT NOT NULL,
+				events TEXT NOT NULL,
+				created_at DATETIME DEFAULT CURRENT_TIMESTAMP,
+				updated_at DATETIME DEFAULT CURRENT_TIMESTAMP
+			);`,
+		),
+
+		execsql(
+			"create_webhook_deliveries",
+			`create table if not exists webhook_deliveries (
+				id INTEGER PRIMARY KEY AUTOINCREMENT,
+				event_id INTEGER NOT NULL,
+				endpoint_id INTEGER NOT NULL,
+				status TEXT NOT NULL,
+				attempts INTEGER NOT NULL DEFAULT 0,
+				next_attempt_at DATETIME NOT NULL,
+				last_error TEXT NOT NULL DEFAULT '',
+				delivered_at DATETIME,
+				created_at DATETIME DEFAULT CURRENT_TIMESTAMP,
+				updated_at DATETIME DEFAULT CURRENT_TIMESTAMP,
+				FOREIGN KEY (event_id) REFERENCES outbox_events(id),
+				FOREIGN KEY (endpoint_id) REFERENCES webhook_endpoints(id) ON DELETE CASCADE
+			);`,
+		),
+
+		execsql(
+			"create_webhook_deliveries_unique_index",
+			"create unique index webhook_deliveries_unique_idx on webhook_deliveries(event_id, endpoint_id);",
+		),
+
+		execsql(
+			"create_webhook_deliveries_due_index",
+			"create index webhook_deliveries_due_idx on webhook_deliveries(status, next_attempt_at);",
+		),
+
+		execsql(
+			"add_prev_hash_to_transaction_lines",
+			"alter table transaction_lines add column prev_hash TEXT;",
+		),
+
+		execsql(
+			"add_hash_to_transaction_lines",
+			"alter table transaction_lines add column hash TEXT;",
+		),
+
+		execsql(
+			"create_account_chains",
+			`create table if not exists account_chains (
+				account_id INTEGER PRIMARY KEY,
+				line_id INTEGER NOT NULL,
+				hash TEXT NOT NULL,
+				FOREIGN KEY (account_id) REFERENCES accounts(id)
+			);`,
+		),
+
+		execsql(
+			"drop_transaction_lines_update_trigger",
+			"DROP TRIGGER prevent_transaction_lines_update;",
+		),
+
+		backfillLineHashes(),
+
+		execsql(
+			"create_transaction_lines_update_trigger_again",
+			`CREATE TRIGGER prevent_transaction_lines_update
+				BEFORE UPDATE ON transaction_lines
+				BEGIN
+					SELECT RAISE(FAIL, 'Updates to transaction_lines are not allowed.');
+				END;`,
+		),
+
+		execsql(
+			"create_transaction_lines_delete_trigger",
+			`CREATE TRIGGER prevent_transaction_lines_delete
+				BEFORE DELETE ON transaction_lines
+				BEGIN
+					SELECT RAISE(FAIL, 'Deletes from transaction_lines are not allowed.');
+				END;`,
+		),
+
+		execsql(
+			"create_transaction_lines_account_prev_hash_index",
+			"create unique index transaction_lines_account_prev_hash_idx on transaction_lines(account_id, prev_hash);",
+		),
+
+		execsql(
+			"create_api_keys",
+			`create table if not exists api_keys (
+				id INTEGER PRIMARY KEY AUTOINCREMENT,
+				name TEXT NOT NULL,
+				prefix TEXT NOT NULL,
+				key_hash TEXT UNIQUE NOT NULL,
+				scopes TEXT NOT NULL,
+				expires_at DATETIME,
+				revoked_at DATETIME,
+				created_at DATETIME DEFAULT CURRENT_TIMESTAMP,
+				updated_at DATETIME DEFAULT CURRENT_TIMESTAMP
+			);`,
+		),
+
+		execsql(
+			"create_roles",
+			`create table if not exists roles (
+				id INTEGER PRIMARY KEY AUTOINCREMENT,
+				name TEXT UNIQUE NOT NULL,
+				created_at DATETIME DEFAULT CURRENT_TIMESTAMP,
+				updated_at DATETIME DEFAULT CURRENT_TIMESTAMP
+			);`,
+		),
+
+		execsql(
+			"create_role_permissions",
+			`create table if not exists role_permissions (
+				id INTEGER PRIMARY KEY AUTOINCREMENT,
+				role_id INTEGER NOT NULL,
+				permission TEXT NOT NULL,
+				created_at DATETIME DEFAULT CURRENT_TIMESTAMP,
+				UNIQUE (role_id, permission),
+				FOREIGN KEY (role_id) REFERENCES roles(id) ON DELETE CASCADE
+			);`,
+		),
+
+		execsql(
+			"create_role_bindings",
+			`create table if not exists role_bindings (
+				id INTEGER PRIMARY KEY AUTOINCREMENT,
+				role_id INTEGER NOT NULL,
+				user_id INTEGER NOT NULL,
+				created_at DATETIME DEFAULT CURRENT_TIMESTAMP,
+				UNIQUE (role_id, user_id),
+				FOREIGN KEY (role_id) REFERENCES roles(id) ON DELETE CASCADE,
+				FOREIGN KEY (user_id) REFERENCES users(id)
+			);`,
+		),
+
+		execsql(
+			"create_approvals",
+			`create table if not exists approvals (
+				id INTEGER PRIMARY KEY AUTOINCREMENT,
+				action TEXT NOT NULL,
+				payload TEXT NOT NULL,
+				status TEXT NOT NULL,
+				maker TEXT NOT NULL,
+				checker TEXT NOT NULL DEFAULT '',
+				decided_at DATETIME,
+				created_at DATETIME DEFAULT CURRENT_TIMESTAMP,
+				updated_at DATETIME DEFAULT CURRENT_TIMESTAMP
+			);`,
+		),
+
+		execsql(
+			"create_rate_limits",
+			`create table if not exists rate_limits (
+				key TEXT PRIMARY KEY,
+				tokens REAL NOT NULL,
+				updated_at DATETIME NOT NULL
+			);`,
+		),
+
+		execsql(
+			"add_signing_secret_to_api_keys",
+			"alter table api_keys add column signing_secret TEXT NOT NULL DEFAULT '';",
+		),
+
+		execsql(
+			"create_request_nonces",
+			`create table if not exists request_nonces (
+				nonce TEXT PRIMARY KEY,
+				expires_at DATETIME NOT NULL
+			);`,
+		),
+
+		execsql(
+			"create_request_nonces_expiry_index",
+			"create index request_nonces_expires_at_idx on request_nonces(expires_at);",
+		),
+
+		execsql(
+			"create_idempotency_keys",
+			`create table if not exists idempotency_keys (
+				id INTEGER PRIMARY KEY AUTOINCREMENT,
+				client TEXT NOT NULL,
+				idempotency_key TEXT NOT NULL,
+				fingerprint TEXT NOT NULL,
+				status TEXT NOT NULL,
+				response_code INTEGER NOT NULL DEFAULT 0,
+				response_body TEXT NOT NULL DEFAULT '',
+				created_at DATETIME DEFAULT CURRENT_TIMESTAMP,
+				updated_at DATETIME DEFAULT CURRENT_TIMESTAMP,
+				UNIQUE (client, idempotency_key)
+			);`,
+		),
+
+		execsql(
+			"add_lineage_to_api_keys",
+			"alter table api_keys add column lineage TEXT NOT NULL DEFAULT '';",
+		),
+
+		execsql(
+			"backfill_api_keys_lineage",
+			"update api_keys set lineage = 'api_key:' || prefix where lineage = '';",
+		),
+
+		redactUserEvents(),
 	)
 )
 
@@ -137,9 +1171,110 @@ func execsql(name, raw string) *migrator.MigrationNoTx {
 	}
 }
 
+// backfillLineHashes chains the lines posted before lines were hashed to the line before them on the same account,
+// in the order they were posted, and points each account's chain head at its last line. Updates to transaction_lines must be allowed while it runs.
+func backfillLineHashes() *migrator.Migration {
+	return &migrator.Migration{
+		Name: "backfill_transaction_line_hashes",
+		Func: func(tx *sql.Tx) error {
+			rows, err := tx.Query("select id, transaction_id, account_id, amount, purpose, created_at from transaction_lines order by account_id, id;")
+			if err != nil {
+				return err
+			}
+
+			type line struct {
+				id, transactionID, accountID int
+				amount                       int64
+				purpose                      string
+				createdAt                    time.Time
+			}
+			var lines []line
+			for rows.Next() {
+				var l line
+				if err := rows.Scan(&l.id, &l.transactionID, &l.accountID, &l.amount, &l.purpose, &l.createdAt); err != nil {
+					rows.Close()
+					return err
+				}
+				lines = append(lines, l)
+			}
+			rows.Close()
+			if err := rows.Err(); err != nil {
+				return err
+			}
+
+			prev := ""
+			for i, l := range lines {
+				if i > 0 && lines[i-1].accountID != l.accountID {
+					prev = ""
+				}
+				hash := pkg.LineHash(prev, l.transactionID, l.accountID, l.amount, l.purpose, l.createdAt)
+				if _, err := tx.Exec("update transaction_lines set prev_hash=$1, hash=$2 where id=$3;", prev, hash, l.id); err != nil {
+					return err
+				}
+				prev = hash
+
+				if i == len(lines)-1 || lines[i+1].accountID != l.accountID {
+					if _, err := tx.Exec("insert into account_chains (account_id, line_id, hash) values ($1, $2, $3);", l.accountID, l.id, hash); err != nil {
+						return err
+					}
+				}
+			}
+			return nil
+		},
+	}
+}
+
+// redactUserEvents strips the user.created events published before they left out personal data down to the user's id,
+// so erased users' emails aren't listed or replayed with their webhook deliveries.
+func redactUserEvents() *migrator.Migration {
+	return &migrator.Migration{
+		Name: "redact_user_created_events",
+		Func: func(tx *sql.Tx) error {
+			rows, err := tx.Query("select id, payload from outbox_events where type='user.created';")
+			if err != nil {
+				return err
+			}
+
+			type user struct {
+				ID        int       `json:"id"`
+				CreatedAt time.Time `json:"created_at"`
+			}
+			payloads := map[int][]byte{}
+			for rows.Next() {
+				var id int
+				var payload string
+				if err := rows.Scan(&id, &payload); err != nil {
+					rows.Close()
+					return err
+				}
+				var u user
+				if err := json.Unmarshal([]byte(payload), &u); err != nil {
+					rows.Close()
+					return err
+				}
+				if payloads[id], err = json.Marshal(u); err != nil {
+					rows.Close()
+					return err
+				}
+			}
+			rows.Close()
+			if err := rows.Err(); err != nil {
+				return err
+			}
+
+			for id, payload := range payloads {
+				if _, err := tx.Exec("update outbox_events set payload=$1 where id=$2;", string(payload), id); err != nil {
+					return err
+				}
+			}
+			return nil
+		},
+	}
+}
+
 func RunSeeds(db *sql.DB) error {
 	// create 1 user for the bank
-	// create 1 account for the banks user
+	// create the system accounts (genesis, fx position, ...) for the banks user
 	tx, err := db.Begin()
 	if err != nil {
 		return err
@@ -151,11 +1286,39 @@ func RunSeeds(db *sql.DB) error {
 		return err
 	}
 
-	_, err = tx.Exec("insert into accounts (user_id, account_number) values ($1,$2) on conflict do nothing;", 1, "000000000")
+	// every currency gets its own set of system accounts
+	for _, c := range pkg.Currencies() {
+		for _, role := range pkg.SystemAccountRoles() {
+			_, err = tx.Exec("insert into accounts (user_id, account_number, currency) values ($1,$2,$3) on conflict do nothing;", 1, pkg.SystemAccountNumber(role, c), c.Code)
+			if err != nil {
+				tx.Rollback()
+				return err
+			}
+		}
+	}
+
+	// the "where true" keeps sqlite from reading "on conflict" as part of the select.
+	_, err = tx.Exec("insert into balances (account_id) select id from accounts where true on conflict do nothing;")
 	if err != nil {
 		tx.Rollback()
 		return err
 	}
 
+	// the default roles are topped up on every start, so their permissions can't be taken away. custom roles can be, they're never touched.
+	for _, role := range pkg.DefaultRoles() {
+		_, err = tx.Exec("insert into roles (name) values ($1) on conflict do nothing;", role.Name)
+		if err != nil {
+			tx.Rollback()
+			return err
+		}
+		for _, permission := range role.Permissions {
+			_, err = tx.Exec("insert into role_permissions (role_id, permission) select id, $1 from roles where name=$2 on conflict do nothing;", permission, role.Name)
+			if err != nil {
+				tx.Rollback()
+				return err
+			}
+		}
+	}
+
 	return tx.Commit()
 }
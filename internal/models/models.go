@@ -1,6 +1,11 @@
 package models
 
-import "time"
+import (
+	"encoding/json"
+	"time"
+
+	"github.com/shopspring/decimal"
+)
 
 type Model struct {
 	ID        int        `json:"id"`
@@ -13,25 +18,353 @@ type Account struct {
 	Model
 	UserID        int    `json:"user_id"`
 	AccountNumber string `json:"account_number"`
+	Currency      string `json:"currency"`
+	Tier          string `json:"tier"`
+	Type          string `json:"type"`
+	Status        string `json:"status"`
+
+	// OverdraftLimit is how far below zero the account's balance can go, a credit line's credit limit.
+	OverdraftLimit   decimal.Decimal `json:"overdraft_limit"`
+	Balance          decimal.Decimal `json:"balance"`
+	AvailableBalance decimal.Decimal `json:"available_balance"`
 
-	Balance float64 `json:"balance"`
+	// the overdraft limit in minor units, converted by the service once the account's currency is known.
+	MinorOverdraftLimit int64 `json:"-"`
+}
+
+// Balance holds an account's balances in minor units.
+// Ledger is what has been posted, Available is what can be spent: the ledger balance minus pending holds, plus the overdraft limit.
+type Balance struct {
+	Ledger    int64 `json:"ledger"`
+	Available int64 `json:"available"`
+	Held      int64 `json:"held"`
+}
+
+// StatusChange is an entry of an account's status audit trail.
+type StatusChange struct {
+	ID             int       `json:"id"`
+	AccountID      int       `json:"account_id"`
+	PreviousStatus string    `json:"previous_status"`
+	NewStatus      string    `json:"new_status"`
+	Reason         string    `json:"reason"`
+	CreatedAt      time.Time `json:"created_at"`
+}
+
+// LimitChange is an entry of an account's overdraft limit audit trail, limits are in minor units.
+type LimitChange struct {
+	ID            int       `json:"id"`
+	AccountID     int       `json:"account_id"`
+	PreviousLimit int64     `json:"previous_limit"`
+	NewLimit      int64     `json:"new_limit"`
+	Reason        string    `json:"reason"`
+	ChangedBy     string    `json:"changed_by"`
+	CreatedAt     time.Time `json:"created_at"`
 }
 
 type Transaction struct {
 	Model
 	Reference string `json:"reference"`
+	Type      string `json:"type"`
+
+	// Amount is the principal moved from the source to the destination account, in the source's minor units.
+	// Transactions that aren't a single movement between two accounts don't have one.
+	Amount                *int64 `json:"amount,omitempty"`
+	SourceAccountID       *int   `json:"source_account_id,omitempty"`
+	DestinationAccountID  *int   `json:"destination_account_id,omitempty"`
+	OriginalTransactionID *int   `json:"original_transaction_id,omitempty"`
+
+	Lines     []*TransactionLine `json:"lines,omitempty"`
+	Reversals []*Transaction     `json:"reversals,omitempty"`
 }
 
 type TransactionLine struct {
 	Model
 	TransactionID int    `json:"transaction_id"`
 	AccountID     int    `json:"account_id"`
+	AccountNumber string `json:"account_number,omitempty"`
+	Currency      string `json:"currency,omitempty"`
 	Amount        int64  `json:"amount"`
 	Purpose       string `json:"purpose"`
+
+	// PrevHash & Hash chain the line to the one posted before it, see pkg.LineHash.
+	PrevHash string `json:"-"`
+	Hash     string `json:"-"`
+}
+
+// StatementLine is a transaction line as seen from its account's point of view.
+type StatementLine struct {
+	ID                        int             `json:"id"`
+	TransactionID             int             `json:"transaction_id"`
+	Reference                 string          `json:"reference"`
+	Type                      string          `json:"type"`
+	Direction                 string          `json:"direction"`
+	Amount                    decimal.Decimal `json:"amount"`
+	CounterpartyAccountNumber string          `json:"counterparty_account_number"`
+	RunningBalance            decimal.Decimal `json:"running_balance"`
+	CreatedAt                 time.Time       `json:"created_at"`
+
+	// amounts in minor units, converted by the service once the account's currency is known.
+	MinorAmount         int64 `json:"-"`
+	MinorRunningBalance int64 `json:"-"`
 }
 
 type User struct {
 	Model
-	Email    string     `json:"email"`
+	Email string `json:"email"`
+	// ErasedAt is when the user's personal data was pseudonymized, following an erasure request.
+	ErasedAt *time.Time `json:"erased_at,omitempty"`
+
 	Accounts []*Account `json:"accounts"`
 }
+
+type FXRate struct {
+	Model
+	BaseCurrency  string          `json:"base_currency"`
+	QuoteCurrency string          `json:"quote_currency"`
+	Rate          decimal.Decimal `json:"rate"`
+	SpreadBps     int64           `json:"spread_bps"`
+	EffectiveAt   time.Time       `json:"effective_at"`
+}
+
+// FXConversion locks in the rate an fx transfer was executed at.
+type FXConversion struct {
+	Model
+	TransactionID     int             `json:"transaction_id"`
+	RateID            int             `json:"rate_id"`
+	BaseCurrency      string          `json:"base_currency"`
+	QuoteCurrency     string          `json:"quote_currency"`
+	Rate              decimal.Decimal `json:"rate"`
+	SpreadBps         int64           `json:"spread_bps"`
+	SourceAmount      int64           `json:"source_amount"`
+	DestinationAmount int64           `json:"destination_amount"`
+	SpreadAmount      int64           `json:"spread_amount"`
+}
+
+// BalanceDrift is an account whose materialized balance disagrees with the sum of its lines.
+type BalanceDrift struct {
+	AccountID     int    `json:"account_id"`
+	AccountNumber string `json:"account_number"`
+	Materialized  int64  `json:"materialized"`
+	Computed      int64  `json:"computed"`
+}
+
+type Hold struct {
+	Model
+	Reference                string    `json:"reference"`
+	AccountID                int       `json:"account_id"`
+	AccountNumber            string    `json:"account_number"`
+	DestinationAccountID     int       `json:"destination_account_id"`
+	DestinationAccountNumber string    `json:"destination_account_number"`
+	Currency                 string    `json:"currency"`
+	Amount                   int64     `json:"amount"`
+	CapturedAmount           int64     `json:"captured_amount"`
+	Status                   string    `json:"status"`
+	ExpiresAt                time.Time `json:"expires_at"`
+	TransactionID            *int      `json:"transaction_id,omitempty"`
+}
+
+// PeriodBalance is an account's balance at the end of a period.
+type PeriodBalance struct {
+	PeriodStart time.Time       `json:"period_start"`
+	PeriodEnd   time.Time       `json:"period_end"`
+	Balance     decimal.Decimal `json:"balance"`
+}
+
+// FeeRule is one band of the fee schedule of a transaction type, account tier & currency.
+// The band that applies to a transaction is the one with the highest MinAmount that doesn't exceed its amount.
+// Amounts are in minor units, a zero MaxFee means the fee isn't capped.
+type FeeRule struct {
+	Model
+	TransactionType string `json:"transaction_type"`
+	AccountTier     string `json:"account_tier"`
+	Currency        string `json:"currency"`
+	MinAmount       int64  `json:"min_amount"`
+	FlatFee         int64  `json:"flat_fee"`
+	PercentageBps   int64  `json:"percentage_bps"`
+	MinFee          int64  `json:"min_fee"`
+	MaxFee          int64  `json:"max_fee"`
+}
+
+// Fee is what was charged on a transaction, in minor units.
+type Fee struct {
+	RuleID        int    `json:"rule_id"`
+	AccountNumber string `json:"account_number"`
+	Currency      string `json:"currency"`
+	Amount        int64  `json:"amount"`
+}
+
+// InterestConfig is the interest an account earns, from EffectiveFrom on. APR is a percentage.
+type InterestConfig struct {
+	AccountID     int             `json:"account_id"`
+	APR           decimal.Decimal `json:"apr"`
+	DayCount      string          `json:"day_count"`
+	EffectiveFrom time.Time       `json:"effective_from"`
+	CreatedAt     time.Time       `json:"created_at"`
+	UpdatedAt     time.Time       `json:"updated_at"`
+}
+
+// InterestAccrual is the interest an account accrued on a day, on its balance at the end of that day.
+// Amount is in fractions of minor units, accruals are summed & rounded when they're posted (TransactionID).
+type InterestAccrual struct {
+	ID            int             `json:"id"`
+	AccountID     int             `json:"account_id"`
+	AccountNumber string          `json:"account_number,omitempty"`
+	Currency      string          `json:"currency,omitempty"`
+	AccrualDate   time.Time       `json:"accrual_date"`
+	Balance       int64           `json:"balance"`
+	APR           decimal.Decimal `json:"apr"`
+	DayCount      string          `json:"day_count"`
+	Amount        decimal.Decimal `json:"amount"`
+	TransactionID *int            `json:"transaction_id,omitempty"`
+	CreatedAt     time.Time       `json:"created_at"`
+}
+
+// Event is an entry of the outbox, written in the same db transaction as the change it describes.
+// Payload is the event's json data, as it's delivered to webhook endpoints.
+type Event struct {
+	ID        int             `json:"id"`
+	Type      string          `json:"type"`
+	Payload   json.RawMessage `json:"data"`
+	CreatedAt time.Time       `json:"created_at"`
+}
+
+// WebhookEndpoint receives the events it subscribed to. Secret signs its deliveries, it's only returned when the endpoint is created.
+type WebhookEndpoint struct {
+	ID        int       `json:"id"`
+	URL       string    `json:"url"`
+	Secret    string    `json:"secret,omitempty"`
+	Events    []string  `json:"events"`
+	CreatedAt time.Time `json:"created_at"`
+	UpdatedAt time.Time `json:"updated_at"`
+}
+
+// WebhookDelivery is an event's delivery to an endpoint, retried until it succeeds or is dead lettered.
+type WebhookDelivery struct {
+	ID            int        `json:"id"`
+	EventID       int        `json:"event_id"`
+	EndpointID    int        `json:"endpoint_id"`
+	Status        string     `json:"status"`
+	Attempts      int        `json:"attempts"`
+	NextAttemptAt time.Time  `json:"next_attempt_at"`
+	LastError     string     `json:"last_error,omitempty"`
+	DeliveredAt   *time.Time `json:"delivered_at,omitempty"`
+	CreatedAt     time.Time  `json:"created_at"`
+	UpdatedAt     time.Time  `json:"updated_at"`
+
+	// what's needed to deliver it, joined from the event & the endpoint.
+	Event  *Event `json:"-"`
+	URL    string `json:"-"`
+	Secret string `json:"-"`
+}
+
+// ChainHead points at the last line chained to an account's lines, and its hash.
+type ChainHead struct {
+	AccountID int    `json:"account_id"`
+	LineID    int    `json:"line_id"`
+	Hash      string `json:"hash"`
+}
+
+// LedgerVerification is the outcome of walking the accounts' hash chains. BrokenAt is the first line that breaks one, if any.
+type LedgerVerification struct {
+	Verified int    `json:"verified"`
+	BrokenAt *int   `json:"broken_at,omitempty"`
+	Reason   string `json:"reason,omitempty"`
+}
+
+// TrialBalanceLine sums up the debits & credits posted to an account, or to a group of accounts, in minor units.
+// Balance is credits minus debits.
+type TrialBalanceLine struct {
+	AccountNumber string `json:"account_number,omitempty"`
+	AccountType   string `json:"account_type,omitempty"`
+	Currency      string `json:"currency"`
+	Debits        int64  `json:"debits"`
+	Credits       int64  `json:"credits"`
+	Balance       int64  `json:"balance"`
+}
+
+// UnbalancedTransaction is a transaction whose debits & credits in a currency don't add up, in minor units.
+type UnbalancedTransaction struct {
+	TransactionID int    `json:"transaction_id"`
+	Reference     string `json:"reference"`
+	Currency      string `json:"currency"`
+	Debits        int64  `json:"debits"`
+	Credits       int64  `json:"credits"`
+}
+
+// IntegrityReport is a trial balance of the ledger, along with everything that's inconsistent in it.
+// The ledger is OK when every currency's accounts sum up to zero and nothing's inconsistent.
+type IntegrityReport struct {
+	OK           bool                `json:"ok"`
+	Accounts     []*TrialBalanceLine `json:"accounts"`
+	AccountTypes []*TrialBalanceLine `json:"account_types"`
+	Currencies   []*TrialBalanceLine `json:"currencies"`
+
+	UnbalancedTransactions []*UnbalancedTransaction `json:"unbalanced_transactions"`
+	OrphanLines            []*TransactionLine       `json:"orphan_lines"`
+	BalanceDrifts          []*BalanceDrift          `json:"balance_drifts"`
+}
+
+// APIKey authenticates api clients. Key is only set when the key is created or rotated, it's never stored.
+type APIKey struct {
+	ID     int      `json:"id"`
+	Name   string   `json:"name"`
+	Prefix string   `json:"prefix"`
+	Key    string   `json:"key,omitempty"`
+	Hash   string   `json:"-"`
+	Scopes []string `json:"scopes"`
+	// Signed keys must sign their requests with SigningSecret, which is only shown when the key is created or rotated.
+	Signed        bool   `json:"signed"`
+	SigningSecret string `json:"-"`
+	// Lineage is who the key acts for, the principals that issued it down to itself, eg. "user:1/api_key:ak_1a2b3c4d".
+	// Rotated keys keep the lineage of the key they replace.
+	Lineage   string     `json:"lineage"`
+	ExpiresAt *time.Time `json:"expires_at,omitempty"`
+	RevokedAt *time.Time `json:"revoked_at,omitempty"`
+	CreatedAt time.Time  `json:"created_at"`
+	UpdatedAt time.Time  `json:"updated_at"`
+}
+
+type Role struct {
+	ID          int       `json:"id"`
+	Name        string    `json:"name"`
+	Permissions []string  `json:"permissions"`
+	CreatedAt   time.Time `json:"created_at"`
+	UpdatedAt   time.Time `json:"updated_at"`
+}
+
+// RoleBinding grants a user the permissions of a role.
+type RoleBinding struct {
+	ID        int       `json:"id"`
+	RoleID    int       `json:"role_id"`
+	Role      string    `json:"role"`
+	UserID    int       `json:"user_id"`
+	CreatedAt time.Time `json:"created_at"`
+}
+
+// Approval is an action held until someone other than its maker approves it, eg. a high-value deposit.
+// Maker & Checker identify principals, as "user:<id>" or an api key's lineage.
+type Approval struct {
+	ID        int             `json:"id"`
+	Action    string          `json:"action"`
+	Payload   json.RawMessage `json:"payload"`
+	Status    string          `json:"status"`
+	Maker     string          `json:"maker"`
+	Checker   string          `json:"checker,omitempty"`
+	DecidedAt *time.Time      `json:"decided_at,omitempty"`
+	CreatedAt time.Time       `json:"created_at"`
+	UpdatedAt time.Time       `json:"updated_at"`
+}
+
+// IdempotencyKey is the key a client sent with a request, with the response to replay when the request is retried.
+// Fingerprint is a hash of the request, so the key can't be reused for a different one.
+type IdempotencyKey struct {
+	ID           int       `json:"id"`
+	Client       string    `json:"client"`
+	Key          string    `json:"key"`
+	Fingerprint  string    `json:"fingerprint"`
+	Status       string    `json:"status"`
+	ResponseCode int       `json:"response_code"`
+	ResponseBody []byte    `json:"-"`
+	CreatedAt    time.Time `json:"created_at"`
+	UpdatedAt    time.Time `json:"updated_at"`
+}
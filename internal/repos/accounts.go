@@ -10,6 +10,8 @@ import (
 	"github.com/gwuah/accounts/internal/models"
 )
 
+const accountColumns = "id, user_id, account_number, currency, tier, type, overdraft_limit, status, created_at, updated_at, deleted_at"
+
 type accountsRepo struct {
 	db     *sql.DB
 	logger *slog.Logger
@@ -27,7 +29,7 @@ func (r *accountsRepo) GetTx(ctx context.Context) (*sql.Tx, error) {
 }
 
 func (r *accountsRepo) GetByUserID(ctx context.Context, tx *sql.Tx, userID int) ([]*models.Account, error) {
-	stmt, err := tx.Prepare("select id, user_id, account_number, created_at, update_at from accounts where user_id=$1;")
+	stmt, err := tx.Prepare(fmt.Sprintf("select %s from accounts where user_id=$1 and deleted_at is null;", accountColumns))
 	if err != nil {
 		return nil, fmt.Errorf("failed to prepare statement. %w", err)
 	}
@@ -55,8 +57,8 @@ func (r *accountsRepo) GetAccounts(ctx context.Context, tx *sql.Tx, accountNumbe
 	}
 
 	query := fmt.Sprintf(
-		"SELECT id, user_id, account_number, created_at, updated_at FROM accounts WHERE account_number IN (%s);",
-		strings.Join(placeholders, ","),
+		"SELECT %s FROM accounts WHERE account_number IN (%s) AND deleted_at IS NULL;",
+		accountColumns, strings.Join(placeholders, ","),
 	)
 
 	stmt, err := tx.Prepare(query)
@@ -73,11 +75,39 @@ func (r *accountsRepo) GetAccounts(ctx context.Context, tx *sql.Tx, accountNumbe
 	return getMany(rows)
 }
 
+// GetAccountsByID is GetAccounts, for when only the ids of the accounts are at hand.
+// Unlike GetAccounts it includes deleted accounts, the ids coming from rows that still reference them.
+func (r *accountsRepo) GetAccountsByID(ctx context.Context, tx *sql.Tx, ids []int) ([]*models.Account, error) {
+	if len(ids) == 0 {
+		return nil, fmt.Errorf("no account ids provided")
+	}
+
+	placeholders := make([]string, len(ids))
+	args := make([]interface{}, len(ids))
+	for i := range ids {
+		placeholders[i] = fmt.Sprintf("$%d", i+1)
+		args[i] = ids[i]
+	}
+
+	stmt, err := tx.Prepare(fmt.Sprintf("select %s from accounts where id in (%s);", accountColumns, strings.Join(placeholders, ",")))
+	if err != nil {
+		return nil, fmt.Errorf("failed to prepare statement. %w", err)
+	}
+	defer stmt.Close()
+
+	rows, err := stmt.QueryContext(ctx, args...)
+	if err != nil {
+		return nil, fmt.Errorf("failed to exec query. %w", err)
+	}
+
+	return getMany(rows)
+}
+
 func getMany(rows *sql.Rows) ([]*models.Account, error) {
 	var out []*models.Account
 	for rows.Next() {
 		var a models.Account
-		err := rows.Scan(&a.ID, &a.UserID, &a.AccountNumber, &a.CreatedAt, &a.UpdatedAt)
+		err := rows.Scan(&a.ID, &a.UserID, &a.AccountNumber, &a.Currency, &a.Tier, &a.Type, &a.MinorOverdraftLimit, &a.Status, &a.CreatedAt, &a.UpdatedAt, &a.DeletedAt)
 		if err != nil {
 			if err == sql.ErrNoRows {
 				continue
@@ -95,17 +125,159 @@ func getMany(rows *sql.Rows) ([]*models.Account, error) {
 }
 
 func (r *accountsRepo) Create(ctx context.Context, tx *sql.Tx, a *models.Account) error {
-	query := `insert into accounts (user_id, account_number) values ($1, $2) returning id, created_at, updated_at;`
+	query := `insert into accounts (user_id, account_number, currency, tier, type) values ($1, $2, $3, $4, $5) returning id, status, created_at, updated_at;`
 	stmt, err := tx.Prepare(query)
 	if err != nil {
 		return fmt.Errorf("failed to prepare statement. %w", err)
 	}
 	defer stmt.Close()
 
-	err = stmt.QueryRow(a.UserID, a.AccountNumber).Scan(&a.ID, &a.CreatedAt, &a.UpdatedAt)
+	err = stmt.QueryRow(a.UserID, a.AccountNumber, a.Currency, a.Tier, a.Type).Scan(&a.ID, &a.Status, &a.CreatedAt, &a.UpdatedAt)
 	if err != nil {
 		return fmt.Errorf("failed to exec query: %w", err)
 	}
 
+	// every account starts with a materialized balance, so it can be locked before it's ever posted to.
+	_, err = tx.ExecContext(ctx, "insert into balances (account_id) values ($1);", a.ID)
+	if err != nil {
+		return fmt.Errorf("failed to create balance: %w", err)
+	}
+
+	return nil
+}
+
+// SetOverdraftLimit changes the account's overdraft limit and records the change in its audit trail.
+// The account is locked on postgres until tx is done, so concurrent changes are recorded one after the other.
+func (r *accountsRepo) SetOverdraftLimit(ctx context.Context, tx *sql.Tx, c *models.LimitChange) error {
+	stmt, err := tx.Prepare(fmt.Sprintf("select overdraft_limit from accounts where id=$1 %s;", forUpdate(r.db)))
+	if err != nil {
+		return fmt.Errorf("failed to prepare statement. %w", err)
+	}
+	defer stmt.Close()
+
+	err = stmt.QueryRowContext(ctx, c.AccountID).Scan(&c.PreviousLimit)
+	if err != nil {
+		return fmt.Errorf("failed to exec query. %w", err)
+	}
+
+	_, err = tx.ExecContext(ctx, "update accounts set overdraft_limit=$1, updated_at=CURRENT_TIMESTAMP where id=$2;", c.NewLimit, c.AccountID)
+	if err != nil {
+		return fmt.Errorf("failed to exec query. %w", err)
+	}
+
+	err = tx.QueryRowContext(ctx, "insert into account_limit_changes (account_id, previous_limit, new_limit, reason, changed_by) values ($1, $2, $3, $4, $5) returning id, created_at;",
+		c.AccountID, c.PreviousLimit, c.NewLimit, c.Reason, c.ChangedBy).Scan(&c.ID, &c.CreatedAt)
+	if err != nil {
+		return fmt.Errorf("failed to exec query. %w", err)
+	}
+
+	return nil
+}
+
+// GetLimitChanges returns the account's overdraft limit audit trail, latest first.
+func (r *accountsRepo) GetLimitChanges(ctx context.Context, tx *sql.Tx, accountID int) ([]*models.LimitChange, error) {
+	stmt, err := tx.Prepare("select id, account_id, previous_limit, new_limit, reason, changed_by, created_at from account_limit_changes where account_id=$1 order by id desc;")
+	if err != nil {
+		return nil, fmt.Errorf("failed to prepare statement. %w", err)
+	}
+	defer stmt.Close()
+
+	rows, err := stmt.QueryContext(ctx, accountID)
+	if err != nil {
+		return nil, fmt.Errorf("failed to exec query. %w", err)
+	}
+
+	var out []*models.LimitChange
+	for rows.Next() {
+		var c models.LimitChange
+		err := rows.Scan(&c.ID, &c.AccountID, &c.PreviousLimit, &c.NewLimit, &c.Reason, &c.ChangedBy, &c.CreatedAt)
+		if err != nil {
+			rows.Close()
+			return nil, fmt.Errorf("failed to scan response. %w", err)
+		}
+		out = append(out, &c)
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("failed to scan response. %w", err)
+	}
+	return out, nil
+}
+
+// SetStatus moves the account to a new status and records the transition in its audit trail.
+// Like SetOverdraftLimit, the account is locked on postgres until tx is done. PreviousStatus is set to the status it moved from.
+func (r *accountsRepo) SetStatus(ctx context.Context, tx *sql.Tx, c *models.StatusChange) error {
+	stmt, err := tx.Prepare(fmt.Sprintf("select status from accounts where id=$1 %s;", forUpdate(r.db)))
+	if err != nil {
+		return fmt.Errorf("failed to prepare statement. %w", err)
+	}
+	defer stmt.Close()
+
+	err = stmt.QueryRowContext(ctx, c.AccountID).Scan(&c.PreviousStatus)
+	if err != nil {
+		return fmt.Errorf("failed to exec query. %w", err)
+	}
+
+	_, err = tx.ExecContext(ctx, "update accounts set status=$1, updated_at=CURRENT_TIMESTAMP where id=$2;", c.NewStatus, c.AccountID)
+	if err != nil {
+		return fmt.Errorf("failed to exec query. %w", err)
+	}
+
+	err = tx.QueryRowContext(ctx, "insert into account_status_changes (account_id, previous_status, new_status, reason) values ($1, $2, $3, $4) returning id, created_at;",
+		c.AccountID, c.PreviousStatus, c.NewStatus, c.Reason).Scan(&c.ID, &c.CreatedAt)
+	if err != nil {
+		return fmt.Errorf("failed to exec query. %w", err)
+	}
+
+	return nil
+}
+
+// GetStatusChanges returns the account's status audit trail, latest first.
+func (r *accountsRepo) GetStatusChanges(ctx context.Context, tx *sql.Tx, accountID int) ([]*models.StatusChange, error) {
+	stmt, err := tx.Prepare("select id, account_id, previous_status, new_status, reason, created_at from account_status_changes where account_id=$1 order by id desc;")
+	if err != nil {
+		return nil, fmt.Errorf("failed to prepare statement. %w", err)
+	}
+	defer stmt.Close()
+
+	rows, err := stmt.QueryContext(ctx, accountID)
+	if err != nil {
+		return nil, fmt.Errorf("failed to exec query. %w", err)
+	}
+
+	var out []*models.StatusChange
+	for rows.Next() {
+		var c models.StatusChange
+		err := rows.Scan(&c.ID, &c.AccountID, &c.PreviousStatus, &c.NewStatus, &c.Reason, &c.CreatedAt)
+		if err != nil {
+			rows.Close()
+			return nil, fmt.Errorf("failed to scan response. %w", err)
+		}
+		out = append(out, &c)
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("failed to scan response. %w", err)
+	}
+	return out, nil
+}
+
+// Delete soft deletes the given accounts.
+func (r *accountsRepo) Delete(ctx context.Context, tx *sql.Tx, ids []int) error {
+	if len(ids) == 0 {
+		return nil
+	}
+
+	placeholders := make([]string, len(ids))
+	args := make([]interface{}, len(ids))
+	for i := range ids {
+		placeholders[i] = fmt.Sprintf("$%d", i+1)
+		args[i] = ids[i]
+	}
+
+	_, err := tx.ExecContext(ctx, fmt.Sprintf("update accounts set deleted_at=CURRENT_TIMESTAMP, updated_at=CURRENT_TIMESTAMP where id in (%s) and deleted_at is null;", strings.Join(placeholders, ",")), args...)
+	if err != nil {
+		return fmt.Errorf("failed to exec query. %w", err)
+	}
 	return nil
 }
@@ -0,0 +1,149 @@
+package repos
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"log/slog"
+	"strings"
+	"time"
+
+	"github.com/gwuah/accounts/internal/models"
+)
+
+const apiKeyColumns = "id, name, prefix, key_hash, scopes, signing_secret, lineage, expires_at, revoked_at, created_at, updated_at"
+
+type apiKeysRepo struct {
+	db     *sql.DB
+	logger *slog.Logger
+}
+
+func NewAPIKeys(logger *slog.Logger, db *sql.DB) *apiKeysRepo {
+	return &apiKeysRepo{
+		db:     db,
+		logger: logger,
+	}
+}
+
+func (r *apiKeysRepo) GetTx(ctx context.Context) (*sql.Tx, error) {
+	return r.db.Begin()
+}
+
+func scanAPIKey(row interface{ Scan(...any) error }) (*models.APIKey, error) {
+	var k models.APIKey
+	var scopes string
+	err := row.Scan(&k.ID, &k.Name, &k.Prefix, &k.Hash, &scopes, &k.SigningSecret, &k.Lineage, &k.ExpiresAt, &k.RevokedAt, &k.CreatedAt, &k.UpdatedAt)
+	if err != nil {
+		return nil, err
+	}
+	k.Scopes = strings.Split(scopes, ",")
+	k.Signed = k.SigningSecret != ""
+	return &k, nil
+}
+
+func (r *apiKeysRepo) Create(ctx context.Context, tx *sql.Tx, k *models.APIKey) error {
+	stmt, err := tx.Prepare("insert into api_keys (name, prefix, key_hash, scopes, signing_secret, lineage) values ($1, $2, $3, $4, $5, $6) returning id, created_at, updated_at;")
+	if err != nil {
+		return fmt.Errorf("failed to prepare statement. %w", err)
+	}
+	defer stmt.Close()
+
+	err = stmt.QueryRowContext(ctx, k.Name, k.Prefix, k.Hash, strings.Join(k.Scopes, ","), k.SigningSecret, k.Lineage).Scan(&k.ID, &k.CreatedAt, &k.UpdatedAt)
+	if err != nil {
+		return fmt.Errorf("failed to exec query. %w", err)
+	}
+	return nil
+}
+
+// GetByHash returns the key with the given hash, revoked & expired keys included. It returns nil if there's none.
+func (r *apiKeysRepo) GetByHash(ctx context.Context, tx *sql.Tx, hash string) (*models.APIKey, error) {
+	stmt, err := tx.Prepare(fmt.Sprintf("select %s from api_keys where key_hash=$1;", apiKeyColumns))
+	if err != nil {
+		return nil, fmt.Errorf("failed to prepare statement. %w", err)
+	}
+	defer stmt.Close()
+
+	k, err := scanAPIKey(stmt.QueryRowContext(ctx, hash))
+	if err != nil {
+		if err == sql.ErrNoRows {
+			return nil, nil
+		}
+		return nil, fmt.Errorf("failed to exec query. %w", err)
+	}
+	return k, nil
+}
+
+// GetByID returns the key, locking it. It returns nil if there's none.
+func (r *apiKeysRepo) GetByID(ctx context.Context, tx *sql.Tx, id int) (*models.APIKey, error) {
+	stmt, err := tx.Prepare(fmt.Sprintf("select %s from api_keys where id=$1 %s;", apiKeyColumns, forUpdate(r.db)))
+	if err != nil {
+		return nil, fmt.Errorf("failed to prepare statement. %w", err)
+	}
+	defer stmt.Close()
+
+	k, err := scanAPIKey(stmt.QueryRowContext(ctx, id))
+	if err != nil {
+		if err == sql.ErrNoRows {
+			return nil, nil
+		}
+		return nil, fmt.Errorf("failed to exec query. %w", err)
+	}
+	return k, nil
+}
+
+func (r *apiKeysRepo) GetAll(ctx context.Context, tx *sql.Tx) ([]*models.APIKey, error) {
+	stmt, err := tx.Prepare(fmt.Sprintf("select %s from api_keys order by id;", apiKeyColumns))
+	if err != nil {
+		return nil, fmt.Errorf("failed to prepare statement. %w", err)
+	}
+	defer stmt.Close()
+
+	rows, err := stmt.QueryContext(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("failed to exec query. %w", err)
+	}
+
+	var out []*models.APIKey
+	for rows.Next() {
+		k, err := scanAPIKey(rows)
+		if err != nil {
+			rows.Close()
+			return nil, fmt.Errorf("failed to scan response. %w", err)
+		}
+		out = append(out, k)
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("failed to scan response. %w", err)
+	}
+	return out, nil
+}
+
+// Expire revokes the key at the given time, or makes it expire then when revoke is false. Keys that already expire earlier keep their expiry.
+func (r *apiKeysRepo) Expire(ctx context.Context, tx *sql.Tx, k *models.APIKey, at time.Time, revoke bool) error {
+	at = at.UTC()
+	if revoke {
+		k.RevokedAt = &at
+	} else if k.ExpiresAt == nil || at.Before(*k.ExpiresAt) {
+		k.ExpiresAt = &at
+	}
+
+	var revokedAt, expiresAt any
+	if k.RevokedAt != nil {
+		revokedAt = k.RevokedAt.UTC()
+	}
+	if k.ExpiresAt != nil {
+		expiresAt = k.ExpiresAt.UTC()
+	}
+	stmt, err := tx.Prepare("update api_keys set revoked_at=$1, expires_at=$2, updated_at=CURRENT_TIMESTAMP where id=$3;")
+	if err != nil {
+		return fmt.Errorf("failed to prepare statement. %w", err)
+	}
+	defer stmt.Close()
+
+	_, err = stmt.ExecContext(ctx, revokedAt, expiresAt, k.ID)
+	if err != nil {
+		return fmt.Errorf("failed to exec query. %w", err)
+	}
+	return nil
+}
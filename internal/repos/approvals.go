@@ -0,0 +1,126 @@
+package repos
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"log/slog"
+	"time"
+
+	"github.com/gwuah/accounts/internal/models"
+)
+
+const approvalColumns = "id, action, payload, status, maker, checker, decided_at, created_at, updated_at"
+
+type approvalsRepo struct {
+	db     *sql.DB
+	logger *slog.Logger
+}
+
+func NewApprovals(logger *slog.Logger, db *sql.DB) *approvalsRepo {
+	return &approvalsRepo{
+		db:     db,
+		logger: logger,
+	}
+}
+
+func (r *approvalsRepo) GetTx(ctx context.Context) (*sql.Tx, error) {
+	return r.db.Begin()
+}
+
+func scanApproval(row interface{ Scan(...any) error }) (*models.Approval, error) {
+	var a models.Approval
+	var payload []byte
+	err := row.Scan(&a.ID, &a.Action, &payload, &a.Status, &a.Maker, &a.Checker, &a.DecidedAt, &a.CreatedAt, &a.UpdatedAt)
+	if err != nil {
+		return nil, err
+	}
+	a.Payload = payload
+	return &a, nil
+}
+
+func (r *approvalsRepo) Create(ctx context.Context, tx *sql.Tx, a *models.Approval) error {
+	stmt, err := tx.Prepare("insert into approvals (action, payload, status, maker) values ($1, $2, $3, $4) returning id, created_at, updated_at;")
+	if err != nil {
+		return fmt.Errorf("failed to prepare statement. %w", err)
+	}
+	defer stmt.Close()
+
+	err = stmt.QueryRowContext(ctx, a.Action, string(a.Payload), a.Status, a.Maker).Scan(&a.ID, &a.CreatedAt, &a.UpdatedAt)
+	if err != nil {
+		return fmt.Errorf("failed to exec query. %w", err)
+	}
+	return nil
+}
+
+// GetByID returns the approval, locking it. It returns nil if there's none.
+func (r *approvalsRepo) GetByID(ctx context.Context, tx *sql.Tx, id int) (*models.Approval, error) {
+	stmt, err := tx.Prepare(fmt.Sprintf("select %s from approvals where id=$1 %s;", approvalColumns, forUpdate(r.db)))
+	if err != nil {
+		return nil, fmt.Errorf("failed to prepare statement. %w", err)
+	}
+	defer stmt.Close()
+
+	a, err := scanApproval(stmt.QueryRowContext(ctx, id))
+	if err != nil {
+		if err == sql.ErrNoRows {
+			return nil, nil
+		}
+		return nil, fmt.Errorf("failed to exec query. %w", err)
+	}
+	return a, nil
+}
+
+// GetAll returns the approvals with the given status, every approval if it's empty, newest first.
+func (r *approvalsRepo) GetAll(ctx context.Context, tx *sql.Tx, status string) ([]*models.Approval, error) {
+	stmt, err := tx.Prepare(fmt.Sprintf("select %s from approvals where ($1 = '' or status = $1) order by id desc;", approvalColumns))
+	if err != nil {
+		return nil, fmt.Errorf("failed to prepare statement. %w", err)
+	}
+	defer stmt.Close()
+
+	rows, err := stmt.QueryContext(ctx, status)
+	if err != nil {
+		return nil, fmt.Errorf("failed to exec query. %w", err)
+	}
+
+	var out []*models.Approval
+	for rows.Next() {
+		a, err := scanApproval(rows)
+		if err != nil {
+			rows.Close()
+			return nil, fmt.Errorf("failed to scan response. %w", err)
+		}
+		out = append(out, a)
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("failed to scan response. %w", err)
+	}
+	return out, nil
+}
+
+// Decide records the checker's decision on a pending approval. It returns false if the approval was already decided.
+func (r *approvalsRepo) Decide(ctx context.Context, tx *sql.Tx, a *models.Approval, status, checker string, at time.Time) (bool, error) {
+	stmt, err := tx.Prepare("update approvals set status=$1, checker=$2, decided_at=$3, updated_at=CURRENT_TIMESTAMP where id=$4 and status='pending';")
+	if err != nil {
+		return false, fmt.Errorf("failed to prepare statement. %w", err)
+	}
+	defer stmt.Close()
+
+	res, err := stmt.ExecContext(ctx, status, checker, at.UTC(), a.ID)
+	if err != nil {
+		return false, fmt.Errorf("failed to exec query. %w", err)
+	}
+	n, err := res.RowsAffected()
+	if err != nil {
+		return false, fmt.Errorf("failed to exec query. %w", err)
+	}
+	if n == 0 {
+		return false, nil
+	}
+
+	at = at.UTC()
+	a.Status, a.Checker, a.DecidedAt = status, checker, &at
+	return true, nil
+}
@@ -0,0 +1,21 @@
+package repos
+
+import (
+	"database/sql"
+
+	"github.com/lib/pq"
+)
+
+func isPostgres(db *sql.DB) bool {
+	_, ok := db.Driver().(*pq.Driver)
+	return ok
+}
+
+// forUpdate returns the row locking clause for the db's dialect.
+// sqlite doesn't have row locks, it serializes writers instead.
+func forUpdate(db *sql.DB) string {
+	if isPostgres(db) {
+		return "for update"
+	}
+	return ""
+}
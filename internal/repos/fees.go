@@ -0,0 +1,103 @@
+package repos
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"log/slog"
+
+	"github.com/gwuah/accounts/internal/models"
+)
+
+const feeRuleColumns = "id, transaction_type, account_tier, currency, min_amount, flat_fee, percentage_bps, min_fee, max_fee, created_at, updated_at"
+
+type feesRepo struct {
+	db     *sql.DB
+	logger *slog.Logger
+}
+
+func NewFees(logger *slog.Logger, db *sql.DB) *feesRepo {
+	return &feesRepo{
+		db:     db,
+		logger: logger,
+	}
+}
+
+func (r *feesRepo) GetTx(ctx context.Context) (*sql.Tx, error) {
+	return r.db.Begin()
+}
+
+func scanFeeRule(row interface{ Scan(...any) error }) (*models.FeeRule, error) {
+	var f models.FeeRule
+	err := row.Scan(&f.ID, &f.TransactionType, &f.AccountTier, &f.Currency, &f.MinAmount, &f.FlatFee, &f.PercentageBps, &f.MinFee, &f.MaxFee, &f.CreatedAt, &f.UpdatedAt)
+	if err != nil {
+		return nil, err
+	}
+	return &f, nil
+}
+
+// SaveRule creates a band of the fee schedule, or replaces the band with the same threshold.
+func (r *feesRepo) SaveRule(ctx context.Context, tx *sql.Tx, f *models.FeeRule) error {
+	query := `insert into fee_rules (transaction_type, account_tier, currency, min_amount, flat_fee, percentage_bps, min_fee, max_fee) values ($1, $2, $3, $4, $5, $6, $7, $8)
+		on conflict (transaction_type, account_tier, currency, min_amount) do update set
+			flat_fee = excluded.flat_fee, percentage_bps = excluded.percentage_bps, min_fee = excluded.min_fee, max_fee = excluded.max_fee, updated_at = CURRENT_TIMESTAMP
+		returning id, created_at, updated_at;`
+	stmt, err := tx.Prepare(query)
+	if err != nil {
+		return fmt.Errorf("failed to prepare statement. %w", err)
+	}
+	defer stmt.Close()
+
+	err = stmt.QueryRow(f.TransactionType, f.AccountTier, f.Currency, f.MinAmount, f.FlatFee, f.PercentageBps, f.MinFee, f.MaxFee).Scan(&f.ID, &f.CreatedAt, &f.UpdatedAt)
+	if err != nil {
+		return fmt.Errorf("failed to exec query: %w", err)
+	}
+
+	return nil
+}
+
+func (r *feesRepo) GetRules(ctx context.Context, tx *sql.Tx) ([]*models.FeeRule, error) {
+	stmt, err := tx.Prepare(fmt.Sprintf("select %s from fee_rules order by transaction_type, account_tier, currency, min_amount;", feeRuleColumns))
+	if err != nil {
+		return nil, fmt.Errorf("failed to prepare statement. %w", err)
+	}
+	defer stmt.Close()
+
+	rows, err := stmt.QueryContext(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("failed to exec query. %w", err)
+	}
+
+	var out []*models.FeeRule
+	for rows.Next() {
+		f, err := scanFeeRule(rows)
+		if err != nil {
+			rows.Close()
+			return nil, fmt.Errorf("failed to scan response. %w", err)
+		}
+		out = append(out, f)
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("failed to scan response. %w", err)
+	}
+	return out, nil
+}
+
+// GetApplicableRule returns the band of the fee schedule an amount falls in, or nil if no fee applies.
+func (r *feesRepo) GetApplicableRule(ctx context.Context, tx *sql.Tx, transactionType, tier, currency string, amount int64) (*models.FeeRule, error) {
+	stmt, err := tx.Prepare(fmt.Sprintf("select %s from fee_rules where transaction_type=$1 and account_tier=$2 and currency=$3 and min_amount <= $4 order by min_amount desc limit 1;", feeRuleColumns))
+	if err != nil {
+		return nil, fmt.Errorf("failed to prepare statement. %w", err)
+	}
+	defer stmt.Close()
+
+	f, err := scanFeeRule(stmt.QueryRowContext(ctx, transactionType, tier, currency, amount))
+	if err != nil {
+		if err == sql.ErrNoRows {
+			return nil, nil
+		}
+		return nil, fmt.Errorf("failed to exec query. %w", err)
+	}
+	return f, nil
+}
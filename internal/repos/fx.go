@@ -0,0 +1,108 @@
+package repos
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"log/slog"
+	"time"
+
+	"github.com/gwuah/accounts/internal/models"
+)
+
+type fxRepo struct {
+	db     *sql.DB
+	logger *slog.Logger
+}
+
+func NewFX(logger *slog.Logger, db *sql.DB) *fxRepo {
+	return &fxRepo{
+		db:     db,
+		logger: logger,
+	}
+}
+
+func (r *fxRepo) GetTx(ctx context.Context) (*sql.Tx, error) {
+	return r.db.Begin()
+}
+
+func (r *fxRepo) CreateRate(ctx context.Context, tx *sql.Tx, rate *models.FXRate) error {
+	query := `insert into fx_rates (base_currency, quote_currency, rate, spread_bps, effective_at) values ($1, $2, $3, $4, $5) returning id, created_at, updated_at;`
+	stmt, err := tx.Prepare(query)
+	if err != nil {
+		return fmt.Errorf("failed to prepare statement. %w", err)
+	}
+	defer stmt.Close()
+
+	err = stmt.QueryRow(rate.BaseCurrency, rate.QuoteCurrency, rate.Rate.String(), rate.SpreadBps, rate.EffectiveAt.UTC()).Scan(&rate.ID, &rate.CreatedAt, &rate.UpdatedAt)
+	if err != nil {
+		return fmt.Errorf("failed to exec query: %w", err)
+	}
+
+	return nil
+}
+
+// GetRates returns the rate history of a currency pair, most recent first.
+func (r *fxRepo) GetRates(ctx context.Context, tx *sql.Tx, base, quote string) ([]*models.FXRate, error) {
+	stmt, err := tx.Prepare("select id, base_currency, quote_currency, rate, spread_bps, effective_at, created_at, updated_at from fx_rates where base_currency=$1 and quote_currency=$2 order by effective_at desc, id desc;")
+	if err != nil {
+		return nil, fmt.Errorf("failed to prepare statement. %w", err)
+	}
+	defer stmt.Close()
+
+	rows, err := stmt.QueryContext(ctx, base, quote)
+	if err != nil {
+		return nil, fmt.Errorf("failed to exec query. %w", err)
+	}
+
+	var out []*models.FXRate
+	for rows.Next() {
+		var rate models.FXRate
+		err := rows.Scan(&rate.ID, &rate.BaseCurrency, &rate.QuoteCurrency, &rate.Rate, &rate.SpreadBps, &rate.EffectiveAt, &rate.CreatedAt, &rate.UpdatedAt)
+		if err != nil {
+			rows.Close()
+			return nil, fmt.Errorf("failed to scan response. %w", err)
+		}
+		out = append(out, &rate)
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("failed to scan response. %w", err)
+	}
+	return out, nil
+}
+
+// GetEffectiveRate returns the latest rate of a currency pair that's in effect at the given time.
+func (r *fxRepo) GetEffectiveRate(ctx context.Context, tx *sql.Tx, base, quote string, at time.Time) (*models.FXRate, error) {
+	stmt, err := tx.Prepare("select id, base_currency, quote_currency, rate, spread_bps, effective_at, created_at, updated_at from fx_rates where base_currency=$1 and quote_currency=$2 and effective_at <= $3 order by effective_at desc, id desc limit 1;")
+	if err != nil {
+		return nil, fmt.Errorf("failed to prepare statement. %w", err)
+	}
+	defer stmt.Close()
+
+	var rate models.FXRate
+	err = stmt.QueryRowContext(ctx, base, quote, at.UTC()).Scan(&rate.ID, &rate.BaseCurrency, &rate.QuoteCurrency, &rate.Rate, &rate.SpreadBps, &rate.EffectiveAt, &rate.CreatedAt, &rate.UpdatedAt)
+	if err != nil {
+		if err == sql.ErrNoRows {
+			return nil, nil
+		}
+		return nil, fmt.Errorf("failed to exec query. %w", err)
+	}
+	return &rate, nil
+}
+
+func (r *fxRepo) CreateConversion(ctx context.Context, tx *sql.Tx, c *models.FXConversion) error {
+	query := `insert into fx_conversions (transaction_id, rate_id, base_currency, quote_currency, rate, spread_bps, source_amount, destination_amount, spread_amount) values ($1, $2, $3, $4, $5, $6, $7, $8, $9) returning id, created_at, updated_at;`
+	stmt, err := tx.Prepare(query)
+	if err != nil {
+		return fmt.Errorf("failed to prepare statement. %w", err)
+	}
+	defer stmt.Close()
+
+	err = stmt.QueryRow(c.TransactionID, c.RateID, c.BaseCurrency, c.QuoteCurrency, c.Rate.String(), c.SpreadBps, c.SourceAmount, c.DestinationAmount, c.SpreadAmount).Scan(&c.ID, &c.CreatedAt, &c.UpdatedAt)
+	if err != nil {
+		return fmt.Errorf("failed to exec query: %w", err)
+	}
+
+	return nil
+}
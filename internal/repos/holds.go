@@ -0,0 +1,106 @@
+package repos
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"log/slog"
+	"time"
+
+	"github.com/gwuah/accounts/internal/models"
+)
+
+type HoldStatus string
+
+const (
+	PENDING  HoldStatus = "pending"
+	CAPTURED HoldStatus = "captured"
+	VOIDED   HoldStatus = "voided"
+	EXPIRED  HoldStatus = "expired"
+)
+
+type holdsRepo struct {
+	db     *sql.DB
+	logger *slog.Logger
+}
+
+func NewHolds(logger *slog.Logger, db *sql.DB) *holdsRepo {
+	return &holdsRepo{
+		db:     db,
+		logger: logger,
+	}
+}
+
+func (r *holdsRepo) GetTx(ctx context.Context) (*sql.Tx, error) {
+	return r.db.Begin()
+}
+
+func (r *holdsRepo) Create(ctx context.Context, tx *sql.Tx, h *models.Hold) error {
+	query := `insert into holds (reference, account_id, destination_account_id, amount, status, expires_at) values ($1, $2, $3, $4, $5, $6) returning id, created_at, updated_at;`
+	stmt, err := tx.Prepare(query)
+	if err != nil {
+		return fmt.Errorf("failed to prepare statement. %w", err)
+	}
+	defer stmt.Close()
+
+	h.Status = string(PENDING)
+	err = stmt.QueryRow(h.Reference, h.AccountID, h.DestinationAccountID, h.Amount, h.Status, h.ExpiresAt.UTC()).Scan(&h.ID, &h.CreatedAt, &h.UpdatedAt)
+	if err != nil {
+		return fmt.Errorf("failed to exec query: %w", err)
+	}
+
+	return nil
+}
+
+func (r *holdsRepo) GetByReference(ctx context.Context, tx *sql.Tx, reference string) (*models.Hold, error) {
+	stmt, err := tx.Prepare(`select h.id, h.reference, h.account_id, a.account_number, h.destination_account_id, d.account_number, a.currency, h.amount, h.captured_amount, h.status, h.expires_at, h.transaction_id, h.created_at, h.updated_at
+		from holds h
+		join accounts a on a.id = h.account_id
+		join accounts d on d.id = h.destination_account_id
+		where h.reference=$1;`)
+	if err != nil {
+		return nil, fmt.Errorf("failed to prepare statement. %w", err)
+	}
+	defer stmt.Close()
+
+	var h models.Hold
+	err = stmt.QueryRowContext(ctx, reference).Scan(&h.ID, &h.Reference, &h.AccountID, &h.AccountNumber, &h.DestinationAccountID, &h.DestinationAccountNumber, &h.Currency, &h.Amount, &h.CapturedAmount, &h.Status, &h.ExpiresAt, &h.TransactionID, &h.CreatedAt, &h.UpdatedAt)
+	if err != nil {
+		if err == sql.ErrNoRows {
+			return nil, nil
+		}
+		return nil, fmt.Errorf("failed to exec query. %w", err)
+	}
+	return &h, nil
+}
+
+// UpdateStatus moves a pending hold into its final status.
+// It returns false if the hold was no longer pending, ie. a concurrent request got to it first.
+func (r *holdsRepo) UpdateStatus(ctx context.Context, tx *sql.Tx, h *models.Hold) (bool, error) {
+	stmt, err := tx.Prepare("update holds set status=$1, captured_amount=$2, transaction_id=$3, updated_at=$4 where id=$5 and status=$6;")
+	if err != nil {
+		return false, fmt.Errorf("failed to prepare statement. %w", err)
+	}
+	defer stmt.Close()
+
+	h.UpdatedAt = time.Now().UTC()
+	res, err := stmt.ExecContext(ctx, h.Status, h.CapturedAmount, h.TransactionID, h.UpdatedAt, h.ID, string(PENDING))
+	if err != nil {
+		return false, fmt.Errorf("failed to exec query. %w", err)
+	}
+
+	n, err := res.RowsAffected()
+	if err != nil {
+		return false, fmt.Errorf("failed to exec query. %w", err)
+	}
+	return n == 1, nil
+}
+
+// Expire marks every pending hold whose ttl has elapsed as expired, and returns how many were.
+func (r *holdsRepo) Expire(ctx context.Context, now time.Time) (int64, error) {
+	res, err := r.db.ExecContext(ctx, "update holds set status=$1, updated_at=$2 where status=$3 and expires_at <= $2;", string(EXPIRED), now.UTC(), string(PENDING))
+	if err != nil {
+		return 0, fmt.Errorf("failed to exec query. %w", err)
+	}
+	return res.RowsAffected()
+}
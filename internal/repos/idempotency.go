@@ -0,0 +1,98 @@
+package repos
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"log/slog"
+	"time"
+
+	"github.com/gwuah/accounts/internal/models"
+)
+
+// idempotencyRepo keeps the clients' idempotency keys & their responses in the db, so a retry to any instance of the service is replayed.
+type idempotencyRepo struct {
+	db     *sql.DB
+	logger *slog.Logger
+}
+
+func NewIdempotency(logger *slog.Logger, db *sql.DB) *idempotencyRepo {
+	return &idempotencyRepo{
+		db:     db,
+		logger: logger,
+	}
+}
+
+// Reserve records the key, created now. If the client already used it, it returns that key instead.
+// Keys created before expiredBefore are forgotten along the way, and so are keys still in k's status, ie. in progress,
+// created before abandonedBefore.
+func (r *idempotencyRepo) Reserve(ctx context.Context, k *models.IdempotencyKey, expiredBefore, abandonedBefore time.Time) (*models.IdempotencyKey, error) {
+	tx, err := r.db.Begin()
+	if err != nil {
+		return nil, err
+	}
+	defer tx.Rollback()
+
+	_, err = tx.ExecContext(ctx, "delete from idempotency_keys where created_at < $1 or (status = $2 and created_at < $3);", expiredBefore.UTC(), k.Status, abandonedBefore.UTC())
+	if err != nil {
+		return nil, fmt.Errorf("failed to exec query. %w", err)
+	}
+
+	stmt, err := tx.Prepare(`insert into idempotency_keys (client, idempotency_key, fingerprint, status, created_at, updated_at) values ($1, $2, $3, $4, $5, $5)
+		on conflict (client, idempotency_key) do nothing returning id;`)
+	if err != nil {
+		return nil, fmt.Errorf("failed to prepare statement. %w", err)
+	}
+	defer stmt.Close()
+
+	now := time.Now().UTC()
+	err = stmt.QueryRowContext(ctx, k.Client, k.Key, k.Fingerprint, k.Status, now).Scan(&k.ID)
+	if err == nil {
+		k.CreatedAt, k.UpdatedAt = now, now
+		return nil, tx.Commit()
+	}
+	if err != sql.ErrNoRows {
+		return nil, fmt.Errorf("failed to exec query. %w", err)
+	}
+
+	existing, err := tx.Prepare(`select id, client, idempotency_key, fingerprint, status, response_code, response_body, created_at, updated_at
+		from idempotency_keys where client=$1 and idempotency_key=$2;`)
+	if err != nil {
+		return nil, fmt.Errorf("failed to prepare statement. %w", err)
+	}
+	defer existing.Close()
+
+	var used models.IdempotencyKey
+	var body string
+	err = existing.QueryRowContext(ctx, k.Client, k.Key).Scan(&used.ID, &used.Client, &used.Key, &used.Fingerprint, &used.Status, &used.ResponseCode, &body, &used.CreatedAt, &used.UpdatedAt)
+	if err != nil {
+		return nil, fmt.Errorf("failed to scan response. %w", err)
+	}
+	used.ResponseBody = []byte(body)
+	return &used, tx.Commit()
+}
+
+// Complete records the response to the key's request.
+func (r *idempotencyRepo) Complete(ctx context.Context, k *models.IdempotencyKey) error {
+	stmt, err := r.db.Prepare("update idempotency_keys set status=$1, response_code=$2, response_body=$3, updated_at=$4 where id=$5;")
+	if err != nil {
+		return fmt.Errorf("failed to prepare statement. %w", err)
+	}
+	defer stmt.Close()
+
+	k.UpdatedAt = time.Now().UTC()
+	_, err = stmt.ExecContext(ctx, k.Status, k.ResponseCode, string(k.ResponseBody), k.UpdatedAt, k.ID)
+	if err != nil {
+		return fmt.Errorf("failed to exec query. %w", err)
+	}
+	return nil
+}
+
+// Release forgets the key, so the client can retry its request.
+func (r *idempotencyRepo) Release(ctx context.Context, k *models.IdempotencyKey) error {
+	_, err := r.db.ExecContext(ctx, "delete from idempotency_keys where id=$1;", k.ID)
+	if err != nil {
+		return fmt.Errorf("failed to exec query. %w", err)
+	}
+	return nil
+}
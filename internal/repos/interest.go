@@ -0,0 +1,188 @@
+package repos
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"log/slog"
+	"time"
+
+	"github.com/gwuah/accounts/internal/models"
+)
+
+type interestRepo struct {
+	db     *sql.DB
+	logger *slog.Logger
+}
+
+func NewInterest(logger *slog.Logger, db *sql.DB) *interestRepo {
+	return &interestRepo{
+		db:     db,
+		logger: logger,
+	}
+}
+
+func (r *interestRepo) GetTx(ctx context.Context) (*sql.Tx, error) {
+	return r.db.Begin()
+}
+
+// SaveConfig sets the interest an account earns, replacing its previous config.
+func (r *interestRepo) SaveConfig(ctx context.Context, tx *sql.Tx, c *models.InterestConfig) error {
+	query := `insert into interest_configs (account_id, apr, day_count, effective_from) values ($1, $2, $3, $4)
+		on conflict (account_id) do update set apr = excluded.apr, day_count = excluded.day_count, effective_from = excluded.effective_from, updated_at = CURRENT_TIMESTAMP
+		returning created_at, updated_at;`
+	stmt, err := tx.Prepare(query)
+	if err != nil {
+		return fmt.Errorf("failed to prepare statement. %w", err)
+	}
+	defer stmt.Close()
+
+	err = stmt.QueryRow(c.AccountID, c.APR.String(), c.DayCount, c.EffectiveFrom.UTC()).Scan(&c.CreatedAt, &c.UpdatedAt)
+	if err != nil {
+		return fmt.Errorf("failed to exec query: %w", err)
+	}
+
+	return nil
+}
+
+func (r *interestRepo) GetConfig(ctx context.Context, tx *sql.Tx, accountID int) (*models.InterestConfig, error) {
+	stmt, err := tx.Prepare("select account_id, apr, day_count, effective_from, created_at, updated_at from interest_configs where account_id=$1;")
+	if err != nil {
+		return nil, fmt.Errorf("failed to prepare statement. %w", err)
+	}
+	defer stmt.Close()
+
+	var c models.InterestConfig
+	err = stmt.QueryRowContext(ctx, accountID).Scan(&c.AccountID, &c.APR, &c.DayCount, &c.EffectiveFrom, &c.CreatedAt, &c.UpdatedAt)
+	if err != nil {
+		if err == sql.ErrNoRows {
+			return nil, nil
+		}
+		return nil, fmt.Errorf("failed to exec query. %w", err)
+	}
+	return &c, nil
+}
+
+// GetConfigs returns the interest configs of every account that still earns interest, ie. that isn't closed.
+func (r *interestRepo) GetConfigs(ctx context.Context, tx *sql.Tx) ([]*models.InterestConfig, error) {
+	stmt, err := tx.Prepare(`select c.account_id, c.apr, c.day_count, c.effective_from, c.created_at, c.updated_at
+		from interest_configs c
+		join accounts a on a.id = c.account_id
+		where a.status <> 'closed'
+		order by c.account_id;`)
+	if err != nil {
+		return nil, fmt.Errorf("failed to prepare statement. %w", err)
+	}
+	defer stmt.Close()
+
+	rows, err := stmt.QueryContext(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("failed to exec query. %w", err)
+	}
+
+	var out []*models.InterestConfig
+	for rows.Next() {
+		var c models.InterestConfig
+		err := rows.Scan(&c.AccountID, &c.APR, &c.DayCount, &c.EffectiveFrom, &c.CreatedAt, &c.UpdatedAt)
+		if err != nil {
+			rows.Close()
+			return nil, fmt.Errorf("failed to scan response. %w", err)
+		}
+		out = append(out, &c)
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("failed to scan response. %w", err)
+	}
+	return out, nil
+}
+
+// GetLastAccrualDate returns the day the account last accrued interest, or nil if it never has.
+func (r *interestRepo) GetLastAccrualDate(ctx context.Context, tx *sql.Tx, accountID int) (*time.Time, error) {
+	stmt, err := tx.Prepare("select accrual_date from interest_accruals where account_id=$1 order by accrual_date desc limit 1;")
+	if err != nil {
+		return nil, fmt.Errorf("failed to prepare statement. %w", err)
+	}
+	defer stmt.Close()
+
+	var date time.Time
+	err = stmt.QueryRowContext(ctx, accountID).Scan(&date)
+	if err != nil {
+		if err == sql.ErrNoRows {
+			return nil, nil
+		}
+		return nil, fmt.Errorf("failed to exec query. %w", err)
+	}
+	return &date, nil
+}
+
+// CreateAccrual records a day's accrual. An account accrues once per day, so it returns false if the day was already accrued.
+func (r *interestRepo) CreateAccrual(ctx context.Context, tx *sql.Tx, a *models.InterestAccrual) (bool, error) {
+	stmt, err := tx.Prepare(`insert into interest_accruals (account_id, accrual_date, balance, apr, day_count, amount) values ($1, $2, $3, $4, $5, $6)
+		on conflict (account_id, accrual_date) do nothing;`)
+	if err != nil {
+		return false, fmt.Errorf("failed to prepare statement. %w", err)
+	}
+	defer stmt.Close()
+
+	res, err := stmt.ExecContext(ctx, a.AccountID, a.AccrualDate.UTC(), a.Balance, a.APR.String(), a.DayCount, a.Amount.String())
+	if err != nil {
+		return false, fmt.Errorf("failed to exec query. %w", err)
+	}
+	n, err := res.RowsAffected()
+	if err != nil {
+		return false, fmt.Errorf("failed to exec query. %w", err)
+	}
+	return n > 0, nil
+}
+
+// GetPendingAccruals returns the accruals dated before the given day that haven't been posted yet, ordered by account.
+// An accountID of 0 returns the pending accruals of every account.
+func (r *interestRepo) GetPendingAccruals(ctx context.Context, tx *sql.Tx, accountID int, before time.Time) ([]*models.InterestAccrual, error) {
+	query := `select i.id, i.account_id, a.account_number, a.currency, i.accrual_date, i.balance, i.apr, i.day_count, i.amount, i.created_at
+		from interest_accruals i
+		join accounts a on a.id = i.account_id
+		where i.transaction_id is null and i.accrual_date < $1 and ($2 = 0 or i.account_id = $2)
+		order by i.account_id, i.accrual_date;`
+	stmt, err := tx.Prepare(query)
+	if err != nil {
+		return nil, fmt.Errorf("failed to prepare statement. %w", err)
+	}
+	defer stmt.Close()
+
+	rows, err := stmt.QueryContext(ctx, before.UTC(), accountID)
+	if err != nil {
+		return nil, fmt.Errorf("failed to exec query. %w", err)
+	}
+
+	var out []*models.InterestAccrual
+	for rows.Next() {
+		var a models.InterestAccrual
+		err := rows.Scan(&a.ID, &a.AccountID, &a.AccountNumber, &a.Currency, &a.AccrualDate, &a.Balance, &a.APR, &a.DayCount, &a.Amount, &a.CreatedAt)
+		if err != nil {
+			rows.Close()
+			return nil, fmt.Errorf("failed to scan response. %w", err)
+		}
+		out = append(out, &a)
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("failed to scan response. %w", err)
+	}
+	return out, nil
+}
+
+// MarkPosted links the account's pending accruals dated before the given day to the transaction that posted them.
+func (r *interestRepo) MarkPosted(ctx context.Context, tx *sql.Tx, accountID int, before time.Time, transactionID int) error {
+	stmt, err := tx.Prepare("update interest_accruals set transaction_id=$1 where account_id=$2 and transaction_id is null and accrual_date < $3;")
+	if err != nil {
+		return fmt.Errorf("failed to prepare statement. %w", err)
+	}
+	defer stmt.Close()
+
+	_, err = stmt.ExecContext(ctx, transactionID, accountID, before.UTC())
+	if err != nil {
+		return fmt.Errorf("failed to exec query. %w", err)
+	}
+	return nil
+}
@@ -0,0 +1,55 @@
+package repos
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"log/slog"
+	"time"
+)
+
+// noncesRepo remembers the nonces of signed requests in the db, so a request replayed to any instance of the service is caught.
+type noncesRepo struct {
+	db     *sql.DB
+	logger *slog.Logger
+}
+
+func NewNonces(logger *slog.Logger, db *sql.DB) *noncesRepo {
+	return &noncesRepo{
+		db:     db,
+		logger: logger,
+	}
+}
+
+// Use records the nonce until it expires. It returns false if it's already been used, expired nonces are forgotten along the way.
+func (r *noncesRepo) Use(ctx context.Context, nonce string, expiresAt, now time.Time) (bool, error) {
+	tx, err := r.db.Begin()
+	if err != nil {
+		return false, err
+	}
+	defer tx.Rollback()
+
+	_, err = tx.ExecContext(ctx, "delete from request_nonces where expires_at < $1;", now.UTC())
+	if err != nil {
+		return false, fmt.Errorf("failed to exec query. %w", err)
+	}
+
+	stmt, err := tx.Prepare("insert into request_nonces (nonce, expires_at) values ($1, $2) on conflict (nonce) do nothing;")
+	if err != nil {
+		return false, fmt.Errorf("failed to prepare statement. %w", err)
+	}
+	defer stmt.Close()
+
+	res, err := stmt.ExecContext(ctx, nonce, expiresAt.UTC())
+	if err != nil {
+		return false, fmt.Errorf("failed to exec query. %w", err)
+	}
+	n, err := res.RowsAffected()
+	if err != nil {
+		return false, fmt.Errorf("failed to exec query. %w", err)
+	}
+	if n == 0 {
+		return false, nil
+	}
+	return true, tx.Commit()
+}
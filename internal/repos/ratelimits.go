@@ -0,0 +1,60 @@
+package repos
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"log/slog"
+	"time"
+
+	"github.com/gwuah/accounts/pkg"
+)
+
+// rateLimitsRepo keeps the rate limits' buckets in the db, so every instance of the service shares them.
+type rateLimitsRepo struct {
+	db     *sql.DB
+	logger *slog.Logger
+}
+
+func NewRateLimits(logger *slog.Logger, db *sql.DB) *rateLimitsRepo {
+	return &rateLimitsRepo{
+		db:     db,
+		logger: logger,
+	}
+}
+
+// Take takes a token from the key's bucket, see pkg.RateLimit. Buckets start full.
+func (r *rateLimitsRepo) Take(ctx context.Context, key string, limit pkg.RateLimit, now time.Time) (bool, time.Duration, error) {
+	tx, err := r.db.Begin()
+	if err != nil {
+		return false, 0, err
+	}
+	defer tx.Rollback()
+
+	stmt, err := tx.Prepare(fmt.Sprintf("select tokens, updated_at from rate_limits where key=$1 %s;", forUpdate(r.db)))
+	if err != nil {
+		return false, 0, fmt.Errorf("failed to prepare statement. %w", err)
+	}
+	defer stmt.Close()
+
+	tokens, last := float64(limit.Burst), now
+	err = stmt.QueryRowContext(ctx, key).Scan(&tokens, &last)
+	if err != nil && err != sql.ErrNoRows {
+		return false, 0, fmt.Errorf("failed to exec query. %w", err)
+	}
+
+	tokens, ok, wait := limit.Take(tokens, last, now)
+
+	upsert, err := tx.Prepare(`insert into rate_limits (key, tokens, updated_at) values ($1, $2, $3)
+		on conflict (key) do update set tokens=excluded.tokens, updated_at=excluded.updated_at;`)
+	if err != nil {
+		return false, 0, fmt.Errorf("failed to prepare statement. %w", err)
+	}
+	defer upsert.Close()
+
+	_, err = upsert.ExecContext(ctx, key, tokens, now.UTC())
+	if err != nil {
+		return false, 0, fmt.Errorf("failed to exec query. %w", err)
+	}
+	return ok, wait, tx.Commit()
+}
@@ -0,0 +1,207 @@
+package repos
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"log/slog"
+
+	"github.com/gwuah/accounts/internal/models"
+)
+
+type rbacRepo struct {
+	db     *sql.DB
+	logger *slog.Logger
+}
+
+func NewRBAC(logger *slog.Logger, db *sql.DB) *rbacRepo {
+	return &rbacRepo{
+		db:     db,
+		logger: logger,
+	}
+}
+
+func (r *rbacRepo) GetTx(ctx context.Context) (*sql.Tx, error) {
+	return r.db.Begin()
+}
+
+// GetRoles returns the roles with their permissions, only the one with the given name if it isn't empty.
+func (r *rbacRepo) GetRoles(ctx context.Context, tx *sql.Tx, name string) ([]*models.Role, error) {
+	query := `select r.id, r.name, r.created_at, r.updated_at, coalesce(p.permission, '')
+		from roles r
+		left join role_permissions p on p.role_id = r.id
+		where ($1 = '' or r.name = $1)
+		order by r.id, p.permission;`
+	stmt, err := tx.Prepare(query)
+	if err != nil {
+		return nil, fmt.Errorf("failed to prepare statement. %w", err)
+	}
+	defer stmt.Close()
+
+	rows, err := stmt.QueryContext(ctx, name)
+	if err != nil {
+		return nil, fmt.Errorf("failed to exec query. %w", err)
+	}
+
+	var out []*models.Role
+	for rows.Next() {
+		var role models.Role
+		var permission string
+		err := rows.Scan(&role.ID, &role.Name, &role.CreatedAt, &role.UpdatedAt, &permission)
+		if err != nil {
+			rows.Close()
+			return nil, fmt.Errorf("failed to scan response. %w", err)
+		}
+		if len(out) == 0 || out[len(out)-1].ID != role.ID {
+			role.Permissions = []string{}
+			out = append(out, &role)
+		}
+		if permission != "" {
+			last := out[len(out)-1]
+			last.Permissions = append(last.Permissions, permission)
+		}
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("failed to scan response. %w", err)
+	}
+	return out, nil
+}
+
+func (r *rbacRepo) CreateRole(ctx context.Context, tx *sql.Tx, role *models.Role) error {
+	stmt, err := tx.Prepare("insert into roles (name) values ($1) returning id, created_at, updated_at;")
+	if err != nil {
+		return fmt.Errorf("failed to prepare statement. %w", err)
+	}
+	defer stmt.Close()
+
+	err = stmt.QueryRowContext(ctx, role.Name).Scan(&role.ID, &role.CreatedAt, &role.UpdatedAt)
+	if err != nil {
+		return fmt.Errorf("failed to exec query. %w", err)
+	}
+
+	permStmt, err := tx.Prepare("insert into role_permissions (role_id, permission) values ($1, $2) on conflict do nothing;")
+	if err != nil {
+		return fmt.Errorf("failed to prepare statement. %w", err)
+	}
+	defer permStmt.Close()
+
+	for _, permission := range role.Permissions {
+		_, err = permStmt.ExecContext(ctx, role.ID, permission)
+		if err != nil {
+			return fmt.Errorf("failed to exec query. %w", err)
+		}
+	}
+	return nil
+}
+
+// GetPermissions returns the permissions of every role bound to the user.
+func (r *rbacRepo) GetPermissions(ctx context.Context, tx *sql.Tx, userID int) ([]string, error) {
+	stmt, err := tx.Prepare(`select distinct p.permission from role_bindings b
+		join role_permissions p on p.role_id = b.role_id
+		where b.user_id = $1;`)
+	if err != nil {
+		return nil, fmt.Errorf("failed to prepare statement. %w", err)
+	}
+	defer stmt.Close()
+
+	rows, err := stmt.QueryContext(ctx, userID)
+	if err != nil {
+		return nil, fmt.Errorf("failed to exec query. %w", err)
+	}
+
+	var out []string
+	for rows.Next() {
+		var permission string
+		if err := rows.Scan(&permission); err != nil {
+			rows.Close()
+			return nil, fmt.Errorf("failed to scan response. %w", err)
+		}
+		out = append(out, permission)
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("failed to scan response. %w", err)
+	}
+	return out, nil
+}
+
+// CreateBinding binds the role to the user. It returns false if the user already has the role.
+func (r *rbacRepo) CreateBinding(ctx context.Context, tx *sql.Tx, b *models.RoleBinding) (bool, error) {
+	stmt, err := tx.Prepare("insert into role_bindings (role_id, user_id) values ($1, $2) on conflict (role_id, user_id) do nothing returning id, created_at;")
+	if err != nil {
+		return false, fmt.Errorf("failed to prepare statement. %w", err)
+	}
+	defer stmt.Close()
+
+	err = stmt.QueryRowContext(ctx, b.RoleID, b.UserID).Scan(&b.ID, &b.CreatedAt)
+	if err != nil {
+		if err == sql.ErrNoRows {
+			return false, nil
+		}
+		return false, fmt.Errorf("failed to exec query. %w", err)
+	}
+	return true, nil
+}
+
+const bindingQuery = `select b.id, b.role_id, r.name, b.user_id, b.created_at from role_bindings b
+	join roles r on r.id = b.role_id`
+
+// GetBindings returns the role bindings of the user, every binding if userID is 0.
+func (r *rbacRepo) GetBindings(ctx context.Context, tx *sql.Tx, userID int) ([]*models.RoleBinding, error) {
+	stmt, err := tx.Prepare(bindingQuery + " where ($1 = 0 or b.user_id = $1) order by b.id;")
+	if err != nil {
+		return nil, fmt.Errorf("failed to prepare statement. %w", err)
+	}
+	defer stmt.Close()
+
+	rows, err := stmt.QueryContext(ctx, userID)
+	if err != nil {
+		return nil, fmt.Errorf("failed to exec query. %w", err)
+	}
+
+	var out []*models.RoleBinding
+	for rows.Next() {
+		var b models.RoleBinding
+		if err := rows.Scan(&b.ID, &b.RoleID, &b.Role, &b.UserID, &b.CreatedAt); err != nil {
+			rows.Close()
+			return nil, fmt.Errorf("failed to scan response. %w", err)
+		}
+		out = append(out, &b)
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("failed to scan response. %w", err)
+	}
+	return out, nil
+}
+
+// DeleteBinding removes the binding and returns it, or nil if there's none.
+func (r *rbacRepo) DeleteBinding(ctx context.Context, tx *sql.Tx, id int) (*models.RoleBinding, error) {
+	stmt, err := tx.Prepare(bindingQuery + " where b.id = $1;")
+	if err != nil {
+		return nil, fmt.Errorf("failed to prepare statement. %w", err)
+	}
+	defer stmt.Close()
+
+	var b models.RoleBinding
+	err = stmt.QueryRowContext(ctx, id).Scan(&b.ID, &b.RoleID, &b.Role, &b.UserID, &b.CreatedAt)
+	if err != nil {
+		if err == sql.ErrNoRows {
+			return nil, nil
+		}
+		return nil, fmt.Errorf("failed to exec query. %w", err)
+	}
+
+	delStmt, err := tx.Prepare("delete from role_bindings where id=$1;")
+	if err != nil {
+		return nil, fmt.Errorf("failed to prepare statement. %w", err)
+	}
+	defer delStmt.Close()
+
+	_, err = delStmt.ExecContext(ctx, id)
+	if err != nil {
+		return nil, fmt.Errorf("failed to exec query. %w", err)
+	}
+	return &b, nil
+}
@@ -5,8 +5,12 @@ import (
 	"database/sql"
 	"fmt"
 	"log/slog"
+	"sort"
+	"strings"
+	"time"
 
 	"github.com/gwuah/accounts/internal/models"
+	"github.com/gwuah/accounts/pkg"
 )
 
 type TransactionPurpose string
@@ -32,58 +36,220 @@ func (r *transactionsRepo) GetTx(ctx context.Context) (*sql.Tx, error) {
 	return r.db.Begin()
 }
 
-func (r *transactionsRepo) GetBalance(ctx context.Context, tx *sql.Tx, accountID int) (int64, error) {
-	stmt, err := tx.Prepare("select transaction_id, purpose, account_id, amount, created_at from transaction_lines where account_id=$1;")
+// GetBalance reads the account's materialized balance, without locking anything. It's for reads, postings use GetBalanceForUpdate.
+func (r *transactionsRepo) GetBalance(ctx context.Context, tx *sql.Tx, accountID int) (*models.Balance, error) {
+	return r.getBalance(ctx, tx, accountID, "")
+}
+
+// GetBalanceForUpdate reads the account's materialized balance, locking it on postgres until tx is done.
+// This way a concurrent transaction can't spend from the account between this read & the lines being posted.
+func (r *transactionsRepo) GetBalanceForUpdate(ctx context.Context, tx *sql.Tx, accountID int) (*models.Balance, error) {
+	return r.getBalance(ctx, tx, accountID, forUpdate(r.db))
+}
+
+func (r *transactionsRepo) getBalance(ctx context.Context, tx *sql.Tx, accountID int, lock string) (*models.Balance, error) {
+	stmt, err := tx.Prepare(fmt.Sprintf("select balance from balances where account_id=$1 %s;", lock))
+	if err != nil {
+		return nil, fmt.Errorf("failed to prepare statement. %w", err)
+	}
+	defer stmt.Close()
+
+	var total int64
+	err = stmt.QueryRowContext(ctx, accountID).Scan(&total)
+	if err != nil && err != sql.ErrNoRows {
+		return nil, fmt.Errorf("failed to exec query. %w", err)
+	}
+
+	held, err := r.getHeldAmount(ctx, tx, accountID)
+	if err != nil {
+		return nil, err
+	}
+
+	// the limit is locked too, so it can't be lowered while it's being spent against.
+	stmt, err = tx.Prepare(fmt.Sprintf("select overdraft_limit from accounts where id=$1 %s;", lock))
+	if err != nil {
+		return nil, fmt.Errorf("failed to prepare statement. %w", err)
+	}
+	defer stmt.Close()
+
+	var limit int64
+	err = stmt.QueryRowContext(ctx, accountID).Scan(&limit)
+	if err != nil && err != sql.ErrNoRows {
+		return nil, fmt.Errorf("failed to exec query. %w", err)
+	}
+
+	return &models.Balance{Ledger: total, Available: total - held + limit, Held: held}, nil
+}
+
+// VerifyBalances recomputes every account's balance from its lines, and returns the accounts whose materialized balance drifted.
+func (r *transactionsRepo) VerifyBalances(ctx context.Context, tx *sql.Tx) ([]*models.BalanceDrift, error) {
+	stmt, err := tx.Prepare(`select a.id, a.account_number, coalesce(b.balance, 0), coalesce(c.computed, 0)
+		from accounts a
+		left join balances b on b.account_id = a.id
+		left join (
+			select account_id, sum(case when purpose = 'credit' then amount else -amount end) as computed
+			from transaction_lines group by account_id
+		) c on c.account_id = a.id
+		where coalesce(b.balance, 0) <> coalesce(c.computed, 0)
+		order by a.id;`)
+	if err != nil {
+		return nil, fmt.Errorf("failed to prepare statement. %w", err)
+	}
+	defer stmt.Close()
+
+	rows, err := stmt.QueryContext(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("failed to exec query. %w", err)
+	}
+
+	var out []*models.BalanceDrift
+	for rows.Next() {
+		var d models.BalanceDrift
+		err := rows.Scan(&d.AccountID, &d.AccountNumber, &d.Materialized, &d.Computed)
+		if err != nil {
+			rows.Close()
+			return nil, fmt.Errorf("failed to scan response. %w", err)
+		}
+		out = append(out, &d)
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("failed to scan response. %w", err)
+	}
+	return out, nil
+}
+
+// GetBalanceAt returns the account's balance at the given time, ie. from the lines posted before it.
+// It starts off the latest snapshot taken at or before that time, so only the lines posted since are summed up.
+func (r *transactionsRepo) GetBalanceAt(ctx context.Context, tx *sql.Tx, accountID int, at time.Time) (*models.Balance, error) {
+	stmt, err := tx.Prepare("select balance, snapshot_at from balance_snapshots where account_id=$1 and snapshot_at <= $2 order by snapshot_at desc limit 1;")
+	if err != nil {
+		return nil, fmt.Errorf("failed to prepare statement. %w", err)
+	}
+	defer stmt.Close()
+
+	var snapshot int64
+	var since time.Time
+	err = stmt.QueryRowContext(ctx, accountID, at.UTC()).Scan(&snapshot, &since)
+	if err != nil && err != sql.ErrNoRows {
+		return nil, fmt.Errorf("failed to exec query. %w", err)
+	}
+
+	stmt, err = tx.Prepare("select coalesce(sum(case when purpose = 'credit' then amount else -amount end), 0) from transaction_lines where account_id=$1 and created_at >= $2 and created_at < $3;")
+	if err != nil {
+		return nil, fmt.Errorf("failed to prepare statement. %w", err)
+	}
+	defer stmt.Close()
+
+	var delta int64
+	err = stmt.QueryRowContext(ctx, accountID, since.UTC(), at.UTC()).Scan(&delta)
+	if err != nil {
+		return nil, fmt.Errorf("failed to exec query. %w", err)
+	}
+
+	// holds that were pending at the time, they've either not been resolved yet or were resolved after it.
+	stmt, err = tx.Prepare("select coalesce(sum(amount), 0) from holds where account_id=$1 and created_at < $2 and expires_at > $2 and (status=$3 or updated_at >= $2);")
+	if err != nil {
+		return nil, fmt.Errorf("failed to prepare statement. %w", err)
+	}
+	defer stmt.Close()
+
+	var held int64
+	err = stmt.QueryRowContext(ctx, accountID, at.UTC(), string(PENDING)).Scan(&held)
+	if err != nil {
+		return nil, fmt.Errorf("failed to exec query. %w", err)
+	}
+
+	// the overdraft limit in force at the time, off the limit's audit trail.
+	stmt, err = tx.Prepare("select new_limit from account_limit_changes where account_id=$1 and created_at < $2 order by created_at desc, id desc limit 1;")
+	if err != nil {
+		return nil, fmt.Errorf("failed to prepare statement. %w", err)
+	}
+	defer stmt.Close()
+
+	var limit int64
+	err = stmt.QueryRowContext(ctx, accountID, at.UTC()).Scan(&limit)
+	if err != nil && err != sql.ErrNoRows {
+		return nil, fmt.Errorf("failed to exec query. %w", err)
+	}
+
+	total := snapshot + delta
+	return &models.Balance{Ledger: total, Available: total - held + limit, Held: held}, nil
+}
+
+// CreateSnapshots records every account's balance at the given time, skipping accounts that already have a snapshot for it.
+// It returns the number of snapshots created.
+func (r *transactionsRepo) CreateSnapshots(ctx context.Context, tx *sql.Tx, at time.Time) (int, error) {
+	stmt, err := tx.Prepare("select account_id from balances where account_id not in (select account_id from balance_snapshots where snapshot_at=$1) order by account_id;")
 	if err != nil {
 		return 0, fmt.Errorf("failed to prepare statement. %w", err)
 	}
 	defer stmt.Close()
 
-	rows, err := stmt.QueryContext(ctx, accountID)
+	rows, err := stmt.QueryContext(ctx, at.UTC())
 	if err != nil {
 		return 0, fmt.Errorf("failed to exec query. %w", err)
 	}
 
-	var out []*models.TransactionLine
+	var accountIDs []int
 	for rows.Next() {
-		var u models.TransactionLine
-		err := rows.Scan(&u.TransactionID, &u.Purpose, &u.AccountID, &u.Amount, &u.CreatedAt)
-		if err != nil {
-			if err == sql.ErrNoRows {
-				continue
-			}
+		var id int
+		if err := rows.Scan(&id); err != nil {
 			rows.Close()
 			return 0, fmt.Errorf("failed to scan response. %w", err)
 		}
-		out = append(out, &u)
+		accountIDs = append(accountIDs, id)
 	}
 	rows.Close()
 	if err := rows.Err(); err != nil {
 		return 0, fmt.Errorf("failed to scan response. %w", err)
 	}
 
-	total := int64(0)
-	for _, line := range out {
-		if line.Purpose == string(CREDIT) {
-			total += line.Amount
+	insert, err := tx.Prepare("insert into balance_snapshots (account_id, balance, snapshot_at) values ($1, $2, $3);")
+	if err != nil {
+		return 0, fmt.Errorf("failed to prepare statement. %w", err)
+	}
+	defer insert.Close()
+
+	for _, id := range accountIDs {
+		balance, err := r.GetBalanceAt(ctx, tx, id, at)
+		if err != nil {
+			return 0, err
 		}
-		if line.Purpose == string(DEBIT) {
-			total -= line.Amount
+		_, err = insert.ExecContext(ctx, id, balance.Ledger, at.UTC())
+		if err != nil {
+			return 0, fmt.Errorf("failed to exec query. %w", err)
 		}
 	}
 
-	return total, nil
+	return len(accountIDs), nil
+}
+
+// getHeldAmount returns the sum of the account's pending holds that haven't expired yet.
+func (r *transactionsRepo) getHeldAmount(ctx context.Context, tx *sql.Tx, accountID int) (int64, error) {
+	stmt, err := tx.Prepare("select coalesce(sum(amount), 0) from holds where account_id=$1 and status=$2 and expires_at > $3;")
+	if err != nil {
+		return 0, fmt.Errorf("failed to prepare statement. %w", err)
+	}
+	defer stmt.Close()
+
+	var held int64
+	err = stmt.QueryRowContext(ctx, accountID, string(PENDING), time.Now().UTC()).Scan(&held)
+	if err != nil {
+		return 0, fmt.Errorf("failed to exec query. %w", err)
+	}
+	return held, nil
 }
 
 func (r *transactionsRepo) Create(ctx context.Context, tx *sql.Tx, t *models.Transaction) error {
-	query := `insert into transactions (reference) values ($1) returning id, created_at, updated_at;`
+	query := `insert into transactions (reference, type, amount, source_account_id, destination_account_id, original_transaction_id) values ($1, $2, $3, $4, $5, $6) returning id, created_at, updated_at;`
 	stmt, err := tx.Prepare(query)
 	if err != nil {
 		return err
 	}
 	defer stmt.Close()
 
-	err = stmt.QueryRow(t.Reference).Scan(&t.ID, &t.CreatedAt, &t.UpdatedAt)
+	err = stmt.QueryRow(t.Reference, t.Type, t.Amount, t.SourceAccountID, t.DestinationAccountID, t.OriginalTransactionID).Scan(&t.ID, &t.CreatedAt, &t.UpdatedAt)
 	if err != nil {
 		return err
 	}
@@ -91,18 +257,435 @@ func (r *transactionsRepo) Create(ctx context.Context, tx *sql.Tx, t *models.Tra
 	return err
 }
 
+const transactionColumns = "id, reference, type, amount, source_account_id, destination_account_id, original_transaction_id, created_at, updated_at"
+
+func scanTransaction(row interface{ Scan(...any) error }) (*models.Transaction, error) {
+	var t models.Transaction
+	err := row.Scan(&t.ID, &t.Reference, &t.Type, &t.Amount, &t.SourceAccountID, &t.DestinationAccountID, &t.OriginalTransactionID, &t.CreatedAt, &t.UpdatedAt)
+	if err != nil {
+		return nil, err
+	}
+	return &t, nil
+}
+
+func (r *transactionsRepo) GetByReference(ctx context.Context, tx *sql.Tx, reference string) (*models.Transaction, error) {
+	stmt, err := tx.Prepare(fmt.Sprintf("select %s from transactions where reference=$1;", transactionColumns))
+	if err != nil {
+		return nil, fmt.Errorf("failed to prepare statement. %w", err)
+	}
+	defer stmt.Close()
+
+	t, err := scanTransaction(stmt.QueryRowContext(ctx, reference))
+	if err != nil {
+		if err == sql.ErrNoRows {
+			return nil, nil
+		}
+		return nil, fmt.Errorf("failed to exec query. %w", err)
+	}
+	return t, nil
+}
+
+// GetReversals returns the reversals & refunds posted against a transaction, oldest first.
+func (r *transactionsRepo) GetReversals(ctx context.Context, tx *sql.Tx, transactionID int) ([]*models.Transaction, error) {
+	stmt, err := tx.Prepare(fmt.Sprintf("select %s from transactions where original_transaction_id=$1 order by id;", transactionColumns))
+	if err != nil {
+		return nil, fmt.Errorf("failed to prepare statement. %w", err)
+	}
+	defer stmt.Close()
+
+	rows, err := stmt.QueryContext(ctx, transactionID)
+	if err != nil {
+		return nil, fmt.Errorf("failed to exec query. %w", err)
+	}
+
+	var out []*models.Transaction
+	for rows.Next() {
+		t, err := scanTransaction(rows)
+		if err != nil {
+			rows.Close()
+			return nil, fmt.Errorf("failed to scan response. %w", err)
+		}
+		out = append(out, t)
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("failed to scan response. %w", err)
+	}
+	return out, nil
+}
+
+func (r *transactionsRepo) GetLines(ctx context.Context, tx *sql.Tx, transactionID int) ([]*models.TransactionLine, error) {
+	stmt, err := tx.Prepare(`select l.id, l.transaction_id, l.account_id, a.account_number, a.currency, l.amount, l.purpose, l.created_at, l.updated_at
+		from transaction_lines l
+		join accounts a on a.id = l.account_id
+		where l.transaction_id=$1 order by l.id;`)
+	if err != nil {
+		return nil, fmt.Errorf("failed to prepare statement. %w", err)
+	}
+	defer stmt.Close()
+
+	rows, err := stmt.QueryContext(ctx, transactionID)
+	if err != nil {
+		return nil, fmt.Errorf("failed to exec query. %w", err)
+	}
+
+	var out []*models.TransactionLine
+	for rows.Next() {
+		var l models.TransactionLine
+		err := rows.Scan(&l.ID, &l.TransactionID, &l.AccountID, &l.AccountNumber, &l.Currency, &l.Amount, &l.Purpose, &l.CreatedAt, &l.UpdatedAt)
+		if err != nil {
+			rows.Close()
+			return nil, fmt.Errorf("failed to scan response. %w", err)
+		}
+		out = append(out, &l)
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("failed to scan response. %w", err)
+	}
+	return out, nil
+}
+
+// CreateTransactionLine appends a line to the ledger, chained to the line before it on the same account.
+// The account's chain head is locked until the db transaction ends, so its lines are chained in the order they're committed.
+// Postings lock their accounts before their lines are created, so the heads are only ever waited on like the accounts are.
 func (r *transactionsRepo) CreateTransactionLine(ctx context.Context, tx *sql.Tx, t *models.TransactionLine) error {
-	query := `insert into transaction_lines (transaction_id, purpose, account_id, amount) values ($1, $2, $3, $4) returning id, created_at, updated_at;`
+	_, err := tx.ExecContext(ctx, "insert into account_chains (account_id, line_id, hash) values ($1, 0, '') on conflict (account_id) do nothing;", t.AccountID)
+	if err != nil {
+		return fmt.Errorf("failed to create account chain: %w", err)
+	}
+	err = tx.QueryRowContext(ctx, fmt.Sprintf("select hash from account_chains where account_id=$1 %s;", forUpdate(r.db)), t.AccountID).Scan(&t.PrevHash)
+	if err != nil {
+		return fmt.Errorf("failed to lock account chain: %w", err)
+	}
+
+	// the timestamp is hashed, so it's set here rather than by the db, at the precision the db keeps.
+	t.CreatedAt = time.Now().UTC().Truncate(time.Microsecond)
+	t.UpdatedAt = t.CreatedAt
+	t.Hash = pkg.LineHash(t.PrevHash, t.TransactionID, t.AccountID, t.Amount, t.Purpose, t.CreatedAt)
+
+	query := `insert into transaction_lines (transaction_id, purpose, account_id, amount, prev_hash, hash, created_at, updated_at) values ($1, $2, $3, $4, $5, $6, $7, $7) returning id;`
 	stmt, err := tx.Prepare(query)
 	if err != nil {
 		return err
 	}
 	defer stmt.Close()
 
-	err = stmt.QueryRow(t.TransactionID, t.Purpose, t.AccountID, t.Amount).Scan(&t.ID, &t.CreatedAt, &t.UpdatedAt)
+	err = stmt.QueryRow(t.TransactionID, t.Purpose, t.AccountID, t.Amount, t.PrevHash, t.Hash, t.CreatedAt).Scan(&t.ID)
 	if err != nil {
 		return err
 	}
 
-	return err
+	_, err = tx.ExecContext(ctx, "update account_chains set line_id=$1, hash=$2 where account_id=$3;", t.ID, t.Hash, t.AccountID)
+	if err != nil {
+		return fmt.Errorf("failed to update account chain: %w", err)
+	}
+
+	// the materialized balance moves with every line, in the same db transaction.
+	delta := t.Amount
+	if t.Purpose == string(DEBIT) {
+		delta = -t.Amount
+	}
+	_, err = tx.ExecContext(ctx, `insert into balances (account_id, balance, version, updated_at) values ($1, $2, 1, $3)
+		on conflict (account_id) do update set balance = balances.balance + excluded.balance, version = balances.version + 1, updated_at = excluded.updated_at;`,
+		t.AccountID, delta, t.CreatedAt.UTC(),
+	)
+	if err != nil {
+		return fmt.Errorf("failed to update balance: %w", err)
+	}
+
+	return nil
+}
+
+// HistoryFilter narrows down an account's history. Zero values are ignored.
+type HistoryFilter struct {
+	// Before is the id of the last line of the previous page.
+	Before    int
+	From      time.Time
+	To        time.Time
+	Direction TransactionPurpose
+	MinAmount int64
+	MaxAmount int64
+	Limit     int
+}
+
+// GetHistory returns the account's lines, newest first, with the counterparty and the account's balance right after each line.
+// Running balances are computed over the full history, before any filter is applied.
+func (r *transactionsRepo) GetHistory(ctx context.Context, tx *sql.Tx, accountID int, filter HistoryFilter) ([]*models.StatementLine, error) {
+	var conditions []string
+	args := []interface{}{accountID}
+	addCondition := func(condition string, arg interface{}) {
+		args = append(args, arg)
+		conditions = append(conditions, fmt.Sprintf(condition, len(args)))
+	}
+
+	if filter.Before > 0 {
+		addCondition("h.id < $%d", filter.Before)
+	}
+	if !filter.From.IsZero() {
+		addCondition("h.created_at >= $%d", filter.From.UTC())
+	}
+	if !filter.To.IsZero() {
+		addCondition("h.created_at < $%d", filter.To.UTC())
+	}
+	if filter.Direction != "" {
+		addCondition("h.purpose = $%d", string(filter.Direction))
+	}
+	if filter.MinAmount > 0 {
+		addCondition("h.amount >= $%d", filter.MinAmount)
+	}
+	if filter.MaxAmount > 0 {
+		addCondition("h.amount <= $%d", filter.MaxAmount)
+	}
+
+	where := ""
+	if len(conditions) > 0 {
+		where = "where " + strings.Join(conditions, " and ")
+	}
+	args = append(args, filter.Limit)
+
+	// the counterparty is the other side of the transaction's principal, or the biggest line on the other side for anything else.
+	query := fmt.Sprintf(`select h.id, h.transaction_id, h.reference, h.type, h.purpose, h.amount, h.counterparty, h.running_balance, h.created_at from (
+			select l.id, l.transaction_id, t.reference, t.type, l.purpose, l.amount, l.created_at,
+				sum(case when l.purpose = 'credit' then l.amount else -l.amount end) over (order by l.id) as running_balance,
+				coalesce((select a.account_number from accounts a where a.id = case
+					when l.account_id = t.source_account_id then t.destination_account_id
+					when l.account_id = t.destination_account_id then t.source_account_id
+					else (
+						select c.account_id from transaction_lines c
+						where c.transaction_id = l.transaction_id and c.purpose <> l.purpose
+						order by c.amount desc, c.id limit 1
+					) end), '') as counterparty
+			from transaction_lines l
+			join transactions t on t.id = l.transaction_id
+			where l.account_id = $1
+		) h %s order by h.id desc limit $%d;`, where, len(args))
+
+	stmt, err := tx.Prepare(query)
+	if err != nil {
+		return nil, fmt.Errorf("failed to prepare statement. %w", err)
+	}
+	defer stmt.Close()
+
+	rows, err := stmt.QueryContext(ctx, args...)
+	if err != nil {
+		return nil, fmt.Errorf("failed to exec query. %w", err)
+	}
+
+	var out []*models.StatementLine
+	for rows.Next() {
+		var l models.StatementLine
+		err := rows.Scan(&l.ID, &l.TransactionID, &l.Reference, &l.Type, &l.Direction, &l.MinorAmount, &l.CounterpartyAccountNumber, &l.MinorRunningBalance, &l.CreatedAt)
+		if err != nil {
+			rows.Close()
+			return nil, fmt.Errorf("failed to scan response. %w", err)
+		}
+		out = append(out, &l)
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("failed to scan response. %w", err)
+	}
+	return out, nil
+}
+
+// LockAccounts locks the materialized balances of the given accounts until tx is done.
+// Rows are always locked in ascending account id order, so two transactions touching the same accounts can't deadlock.
+// On sqlite this is a no-op, transactions already hold the db's write lock from the moment they begin.
+func (r *transactionsRepo) LockAccounts(ctx context.Context, tx *sql.Tx, accountIDs []int) error {
+	if !isPostgres(r.db) || len(accountIDs) == 0 {
+		return nil
+	}
+
+	ids := append([]int(nil), accountIDs...)
+	sort.Ints(ids)
+
+	placeholders := make([]string, 0, len(ids))
+	args := make([]interface{}, 0, len(ids))
+	for i, id := range ids {
+		if i > 0 && ids[i-1] == id {
+			continue
+		}
+		args = append(args, id)
+		placeholders = append(placeholders, fmt.Sprintf("$%d", len(args)))
+	}
+
+	query := fmt.Sprintf("select account_id from balances where account_id in (%s) order by account_id for update;", strings.Join(placeholders, ","))
+	rows, err := tx.QueryContext(ctx, query, args...)
+	if err != nil {
+		return fmt.Errorf("failed to lock accounts. %w", err)
+	}
+	rows.Close()
+	return rows.Err()
+}
+
+// GetChainHeads returns the head of every account's chain, ie. of every account with lines.
+func (r *transactionsRepo) GetChainHeads(ctx context.Context, tx *sql.Tx) ([]*models.ChainHead, error) {
+	stmt, err := tx.Prepare("select account_id, line_id, hash from account_chains order by account_id;")
+	if err != nil {
+		return nil, fmt.Errorf("failed to prepare statement. %w", err)
+	}
+	defer stmt.Close()
+
+	rows, err := stmt.QueryContext(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("failed to exec query. %w", err)
+	}
+
+	var out []*models.ChainHead
+	for rows.Next() {
+		var h models.ChainHead
+		err := rows.Scan(&h.AccountID, &h.LineID, &h.Hash)
+		if err != nil {
+			rows.Close()
+			return nil, fmt.Errorf("failed to scan response. %w", err)
+		}
+		out = append(out, &h)
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("failed to scan response. %w", err)
+	}
+	return out, nil
+}
+
+// GetChainLines returns up to limit lines after the given account's line, in chain order: by account, then in the order they were chained.
+func (r *transactionsRepo) GetChainLines(ctx context.Context, tx *sql.Tx, afterAccountID, afterID, limit int) ([]*models.TransactionLine, error) {
+	stmt, err := tx.Prepare(`select id, transaction_id, account_id, amount, purpose, coalesce(prev_hash, ''), coalesce(hash, ''), created_at
+		from transaction_lines where account_id > $1 or (account_id = $1 and id > $2) order by account_id, id limit $3;`)
+	if err != nil {
+		return nil, fmt.Errorf("failed to prepare statement. %w", err)
+	}
+	defer stmt.Close()
+
+	rows, err := stmt.QueryContext(ctx, afterAccountID, afterID, limit)
+	if err != nil {
+		return nil, fmt.Errorf("failed to exec query. %w", err)
+	}
+
+	var out []*models.TransactionLine
+	for rows.Next() {
+		var l models.TransactionLine
+		err := rows.Scan(&l.ID, &l.TransactionID, &l.AccountID, &l.Amount, &l.Purpose, &l.PrevHash, &l.Hash, &l.CreatedAt)
+		if err != nil {
+			rows.Close()
+			return nil, fmt.Errorf("failed to scan response. %w", err)
+		}
+		out = append(out, &l)
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("failed to scan response. %w", err)
+	}
+	return out, nil
+}
+
+// GetTrialBalance sums up the debits & credits posted to every account that has lines, deleted accounts included.
+func (r *transactionsRepo) GetTrialBalance(ctx context.Context, tx *sql.Tx) ([]*models.TrialBalanceLine, error) {
+	stmt, err := tx.Prepare(`select a.account_number, a.type, a.currency,
+			coalesce(sum(case when l.purpose = 'debit' then l.amount else 0 end), 0),
+			coalesce(sum(case when l.purpose = 'credit' then l.amount else 0 end), 0)
+		from accounts a
+		join transaction_lines l on l.account_id = a.id
+		group by a.id, a.account_number, a.type, a.currency
+		order by a.currency, a.account_number;`)
+	if err != nil {
+		return nil, fmt.Errorf("failed to prepare statement. %w", err)
+	}
+	defer stmt.Close()
+
+	rows, err := stmt.QueryContext(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("failed to exec query. %w", err)
+	}
+
+	var out []*models.TrialBalanceLine
+	for rows.Next() {
+		var l models.TrialBalanceLine
+		err := rows.Scan(&l.AccountNumber, &l.AccountType, &l.Currency, &l.Debits, &l.Credits)
+		if err != nil {
+			rows.Close()
+			return nil, fmt.Errorf("failed to scan response. %w", err)
+		}
+		l.Balance = l.Credits - l.Debits
+		out = append(out, &l)
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("failed to scan response. %w", err)
+	}
+	return out, nil
+}
+
+// GetUnbalancedTransactions returns the transactions whose debits & credits don't add up, per currency.
+func (r *transactionsRepo) GetUnbalancedTransactions(ctx context.Context, tx *sql.Tx) ([]*models.UnbalancedTransaction, error) {
+	stmt, err := tx.Prepare(`select t.id, t.reference, a.currency,
+			sum(case when l.purpose = 'debit' then l.amount else 0 end),
+			sum(case when l.purpose = 'credit' then l.amount else 0 end)
+		from transactions t
+		join transaction_lines l on l.transaction_id = t.id
+		join accounts a on a.id = l.account_id
+		group by t.id, t.reference, a.currency
+		having sum(case when l.purpose = 'credit' then l.amount else -l.amount end) <> 0
+		order by t.id, a.currency;`)
+	if err != nil {
+		return nil, fmt.Errorf("failed to prepare statement. %w", err)
+	}
+	defer stmt.Close()
+
+	rows, err := stmt.QueryContext(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("failed to exec query. %w", err)
+	}
+
+	var out []*models.UnbalancedTransaction
+	for rows.Next() {
+		var u models.UnbalancedTransaction
+		err := rows.Scan(&u.TransactionID, &u.Reference, &u.Currency, &u.Debits, &u.Credits)
+		if err != nil {
+			rows.Close()
+			return nil, fmt.Errorf("failed to scan response. %w", err)
+		}
+		out = append(out, &u)
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("failed to scan response. %w", err)
+	}
+	return out, nil
+}
+
+// GetOrphanLines returns the lines whose transaction or account doesn't exist.
+func (r *transactionsRepo) GetOrphanLines(ctx context.Context, tx *sql.Tx) ([]*models.TransactionLine, error) {
+	stmt, err := tx.Prepare(`select l.id, l.transaction_id, l.account_id, l.amount, l.purpose, l.created_at, l.updated_at
+		from transaction_lines l
+		left join transactions t on t.id = l.transaction_id
+		left join accounts a on a.id = l.account_id
+		where t.id is null or a.id is null
+		order by l.id;`)
+	if err != nil {
+		return nil, fmt.Errorf("failed to prepare statement. %w", err)
+	}
+	defer stmt.Close()
+
+	rows, err := stmt.QueryContext(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("failed to exec query. %w", err)
+	}
+
+	var out []*models.TransactionLine
+	for rows.Next() {
+		var l models.TransactionLine
+		err := rows.Scan(&l.ID, &l.TransactionID, &l.AccountID, &l.Amount, &l.Purpose, &l.CreatedAt, &l.UpdatedAt)
+		if err != nil {
+			rows.Close()
+			return nil, fmt.Errorf("failed to scan response. %w", err)
+		}
+		out = append(out, &l)
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("failed to scan response. %w", err)
+	}
+	return out, nil
 }
@@ -3,6 +3,7 @@ package repos
 import (
 	"context"
 	"database/sql"
+	"encoding/json"
 	"fmt"
 	"log/slog"
 
@@ -25,37 +26,88 @@ func (r *usersRepo) GetTx(ctx context.Context) (*sql.Tx, error) {
 	return r.db.Begin()
 }
 
+const userColumns = "id, email, created_at, updated_at, deleted_at, erased_at"
+
+func scanUser(row interface{ Scan(...any) error }) (*models.User, error) {
+	var u models.User
+	err := row.Scan(&u.ID, &u.Email, &u.CreatedAt, &u.UpdatedAt, &u.DeletedAt, &u.ErasedAt)
+	if err != nil {
+		return nil, err
+	}
+	return &u, nil
+}
+
+// GetByID returns the user, or nil if it doesn't exist or has been deleted.
 func (r *usersRepo) GetByID(ctx context.Context, tx *sql.Tx, userID int) (*models.User, error) {
-	stmt, err := tx.Prepare("select id, email, created_at, update_at from users where id=$1;")
+	stmt, err := tx.Prepare(fmt.Sprintf("select %s from users where id=$1 and deleted_at is null;", userColumns))
+	if err != nil {
+		return nil, fmt.Errorf("failed to prepare statement. %w", err)
+	}
+	defer stmt.Close()
+
+	u, err := scanUser(stmt.QueryRowContext(ctx, userID))
+	if err != nil {
+		if err == sql.ErrNoRows {
+			return nil, nil
+		}
+		return nil, fmt.Errorf("failed to exec query. %w", err)
+	}
+	return u, nil
+}
+
+// Delete soft deletes the user, it returns nil if the user doesn't exist or was already deleted.
+func (r *usersRepo) Delete(ctx context.Context, tx *sql.Tx, userID int) (*models.User, error) {
+	stmt, err := tx.Prepare(fmt.Sprintf("update users set deleted_at=CURRENT_TIMESTAMP, updated_at=CURRENT_TIMESTAMP where id=$1 and deleted_at is null returning %s;", userColumns))
 	if err != nil {
 		return nil, fmt.Errorf("failed to prepare statement. %w", err)
 	}
 	defer stmt.Close()
 
-	rows, err := stmt.QueryContext(ctx, userID)
+	u, err := scanUser(stmt.QueryRowContext(ctx, userID))
 	if err != nil {
+		if err == sql.ErrNoRows {
+			return nil, nil
+		}
 		return nil, fmt.Errorf("failed to exec query. %w", err)
 	}
+	return u, nil
+}
 
-	var out []*models.User
-	for rows.Next() {
-		var u models.User
-		err := rows.Scan(&u.ID, &u.Email, &u.CreatedAt, &u.UpdatedAt)
-		if err != nil {
-			if err == sql.ErrNoRows {
-				continue
-			}
-			rows.Close()
-			return nil, fmt.Errorf("failed to scan response. %w", err)
+// Erase pseudonymizes the user's personal data and soft deletes it, if it isn't already.
+// The email is replaced by one derived from the id alone, so it stays unique without being linkable to the person.
+// Responses kept for replaying idempotent requests, eg. the one that created the user, are pseudonymized the same way.
+// It returns nil if the user doesn't exist or was already erased.
+func (r *usersRepo) Erase(ctx context.Context, tx *sql.Tx, userID int) (*models.User, error) {
+	var email string
+	err := tx.QueryRowContext(ctx, fmt.Sprintf("select email from users where id=$1 and erased_at is null %s;", forUpdate(r.db)), userID).Scan(&email)
+	if err != nil {
+		if err == sql.ErrNoRows {
+			return nil, nil
 		}
-		out = append(out, &u)
+		return nil, fmt.Errorf("failed to exec query. %w", err)
+	}
+
+	query := fmt.Sprintf(`update users set email=$1, erased_at=CURRENT_TIMESTAMP, deleted_at=coalesce(deleted_at, CURRENT_TIMESTAMP), updated_at=CURRENT_TIMESTAMP
+		where id=$2 and erased_at is null returning %s;`, userColumns)
+	stmt, err := tx.Prepare(query)
+	if err != nil {
+		return nil, fmt.Errorf("failed to prepare statement. %w", err)
 	}
-	rows.Close()
-	if err := rows.Err(); err != nil {
-		return nil, fmt.Errorf("failed to scan response. %w", err)
+	defer stmt.Close()
+
+	u, err := scanUser(stmt.QueryRowContext(ctx, fmt.Sprintf("erased-%d@users.invalid", userID), userID))
+	if err != nil {
+		return nil, fmt.Errorf("failed to exec query. %w", err)
 	}
 
-	return out[0], nil
+	// responses are json, the emails are replaced as they're encoded in them.
+	from, _ := json.Marshal(email)
+	to, _ := json.Marshal(u.Email)
+	_, err = tx.ExecContext(ctx, "update idempotency_keys set response_body=replace(response_body, $1, $2) where replace(response_body, $1, $2) <> response_body;", string(from), string(to))
+	if err != nil {
+		return nil, fmt.Errorf("failed to exec query. %w", err)
+	}
+	return u, nil
 }
 
 func (r *usersRepo) Create(ctx context.Context, tx *sql.Tx, u *models.User) error {
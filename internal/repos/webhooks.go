@@ -0,0 +1,269 @@
+package repos
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"log/slog"
+	"strings"
+	"time"
+
+	"github.com/gwuah/accounts/internal/models"
+)
+
+const deliveryColumns = "d.id, d.event_id, d.endpoint_id, d.status, d.attempts, d.next_attempt_at, d.last_error, d.delivered_at, d.created_at, d.updated_at"
+
+type webhooksRepo struct {
+	db     *sql.DB
+	logger *slog.Logger
+}
+
+func NewWebhooks(logger *slog.Logger, db *sql.DB) *webhooksRepo {
+	return &webhooksRepo{
+		db:     db,
+		logger: logger,
+	}
+}
+
+func (r *webhooksRepo) GetTx(ctx context.Context) (*sql.Tx, error) {
+	return r.db.Begin()
+}
+
+func (r *webhooksRepo) CreateEndpoint(ctx context.Context, tx *sql.Tx, e *models.WebhookEndpoint) error {
+	stmt, err := tx.Prepare("insert into webhook_endpoints (url, secret, events) values ($1, $2, $3) returning id, created_at, updated_at;")
+	if err != nil {
+		return fmt.Errorf("failed to prepare statement. %w", err)
+	}
+	defer stmt.Close()
+
+	err = stmt.QueryRowContext(ctx, e.URL, e.Secret, strings.Join(e.Events, ",")).Scan(&e.ID, &e.CreatedAt, &e.UpdatedAt)
+	if err != nil {
+		return fmt.Errorf("failed to exec query. %w", err)
+	}
+	return nil
+}
+
+// GetEndpoints returns every registered endpoint, secrets included.
+func (r *webhooksRepo) GetEndpoints(ctx context.Context, tx *sql.Tx) ([]*models.WebhookEndpoint, error) {
+	stmt, err := tx.Prepare("select id, url, secret, events, created_at, updated_at from webhook_endpoints order by id;")
+	if err != nil {
+		return nil, fmt.Errorf("failed to prepare statement. %w", err)
+	}
+	defer stmt.Close()
+
+	rows, err := stmt.QueryContext(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("failed to exec query. %w", err)
+	}
+
+	var out []*models.WebhookEndpoint
+	for rows.Next() {
+		var e models.WebhookEndpoint
+		var events string
+		err := rows.Scan(&e.ID, &e.URL, &e.Secret, &events, &e.CreatedAt, &e.UpdatedAt)
+		if err != nil {
+			rows.Close()
+			return nil, fmt.Errorf("failed to scan response. %w", err)
+		}
+		e.Events = strings.Split(events, ",")
+		out = append(out, &e)
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("failed to scan response. %w", err)
+	}
+	return out, nil
+}
+
+// CreateEvent writes an event to the outbox. It must run in the transaction of the change it describes,
+// so the event exists if and only if the change was committed.
+func (r *webhooksRepo) CreateEvent(ctx context.Context, tx *sql.Tx, e *models.Event) error {
+	stmt, err := tx.Prepare("insert into outbox_events (type, payload) values ($1, $2) returning id, created_at;")
+	if err != nil {
+		return fmt.Errorf("failed to prepare statement. %w", err)
+	}
+	defer stmt.Close()
+
+	err = stmt.QueryRowContext(ctx, e.Type, string(e.Payload)).Scan(&e.ID, &e.CreatedAt)
+	if err != nil {
+		return fmt.Errorf("failed to exec query. %w", err)
+	}
+	return nil
+}
+
+// GetUndispatchedEvents returns the oldest events that haven't been fanned out to the endpoints yet, locking them.
+func (r *webhooksRepo) GetUndispatchedEvents(ctx context.Context, tx *sql.Tx, limit int) ([]*models.Event, error) {
+	stmt, err := tx.Prepare(fmt.Sprintf("select id, type, payload, created_at from outbox_events where dispatched_at is null order by id limit $1 %s;", forUpdate(r.db)))
+	if err != nil {
+		return nil, fmt.Errorf("failed to prepare statement. %w", err)
+	}
+	defer stmt.Close()
+
+	rows, err := stmt.QueryContext(ctx, limit)
+	if err != nil {
+		return nil, fmt.Errorf("failed to exec query. %w", err)
+	}
+
+	var out []*models.Event
+	for rows.Next() {
+		var e models.Event
+		var payload []byte
+		err := rows.Scan(&e.ID, &e.Type, &payload, &e.CreatedAt)
+		if err != nil {
+			rows.Close()
+			return nil, fmt.Errorf("failed to scan response. %w", err)
+		}
+		e.Payload = payload
+		out = append(out, &e)
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("failed to scan response. %w", err)
+	}
+	return out, nil
+}
+
+func (r *webhooksRepo) MarkDispatched(ctx context.Context, tx *sql.Tx, eventID int) error {
+	stmt, err := tx.Prepare("update outbox_events set dispatched_at=CURRENT_TIMESTAMP where id=$1;")
+	if err != nil {
+		return fmt.Errorf("failed to prepare statement. %w", err)
+	}
+	defer stmt.Close()
+
+	_, err = stmt.ExecContext(ctx, eventID)
+	if err != nil {
+		return fmt.Errorf("failed to exec query. %w", err)
+	}
+	return nil
+}
+
+// CreateDelivery queues an event's delivery to an endpoint. An event is delivered once per endpoint.
+func (r *webhooksRepo) CreateDelivery(ctx context.Context, tx *sql.Tx, d *models.WebhookDelivery) error {
+	stmt, err := tx.Prepare(`insert into webhook_deliveries (event_id, endpoint_id, status, next_attempt_at) values ($1, $2, $3, $4)
+		on conflict (event_id, endpoint_id) do nothing;`)
+	if err != nil {
+		return fmt.Errorf("failed to prepare statement. %w", err)
+	}
+	defer stmt.Close()
+
+	_, err = stmt.ExecContext(ctx, d.EventID, d.EndpointID, d.Status, d.NextAttemptAt.UTC())
+	if err != nil {
+		return fmt.Errorf("failed to exec query. %w", err)
+	}
+	return nil
+}
+
+// GetDueDeliveries returns the pending deliveries whose next attempt is due, with the event and the endpoint they're for.
+func (r *webhooksRepo) GetDueDeliveries(ctx context.Context, tx *sql.Tx, now time.Time, limit int) ([]*models.WebhookDelivery, error) {
+	query := fmt.Sprintf(`select %s, e.type, e.payload, e.created_at, w.url, w.secret
+		from webhook_deliveries d
+		join outbox_events e on e.id = d.event_id
+		join webhook_endpoints w on w.id = d.endpoint_id
+		where d.status = 'pending' and d.next_attempt_at <= $1
+		order by d.next_attempt_at, d.id
+		limit $2;`, deliveryColumns)
+	stmt, err := tx.Prepare(query)
+	if err != nil {
+		return nil, fmt.Errorf("failed to prepare statement. %w", err)
+	}
+	defer stmt.Close()
+
+	rows, err := stmt.QueryContext(ctx, now.UTC(), limit)
+	if err != nil {
+		return nil, fmt.Errorf("failed to exec query. %w", err)
+	}
+
+	var out []*models.WebhookDelivery
+	for rows.Next() {
+		var d models.WebhookDelivery
+		var e models.Event
+		var payload []byte
+		err := rows.Scan(&d.ID, &d.EventID, &d.EndpointID, &d.Status, &d.Attempts, &d.NextAttemptAt, &d.LastError, &d.DeliveredAt, &d.CreatedAt, &d.UpdatedAt,
+			&e.Type, &payload, &e.CreatedAt, &d.URL, &d.Secret)
+		if err != nil {
+			rows.Close()
+			return nil, fmt.Errorf("failed to scan response. %w", err)
+		}
+		e.ID = d.EventID
+		e.Payload = payload
+		d.Event = &e
+		out = append(out, &d)
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("failed to scan response. %w", err)
+	}
+	return out, nil
+}
+
+// UpdateDelivery records the outcome of a delivery attempt.
+func (r *webhooksRepo) UpdateDelivery(ctx context.Context, tx *sql.Tx, d *models.WebhookDelivery) error {
+	stmt, err := tx.Prepare(`update webhook_deliveries set status=$1, attempts=$2, next_attempt_at=$3, last_error=$4, delivered_at=$5, updated_at=CURRENT_TIMESTAMP
+		where id=$6;`)
+	if err != nil {
+		return fmt.Errorf("failed to prepare statement. %w", err)
+	}
+	defer stmt.Close()
+
+	var deliveredAt any
+	if d.DeliveredAt != nil {
+		deliveredAt = d.DeliveredAt.UTC()
+	}
+	_, err = stmt.ExecContext(ctx, d.Status, d.Attempts, d.NextAttemptAt.UTC(), d.LastError, deliveredAt, d.ID)
+	if err != nil {
+		return fmt.Errorf("failed to exec query. %w", err)
+	}
+	return nil
+}
+
+// GetDeliveries returns the deliveries with the given status, every delivery if it's empty, newest first.
+func (r *webhooksRepo) GetDeliveries(ctx context.Context, tx *sql.Tx, status string) ([]*models.WebhookDelivery, error) {
+	stmt, err := tx.Prepare(fmt.Sprintf("select %s from webhook_deliveries d where ($1 = '' or d.status = $1) order by d.id desc;", deliveryColumns))
+	if err != nil {
+		return nil, fmt.Errorf("failed to prepare statement. %w", err)
+	}
+	defer stmt.Close()
+
+	rows, err := stmt.QueryContext(ctx, status)
+	if err != nil {
+		return nil, fmt.Errorf("failed to exec query. %w", err)
+	}
+
+	var out []*models.WebhookDelivery
+	for rows.Next() {
+		var d models.WebhookDelivery
+		err := rows.Scan(&d.ID, &d.EventID, &d.EndpointID, &d.Status, &d.Attempts, &d.NextAttemptAt, &d.LastError, &d.DeliveredAt, &d.CreatedAt, &d.UpdatedAt)
+		if err != nil {
+			rows.Close()
+			return nil, fmt.Errorf("failed to scan response. %w", err)
+		}
+		out = append(out, &d)
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("failed to scan response. %w", err)
+	}
+	return out, nil
+}
+
+// ReplayDelivery queues a delivery again, with a fresh set of attempts. It returns nil if the delivery doesn't exist.
+func (r *webhooksRepo) ReplayDelivery(ctx context.Context, tx *sql.Tx, id int, now time.Time) (*models.WebhookDelivery, error) {
+	query := `update webhook_deliveries set status='pending', attempts=0, next_attempt_at=$1, last_error='', delivered_at=null, updated_at=CURRENT_TIMESTAMP
+		where id=$2
+		returning id, event_id, endpoint_id, status, attempts, next_attempt_at, last_error, delivered_at, created_at, updated_at;`
+	stmt, err := tx.Prepare(query)
+	if err != nil {
+		return nil, fmt.Errorf("failed to prepare statement. %w", err)
+	}
+	defer stmt.Close()
+
+	var d models.WebhookDelivery
+	err = stmt.QueryRowContext(ctx, now.UTC(), id).Scan(&d.ID, &d.EventID, &d.EndpointID, &d.Status, &d.Attempts, &d.NextAttemptAt, &d.LastError, &d.DeliveredAt, &d.CreatedAt, &d.UpdatedAt)
+	if err != nil {
+		if err == sql.ErrNoRows {
+			return nil, nil
+		}
+		return nil, fmt.Errorf("failed to exec query. %w", err)
+	}
+	return &d, nil
+}
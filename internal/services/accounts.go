@@ -3,34 +3,97 @@ package services
 import (
 	"context"
 	"database/sql"
+	"encoding/base64"
 	"encoding/json"
 	"errors"
+	"fmt"
 	"log/slog"
 	"net/http"
+	"net/url"
+	"strconv"
+	"time"
 
 	"github.com/gorilla/mux"
 	"github.com/gwuah/accounts/internal/models"
+	"github.com/gwuah/accounts/internal/repos"
 	"github.com/gwuah/accounts/pkg"
+	"github.com/shopspring/decimal"
 )
 
 type AccountRepository interface {
 	GetTx(ctx context.Context) (*sql.Tx, error)
 	Create(ctx context.Context, tx *sql.Tx, a *models.Account) error
 	GetAccounts(ctx context.Context, tx *sql.Tx, accountNumbers []string) ([]*models.Account, error)
+	SetOverdraftLimit(ctx context.Context, tx *sql.Tx, c *models.LimitChange) error
+	GetLimitChanges(ctx context.Context, tx *sql.Tx, accountID int) ([]*models.LimitChange, error)
+	GetAccountsByID(ctx context.Context, tx *sql.Tx, ids []int) ([]*models.Account, error)
+	SetStatus(ctx context.Context, tx *sql.Tx, c *models.StatusChange) error
+	GetStatusChanges(ctx context.Context, tx *sql.Tx, accountID int) ([]*models.StatusChange, error)
+	GetByUserID(ctx context.Context, tx *sql.Tx, userID int) ([]*models.Account, error)
+	Delete(ctx context.Context, tx *sql.Tx, ids []int) error
+}
+
+// DefaultAccountTier is the tier accounts are created in, when none is given. Tiers pick the fee schedule that applies to an account.
+const DefaultAccountTier = "standard"
+
+const (
+	// DepositAccount is the default type of account, its normal balance is positive and it can go below zero up to its overdraft limit.
+	DepositAccount = "deposit"
+	// CreditLineAccount is drawn down from zero, its normal balance is negative and its overdraft limit is the credit limit.
+	// It never holds money of its own: it can't be credited past zero, ie. repaid more than is drawn, and earns no interest.
+	CreditLineAccount = "credit_line"
+)
+
+// checkCreditLines returns why the lines can't be posted given the balance of the credit lines they credit, or "" if they can.
+// Like checkStatuses, it must be called once the accounts are locked.
+func checkCreditLines(ctx context.Context, tx *sql.Tx, accountRepo AccountRepository, transactionRepo TransactionRepository, lines []*models.TransactionLine) (string, error) {
+	accounts, err := accountRepo.GetAccountsByID(ctx, tx, lineAccountIDs(lines))
+	if err != nil {
+		return "", err
+	}
+
+	debited := netDebits(lines)
+	for _, account := range accounts {
+		if account.Type != CreditLineAccount || debited[account.ID] >= 0 {
+			continue
+		}
+		balance, err := transactionRepo.GetBalanceForUpdate(ctx, tx, account.ID)
+		if err != nil {
+			return "", err
+		}
+		if balance.Ledger-debited[account.ID] > 0 {
+			return fmt.Sprintf("credit line %s can't be repaid more than is drawn", account.AccountNumber), nil
+		}
+	}
+	return "", nil
 }
 
 type createAccountRequest struct {
-	UserID int `json:"user_id"`
+	UserID   int    `json:"user_id"`
+	Currency string `json:"currency"`
+	Tier     string `json:"tier"`
+	Type     string `json:"type"`
 }
 
 func (r createAccountRequest) validate() error {
 	if r.UserID == 0 {
 		return errors.New("'user_id' is required, can't be empty")
 	}
+	if r.Currency != "" {
+		if _, err := pkg.GetCurrency(r.Currency); err != nil {
+			return err
+		}
+	}
+	if len(r.Tier) > 50 {
+		return errors.New("'tier' can't be longer than 50 characters")
+	}
+	if r.Type != "" && r.Type != DepositAccount && r.Type != CreditLineAccount {
+		return fmt.Errorf("'type' must be either '%s' or '%s'", DepositAccount, CreditLineAccount)
+	}
 	return nil
 }
 
-func createAccount(global *slog.Logger, accountRepo AccountRepository, userRepo UserRepository) http.HandlerFunc {
+func createAccount(global *slog.Logger, accountRepo AccountRepository, userRepo UserRepository, webhookRepo WebhookRepository) http.HandlerFunc {
 	return func(w http.ResponseWriter, r *http.Request) {
 		logger := global.With("entity", "accounts")
 
@@ -46,12 +109,28 @@ func createAccount(global *slog.Logger, accountRepo AccountRepository, userRepo
 			return
 		}
 
-		// check if user exists, before creating account.
-		// very important validation
+		currency := pkg.DefaultCurrency
+		if req.Currency != "" {
+			c, _ := pkg.GetCurrency(req.Currency)
+			currency = c.Code
+		}
+
+		tier := DefaultAccountTier
+		if req.Tier != "" {
+			tier = req.Tier
+		}
+
+		accountType := DepositAccount
+		if req.Type != "" {
+			accountType = req.Type
+		}
 
 		account := &models.Account{
 			UserID:        req.UserID,
 			AccountNumber: pkg.CreateAccountNumber(),
+			Currency:      currency,
+			Tier:          tier,
+			Type:          accountType,
 		}
 
 		tx, err := userRepo.GetTx(r.Context())
@@ -61,13 +140,42 @@ func createAccount(global *slog.Logger, accountRepo AccountRepository, userRepo
 			return
 		}
 
+		if !canAccess(r.Context(), req.UserID) {
+			tx.Rollback()
+			writeForbidden(w, "users can only open accounts for themselves")
+			return
+		}
+
+		// deleted users can't open accounts.
+		user, err := userRepo.GetByID(r.Context(), tx, req.UserID)
+		if err != nil {
+			tx.Rollback()
+			logger.Error("failed to get user", "err", err)
+			writeInternalServer(w, "failed to create account")
+			return
+		}
+		if user == nil {
+			tx.Rollback()
+			writeNotFound(w, "user not found")
+			return
+		}
+
 		err = accountRepo.Create(r.Context(), tx, account)
 		if err != nil {
+			tx.Rollback()
 			logger.Error("failed to create account", "err", err)
 			writeInternalServer(w, "failed to create account")
 			return
 		}
 
+		err = publishEvent(r.Context(), tx, webhookRepo, EventAccountCreated, account)
+		if err != nil {
+			tx.Rollback()
+			logger.Error("failed to publish event", "err", err)
+			writeInternalServer(w, "failed to create account")
+			return
+		}
+
 		err = tx.Commit()
 		if err != nil {
 			logger.Error("failed to commit transaction", "err", err)
@@ -94,32 +202,481 @@ func getAccount(global *slog.Logger, accountRepo AccountRepository, userRepo Use
 			return
 		}
 
-		accounts, err := accountRepo.GetAccounts(r.Context(), tx, []string{accountNumber, GenesisAccountNumber})
+		accounts, err := accountRepo.GetAccounts(r.Context(), tx, []string{accountNumber})
 		if err != nil {
+			tx.Rollback()
 			logger.Error("failed to get accounts", "err", err)
 			writeInternalServer(w, "failed to get accounts")
 			return
 		}
 
+		// users only see their own accounts, other accounts look like they don't exist.
 		account := getAccountByAccountNumber(accounts, accountNumber)
+		if account == nil || !canAccess(r.Context(), account.UserID) {
+			tx.Rollback()
+			writeNotFound(w, "account not found")
+			return
+		}
+
+		currency, err := pkg.GetCurrency(account.Currency)
+		if err != nil {
+			tx.Rollback()
+			logger.Error("account has unsupported currency", "err", err)
+			writeInternalServer(w, "failed to get accounts")
+			return
+		}
+
+		response := map[string]interface{}{
+			"account": account,
+		}
 
-		balance, err := transactionRepo.GetBalance(r.Context(), tx, account.ID)
+		var balance *models.Balance
+		if v := r.URL.Query().Get("as_of"); v != "" {
+			var asOf time.Time
+			asOf, err = parseEndOfPeriod(v)
+			if err != nil {
+				tx.Rollback()
+				writeBadRequest(w, errors.New("'as_of' must be a date (2006-01-02) or an RFC3339 timestamp"))
+				return
+			}
+			balance, err = transactionRepo.GetBalanceAt(r.Context(), tx, account.ID, asOf)
+			response["as_of"] = asOf
+		} else {
+			balance, err = transactionRepo.GetBalance(r.Context(), tx, account.ID)
+		}
 		if err != nil {
+			tx.Rollback()
 			logger.Error("failed to get accounts", "err", err)
 			writeInternalServer(w, "failed to get accounts")
 			return
 		}
+		tx.Rollback()
+
+		account.OverdraftLimit = pkg.ConvertToMajor(account.MinorOverdraftLimit, currency)
+		account.Balance = pkg.ConvertToMajor(balance.Ledger, currency)
+		account.AvailableBalance = pkg.ConvertToMajor(balance.Available, currency)
+
+		writeOk(w, response)
+	}
+}
+
+const (
+	defaultHistoryLimit = 50
+	maxHistoryLimit     = 200
+)
+
+// parseHistoryFilter reads the history filters off the query string, amounts are in the account's major units.
+func parseHistoryFilter(query url.Values, currency pkg.Currency) (repos.HistoryFilter, error) {
+	filter := repos.HistoryFilter{Limit: defaultHistoryLimit}
+
+	if v := query.Get("limit"); v != "" {
+		limit, err := strconv.Atoi(v)
+		if err != nil || limit <= 0 {
+			return filter, errors.New("'limit' must be a positive number")
+		}
+		filter.Limit = min(limit, maxHistoryLimit)
+	}
+
+	if v := query.Get("cursor"); v != "" {
+		before, err := decodeCursor(v)
+		if err != nil {
+			return filter, errors.New("invalid 'cursor'")
+		}
+		filter.Before = before
+	}
 
-		account.Balance = pkg.ConvertToUnit(balance)
+	for key, dst := range map[string]*time.Time{"from": &filter.From, "to": &filter.To} {
+		if v := query.Get(key); v != "" {
+			t, err := parseTime(v)
+			if err != nil {
+				return filter, fmt.Errorf("'%s' must be a date (2006-01-02) or an RFC3339 timestamp", key)
+			}
+			*dst = t
+		}
+	}
+
+	switch direction := query.Get("direction"); direction {
+	case "":
+	case string(repos.DEBIT), string(repos.CREDIT):
+		filter.Direction = repos.TransactionPurpose(direction)
+	default:
+		return filter, errors.New("'direction' must be either 'debit' or 'credit'")
+	}
+
+	for key, dst := range map[string]*int64{"min_amount": &filter.MinAmount, "max_amount": &filter.MaxAmount} {
+		if v := query.Get(key); v != "" {
+			amount, err := decimal.NewFromString(v)
+			if err != nil || amount.IsNegative() {
+				return filter, fmt.Errorf("'%s' must be a positive amount", key)
+			}
+			*dst, err = pkg.ConvertToMinor(amount, currency)
+			if err != nil {
+				return filter, fmt.Errorf("invalid '%s'. %w", key, err)
+			}
+		}
+	}
+
+	return filter, nil
+}
+
+// parseTime accepts dates, which are read as midnight UTC, and RFC3339 timestamps.
+func parseTime(v string) (time.Time, error) {
+	if t, err := time.Parse(time.DateOnly, v); err == nil {
+		return t, nil
+	}
+	return time.Parse(time.RFC3339, v)
+}
+
+// parseEndOfPeriod is like parseTime, except dates are read as the end of that day.
+func parseEndOfPeriod(v string) (time.Time, error) {
+	if t, err := time.Parse(time.DateOnly, v); err == nil {
+		return t.AddDate(0, 0, 1), nil
+	}
+	return time.Parse(time.RFC3339, v)
+}
+
+func encodeCursor(id int) string {
+	return base64.RawURLEncoding.EncodeToString([]byte(strconv.Itoa(id)))
+}
+
+func decodeCursor(cursor string) (int, error) {
+	b, err := base64.RawURLEncoding.DecodeString(cursor)
+	if err != nil {
+		return 0, err
+	}
+	return strconv.Atoi(string(b))
+}
+
+func getAccountTransactions(global *slog.Logger, accountRepo AccountRepository, transactionRepo TransactionRepository) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		logger := global.With("entity", "accounts")
+		accountNumber := mux.Vars(r)["accountNumber"]
+
+		tx, err := transactionRepo.GetTx(r.Context())
+		if err != nil {
+			logger.Error("failed to acquire transaction", "err", err)
+			writeInternalServer(w, "failed to get transactions")
+			return
+		}
+		defer tx.Rollback()
+
+		accounts, err := accountRepo.GetAccounts(r.Context(), tx, []string{accountNumber})
+		if err != nil {
+			logger.Error("failed to get accounts", "err", err)
+			writeInternalServer(w, "failed to get transactions")
+			return
+		}
+
+		account := getAccountByAccountNumber(accounts, accountNumber)
+		if account == nil || !canAccess(r.Context(), account.UserID) {
+			writeNotFound(w, "account not found")
+			return
+		}
+
+		currency, err := pkg.GetCurrency(account.Currency)
+		if err != nil {
+			logger.Error("account has unsupported currency", "err", err)
+			writeInternalServer(w, "failed to get transactions")
+			return
+		}
+
+		filter, err := parseHistoryFilter(r.URL.Query(), currency)
+		if err != nil {
+			writeBadRequest(w, err)
+			return
+		}
+
+		// fetch one extra line to know if there's a next page.
+		limit := filter.Limit
+		filter.Limit++
+
+		lines, err := transactionRepo.GetHistory(r.Context(), tx, account.ID, filter)
+		if err != nil {
+			logger.Error("failed to get history", "err", err)
+			writeInternalServer(w, "failed to get transactions")
+			return
+		}
+
+		nextCursor := ""
+		if len(lines) > limit {
+			lines = lines[:limit]
+			nextCursor = encodeCursor(lines[limit-1].ID)
+		}
+
+		for _, line := range lines {
+			line.Amount = pkg.ConvertToMajor(line.MinorAmount, currency)
+			line.RunningBalance = pkg.ConvertToMajor(line.MinorRunningBalance, currency)
+		}
+		if lines == nil {
+			lines = []*models.StatementLine{}
+		}
 
 		writeOk(w, map[string]interface{}{
-			"account": account,
+			"transactions": lines,
+			"next_cursor":  nextCursor,
+		})
+	}
+}
+
+const (
+	defaultBalancePeriods = 30
+	maxBalancePeriods     = 366
+)
+
+// balancePeriods splits [from, to] into periods of the given interval, the first one starting at from.
+// Both ends are dates, so the last period is the one that contains to.
+func balancePeriods(from, to time.Time, interval string) ([]*models.PeriodBalance, error) {
+	var next func(time.Time) time.Time
+	switch interval {
+	case "", "day":
+		next = func(t time.Time) time.Time { return t.AddDate(0, 0, 1) }
+	case "week":
+		next = func(t time.Time) time.Time { return t.AddDate(0, 0, 7) }
+	case "month":
+		from = time.Date(from.Year(), from.Month(), 1, 0, 0, 0, 0, time.UTC)
+		next = func(t time.Time) time.Time { return t.AddDate(0, 1, 0) }
+	default:
+		return nil, errors.New("'interval' must be one of 'day', 'week' or 'month'")
+	}
+
+	var periods []*models.PeriodBalance
+	for start := from; !start.After(to); start = next(start) {
+		if len(periods) == maxBalancePeriods {
+			return nil, fmt.Errorf("can't return more than %d periods, narrow down 'from' and 'to'", maxBalancePeriods)
+		}
+		periods = append(periods, &models.PeriodBalance{PeriodStart: start, PeriodEnd: next(start)})
+	}
+	return periods, nil
+}
+
+func getAccountBalances(global *slog.Logger, accountRepo AccountRepository, transactionRepo TransactionRepository) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		logger := global.With("entity", "accounts")
+		accountNumber := mux.Vars(r)["accountNumber"]
+		query := r.URL.Query()
+
+		to := time.Now().UTC().Truncate(24 * time.Hour)
+		if v := query.Get("to"); v != "" {
+			t, err := time.Parse(time.DateOnly, v)
+			if err != nil {
+				writeBadRequest(w, errors.New("'to' must be a date (2006-01-02)"))
+				return
+			}
+			to = t
+		}
+		from := to.AddDate(0, 0, 1-defaultBalancePeriods)
+		if v := query.Get("from"); v != "" {
+			t, err := time.Parse(time.DateOnly, v)
+			if err != nil {
+				writeBadRequest(w, errors.New("'from' must be a date (2006-01-02)"))
+				return
+			}
+			from = t
+		}
+		if from.After(to) {
+			writeBadRequest(w, errors.New("'from' can't be after 'to'"))
+			return
+		}
+
+		periods, err := balancePeriods(from, to, query.Get("interval"))
+		if err != nil {
+			writeBadRequest(w, err)
+			return
+		}
+
+		tx, err := transactionRepo.GetTx(r.Context())
+		if err != nil {
+			logger.Error("failed to acquire transaction", "err", err)
+			writeInternalServer(w, "failed to get balances")
+			return
+		}
+		defer tx.Rollback()
+
+		accounts, err := accountRepo.GetAccounts(r.Context(), tx, []string{accountNumber})
+		if err != nil {
+			logger.Error("failed to get accounts", "err", err)
+			writeInternalServer(w, "failed to get balances")
+			return
+		}
+
+		account := getAccountByAccountNumber(accounts, accountNumber)
+		if account == nil || !canAccess(r.Context(), account.UserID) {
+			writeNotFound(w, "account not found")
+			return
+		}
+
+		currency, err := pkg.GetCurrency(account.Currency)
+		if err != nil {
+			logger.Error("account has unsupported currency", "err", err)
+			writeInternalServer(w, "failed to get balances")
+			return
+		}
+
+		for _, period := range periods {
+			balance, err := transactionRepo.GetBalanceAt(r.Context(), tx, account.ID, period.PeriodEnd)
+			if err != nil {
+				logger.Error("failed to get balance", "err", err)
+				writeInternalServer(w, "failed to get balances")
+				return
+			}
+			period.Balance = pkg.ConvertToMajor(balance.Ledger, currency)
+		}
+
+		writeOk(w, map[string]interface{}{
+			"currency": currency.Code,
+			"balances": periods,
+		})
+	}
+}
+
+type setOverdraftLimitRequest struct {
+	Limit  decimal.Decimal `json:"limit"`
+	Reason string          `json:"reason"`
+}
+
+func (r setOverdraftLimitRequest) validate() error {
+	if r.Limit.IsNegative() {
+		return errors.New("'limit' can't be negative")
+	}
+	if r.Reason == "" {
+		return errors.New("'reason' is required, can't be empty")
+	}
+	return nil
+}
+
+// setOverdraftLimit is an admin action, every change is recorded with who made it, ie. the request's principal, & why.
+// Lowering the limit below what's already overdrawn doesn't undo anything, it only blocks further debits.
+func setOverdraftLimit(global *slog.Logger, accountRepo AccountRepository) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		logger := global.With("entity", "accounts")
+		accountNumber := mux.Vars(r)["accountNumber"]
+
+		var req setOverdraftLimitRequest
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			logger.Error("error reading request", "err", err)
+			writeBadRequest(w, err)
+			return
+		}
+		if err := req.validate(); err != nil {
+			logger.Error("error validating request", "err", err)
+			writeBadRequest(w, err)
+			return
+		}
+		if pkg.IsSystemAccountNumber(accountNumber) {
+			writeBadRequest(w, errors.New("action not allowed for this account number"))
+			return
+		}
+
+		tx, err := accountRepo.GetTx(r.Context())
+		if err != nil {
+			logger.Error("failed to acquire db transaction", "err", err)
+			writeInternalServer(w, "failed to set overdraft limit")
+			return
+		}
+
+		accounts, err := accountRepo.GetAccounts(r.Context(), tx, []string{accountNumber})
+		if err != nil {
+			tx.Rollback()
+			logger.Error("failed to get accounts", "err", err)
+			writeInternalServer(w, "failed to set overdraft limit")
+			return
+		}
+		account := getAccountByAccountNumber(accounts, accountNumber)
+		if account == nil {
+			tx.Rollback()
+			writeNotFound(w, "account not found")
+			return
+		}
+
+		currency, err := pkg.GetCurrency(account.Currency)
+		if err != nil {
+			tx.Rollback()
+			logger.Error("account has unsupported currency", "err", err)
+			writeInternalServer(w, "failed to set overdraft limit")
+			return
+		}
+
+		limit, err := pkg.ConvertToMinor(req.Limit, currency)
+		if err != nil {
+			tx.Rollback()
+			writeBadRequest(w, err)
+			return
+		}
+
+		change := &models.LimitChange{
+			AccountID: account.ID,
+			NewLimit:  limit,
+			Reason:    req.Reason,
+			ChangedBy: principalName(PrincipalFromContext(r.Context())),
+		}
+		err = accountRepo.SetOverdraftLimit(r.Context(), tx, change)
+		if err != nil {
+			tx.Rollback()
+			logger.Error("failed to set overdraft limit", "err", err)
+			writeInternalServer(w, "failed to set overdraft limit")
+			return
+		}
+
+		err = tx.Commit()
+		if err != nil {
+			logger.Error("failed to commit db transaction", "err", err)
+			writeInternalServer(w, "failed to set overdraft limit")
+			return
+		}
+
+		writeOk(w, map[string]interface{}{
+			"limit_change": change,
+		})
+	}
+}
+
+func getLimitChanges(global *slog.Logger, accountRepo AccountRepository) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		logger := global.With("entity", "accounts")
+		accountNumber := mux.Vars(r)["accountNumber"]
+
+		tx, err := accountRepo.GetTx(r.Context())
+		if err != nil {
+			logger.Error("failed to acquire db transaction", "err", err)
+			writeInternalServer(w, "failed to get limit changes")
+			return
+		}
+		defer tx.Rollback()
+
+		accounts, err := accountRepo.GetAccounts(r.Context(), tx, []string{accountNumber})
+		if err != nil {
+			logger.Error("failed to get accounts", "err", err)
+			writeInternalServer(w, "failed to get limit changes")
+			return
+		}
+		account := getAccountByAccountNumber(accounts, accountNumber)
+		if account == nil {
+			writeNotFound(w, "account not found")
+			return
+		}
+
+		changes, err := accountRepo.GetLimitChanges(r.Context(), tx, account.ID)
+		if err != nil {
+			logger.Error("failed to get limit changes", "err", err)
+			writeInternalServer(w, "failed to get limit changes")
+			return
+		}
+		if changes == nil {
+			changes = []*models.LimitChange{}
+		}
+
+		writeOk(w, map[string]interface{}{
+			"limit_changes": changes,
 		})
 	}
 }
 
-func AddAccountRoutes(logger *slog.Logger, r *mux.Router, accountRepo AccountRepository, userRepo UserRepository, transactionRepo TransactionRepository) {
-	r.Methods("POST").Path("/accounts").HandlerFunc(createAccount(logger, accountRepo, userRepo))
+func AddAccountRoutes(logger *slog.Logger, r *mux.Router, accountRepo AccountRepository, userRepo UserRepository, transactionRepo TransactionRepository, webhookRepo WebhookRepository) {
+	r.Methods("POST").Path("/accounts").HandlerFunc(createAccount(logger, accountRepo, userRepo, webhookRepo))
 	r.Methods("GET").Path("/accounts/{accountNumber}").HandlerFunc(getAccount(logger, accountRepo, userRepo, transactionRepo))
+	r.Methods("GET").Path("/accounts/{accountNumber}/transactions").HandlerFunc(getAccountTransactions(logger, accountRepo, transactionRepo))
+	r.Methods("GET").Path("/accounts/{accountNumber}/balances").HandlerFunc(getAccountBalances(logger, accountRepo, transactionRepo))
+	r.Methods("PUT").Path("/accounts/{accountNumber}/overdraft-limit").HandlerFunc(setOverdraftLimit(logger, accountRepo))
+	r.Methods("GET").Path("/accounts/{accountNumber}/overdraft-limit/changes").HandlerFunc(getLimitChanges(logger, accountRepo))
 
 }
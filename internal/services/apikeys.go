@@ -0,0 +1,343 @@
+package services
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/gorilla/mux"
+	"github.com/gwuah/accounts/internal/models"
+	"github.com/gwuah/accounts/pkg"
+)
+
+type APIKeyRepository interface {
+	GetTx(ctx context.Context) (*sql.Tx, error)
+	Create(ctx context.Context, tx *sql.Tx, k *models.APIKey) error
+	GetByHash(ctx context.Context, tx *sql.Tx, hash string) (*models.APIKey, error)
+	GetByID(ctx context.Context, tx *sql.Tx, id int) (*models.APIKey, error)
+	GetAll(ctx context.Context, tx *sql.Tx) ([]*models.APIKey, error)
+	Expire(ctx context.Context, tx *sql.Tx, k *models.APIKey, at time.Time, revoke bool) error
+}
+
+type createAPIKeyRequest struct {
+	Name   string   `json:"name"`
+	Scopes []string `json:"scopes"`
+	// Signed keys must sign their requests, see pkg.SignRequest.
+	Signed bool `json:"signed"`
+}
+
+func (r createAPIKeyRequest) validate() error {
+	if strings.TrimSpace(r.Name) == "" {
+		return errors.New("'name' is required, can't be empty")
+	}
+	return validateScopes(r.Scopes)
+}
+
+func validateScopes(scopes []string) error {
+	if len(scopes) == 0 {
+		return errors.New("'scopes' is required, can't be empty")
+	}
+	for _, scope := range scopes {
+		if !validScope(scope) {
+			return fmt.Errorf("'%s' isn't a scope, scopes are '<resource>:read' or '<resource>:write' with a resource in %s, '%s' or '%s'", scope, strings.Join(scopeResources, ", "), ScopeAdmin, ScopeAll)
+		}
+	}
+	return nil
+}
+
+// CreateAPIKey creates a key with the given scopes, with a secret to sign its requests with when signed is set.
+// The key starts a lineage of its own. The returned key is the only time it's in the clear.
+func CreateAPIKey(ctx context.Context, tx *sql.Tx, apiKeyRepo APIKeyRepository, name string, scopes []string, signed bool) (*models.APIKey, error) {
+	return issueAPIKey(ctx, tx, apiKeyRepo, name, scopes, signed, func(self string) string { return self })
+}
+
+// issueAPIKey creates a key like CreateAPIKey, with the lineage returned by lineage given the key's own principal name.
+func issueAPIKey(ctx context.Context, tx *sql.Tx, apiKeyRepo APIKeyRepository, name string, scopes []string, signed bool, lineage func(self string) string) (*models.APIKey, error) {
+	if err := validateScopes(scopes); err != nil {
+		return nil, err
+	}
+
+	token, err := pkg.NewAPIKey()
+	if err != nil {
+		return nil, err
+	}
+
+	key := &models.APIKey{
+		Name:   name,
+		Prefix: token[:pkg.APIKeyPrefixLength],
+		Hash:   pkg.HashAPIKey(token),
+		Scopes: scopes,
+		Signed: signed,
+	}
+	key.Lineage = lineage("api_key:" + key.Prefix)
+	if signed {
+		key.SigningSecret, err = pkg.NewSigningSecret()
+		if err != nil {
+			return nil, err
+		}
+	}
+	if err := apiKeyRepo.Create(ctx, tx, key); err != nil {
+		return nil, err
+	}
+	key.Key = token
+	return key, nil
+}
+
+func createAPIKey(global *slog.Logger, apiKeyRepo APIKeyRepository) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		logger := global.With("entity", "api_keys")
+
+		var req createAPIKeyRequest
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			logger.Error("error reading request", "err", err)
+			writeBadRequest(w, err)
+			return
+		}
+		if err := req.validate(); err != nil {
+			logger.Error("error validating request", "err", err)
+			writeBadRequest(w, err)
+			return
+		}
+
+		// keys & users can't grant more than they have.
+		for _, scope := range req.Scopes {
+			if !PrincipalFromContext(r.Context()).grants(scope) {
+				writeForbidden(w, fmt.Sprintf("can't grant the '%s' scope, you don't have it", scope))
+				return
+			}
+		}
+
+		tx, err := apiKeyRepo.GetTx(r.Context())
+		if err != nil {
+			logger.Error("failed to acquire db transaction", "err", err)
+			writeInternalServer(w, "failed to create api key")
+			return
+		}
+
+		// keys act for whoever created them too, so they can't stand in for their creator as someone else.
+		issuer := principalName(PrincipalFromContext(r.Context()))
+		key, err := issueAPIKey(r.Context(), tx, apiKeyRepo, req.Name, req.Scopes, req.Signed, func(self string) string {
+			if issuer == "" {
+				return self
+			}
+			return issuer + "/" + self
+		})
+		if err != nil {
+			tx.Rollback()
+			logger.Error("failed to create api key", "err", err)
+			writeInternalServer(w, "failed to create api key")
+			return
+		}
+
+		err = tx.Commit()
+		if err != nil {
+			logger.Error("failed to commit db transaction", "err", err)
+			writeInternalServer(w, "failed to create api key")
+			return
+		}
+
+		writeOk(w, apiKeyResponse(key, nil))
+	}
+}
+
+// apiKeyResponse is the response to creating or rotating a key, the only time its signing secret is shown.
+func apiKeyResponse(key, rotated *models.APIKey) map[string]interface{} {
+	response := map[string]interface{}{
+		"api_key": key,
+	}
+	if rotated != nil {
+		response["rotated_key"] = rotated
+	}
+	if key.Signed {
+		response["signing_secret"] = key.SigningSecret
+	}
+	return response
+}
+
+func getAPIKeys(global *slog.Logger, apiKeyRepo APIKeyRepository) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		logger := global.With("entity", "api_keys")
+
+		tx, err := apiKeyRepo.GetTx(r.Context())
+		if err != nil {
+			logger.Error("failed to acquire db transaction", "err", err)
+			writeInternalServer(w, "failed to get api keys")
+			return
+		}
+		defer tx.Rollback()
+
+		keys, err := apiKeyRepo.GetAll(r.Context(), tx)
+		if err != nil {
+			logger.Error("failed to get api keys", "err", err)
+			writeInternalServer(w, "failed to get api keys")
+			return
+		}
+
+		writeOk(w, map[string]interface{}{
+			"api_keys": keys,
+		})
+	}
+}
+
+type rotateAPIKeyRequest struct {
+	// GraceSeconds keeps the old key working for a while, so clients can switch over. It's revoked right away by default.
+	GraceSeconds int `json:"grace_seconds"`
+}
+
+func (r rotateAPIKeyRequest) validate() error {
+	if r.GraceSeconds < 0 {
+		return errors.New("'grace_seconds' can't be negative")
+	}
+	return nil
+}
+
+// getActiveAPIKey returns the key being rotated or revoked, writing the response and rolling back when it's missing or already unusable.
+func getActiveAPIKey(ctx context.Context, w http.ResponseWriter, logger *slog.Logger, tx *sql.Tx, apiKeyRepo APIKeyRepository, id int, action string) (*models.APIKey, bool) {
+	key, err := apiKeyRepo.GetByID(ctx, tx, id)
+	if err != nil {
+		tx.Rollback()
+		logger.Error("failed to get api key", "err", err)
+		writeInternalServer(w, fmt.Sprintf("failed to %s api key", action))
+		return nil, false
+	}
+	if key == nil {
+		tx.Rollback()
+		writeNotFound(w, "api key not found")
+		return nil, false
+	}
+	if key.RevokedAt != nil || (key.ExpiresAt != nil && !time.Now().Before(*key.ExpiresAt)) {
+		tx.Rollback()
+		writeUnprocessableEntity(w, "api key is already revoked or expired")
+		return nil, false
+	}
+	return key, true
+}
+
+// rotateAPIKey replaces a key with a new one with the same name & scopes, which only those holding all the scopes can do.
+// The new key keeps the old one's lineage when it's rotated from within it, eg. by itself or whoever issued it. Otherwise it's
+// the caller's, so rotating someone else's key doesn't let the caller act as them.
+func rotateAPIKey(global *slog.Logger, apiKeyRepo APIKeyRepository) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		logger := global.With("entity", "api_keys")
+		id := stringToInt(mux.Vars(r)["id"])
+
+		var req rotateAPIKeyRequest
+		if r.ContentLength != 0 {
+			if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+				logger.Error("error reading request", "err", err)
+				writeBadRequest(w, err)
+				return
+			}
+		}
+		if err := req.validate(); err != nil {
+			logger.Error("error validating request", "err", err)
+			writeBadRequest(w, err)
+			return
+		}
+
+		tx, err := apiKeyRepo.GetTx(r.Context())
+		if err != nil {
+			logger.Error("failed to acquire db transaction", "err", err)
+			writeInternalServer(w, "failed to rotate api key")
+			return
+		}
+
+		old, ok := getActiveAPIKey(r.Context(), w, logger, tx, apiKeyRepo, id, "rotate")
+		if !ok {
+			return
+		}
+		for _, scope := range old.Scopes {
+			if !PrincipalFromContext(r.Context()).grants(scope) {
+				tx.Rollback()
+				writeForbidden(w, fmt.Sprintf("can't rotate a key with the '%s' scope, you don't have it", scope))
+				return
+			}
+		}
+
+		if req.GraceSeconds > 0 {
+			err = apiKeyRepo.Expire(r.Context(), tx, old, time.Now().Add(time.Duration(req.GraceSeconds)*time.Second), false)
+		} else {
+			err = apiKeyRepo.Expire(r.Context(), tx, old, time.Now(), true)
+		}
+		if err != nil {
+			tx.Rollback()
+			logger.Error("failed to expire api key", "err", err)
+			writeInternalServer(w, "failed to rotate api key")
+			return
+		}
+
+		issuer := principalName(PrincipalFromContext(r.Context()))
+		key, err := issueAPIKey(r.Context(), tx, apiKeyRepo, old.Name, old.Scopes, old.Signed, func(self string) string {
+			if issuer == "" || samePrincipal(issuer, old.Lineage) {
+				return old.Lineage
+			}
+			return issuer + "/" + self
+		})
+		if err != nil {
+			tx.Rollback()
+			logger.Error("failed to create api key", "err", err)
+			writeInternalServer(w, "failed to rotate api key")
+			return
+		}
+
+		err = tx.Commit()
+		if err != nil {
+			logger.Error("failed to commit db transaction", "err", err)
+			writeInternalServer(w, "failed to rotate api key")
+			return
+		}
+
+		writeOk(w, apiKeyResponse(key, old))
+	}
+}
+
+func revokeAPIKey(global *slog.Logger, apiKeyRepo APIKeyRepository) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		logger := global.With("entity", "api_keys")
+		id := stringToInt(mux.Vars(r)["id"])
+
+		tx, err := apiKeyRepo.GetTx(r.Context())
+		if err != nil {
+			logger.Error("failed to acquire db transaction", "err", err)
+			writeInternalServer(w, "failed to revoke api key")
+			return
+		}
+
+		key, ok := getActiveAPIKey(r.Context(), w, logger, tx, apiKeyRepo, id, "revoke")
+		if !ok {
+			return
+		}
+
+		err = apiKeyRepo.Expire(r.Context(), tx, key, time.Now(), true)
+		if err != nil {
+			tx.Rollback()
+			logger.Error("failed to revoke api key", "err", err)
+			writeInternalServer(w, "failed to revoke api key")
+			return
+		}
+
+		err = tx.Commit()
+		if err != nil {
+			logger.Error("failed to commit db transaction", "err", err)
+			writeInternalServer(w, "failed to revoke api key")
+			return
+		}
+
+		writeOk(w, map[string]interface{}{
+			"api_key": key,
+		})
+	}
+}
+
+func AddAPIKeyRoutes(logger *slog.Logger, r *mux.Router, apiKeyRepo APIKeyRepository) {
+	r.Methods("POST").Path("/api-keys").HandlerFunc(createAPIKey(logger, apiKeyRepo))
+	r.Methods("GET").Path("/api-keys").HandlerFunc(getAPIKeys(logger, apiKeyRepo))
+	r.Methods("POST").Path("/api-keys/{id}/rotate").HandlerFunc(rotateAPIKey(logger, apiKeyRepo))
+	r.Methods("DELETE").Path("/api-keys/{id}").HandlerFunc(revokeAPIKey(logger, apiKeyRepo))
+}
@@ -0,0 +1,233 @@
+package services
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/gorilla/mux"
+	"github.com/gwuah/accounts/internal/models"
+	"github.com/shopspring/decimal"
+)
+
+type ApprovalRepository interface {
+	GetTx(ctx context.Context) (*sql.Tx, error)
+	Create(ctx context.Context, tx *sql.Tx, a *models.Approval) error
+	GetByID(ctx context.Context, tx *sql.Tx, id int) (*models.Approval, error)
+	GetAll(ctx context.Context, tx *sql.Tx, status string) ([]*models.Approval, error)
+	Decide(ctx context.Context, tx *sql.Tx, a *models.Approval, status, checker string, at time.Time) (bool, error)
+}
+
+const (
+	ApprovalPending  = "pending"
+	ApprovalApproved = "approved"
+	ApprovalRejected = "rejected"
+)
+
+// DepositAction is the action of deposits held for approval, their payload is the deposit's request.
+const DepositAction = "deposit"
+
+// DepositApprovalThreshold is the amount, in the deposit's currency major units, from which deposits need a second person's approval.
+var DepositApprovalThreshold = decimal.NewFromInt(10000)
+
+// principalName identifies the principal as a maker or checker of approvals. Api keys are identified by their lineage,
+// which survives rotation.
+func principalName(p *Principal) string {
+	switch {
+	case p == nil:
+		return ""
+	case p.APIKey != nil:
+		return p.APIKey.Lineage
+	default:
+		return fmt.Sprintf("user:%d", p.UserID)
+	}
+}
+
+// samePrincipal reports whether a and b are the same principal, or one issued the other's api key, directly or not.
+func samePrincipal(a, b string) bool {
+	return a == b || strings.HasPrefix(a, b+"/") || strings.HasPrefix(b, a+"/")
+}
+
+// requestApproval holds the action until it's approved, responding with the pending approval.
+func requestApproval(w http.ResponseWriter, r *http.Request, logger *slog.Logger, approvalRepo ApprovalRepository, action string, payload any) {
+	b, err := json.Marshal(payload)
+	if err != nil {
+		logger.Error("failed to encode approval payload", "err", err)
+		writeInternalServer(w, "failed to request approval")
+		return
+	}
+
+	tx, err := approvalRepo.GetTx(r.Context())
+	if err != nil {
+		logger.Error("failed to acquire db transaction", "err", err)
+		writeInternalServer(w, "failed to request approval")
+		return
+	}
+
+	approval := &models.Approval{
+		Action:  action,
+		Payload: b,
+		Status:  ApprovalPending,
+		Maker:   principalName(PrincipalFromContext(r.Context())),
+	}
+	err = approvalRepo.Create(r.Context(), tx, approval)
+	if err != nil {
+		tx.Rollback()
+		logger.Error("failed to create approval", "err", err)
+		writeInternalServer(w, "failed to request approval")
+		return
+	}
+
+	err = tx.Commit()
+	if err != nil {
+		logger.Error("failed to commit db transaction", "err", err)
+		writeInternalServer(w, "failed to request approval")
+		return
+	}
+
+	writeAccepted(w, map[string]interface{}{
+		"approval": approval,
+	})
+}
+
+func getApprovals(global *slog.Logger, approvalRepo ApprovalRepository) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		logger := global.With("entity", "approvals")
+
+		status := r.URL.Query().Get("status")
+		if status != "" && status != ApprovalPending && status != ApprovalApproved && status != ApprovalRejected {
+			writeBadRequest(w, fmt.Errorf("'status' must be one of %s, %s or %s", ApprovalPending, ApprovalApproved, ApprovalRejected))
+			return
+		}
+
+		tx, err := approvalRepo.GetTx(r.Context())
+		if err != nil {
+			logger.Error("failed to acquire db transaction", "err", err)
+			writeInternalServer(w, "failed to get approvals")
+			return
+		}
+		defer tx.Rollback()
+
+		approvals, err := approvalRepo.GetAll(r.Context(), tx, status)
+		if err != nil {
+			logger.Error("failed to get approvals", "err", err)
+			writeInternalServer(w, "failed to get approvals")
+			return
+		}
+
+		writeOk(w, map[string]interface{}{
+			"approvals": approvals,
+		})
+	}
+}
+
+// getPendingApproval returns the approval being decided, writing the response when it's missing or already decided.
+func getPendingApproval(ctx context.Context, w http.ResponseWriter, logger *slog.Logger, tx *sql.Tx, approvalRepo ApprovalRepository, id int, action string) (*models.Approval, bool) {
+	approval, err := approvalRepo.GetByID(ctx, tx, id)
+	if err != nil {
+		logger.Error("failed to get approval", "err", err)
+		writeInternalServer(w, fmt.Sprintf("failed to %s", action))
+		return nil, false
+	}
+	if approval == nil {
+		writeNotFound(w, "approval not found")
+		return nil, false
+	}
+	if approval.Status != ApprovalPending {
+		writeUnprocessableEntity(w, fmt.Sprintf("approval is already %s", approval.Status))
+		return nil, false
+	}
+	return approval, true
+}
+
+// approve carries out a pending action, marking it approved in the same db transaction. Its maker can't approve it.
+func approve(global *slog.Logger, accountRepo AccountRepository, transactionRepo TransactionRepository, fxRepo FXRepository, feeRepo FeeRepository, webhookRepo WebhookRepository, approvalRepo ApprovalRepository) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		logger := global.With("entity", "approvals")
+		id := stringToInt(mux.Vars(r)["id"])
+
+		tx, err := approvalRepo.GetTx(r.Context())
+		if err != nil {
+			logger.Error("failed to acquire db transaction", "err", err)
+			writeInternalServer(w, "failed to approve")
+			return
+		}
+		approval, ok := getPendingApproval(r.Context(), w, logger, tx, approvalRepo, id, "approve")
+		tx.Rollback()
+		if !ok {
+			return
+		}
+
+		checker := principalName(PrincipalFromContext(r.Context()))
+		if samePrincipal(checker, approval.Maker) {
+			writeForbidden(w, "approvals need someone other than whoever requested them")
+			return
+		}
+
+		var req createTransactionRequest
+		if err := json.Unmarshal(approval.Payload, &req); err != nil {
+			logger.Error("failed to decode approval payload", "err", err)
+			writeInternalServer(w, "failed to approve")
+			return
+		}
+
+		// the approval is decided with the transaction, so a transaction that can't go through leaves it pending, and two checkers can't both post it.
+		postTransaction(r.Context(), w, logger, accountRepo, transactionRepo, fxRepo, feeRepo, webhookRepo, req, func(tx *sql.Tx) (string, error) {
+			decided, err := approvalRepo.Decide(r.Context(), tx, approval, ApprovalApproved, checker, time.Now())
+			if err != nil || decided {
+				return "", err
+			}
+			return "approval was already decided", nil
+		})
+	}
+}
+
+func reject(global *slog.Logger, approvalRepo ApprovalRepository) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		logger := global.With("entity", "approvals")
+		id := stringToInt(mux.Vars(r)["id"])
+
+		tx, err := approvalRepo.GetTx(r.Context())
+		if err != nil {
+			logger.Error("failed to acquire db transaction", "err", err)
+			writeInternalServer(w, "failed to reject")
+			return
+		}
+
+		approval, ok := getPendingApproval(r.Context(), w, logger, tx, approvalRepo, id, "reject")
+		if !ok {
+			tx.Rollback()
+			return
+		}
+
+		_, err = approvalRepo.Decide(r.Context(), tx, approval, ApprovalRejected, principalName(PrincipalFromContext(r.Context())), time.Now())
+		if err != nil {
+			tx.Rollback()
+			logger.Error("failed to reject approval", "err", err)
+			writeInternalServer(w, "failed to reject")
+			return
+		}
+
+		err = tx.Commit()
+		if err != nil {
+			logger.Error("failed to commit db transaction", "err", err)
+			writeInternalServer(w, "failed to reject")
+			return
+		}
+
+		writeOk(w, map[string]interface{}{
+			"approval": approval,
+		})
+	}
+}
+
+func AddApprovalRoutes(logger *slog.Logger, r *mux.Router, accountRepo AccountRepository, transactionRepo TransactionRepository, fxRepo FXRepository, feeRepo FeeRepository, webhookRepo WebhookRepository, approvalRepo ApprovalRepository) {
+	r.Methods("GET").Path("/approvals").HandlerFunc(getApprovals(logger, approvalRepo))
+	r.Methods("POST").Path("/approvals/{id}/approve").HandlerFunc(approve(logger, accountRepo, transactionRepo, fxRepo, feeRepo, webhookRepo, approvalRepo))
+	r.Methods("POST").Path("/approvals/{id}/reject").HandlerFunc(reject(logger, approvalRepo))
+}
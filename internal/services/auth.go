@@ -0,0 +1,252 @@
+package services
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gorilla/mux"
+	"github.com/gwuah/accounts/internal/models"
+	"github.com/gwuah/accounts/pkg"
+)
+
+const (
+	// ScopeAll grants every scope.
+	ScopeAll = "*"
+	// ScopeAdmin grants the admin routes, eg. the ledger's integrity report.
+	ScopeAdmin = "admin"
+	// RoleAdmin is the token role that lets a user act on every account, like an api key with every scope.
+	RoleAdmin = "admin"
+)
+
+// scopeResources are the resources scopes are granted on, as "<resource>:read" (GET routes) or "<resource>:write" (every other route).
+// A route's resource is the first segment of its path, journal entries being transactions and fee rules fees.
+var scopeResources = []string{"users", "accounts", "transactions", "holds", "fx", "fees", "webhooks", "api-keys", "rbac", "approvals"}
+
+// scopeOverrides are the routes whose scope is finer than their resource's, as "<method> <path template>".
+// Setting an account's overdraft limit or interest rate mints credit, so the keys that open accounts can't do it.
+var scopeOverrides = map[string]string{
+	"PUT /accounts/{accountNumber}/overdraft-limit": "accounts:limits",
+	"PUT /accounts/{accountNumber}/interest":        "accounts:limits",
+}
+
+var resourceAliases = map[string]string{
+	"journal-entries": "transactions",
+	"fee-rules":       "fees",
+}
+
+// publicPaths are the routes that don't need an api key.
+var publicPaths = []string{"/"}
+
+// userRoutes are the routes users can call with a token without a role granting them, as "<method> <path template>".
+// The handlers make sure they only see their own accounts & transactions and only debit their own accounts.
+var userRoutes = []string{
+	"GET /users/{id}",
+	"POST /accounts",
+	"GET /accounts/{accountNumber}",
+	"GET /accounts/{accountNumber}/transactions",
+	"GET /accounts/{accountNumber}/balances",
+	"GET /accounts/{accountNumber}/interest",
+	"POST /transactions",
+	"GET /transactions/{reference}",
+}
+
+func validScope(scope string) bool {
+	if scope == ScopeAll || scope == ScopeAdmin {
+		return true
+	}
+	for _, override := range scopeOverrides {
+		if scope == override {
+			return true
+		}
+	}
+	resource, action, ok := strings.Cut(scope, ":")
+	return ok && slices.Contains(scopeResources, resource) && (action == "read" || action == "write")
+}
+
+// requiredScope returns the scope needed to call the request's route.
+func requiredScope(r *http.Request, template string) string {
+	if scope, ok := scopeOverrides[r.Method+" "+template]; ok {
+		return scope
+	}
+	resource, _, _ := strings.Cut(strings.TrimPrefix(template, "/"), "/")
+	if alias, ok := resourceAliases[resource]; ok {
+		resource = alias
+	}
+	if resource == ScopeAdmin {
+		return ScopeAdmin
+	}
+	if r.Method == http.MethodGet || r.Method == http.MethodHead {
+		return resource + ":read"
+	}
+	return resource + ":write"
+}
+
+func hasScope(key *models.APIKey, scope string) bool {
+	return slices.Contains(key.Scopes, ScopeAll) || slices.Contains(key.Scopes, scope)
+}
+
+type contextKey string
+
+const principalContextKey contextKey = "principal"
+
+// Principal is who a request is made by, either an api key, ie. an operator or another service, or a user with a token.
+type Principal struct {
+	APIKey *models.APIKey
+	// UserID is the token's subject, set for users only.
+	UserID int
+	Admin  bool
+	// Permissions are what the user's roles grant them, admins aside.
+	Permissions []string
+	// Elevated is set when one of the user's roles grants them the route, they then act on every account, like an api key.
+	Elevated bool
+}
+
+// PrincipalFromContext returns who the request was authenticated as, or nil.
+func PrincipalFromContext(ctx context.Context) *Principal {
+	principal, _ := ctx.Value(principalContextKey).(*Principal)
+	return principal
+}
+
+// APIKeyFromContext returns the api key the request was authenticated with, or nil.
+func APIKeyFromContext(ctx context.Context) *models.APIKey {
+	if principal := PrincipalFromContext(ctx); principal != nil {
+		return principal.APIKey
+	}
+	return nil
+}
+
+// canAccess reports whether the request may act on the given user's accounts. Only users are restricted to their own,
+// api keys are already limited by their scopes and admins can access everything.
+func canAccess(ctx context.Context, userID int) bool {
+	principal := PrincipalFromContext(ctx)
+	return principal.unrestricted() || principal.UserID == userID
+}
+
+// grants reports whether the principal holds the scope, an api key through its scopes and a user through their roles.
+func (p *Principal) grants(scope string) bool {
+	switch {
+	case p == nil || p.Admin:
+		return true
+	case p.APIKey != nil:
+		return hasScope(p.APIKey, scope)
+	default:
+		return hasPermission(p.Permissions, scope)
+	}
+}
+
+// unrestricted reports whether the principal isn't limited to a user's own accounts.
+func (p *Principal) unrestricted() bool {
+	return p == nil || p.APIKey != nil || p.Admin || p.Elevated
+}
+
+// Authenticate is a mux middleware that authenticates requests with an api key or, when verifier isn't nil, a user's jwt,
+// both sent as "Authorization: Bearer <token>". The key must be neither revoked nor expired and have the scope of the route.
+// Users need a role granting the route's permission, the admin claim, or to be calling one of the user routes.
+// The principal is then attached to the request's context.
+func Authenticate(global *slog.Logger, apiKeyRepo APIKeyRepository, rbacRepo RBACRepository, verifier *pkg.JWTVerifier) mux.MiddlewareFunc {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			logger := global.With("entity", "auth")
+
+			template := r.URL.Path
+			if route := mux.CurrentRoute(r); route != nil {
+				template, _ = route.GetPathTemplate()
+			}
+			if slices.Contains(publicPaths, template) {
+				next.ServeHTTP(w, r)
+				return
+			}
+
+			token, ok := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer ")
+			if !ok || token == "" {
+				writeUnauthorized(w, "missing api key")
+				return
+			}
+
+			if verifier != nil && pkg.LooksLikeJWT(token) {
+				principal, err := authenticateUser(verifier, token, time.Now())
+				if err != nil {
+					logger.Warn("invalid token", "path", r.URL.Path, "err", err)
+					writeUnauthorized(w, "invalid token")
+					return
+				}
+				if !principal.Admin {
+					permissions, err := userPermissions(r.Context(), rbacRepo, principal.UserID)
+					if err != nil {
+						logger.Error("failed to get user permissions", "err", err)
+						writeInternalServer(w, "failed to authenticate")
+						return
+					}
+					principal.Permissions = permissions
+					permission := routePermission(r, template)
+					principal.Elevated = hasPermission(permissions, permission)
+					if !principal.Elevated && !slices.Contains(userRoutes, r.Method+" "+template) {
+						logger.Warn("user lacks permission", "user_id", principal.UserID, "permission", permission)
+						writeForbidden(w, fmt.Sprintf("user lacks the '%s' permission", permission))
+						return
+					}
+				}
+				next.ServeHTTP(w, r.WithContext(context.WithValue(r.Context(), principalContextKey, principal)))
+				return
+			}
+
+			key, err := authenticateAPIKey(r.Context(), apiKeyRepo, token, time.Now())
+			if err != nil {
+				logger.Error("failed to authenticate api key", "err", err)
+				writeInternalServer(w, "failed to authenticate")
+				return
+			}
+			if key == nil {
+				logger.Warn("invalid api key", "path", r.URL.Path)
+				writeUnauthorized(w, "invalid api key")
+				return
+			}
+
+			scope := requiredScope(r, template)
+			if !hasScope(key, scope) {
+				logger.Warn("api key lacks scope", "api_key", key.Prefix, "scope", scope)
+				writeForbidden(w, fmt.Sprintf("api key lacks the '%s' scope", scope))
+				return
+			}
+
+			next.ServeHTTP(w, r.WithContext(context.WithValue(r.Context(), principalContextKey, &Principal{APIKey: key})))
+		})
+	}
+}
+
+// authenticateUser verifies the token, whose subject must be a user id.
+func authenticateUser(verifier *pkg.JWTVerifier, token string, now time.Time) (*Principal, error) {
+	claims, err := verifier.Verify(token, now)
+	if err != nil {
+		return nil, err
+	}
+	userID, err := strconv.Atoi(claims.Subject)
+	if err != nil || userID <= 0 {
+		return nil, fmt.Errorf("subject %q isn't a user id", claims.Subject)
+	}
+	return &Principal{UserID: userID, Admin: slices.Contains(claims.Roles, RoleAdmin)}, nil
+}
+
+// authenticateAPIKey returns the key matching token, or nil if there's none or it's revoked or expired.
+func authenticateAPIKey(ctx context.Context, apiKeyRepo APIKeyRepository, token string, now time.Time) (*models.APIKey, error) {
+	tx, err := apiKeyRepo.GetTx(ctx)
+	if err != nil {
+		return nil, err
+	}
+	defer tx.Rollback()
+
+	key, err := apiKeyRepo.GetByHash(ctx, tx, pkg.HashAPIKey(token))
+	if err != nil || key == nil {
+		return nil, err
+	}
+	if key.RevokedAt != nil || (key.ExpiresAt != nil && !now.Before(*key.ExpiresAt)) {
+		return nil, nil
+	}
+	return key, nil
+}
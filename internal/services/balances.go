@@ -0,0 +1,88 @@
+package services
+
+import (
+	"context"
+	"log/slog"
+	"time"
+
+	"github.com/gwuah/accounts/internal/models"
+)
+
+// VerifyBalances periodically recomputes every account's balance from its transaction lines, until ctx is done.
+// Materialized balances that drifted from their lines are reported, they're not fixed automatically.
+func VerifyBalances(ctx context.Context, logger *slog.Logger, transactionRepo TransactionRepository, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			drifts, err := verifyBalances(ctx, transactionRepo)
+			if err != nil {
+				logger.Error("failed to verify balances", "err", err)
+				continue
+			}
+			for _, drift := range drifts {
+				logger.Error("balance drift detected",
+					"account_number", drift.AccountNumber,
+					"materialized", drift.Materialized,
+					"computed", drift.Computed,
+				)
+			}
+		}
+	}
+}
+
+func verifyBalances(ctx context.Context, transactionRepo TransactionRepository) ([]*models.BalanceDrift, error) {
+	tx, err := transactionRepo.GetTx(ctx)
+	if err != nil {
+		return nil, err
+	}
+	defer tx.Rollback()
+
+	return transactionRepo.VerifyBalances(ctx, tx)
+}
+
+// snapshotDelay gives transactions that were in flight at midnight time to commit, before that day's balances are snapshotted.
+const snapshotDelay = 5 * time.Minute
+
+// SnapshotBalances periodically records every account's balance at the last midnight (UTC), until ctx is done.
+// Snapshots are what keep point-in-time balance queries from summing an account's full history.
+func SnapshotBalances(ctx context.Context, logger *slog.Logger, transactionRepo TransactionRepository, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case now := <-ticker.C:
+			at := now.UTC().Add(-snapshotDelay).Truncate(24 * time.Hour)
+			count, err := snapshotBalances(ctx, transactionRepo, at)
+			if err != nil {
+				logger.Error("failed to snapshot balances", "err", err, "at", at)
+				continue
+			}
+			if count > 0 {
+				logger.Info("balances snapshotted", "count", count, "at", at)
+			}
+		}
+	}
+}
+
+func snapshotBalances(ctx context.Context, transactionRepo TransactionRepository, at time.Time) (int, error) {
+	tx, err := transactionRepo.GetTx(ctx)
+	if err != nil {
+		return 0, err
+	}
+
+	count, err := transactionRepo.CreateSnapshots(ctx, tx, at)
+	if err != nil {
+		tx.Rollback()
+		return 0, err
+	}
+
+	return count, tx.Commit()
+}
@@ -0,0 +1,206 @@
+package services
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net/http"
+
+	"github.com/gorilla/mux"
+	"github.com/gwuah/accounts/internal/models"
+	"github.com/gwuah/accounts/internal/repos"
+	"github.com/gwuah/accounts/pkg"
+	"github.com/shopspring/decimal"
+)
+
+type FeeRepository interface {
+	GetTx(ctx context.Context) (*sql.Tx, error)
+	SaveRule(ctx context.Context, tx *sql.Tx, f *models.FeeRule) error
+	GetRules(ctx context.Context, tx *sql.Tx) ([]*models.FeeRule, error)
+	GetApplicableRule(ctx context.Context, tx *sql.Tx, transactionType, tier, currency string, amount int64) (*models.FeeRule, error)
+}
+
+// createFeeRuleRequest takes amounts in the currency's major units, like every other request.
+type createFeeRuleRequest struct {
+	TransactionType string          `json:"transaction_type"`
+	AccountTier     string          `json:"account_tier"`
+	Currency        string          `json:"currency"`
+	MinAmount       decimal.Decimal `json:"min_amount"`
+	FlatFee         decimal.Decimal `json:"flat_fee"`
+	PercentageBps   int64           `json:"percentage_bps"`
+	MinFee          decimal.Decimal `json:"min_fee"`
+	MaxFee          decimal.Decimal `json:"max_fee"`
+}
+
+func (r createFeeRuleRequest) validate() error {
+	switch r.TransactionType {
+	case Deposit, Withdrawal, Transfer, FXTransfer:
+	default:
+		return errors.New("'transaction_type' must be one of 'deposit', 'withdrawal', 'transfer' or 'fx_transfer'")
+	}
+	if _, err := pkg.GetCurrency(r.Currency); err != nil {
+		return err
+	}
+	if len(r.AccountTier) > 50 {
+		return errors.New("'account_tier' can't be longer than 50 characters")
+	}
+	for name, amount := range map[string]decimal.Decimal{"min_amount": r.MinAmount, "flat_fee": r.FlatFee, "min_fee": r.MinFee, "max_fee": r.MaxFee} {
+		if amount.IsNegative() {
+			return fmt.Errorf("'%s' can't be negative", name)
+		}
+	}
+	if r.PercentageBps < 0 || r.PercentageBps > 10000 {
+		return errors.New("'percentage_bps' must be between 0 and 10000")
+	}
+	if r.MaxFee.IsPositive() && r.MaxFee.LessThan(r.MinFee) {
+		return errors.New("'max_fee' can't be less than 'min_fee'")
+	}
+	return nil
+}
+
+func createFeeRule(global *slog.Logger, feeRepo FeeRepository) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		logger := global.With("entity", "fee_rules")
+
+		var req createFeeRuleRequest
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			logger.Error("error reading request", "err", err)
+			writeBadRequest(w, err)
+			return
+		}
+		if err := req.validate(); err != nil {
+			logger.Error("error validating request", "err", err)
+			writeBadRequest(w, err)
+			return
+		}
+
+		currency, _ := pkg.GetCurrency(req.Currency)
+		rule := &models.FeeRule{
+			TransactionType: req.TransactionType,
+			AccountTier:     req.AccountTier,
+			Currency:        currency.Code,
+			PercentageBps:   req.PercentageBps,
+		}
+		if rule.AccountTier == "" {
+			rule.AccountTier = DefaultAccountTier
+		}
+
+		for _, field := range []struct {
+			amount decimal.Decimal
+			dst    *int64
+		}{{req.MinAmount, &rule.MinAmount}, {req.FlatFee, &rule.FlatFee}, {req.MinFee, &rule.MinFee}, {req.MaxFee, &rule.MaxFee}} {
+			minor, err := pkg.ConvertToMinor(field.amount, currency)
+			if err != nil {
+				writeBadRequest(w, err)
+				return
+			}
+			*field.dst = minor
+		}
+
+		tx, err := feeRepo.GetTx(r.Context())
+		if err != nil {
+			logger.Error("failed to acquire db transaction", "err", err)
+			writeInternalServer(w, "failed to create fee rule")
+			return
+		}
+
+		err = feeRepo.SaveRule(r.Context(), tx, rule)
+		if err != nil {
+			tx.Rollback()
+			logger.Error("failed to save fee rule", "err", err)
+			writeInternalServer(w, "failed to create fee rule")
+			return
+		}
+
+		err = tx.Commit()
+		if err != nil {
+			logger.Error("failed to commit db transaction", "err", err)
+			writeInternalServer(w, "failed to create fee rule")
+			return
+		}
+
+		writeOk(w, map[string]interface{}{
+			"fee_rule": rule,
+		})
+	}
+}
+
+func getFeeRules(global *slog.Logger, feeRepo FeeRepository) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		logger := global.With("entity", "fee_rules")
+
+		tx, err := feeRepo.GetTx(r.Context())
+		if err != nil {
+			logger.Error("failed to acquire db transaction", "err", err)
+			writeInternalServer(w, "failed to get fee rules")
+			return
+		}
+		defer tx.Rollback()
+
+		rules, err := feeRepo.GetRules(r.Context(), tx)
+		if err != nil {
+			logger.Error("failed to get fee rules", "err", err)
+			writeInternalServer(w, "failed to get fee rules")
+			return
+		}
+		if rules == nil {
+			rules = []*models.FeeRule{}
+		}
+
+		writeOk(w, map[string]interface{}{
+			"fee_rules": rules,
+		})
+	}
+}
+
+// buildFeeLines charges the fee that applies to a transaction to the payer, crediting its currency's fee revenue account.
+// The fee depends on the transaction's type, the payer's tier and the amount, in the payer's currency. No fee means no lines.
+func buildFeeLines(ctx context.Context, tx *sql.Tx, accountRepo AccountRepository, feeRepo FeeRepository, transaction *models.Transaction, payer *models.Account, amount int64) ([]*models.TransactionLine, *models.Fee, error) {
+	rule, err := feeRepo.GetApplicableRule(ctx, tx, transaction.Type, payer.Tier, payer.Currency, amount)
+	if err != nil {
+		return nil, nil, err
+	}
+	if rule == nil {
+		return nil, nil, nil
+	}
+
+	fee := pkg.CalculateFee(amount, rule.FlatFee, rule.PercentageBps, rule.MinFee, rule.MaxFee)
+	if fee <= 0 {
+		return nil, nil, nil
+	}
+
+	currency, err := pkg.GetCurrency(payer.Currency)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	revenueAccountNumber := pkg.SystemAccountNumber(pkg.FeeRevenueRole, currency)
+	accounts, err := accountRepo.GetAccounts(ctx, tx, []string{revenueAccountNumber})
+	if err != nil {
+		return nil, nil, err
+	}
+	revenue := getAccountByAccountNumber(accounts, revenueAccountNumber)
+	if revenue == nil {
+		return nil, nil, fmt.Errorf("missing fee revenue account for %s", currency.Code)
+	}
+
+	lines := []*models.TransactionLine{
+		{TransactionID: transaction.ID, AccountID: payer.ID, Amount: fee, Purpose: string(repos.DEBIT)},
+		{TransactionID: transaction.ID, AccountID: revenue.ID, Amount: fee, Purpose: string(repos.CREDIT)},
+	}
+
+	return lines, &models.Fee{
+		RuleID:        rule.ID,
+		AccountNumber: payer.AccountNumber,
+		Currency:      currency.Code,
+		Amount:        fee,
+	}, nil
+}
+
+func AddFeeRoutes(logger *slog.Logger, r *mux.Router, feeRepo FeeRepository) {
+	r.Methods("POST").Path("/fee-rules").HandlerFunc(createFeeRule(logger, feeRepo))
+	r.Methods("GET").Path("/fee-rules").HandlerFunc(getFeeRules(logger, feeRepo))
+}
@@ -0,0 +1,223 @@
+package services
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"time"
+
+	"github.com/gorilla/mux"
+	"github.com/gwuah/accounts/internal/models"
+	"github.com/gwuah/accounts/internal/repos"
+	"github.com/gwuah/accounts/pkg"
+	"github.com/shopspring/decimal"
+)
+
+type FXRepository interface {
+	GetTx(ctx context.Context) (*sql.Tx, error)
+	CreateRate(ctx context.Context, tx *sql.Tx, rate *models.FXRate) error
+	GetRates(ctx context.Context, tx *sql.Tx, base, quote string) ([]*models.FXRate, error)
+	GetEffectiveRate(ctx context.Context, tx *sql.Tx, base, quote string, at time.Time) (*models.FXRate, error)
+	CreateConversion(ctx context.Context, tx *sql.Tx, c *models.FXConversion) error
+}
+
+type createRateRequest struct {
+	Base        string          `json:"base"`
+	Quote       string          `json:"quote"`
+	Rate        decimal.Decimal `json:"rate"`
+	SpreadBps   int64           `json:"spread_bps"`
+	EffectiveAt *time.Time      `json:"effective_at"`
+}
+
+func (r createRateRequest) validate() error {
+	base, err := pkg.GetCurrency(r.Base)
+	if err != nil {
+		return err
+	}
+	quote, err := pkg.GetCurrency(r.Quote)
+	if err != nil {
+		return err
+	}
+	if base.Code == quote.Code {
+		return errors.New("'base' and 'quote' must be different currencies")
+	}
+	if !r.Rate.IsPositive() {
+		return errors.New("'rate' is required. (positive value)")
+	}
+	if r.SpreadBps < 0 || r.SpreadBps >= 10000 {
+		return errors.New("'spread_bps' must be between 0 and 9999")
+	}
+	return nil
+}
+
+func createRate(global *slog.Logger, fxRepo FXRepository) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		logger := global.With("entity", "fx_rates")
+
+		var req createRateRequest
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			logger.Error("error reading request", "err", err)
+			writeBadRequest(w, err)
+			return
+		}
+		if err := req.validate(); err != nil {
+			logger.Error("error validating request", "err", err)
+			writeBadRequest(w, err)
+			return
+		}
+
+		base, _ := pkg.GetCurrency(req.Base)
+		quote, _ := pkg.GetCurrency(req.Quote)
+
+		rate := &models.FXRate{
+			BaseCurrency:  base.Code,
+			QuoteCurrency: quote.Code,
+			Rate:          req.Rate,
+			SpreadBps:     req.SpreadBps,
+			EffectiveAt:   time.Now().UTC(),
+		}
+		if req.EffectiveAt != nil {
+			rate.EffectiveAt = req.EffectiveAt.UTC()
+		}
+
+		tx, err := fxRepo.GetTx(r.Context())
+		if err != nil {
+			logger.Error("failed to acquire db transaction", "err", err)
+			writeInternalServer(w, "failed to create rate")
+			return
+		}
+
+		err = fxRepo.CreateRate(r.Context(), tx, rate)
+		if err != nil {
+			tx.Rollback()
+			logger.Error("failed to create rate", "err", err)
+			writeInternalServer(w, "failed to create rate")
+			return
+		}
+
+		err = tx.Commit()
+		if err != nil {
+			logger.Error("failed to commit db transaction", "err", err)
+			writeInternalServer(w, "failed to create rate")
+			return
+		}
+
+		writeOk(w, map[string]interface{}{
+			"rate": rate,
+		})
+	}
+}
+
+func getRates(global *slog.Logger, fxRepo FXRepository) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		logger := global.With("entity", "fx_rates")
+
+		base, err := pkg.GetCurrency(r.URL.Query().Get("base"))
+		if err != nil {
+			writeBadRequest(w, err)
+			return
+		}
+		quote, err := pkg.GetCurrency(r.URL.Query().Get("quote"))
+		if err != nil {
+			writeBadRequest(w, err)
+			return
+		}
+
+		tx, err := fxRepo.GetTx(r.Context())
+		if err != nil {
+			logger.Error("failed to acquire db transaction", "err", err)
+			writeInternalServer(w, "failed to get rates")
+			return
+		}
+		defer tx.Rollback()
+
+		rates, err := fxRepo.GetRates(r.Context(), tx, base.Code, quote.Code)
+		if err != nil {
+			logger.Error("failed to get rates", "err", err)
+			writeInternalServer(w, "failed to get rates")
+			return
+		}
+
+		writeOk(w, map[string]interface{}{
+			"rates": rates,
+		})
+	}
+}
+
+// buildFXLines books an fx transfer through the fx position accounts of both currencies, so each currency's legs balance.
+// The spread is credited to the destination currency's fx revenue account.
+func buildFXLines(ctx context.Context, tx *sql.Tx, accountRepo AccountRepository, fxRepo FXRepository, transaction *models.Transaction, from, to *models.Account, amount int64) ([]*models.TransactionLine, *models.FXConversion, error) {
+	source, err := pkg.GetCurrency(from.Currency)
+	if err != nil {
+		return nil, nil, err
+	}
+	destination, err := pkg.GetCurrency(to.Currency)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	rate, err := fxRepo.GetEffectiveRate(ctx, tx, source.Code, destination.Code, time.Now())
+	if err != nil {
+		return nil, nil, err
+	}
+	if rate == nil {
+		return nil, nil, fmt.Errorf("%w for %s/%s", errNoFXRate, source.Code, destination.Code)
+	}
+
+	converted, spread := pkg.ConvertCurrency(amount, source, destination, rate.Rate, rate.SpreadBps)
+	if converted <= 0 {
+		return nil, nil, errAmountTooSmall
+	}
+
+	sourcePosition := pkg.SystemAccountNumber(pkg.FXPositionRole, source)
+	destinationPosition := pkg.SystemAccountNumber(pkg.FXPositionRole, destination)
+	revenue := pkg.SystemAccountNumber(pkg.FXRevenueRole, destination)
+
+	accounts, err := accountRepo.GetAccounts(ctx, tx, []string{sourcePosition, destinationPosition, revenue})
+	if err != nil {
+		return nil, nil, err
+	}
+	if len(accounts) != 3 {
+		return nil, nil, fmt.Errorf("missing fx system accounts for %s/%s", source.Code, destination.Code)
+	}
+
+	lines := []*models.TransactionLine{
+		{TransactionID: transaction.ID, AccountID: from.ID, Amount: amount, Purpose: string(repos.DEBIT)},
+		{TransactionID: transaction.ID, AccountID: getAccountByAccountNumber(accounts, sourcePosition).ID, Amount: amount, Purpose: string(repos.CREDIT)},
+		{TransactionID: transaction.ID, AccountID: getAccountByAccountNumber(accounts, destinationPosition).ID, Amount: converted + spread, Purpose: string(repos.DEBIT)},
+		{TransactionID: transaction.ID, AccountID: to.ID, Amount: converted, Purpose: string(repos.CREDIT)},
+	}
+	if spread > 0 {
+		lines = append(lines, &models.TransactionLine{
+			TransactionID: transaction.ID, AccountID: getAccountByAccountNumber(accounts, revenue).ID, Amount: spread, Purpose: string(repos.CREDIT),
+		})
+	}
+
+	conversion := &models.FXConversion{
+		TransactionID:     transaction.ID,
+		RateID:            rate.ID,
+		BaseCurrency:      source.Code,
+		QuoteCurrency:     destination.Code,
+		Rate:              rate.Rate,
+		SpreadBps:         rate.SpreadBps,
+		SourceAmount:      amount,
+		DestinationAmount: converted,
+		SpreadAmount:      spread,
+	}
+
+	return lines, conversion, nil
+}
+
+var (
+	errNoFXRate       = errors.New("no fx rate available")
+	errAmountTooSmall = errors.New("amount is too small to convert")
+)
+
+func AddFXRoutes(logger *slog.Logger, r *mux.Router, fxRepo FXRepository) {
+	r.Methods("POST").Path("/fx/rates").HandlerFunc(createRate(logger, fxRepo))
+	r.Methods("GET").Path("/fx/rates").HandlerFunc(getRates(logger, fxRepo))
+}
@@ -0,0 +1,522 @@
+package services
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"time"
+
+	"github.com/gorilla/mux"
+	"github.com/gwuah/accounts/internal/models"
+	"github.com/gwuah/accounts/internal/repos"
+	"github.com/gwuah/accounts/pkg"
+	"github.com/shopspring/decimal"
+)
+
+const DefaultHoldTTL = 7 * 24 * time.Hour
+
+type HoldRepository interface {
+	GetTx(ctx context.Context) (*sql.Tx, error)
+	Create(ctx context.Context, tx *sql.Tx, h *models.Hold) error
+	GetByReference(ctx context.Context, tx *sql.Tx, reference string) (*models.Hold, error)
+	UpdateStatus(ctx context.Context, tx *sql.Tx, h *models.Hold) (bool, error)
+	Expire(ctx context.Context, now time.Time) (int64, error)
+}
+
+type createHoldRequest struct {
+	From       string          `json:"from"`
+	To         string          `json:"to"`
+	Amount     decimal.Decimal `json:"amount"`
+	Reference  string          `json:"reference"`
+	TTLSeconds int64           `json:"ttl_seconds"`
+}
+
+func (r createHoldRequest) validate() error {
+	if r.From == "" || r.To == "" {
+		return errors.New("origin/destination accounts are required for a hold")
+	}
+	if pkg.IsSystemAccountNumber(r.From) || pkg.IsSystemAccountNumber(r.To) {
+		return errors.New("action not allowed for this account number")
+	}
+	if !r.Amount.IsPositive() {
+		return errors.New("amount is required. (positive value)")
+	}
+	if r.Reference == "" {
+		return errors.New("'reference' is required, can't be empty")
+	}
+	if r.TTLSeconds < 0 {
+		return errors.New("'ttl_seconds' can't be negative")
+	}
+	return nil
+}
+
+type captureHoldRequest struct {
+	// Amount is optional, when it's omitted the full hold is captured.
+	Amount decimal.Decimal `json:"amount"`
+}
+
+func createHold(global *slog.Logger, accountRepo AccountRepository, transactionRepo TransactionRepository, holdRepo HoldRepository) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		logger := global.With("entity", "holds")
+
+		var req createHoldRequest
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			logger.Error("error reading request", "err", err)
+			writeBadRequest(w, err)
+			return
+		}
+		if err := req.validate(); err != nil {
+			logger.Error("error validating request", "err", err)
+			writeBadRequest(w, err)
+			return
+		}
+
+		tx, err := holdRepo.GetTx(r.Context())
+		if err != nil {
+			logger.Error("failed to acquire db transaction", "err", err)
+			writeInternalServer(w, "failed to create hold")
+			return
+		}
+
+		accounts, err := accountRepo.GetAccounts(r.Context(), tx, []string{req.From, req.To})
+		if err != nil {
+			tx.Rollback()
+			logger.Error("failed to get accounts", "err", err)
+			writeInternalServer(w, "failed to create hold")
+			return
+		}
+		if len(accounts) != 2 {
+			tx.Rollback()
+			writeNotFound(w, "account not found")
+			return
+		}
+
+		from := getAccountByAccountNumber(accounts, req.From)
+		to := getAccountByAccountNumber(accounts, req.To)
+		if from.Currency != to.Currency {
+			tx.Rollback()
+			writeBadRequest(w, fmt.Errorf("can't hold funds between %s and %s accounts", from.Currency, to.Currency))
+			return
+		}
+
+		currency, err := pkg.GetCurrency(from.Currency)
+		if err != nil {
+			tx.Rollback()
+			logger.Error("account has unsupported currency", "err", err)
+			writeInternalServer(w, "failed to create hold")
+			return
+		}
+
+		ttl := DefaultHoldTTL
+		if req.TTLSeconds > 0 {
+			ttl = time.Duration(req.TTLSeconds) * time.Second
+		}
+
+		amount, err := pkg.ConvertToMinor(req.Amount, currency)
+		if err != nil {
+			tx.Rollback()
+			writeBadRequest(w, err)
+			return
+		}
+
+		hold := &models.Hold{
+			Reference:                req.Reference,
+			AccountID:                from.ID,
+			AccountNumber:            from.AccountNumber,
+			DestinationAccountID:     to.ID,
+			DestinationAccountNumber: to.AccountNumber,
+			Currency:                 currency.Code,
+			Amount:                   amount,
+			ExpiresAt:                time.Now().UTC().Add(ttl),
+		}
+
+		err = transactionRepo.LockAccounts(r.Context(), tx, []int{from.ID})
+		if err != nil {
+			tx.Rollback()
+			logger.Error("failed to lock accounts", "err", err)
+			writeInternalServer(w, "failed to create hold")
+			return
+		}
+
+		// the hold is checked like the transfer it'll be captured as.
+		reason, err := checkStatuses(r.Context(), tx, accountRepo, []*models.TransactionLine{
+			{AccountID: from.ID, Purpose: string(repos.DEBIT)},
+			{AccountID: to.ID, Purpose: string(repos.CREDIT)},
+		})
+		if err != nil {
+			tx.Rollback()
+			logger.Error("failed to check account statuses", "err", err)
+			writeInternalServer(w, "failed to create hold")
+			return
+		}
+		if reason != "" {
+			tx.Rollback()
+			writeUnprocessableEntity(w, reason)
+			return
+		}
+
+		balance, err := transactionRepo.GetBalanceForUpdate(r.Context(), tx, from.ID)
+		if err != nil {
+			tx.Rollback()
+			logger.Error("failed to get balance", "err", err)
+			writeInternalServer(w, "failed to create hold")
+			return
+		}
+		if balance.Available < hold.Amount {
+			tx.Rollback()
+			writeUnprocessableEntity(w, "insufficient balance")
+			return
+		}
+
+		err = holdRepo.Create(r.Context(), tx, hold)
+		if err != nil {
+			tx.Rollback()
+			if isUniqueViolation(err, "holds", "reference") {
+				writeConflict(w, "duplicate hold request")
+				return
+			}
+			logger.Error("failed to create hold", "err", err)
+			writeInternalServer(w, "failed to create hold")
+			return
+		}
+
+		err = tx.Commit()
+		if err != nil {
+			logger.Error("failed to commit db transaction", "err", err)
+			writeInternalServer(w, "failed to create hold")
+			return
+		}
+
+		writeOk(w, map[string]interface{}{
+			"hold": hold,
+		})
+	}
+}
+
+func getHold(global *slog.Logger, holdRepo HoldRepository) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		logger := global.With("entity", "holds")
+		reference := mux.Vars(r)["reference"]
+
+		tx, err := holdRepo.GetTx(r.Context())
+		if err != nil {
+			logger.Error("failed to acquire db transaction", "err", err)
+			writeInternalServer(w, "failed to get hold")
+			return
+		}
+		defer tx.Rollback()
+
+		hold, err := holdRepo.GetByReference(r.Context(), tx, reference)
+		if err != nil {
+			logger.Error("failed to get hold", "err", err)
+			writeInternalServer(w, "failed to get hold")
+			return
+		}
+		if hold == nil {
+			writeNotFound(w, "hold not found")
+			return
+		}
+
+		writeOk(w, map[string]interface{}{
+			"hold": hold,
+		})
+	}
+}
+
+// captureHold posts the held amount (or part of it) from the held account to the hold's destination.
+// Whatever isn't captured is released back to the account.
+func captureHold(global *slog.Logger, accountRepo AccountRepository, transactionRepo TransactionRepository, holdRepo HoldRepository, webhookRepo WebhookRepository) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		logger := global.With("entity", "holds")
+		reference := mux.Vars(r)["reference"]
+
+		// the body is optional, an empty one captures the full hold.
+		var req captureHoldRequest
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil && err != io.EOF {
+			logger.Error("error reading request", "err", err)
+			writeBadRequest(w, err)
+			return
+		}
+		if req.Amount.IsNegative() {
+			writeBadRequest(w, errors.New("amount can't be negative"))
+			return
+		}
+
+		tx, err := holdRepo.GetTx(r.Context())
+		if err != nil {
+			logger.Error("failed to acquire db transaction", "err", err)
+			writeInternalServer(w, "failed to capture hold")
+			return
+		}
+
+		hold, ok := getPendingHold(r.Context(), w, logger, tx, holdRepo, reference)
+		if !ok {
+			return
+		}
+
+		currency, err := pkg.GetCurrency(hold.Currency)
+		if err != nil {
+			tx.Rollback()
+			logger.Error("account has unsupported currency", "err", err)
+			writeInternalServer(w, "failed to capture hold")
+			return
+		}
+
+		amount := hold.Amount
+		if req.Amount.IsPositive() {
+			amount, err = pkg.ConvertToMinor(req.Amount, currency)
+			if err != nil {
+				tx.Rollback()
+				writeBadRequest(w, err)
+				return
+			}
+		}
+		if amount > hold.Amount {
+			tx.Rollback()
+			writeBadRequest(w, errors.New("can't capture more than the held amount"))
+			return
+		}
+
+		err = transactionRepo.LockAccounts(r.Context(), tx, []int{hold.AccountID, hold.DestinationAccountID})
+		if err != nil {
+			tx.Rollback()
+			logger.Error("failed to lock accounts", "err", err)
+			writeInternalServer(w, "failed to capture hold")
+			return
+		}
+
+		reason, err := checkStatuses(r.Context(), tx, accountRepo, []*models.TransactionLine{
+			{AccountID: hold.AccountID, Purpose: string(repos.DEBIT)},
+			{AccountID: hold.DestinationAccountID, Purpose: string(repos.CREDIT)},
+		})
+		if err != nil {
+			tx.Rollback()
+			logger.Error("failed to check account statuses", "err", err)
+			writeInternalServer(w, "failed to capture hold")
+			return
+		}
+		if reason != "" {
+			tx.Rollback()
+			writeUnprocessableEntity(w, reason)
+			return
+		}
+
+		reason, err = checkCreditLines(r.Context(), tx, accountRepo, transactionRepo, []*models.TransactionLine{
+			{AccountID: hold.AccountID, Amount: amount, Purpose: string(repos.DEBIT)},
+			{AccountID: hold.DestinationAccountID, Amount: amount, Purpose: string(repos.CREDIT)},
+		})
+		if err != nil {
+			tx.Rollback()
+			logger.Error("failed to check credit lines", "err", err)
+			writeInternalServer(w, "failed to capture hold")
+			return
+		}
+		if reason != "" {
+			tx.Rollback()
+			writeUnprocessableEntity(w, reason)
+			return
+		}
+
+		// the hold itself is excluded from the available balance, so it's added back before checking.
+		balance, err := transactionRepo.GetBalanceForUpdate(r.Context(), tx, hold.AccountID)
+		if err != nil {
+			tx.Rollback()
+			logger.Error("failed to get balance", "err", err)
+			writeInternalServer(w, "failed to capture hold")
+			return
+		}
+		if balance.Available+hold.Amount < amount {
+			tx.Rollback()
+			writeUnprocessableEntity(w, "insufficient balance")
+			return
+		}
+
+		transaction := &models.Transaction{
+			Reference:            fmt.Sprintf("%s-capture", hold.Reference),
+			Type:                 Capture,
+			Amount:               &amount,
+			SourceAccountID:      &hold.AccountID,
+			DestinationAccountID: &hold.DestinationAccountID,
+		}
+		err = transactionRepo.Create(r.Context(), tx, transaction)
+		if err != nil {
+			tx.Rollback()
+			if isUniqueViolation(err, "transactions", "reference") {
+				writeConflict(w, "duplicate transaction request")
+				return
+			}
+			logger.Error("failed to create capture transaction", "err", err)
+			writeInternalServer(w, "failed to capture hold")
+			return
+		}
+
+		lines := []*models.TransactionLine{
+			{TransactionID: transaction.ID, AccountID: hold.AccountID, Amount: amount, Purpose: string(repos.DEBIT)},
+			{TransactionID: transaction.ID, AccountID: hold.DestinationAccountID, Amount: amount, Purpose: string(repos.CREDIT)},
+		}
+		for _, line := range lines {
+			err = transactionRepo.CreateTransactionLine(r.Context(), tx, line)
+			if err != nil {
+				tx.Rollback()
+				logger.Error("failed to create transaction line", "err", err, "purpose", line.Purpose)
+				writeInternalServer(w, "failed to capture hold")
+				return
+			}
+		}
+
+		err = publishTransaction(r.Context(), tx, transactionRepo, webhookRepo, transaction)
+		if err != nil {
+			tx.Rollback()
+			logger.Error("failed to publish event", "err", err)
+			writeInternalServer(w, "failed to capture hold")
+			return
+		}
+
+		hold.Status = string(repos.CAPTURED)
+		hold.CapturedAmount = amount
+		hold.TransactionID = &transaction.ID
+		if !updateHoldStatus(r.Context(), w, logger, tx, holdRepo, hold) {
+			return
+		}
+
+		err = tx.Commit()
+		if err != nil {
+			logger.Error("failed to commit db transaction", "err", err)
+			writeInternalServer(w, "failed to capture hold")
+			return
+		}
+
+		writeOk(w, map[string]interface{}{
+			"hold": hold,
+		})
+	}
+}
+
+func voidHold(global *slog.Logger, holdRepo HoldRepository) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		logger := global.With("entity", "holds")
+		reference := mux.Vars(r)["reference"]
+
+		tx, err := holdRepo.GetTx(r.Context())
+		if err != nil {
+			logger.Error("failed to acquire db transaction", "err", err)
+			writeInternalServer(w, "failed to void hold")
+			return
+		}
+
+		hold, ok := getPendingHold(r.Context(), w, logger, tx, holdRepo, reference)
+		if !ok {
+			return
+		}
+
+		hold.Status = string(repos.VOIDED)
+		if !updateHoldStatus(r.Context(), w, logger, tx, holdRepo, hold) {
+			return
+		}
+
+		err = tx.Commit()
+		if err != nil {
+			logger.Error("failed to commit db transaction", "err", err)
+			writeInternalServer(w, "failed to void hold")
+			return
+		}
+
+		writeOk(w, map[string]interface{}{
+			"hold": hold,
+		})
+	}
+}
+
+// getPendingHold loads a hold that can still be captured or voided, and writes the error response if it can't.
+// Holds whose ttl has elapsed are marked as expired on the way.
+// The db transaction is rolled back whenever it returns false.
+func getPendingHold(ctx context.Context, w http.ResponseWriter, logger *slog.Logger, tx *sql.Tx, holdRepo HoldRepository, reference string) (*models.Hold, bool) {
+	hold, err := holdRepo.GetByReference(ctx, tx, reference)
+	if err != nil {
+		tx.Rollback()
+		logger.Error("failed to get hold", "err", err)
+		writeInternalServer(w, "failed to get hold")
+		return nil, false
+	}
+	if hold == nil {
+		tx.Rollback()
+		writeNotFound(w, "hold not found")
+		return nil, false
+	}
+
+	if hold.Status == string(repos.PENDING) && !hold.ExpiresAt.After(time.Now()) {
+		hold.Status = string(repos.EXPIRED)
+		if _, err := holdRepo.UpdateStatus(ctx, tx, hold); err != nil {
+			tx.Rollback()
+			logger.Error("failed to expire hold", "err", err)
+			writeInternalServer(w, "failed to get hold")
+			return nil, false
+		}
+		if err := tx.Commit(); err != nil {
+			logger.Error("failed to commit db transaction", "err", err)
+			writeInternalServer(w, "failed to get hold")
+			return nil, false
+		}
+		writeUnprocessableEntity(w, "hold has expired")
+		return nil, false
+	}
+
+	if hold.Status != string(repos.PENDING) {
+		tx.Rollback()
+		writeUnprocessableEntity(w, fmt.Sprintf("hold has already been %s", hold.Status))
+		return nil, false
+	}
+
+	return hold, true
+}
+
+func updateHoldStatus(ctx context.Context, w http.ResponseWriter, logger *slog.Logger, tx *sql.Tx, holdRepo HoldRepository, hold *models.Hold) bool {
+	updated, err := holdRepo.UpdateStatus(ctx, tx, hold)
+	if err != nil {
+		tx.Rollback()
+		logger.Error("failed to update hold", "err", err)
+		writeInternalServer(w, "failed to update hold")
+		return false
+	}
+	if !updated {
+		tx.Rollback()
+		writeConflict(w, "hold was updated by another request")
+		return false
+	}
+	return true
+}
+
+// ExpireHolds periodically marks holds whose ttl has elapsed as expired, until ctx is done.
+// Expired holds are already excluded from available balances, this keeps their status accurate.
+func ExpireHolds(ctx context.Context, logger *slog.Logger, holdRepo HoldRepository, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			n, err := holdRepo.Expire(ctx, time.Now())
+			if err != nil {
+				logger.Error("failed to expire holds", "err", err)
+				continue
+			}
+			if n > 0 {
+				logger.Info("expired holds", "count", n)
+			}
+		}
+	}
+}
+
+func AddHoldRoutes(logger *slog.Logger, r *mux.Router, accountRepo AccountRepository, transactionRepo TransactionRepository, holdRepo HoldRepository, webhookRepo WebhookRepository) {
+	r.Methods("POST").Path("/holds").HandlerFunc(createHold(logger, accountRepo, transactionRepo, holdRepo))
+	r.Methods("GET").Path("/holds/{reference}").HandlerFunc(getHold(logger, holdRepo))
+	r.Methods("POST").Path("/holds/{reference}/capture").HandlerFunc(captureHold(logger, accountRepo, transactionRepo, holdRepo, webhookRepo))
+	r.Methods("POST").Path("/holds/{reference}/void").HandlerFunc(voidHold(logger, holdRepo))
+}
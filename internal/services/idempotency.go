@@ -0,0 +1,164 @@
+package services
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"slices"
+	"time"
+
+	"github.com/gorilla/mux"
+	"github.com/gwuah/accounts/internal/models"
+)
+
+const (
+	// IdempotencyKeyHeader is the header clients set to make retrying a request safe.
+	IdempotencyKeyHeader = "Idempotency-Key"
+	// IdempotentReplayedHeader is set on responses replayed for a retried request.
+	IdempotentReplayedHeader = "Idempotent-Replayed"
+)
+
+const (
+	IdempotencyInProgress = "in_progress"
+	IdempotencyCompleted  = "completed"
+)
+
+// IdempotencyKeyTTL is how long a key's response is kept for replaying.
+const IdempotencyKeyTTL = 24 * time.Hour
+
+// IdempotencyKeyAbandonedAfter is how long a key can stay in progress. A request that hasn't completed by then is taken
+// to have died with the process that served it, and its key is given up for the client to retry it.
+const IdempotencyKeyAbandonedAfter = time.Minute
+
+// idempotentRoutes are the routes that honour idempotency keys, as "<method> <path template>".
+var idempotentRoutes = []string{
+	"POST /users",
+	"POST /accounts",
+	"POST /transactions",
+}
+
+// IdempotencyStore keeps the clients' idempotency keys & the responses to their requests.
+type IdempotencyStore interface {
+	// Reserve records the key. If the client already used it, it returns that key instead.
+	// Keys that expired, or were left in progress since abandonedBefore, are forgotten first.
+	Reserve(ctx context.Context, k *models.IdempotencyKey, expiredBefore, abandonedBefore time.Time) (*models.IdempotencyKey, error)
+	Complete(ctx context.Context, k *models.IdempotencyKey) error
+	Release(ctx context.Context, k *models.IdempotencyKey) error
+}
+
+// recordingResponseWriter keeps a copy of the response it writes.
+type recordingResponseWriter struct {
+	http.ResponseWriter
+	code int
+	body bytes.Buffer
+}
+
+func (w *recordingResponseWriter) WriteHeader(code int) {
+	if w.code == 0 {
+		w.code = code
+	}
+	w.ResponseWriter.WriteHeader(code)
+}
+
+func (w *recordingResponseWriter) Write(b []byte) (int, error) {
+	if w.code == 0 {
+		w.code = http.StatusOK
+	}
+	w.body.Write(b)
+	return w.ResponseWriter.Write(b)
+}
+
+// requestFingerprint hashes what makes a request the same request.
+func requestFingerprint(r *http.Request, body []byte) string {
+	sum := sha256.Sum256(body)
+	fingerprint := sha256.Sum256([]byte(r.Method + "\n" + r.URL.Path + "\n" + hex.EncodeToString(sum[:])))
+	return hex.EncodeToString(fingerprint[:])
+}
+
+// Idempotency is a mux middleware that makes the idempotentRoutes safe to retry, for requests with an Idempotency-Key header.
+// The first request with a key goes through & its response is kept, retries with the same key & payload get that response again,
+// and a key reused with a different payload is refused. Keys are the client's own, ie. scoped to the api key or user.
+// It must come after Authenticate, to know the client, and after VerifySignatures, so retries must be signed again.
+func Idempotency(global *slog.Logger, store IdempotencyStore) mux.MiddlewareFunc {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			logger := global.With("entity", "idempotency")
+
+			key := r.Header.Get(IdempotencyKeyHeader)
+			if key == "" {
+				next.ServeHTTP(w, r)
+				return
+			}
+			route := mux.CurrentRoute(r)
+			if route == nil {
+				next.ServeHTTP(w, r)
+				return
+			}
+			if template, _ := route.GetPathTemplate(); !slices.Contains(idempotentRoutes, r.Method+" "+template) {
+				next.ServeHTTP(w, r)
+				return
+			}
+			if len(key) > 255 {
+				writeBadRequest(w, fmt.Errorf("'%s' can't be longer than 255 characters", IdempotencyKeyHeader))
+				return
+			}
+
+			body, err := io.ReadAll(r.Body)
+			if err != nil {
+				writeBadRequest(w, err)
+				return
+			}
+			r.Body = io.NopCloser(bytes.NewReader(body))
+
+			k := &models.IdempotencyKey{
+				Client:      principalName(PrincipalFromContext(r.Context())),
+				Key:         key,
+				Fingerprint: requestFingerprint(r, body),
+				Status:      IdempotencyInProgress,
+			}
+			now := time.Now()
+			used, err := store.Reserve(r.Context(), k, now.Add(-IdempotencyKeyTTL), now.Add(-IdempotencyKeyAbandonedAfter))
+			if err != nil {
+				logger.Error("failed to reserve idempotency key", "err", err)
+				writeInternalServer(w, "failed to check idempotency key")
+				return
+			}
+			if used != nil {
+				switch {
+				case used.Fingerprint != k.Fingerprint:
+					writeUnprocessableEntity(w, "idempotency key was already used for a different request")
+				case used.Status == IdempotencyInProgress:
+					writeConflict(w, "a request with this idempotency key is still in progress")
+				default:
+					logger.Info("replaying response", "client", used.Client, "key", used.Key)
+					w.Header().Set("Content-Type", "application/json; charset=utf-8")
+					w.Header().Set(IdempotentReplayedHeader, "true")
+					w.WriteHeader(used.ResponseCode)
+					w.Write(used.ResponseBody)
+				}
+				return
+			}
+
+			rw := &recordingResponseWriter{ResponseWriter: w}
+			next.ServeHTTP(rw, r)
+
+			// failures on our side roll the request back, so the key is given up for the client to retry it.
+			if rw.code == 0 || rw.code >= http.StatusInternalServerError {
+				if err := store.Release(context.Background(), k); err != nil {
+					logger.Error("failed to release idempotency key", "err", err, "key", k.Key)
+				}
+				return
+			}
+
+			k.Status, k.ResponseCode, k.ResponseBody = IdempotencyCompleted, rw.code, rw.body.Bytes()
+			if err := store.Complete(context.Background(), k); err != nil {
+				logger.Error("failed to record idempotent response", "err", err, "key", k.Key)
+			}
+		})
+	}
+}
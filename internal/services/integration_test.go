@@ -3,16 +3,25 @@ package services_test
 import (
 	"bytes"
 	"context"
+	"crypto"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"encoding/base64"
 	"encoding/json"
 	"fmt"
 	"io"
 	"io/ioutil"
 	"log/slog"
+	"math/big"
 	"net/http"
 	"net/http/httptest"
 	"os"
 	"path/filepath"
+	"strings"
+	"sync"
 	"testing"
+	"time"
 
 	"github.com/gorilla/mux"
 	"github.com/gwuah/accounts/internal/config"
@@ -21,6 +30,7 @@ import (
 	"github.com/gwuah/accounts/internal/repos"
 	"github.com/gwuah/accounts/internal/services"
 	"github.com/gwuah/accounts/pkg"
+	"github.com/shopspring/decimal"
 	"github.com/stretchr/testify/require"
 )
 
@@ -44,11 +54,28 @@ func setup(t *testing.T) (context.Context, *mux.Router, *database.DB, *slog.Logg
 	ar := repos.NewAccount(logger, db.Instance())
 	ur := repos.NewUsers(logger, db.Instance())
 	tr := repos.NewTransactions(logger, db.Instance())
+	fr := repos.NewFX(logger, db.Instance())
+	hr := repos.NewHolds(logger, db.Instance())
+	fer := repos.NewFees(logger, db.Instance())
+	ir := repos.NewInterest(logger, db.Instance())
+	wr := repos.NewWebhooks(logger, db.Instance())
+	apr := repos.NewApprovals(logger, db.Instance())
 
 	r := mux.NewRouter()
-	services.AddUserRoutes(logger, r, ar, ur)
-	services.AddAccountRoutes(logger, r, ar, ur, tr)
-	services.AddTransactionRoutes(logger, r, ar, ur, tr)
+	services.AddUserRoutes(logger, r, ar, ur, wr)
+	services.AddAccountRoutes(logger, r, ar, ur, tr, wr)
+	services.AddAccountStatusRoutes(logger, r, ar, tr, ir, wr)
+	services.AddTransactionRoutes(logger, r, ar, ur, tr, fr, fer, wr, apr)
+	services.AddFXRoutes(logger, r, fr)
+	services.AddHoldRoutes(logger, r, ar, tr, hr, wr)
+	services.AddJournalEntryRoutes(logger, r, ar, tr, wr)
+	services.AddFeeRoutes(logger, r, fer)
+	services.AddInterestRoutes(logger, r, ar, ir)
+	services.AddWebhookRoutes(logger, r, wr)
+	services.AddLedgerRoutes(logger, r, tr)
+	services.AddAPIKeyRoutes(logger, r, repos.NewAPIKeys(logger, db.Instance()))
+	services.AddRBACRoutes(logger, r, repos.NewRBAC(logger, db.Instance()), ur)
+	services.AddApprovalRoutes(logger, r, ar, tr, fr, fer, wr, apr)
 
 	teardown := func() {
 		os.Remove(filepath.Join(dir, "accounts.db"))
@@ -140,7 +167,7 @@ func TestCreateUserCreateAccountDepositTransfer(t *testing.T) {
 	var finalA1Response map[string]models.Account
 	w = performRequestAndGetResponse[map[string]models.Account](r, t)(req, &finalA1Response)
 	require.Equal(t, http.StatusOK, w.Code)
-	require.Equal(t, float64(0), finalA1Response["account"].Balance)
+	require.Equal(t, "0", finalA1Response["account"].Balance.String())
 
 	// verify that account 2 has balance of 200
 	reqBody = fmt.Sprintf(`{"from":"%s","to":"%s","type":"transfer","amount":100,"reference":"%s"}`, a1Response["account"].AccountNumber, a2Response["account"].AccountNumber, pkg.CreateAccountNumber())
@@ -148,5 +175,2801 @@ func TestCreateUserCreateAccountDepositTransfer(t *testing.T) {
 	var finalA2Response map[string]models.Account
 	w = performRequestAndGetResponse[map[string]models.Account](r, t)(req, &finalA2Response)
 	require.Equal(t, http.StatusOK, w.Code)
-	require.Equal(t, float64(200), finalA2Response["account"].Balance)
+	require.Equal(t, "200", finalA2Response["account"].Balance.String())
+}
+
+func TestMultiCurrencyAccounts(t *testing.T) {
+	_, r, _, _, teardown := setup(t)
+	defer teardown()
+
+	req := httptest.NewRequest("POST", "/users", bytes.NewBuffer([]byte(`{"email": "1@gmail.com"}'`)))
+	var uResponse map[string]models.User
+	w := performRequestAndGetResponse[map[string]models.User](r, t)(req, &uResponse)
+	require.Equal(t, http.StatusOK, w.Code)
+
+	// create a usd & eur account for the user
+	req = httptest.NewRequest("POST", "/accounts", bytes.NewBuffer([]byte(fmt.Sprintf(`{"user_id": %d}`, uResponse["user"].ID))))
+	var usdResponse map[string]models.Account
+	w = performRequestAndGetResponse[map[string]models.Account](r, t)(req, &usdResponse)
+	require.Equal(t, http.StatusOK, w.Code)
+	require.Equal(t, "USD", usdResponse["account"].Currency)
+
+	req = httptest.NewRequest("POST", "/accounts", bytes.NewBuffer([]byte(fmt.Sprintf(`{"user_id": %d, "currency": "eur"}`, uResponse["user"].ID))))
+	var eurResponse map[string]models.Account
+	w = performRequestAndGetResponse[map[string]models.Account](r, t)(req, &eurResponse)
+	require.Equal(t, http.StatusOK, w.Code)
+	require.Equal(t, "EUR", eurResponse["account"].Currency)
+
+	// unsupported currencies are rejected
+	req = httptest.NewRequest("POST", "/accounts", bytes.NewBuffer([]byte(fmt.Sprintf(`{"user_id": %d, "currency": "XYZ"}`, uResponse["user"].ID))))
+	var badResponse map[string]string
+	w = performRequestAndGetResponse[map[string]string](r, t)(req, &badResponse)
+	require.Equal(t, http.StatusBadRequest, w.Code)
+
+	// deposits into the eur account are funded by the eur genesis account
+	reqBody := fmt.Sprintf(`{"to":"%s","type":"deposit","amount":50.25,"reference":"%s"}`, eurResponse["account"].AccountNumber, pkg.CreateAccountNumber())
+	req = httptest.NewRequest("POST", "/transactions", bytes.NewBuffer([]byte(reqBody)))
+	var dResponse map[string]string
+	w = performRequestAndGetResponse[map[string]string](r, t)(req, &dResponse)
+	require.Equal(t, http.StatusOK, w.Code)
+
+	req = httptest.NewRequest("GET", "/accounts/000000978", nil)
+	var genesisResponse map[string]models.Account
+	w = performRequestAndGetResponse[map[string]models.Account](r, t)(req, &genesisResponse)
+	require.Equal(t, http.StatusOK, w.Code)
+	require.Equal(t, "-50.25", genesisResponse["account"].Balance.String())
+
+	// transfers across currencies are rejected
+	reqBody = fmt.Sprintf(`{"from":"%s","to":"%s","type":"transfer","amount":10,"reference":"%s"}`, eurResponse["account"].AccountNumber, usdResponse["account"].AccountNumber, pkg.CreateAccountNumber())
+	req = httptest.NewRequest("POST", "/transactions", bytes.NewBuffer([]byte(reqBody)))
+	var tResponse map[string]string
+	w = performRequestAndGetResponse[map[string]string](r, t)(req, &tResponse)
+	require.Equal(t, http.StatusBadRequest, w.Code)
+	require.Equal(t, "can't transfer between EUR and USD accounts", tResponse["error"])
+
+	req = httptest.NewRequest("GET", fmt.Sprintf("/accounts/%s", eurResponse["account"].AccountNumber), nil)
+	var finalResponse map[string]models.Account
+	w = performRequestAndGetResponse[map[string]models.Account](r, t)(req, &finalResponse)
+	require.Equal(t, http.StatusOK, w.Code)
+	require.Equal(t, "50.25", finalResponse["account"].Balance.String())
+}
+
+func TestFXTransfer(t *testing.T) {
+	_, r, _, _, teardown := setup(t)
+	defer teardown()
+
+	req := httptest.NewRequest("POST", "/users", bytes.NewBuffer([]byte(`{"email": "1@gmail.com"}'`)))
+	var uResponse map[string]models.User
+	w := performRequestAndGetResponse[map[string]models.User](r, t)(req, &uResponse)
+	require.Equal(t, http.StatusOK, w.Code)
+
+	req = httptest.NewRequest("POST", "/accounts", bytes.NewBuffer([]byte(fmt.Sprintf(`{"user_id": %d, "currency": "USD"}`, uResponse["user"].ID))))
+	var usdResponse map[string]models.Account
+	w = performRequestAndGetResponse[map[string]models.Account](r, t)(req, &usdResponse)
+	require.Equal(t, http.StatusOK, w.Code)
+
+	req = httptest.NewRequest("POST", "/accounts", bytes.NewBuffer([]byte(fmt.Sprintf(`{"user_id": %d, "currency": "EUR"}`, uResponse["user"].ID))))
+	var eurResponse map[string]models.Account
+	w = performRequestAndGetResponse[map[string]models.Account](r, t)(req, &eurResponse)
+	require.Equal(t, http.StatusOK, w.Code)
+
+	reqBody := fmt.Sprintf(`{"to":"%s","type":"deposit","amount":100,"reference":"%s"}`, usdResponse["account"].AccountNumber, pkg.CreateAccountNumber())
+	req = httptest.NewRequest("POST", "/transactions", bytes.NewBuffer([]byte(reqBody)))
+	var dResponse map[string]string
+	w = performRequestAndGetResponse[map[string]string](r, t)(req, &dResponse)
+	require.Equal(t, http.StatusOK, w.Code)
+
+	// without a rate, the transfer can't be executed
+	fxBody := fmt.Sprintf(`{"from":"%s","to":"%s","type":"fx_transfer","amount":50,"reference":"%s"}`, usdResponse["account"].AccountNumber, eurResponse["account"].AccountNumber, pkg.CreateAccountNumber())
+	req = httptest.NewRequest("POST", "/transactions", bytes.NewBuffer([]byte(fxBody)))
+	var noRateResponse map[string]string
+	w = performRequestAndGetResponse[map[string]string](r, t)(req, &noRateResponse)
+	require.Equal(t, http.StatusUnprocessableEntity, w.Code)
+
+	// 1 USD = 0.90 EUR with a 1% spread
+	req = httptest.NewRequest("POST", "/fx/rates", bytes.NewBuffer([]byte(`{"base":"USD","quote":"EUR","rate":"0.90","spread_bps":100,"effective_at":"2020-01-01T00:00:00Z"}`)))
+	var rateResponse map[string]models.FXRate
+	w = performRequestAndGetResponse[map[string]models.FXRate](r, t)(req, &rateResponse)
+	require.Equal(t, http.StatusOK, w.Code)
+
+	// a rate that's not yet effective is ignored
+	req = httptest.NewRequest("POST", "/fx/rates", bytes.NewBuffer([]byte(`{"base":"USD","quote":"EUR","rate":"2","effective_at":"2999-01-01T00:00:00Z"}`)))
+	w = performRequestAndGetResponse[map[string]models.FXRate](r, t)(req, &rateResponse)
+	require.Equal(t, http.StatusOK, w.Code)
+
+	req = httptest.NewRequest("POST", "/transactions", bytes.NewBuffer([]byte(fxBody)))
+	type fxTransferResponse struct {
+		Status     string              `json:"status"`
+		Conversion models.FXConversion `json:"conversion"`
+	}
+	var fxResponse fxTransferResponse
+	w = performRequestAndGetResponse[fxTransferResponse](r, t)(req, &fxResponse)
+	require.Equal(t, http.StatusOK, w.Code)
+	require.Equal(t, int64(5000), fxResponse.Conversion.SourceAmount)
+	require.Equal(t, int64(4455), fxResponse.Conversion.DestinationAmount)
+	require.Equal(t, int64(45), fxResponse.Conversion.SpreadAmount)
+	require.Equal(t, "0.9", fxResponse.Conversion.Rate.String())
+
+	balances := map[string]string{
+		usdResponse["account"].AccountNumber: "50",
+		eurResponse["account"].AccountNumber: "44.55",
+		"000001840":                          "50",   // usd fx position
+		"000001978":                          "-45",  // eur fx position
+		"000002978":                          "0.45", // eur fx revenue
+	}
+	for accountNumber, balance := range balances {
+		req = httptest.NewRequest("GET", fmt.Sprintf("/accounts/%s", accountNumber), nil)
+		var aResponse map[string]models.Account
+		w = performRequestAndGetResponse[map[string]models.Account](r, t)(req, &aResponse)
+		require.Equal(t, http.StatusOK, w.Code)
+		require.Equal(t, balance, aResponse["account"].Balance.String(), accountNumber)
+	}
+}
+
+func TestHolds(t *testing.T) {
+	_, r, _, _, teardown := setup(t)
+	defer teardown()
+
+	req := httptest.NewRequest("POST", "/users", bytes.NewBuffer([]byte(`{"email": "1@gmail.com"}'`)))
+	var uResponse map[string]models.User
+	w := performRequestAndGetResponse[map[string]models.User](r, t)(req, &uResponse)
+	require.Equal(t, http.StatusOK, w.Code)
+
+	reqBody := fmt.Sprintf(`{"user_id": %d}`, uResponse["user"].ID)
+	req = httptest.NewRequest("POST", "/accounts", bytes.NewBuffer([]byte(reqBody)))
+	var a1Response map[string]models.Account
+	w = performRequestAndGetResponse[map[string]models.Account](r, t)(req, &a1Response)
+	require.Equal(t, http.StatusOK, w.Code)
+	customer := a1Response["account"].AccountNumber
+
+	req = httptest.NewRequest("POST", "/accounts", bytes.NewBuffer([]byte(reqBody)))
+	var a2Response map[string]models.Account
+	w = performRequestAndGetResponse[map[string]models.Account](r, t)(req, &a2Response)
+	require.Equal(t, http.StatusOK, w.Code)
+	merchant := a2Response["account"].AccountNumber
+
+	reqBody = fmt.Sprintf(`{"to":"%s","type":"deposit","amount":100,"reference":"%s"}`, customer, pkg.CreateAccountNumber())
+	req = httptest.NewRequest("POST", "/transactions", bytes.NewBuffer([]byte(reqBody)))
+	var dResponse map[string]string
+	w = performRequestAndGetResponse[map[string]string](r, t)(req, &dResponse)
+	require.Equal(t, http.StatusOK, w.Code)
+
+	getAccount := func(accountNumber string) models.Account {
+		req := httptest.NewRequest("GET", fmt.Sprintf("/accounts/%s", accountNumber), nil)
+		var aResponse map[string]models.Account
+		w := performRequestAndGetResponse[map[string]models.Account](r, t)(req, &aResponse)
+		require.Equal(t, http.StatusOK, w.Code)
+		return aResponse["account"]
+	}
+
+	type holdResponse struct {
+		Hold  models.Hold `json:"hold"`
+		Error string      `json:"error"`
+	}
+	placeHold := func(reference string, amount float64, ttl int) (int, holdResponse) {
+		reqBody := fmt.Sprintf(`{"from":"%s","to":"%s","amount":%v,"reference":"%s","ttl_seconds":%d}`, customer, merchant, amount, reference, ttl)
+		req := httptest.NewRequest("POST", "/holds", bytes.NewBuffer([]byte(reqBody)))
+		var hResponse holdResponse
+		w := performRequestAndGetResponse[holdResponse](r, t)(req, &hResponse)
+		return w.Code, hResponse
+	}
+
+	// hold 60, which reduces the available balance but not the ledger balance
+	code, hResponse := placeHold("hold-1", 60, 0)
+	require.Equal(t, http.StatusOK, code)
+	require.Equal(t, "pending", hResponse.Hold.Status)
+
+	account := getAccount(customer)
+	require.Equal(t, "100", account.Balance.String())
+	require.Equal(t, "40", account.AvailableBalance.String())
+
+	// transfers are checked against the available balance
+	reqBody = fmt.Sprintf(`{"from":"%s","to":"%s","type":"transfer","amount":50,"reference":"%s"}`, customer, merchant, pkg.CreateAccountNumber())
+	req = httptest.NewRequest("POST", "/transactions", bytes.NewBuffer([]byte(reqBody)))
+	var tResponse map[string]string
+	w = performRequestAndGetResponse[map[string]string](r, t)(req, &tResponse)
+	require.Equal(t, http.StatusUnprocessableEntity, w.Code)
+	require.Equal(t, "insufficient balance", tResponse["error"])
+
+	// as are other holds
+	code, _ = placeHold("hold-2", 50, 0)
+	require.Equal(t, http.StatusUnprocessableEntity, code)
+
+	// partially capture the hold, the remainder is released
+	req = httptest.NewRequest("POST", "/holds/hold-1/capture", bytes.NewBuffer([]byte(`{"amount": 45.5}`)))
+	var cResponse map[string]models.Hold
+	w = performRequestAndGetResponse[map[string]models.Hold](r, t)(req, &cResponse)
+	require.Equal(t, http.StatusOK, w.Code)
+	require.Equal(t, "captured", cResponse["hold"].Status)
+	require.Equal(t, int64(4550), cResponse["hold"].CapturedAmount)
+
+	account = getAccount(customer)
+	require.Equal(t, "54.5", account.Balance.String())
+	require.Equal(t, "54.5", account.AvailableBalance.String())
+	require.Equal(t, "45.5", getAccount(merchant).Balance.String())
+
+	// a captured hold can't be captured or voided again
+	req = httptest.NewRequest("POST", "/holds/hold-1/void", nil)
+	var vResponse map[string]string
+	w = performRequestAndGetResponse[map[string]string](r, t)(req, &vResponse)
+	require.Equal(t, http.StatusUnprocessableEntity, w.Code)
+
+	// voiding releases the held funds
+	code, _ = placeHold("hold-3", 50, 0)
+	require.Equal(t, http.StatusOK, code)
+	require.Equal(t, "4.5", getAccount(customer).AvailableBalance.String())
+
+	req = httptest.NewRequest("POST", "/holds/hold-3/void", nil)
+	var v2Response map[string]models.Hold
+	w = performRequestAndGetResponse[map[string]models.Hold](r, t)(req, &v2Response)
+	require.Equal(t, http.StatusOK, w.Code)
+	require.Equal(t, "voided", v2Response["hold"].Status)
+	require.Equal(t, "54.5", getAccount(customer).AvailableBalance.String())
+
+	// expired holds no longer count against the available balance, and can't be captured
+	code, _ = placeHold("hold-4", 50, 1)
+	require.Equal(t, http.StatusOK, code)
+	require.Equal(t, "4.5", getAccount(customer).AvailableBalance.String())
+
+	time.Sleep(1100 * time.Millisecond)
+	require.Equal(t, "54.5", getAccount(customer).AvailableBalance.String())
+
+	req = httptest.NewRequest("POST", "/holds/hold-4/capture", nil)
+	var eResponse map[string]string
+	w = performRequestAndGetResponse[map[string]string](r, t)(req, &eResponse)
+	require.Equal(t, http.StatusUnprocessableEntity, w.Code)
+	require.Equal(t, "hold has expired", eResponse["error"])
+
+	req = httptest.NewRequest("GET", "/holds/hold-4", nil)
+	var gResponse map[string]models.Hold
+	w = performRequestAndGetResponse[map[string]models.Hold](r, t)(req, &gResponse)
+	require.Equal(t, http.StatusOK, w.Code)
+	require.Equal(t, "expired", gResponse["hold"].Status)
+}
+
+func TestReversalsAndRefunds(t *testing.T) {
+	_, r, _, _, teardown := setup(t)
+	defer teardown()
+
+	req := httptest.NewRequest("POST", "/users", bytes.NewBuffer([]byte(`{"email": "1@gmail.com"}'`)))
+	var uResponse map[string]models.User
+	w := performRequestAndGetResponse[map[string]models.User](r, t)(req, &uResponse)
+	require.Equal(t, http.StatusOK, w.Code)
+
+	reqBody := fmt.Sprintf(`{"user_id": %d}`, uResponse["user"].ID)
+	req = httptest.NewRequest("POST", "/accounts", bytes.NewBuffer([]byte(reqBody)))
+	var a1Response map[string]models.Account
+	w = performRequestAndGetResponse[map[string]models.Account](r, t)(req, &a1Response)
+	require.Equal(t, http.StatusOK, w.Code)
+	a1 := a1Response["account"].AccountNumber
+
+	req = httptest.NewRequest("POST", "/accounts", bytes.NewBuffer([]byte(reqBody)))
+	var a2Response map[string]models.Account
+	w = performRequestAndGetResponse[map[string]models.Account](r, t)(req, &a2Response)
+	require.Equal(t, http.StatusOK, w.Code)
+	a2 := a2Response["account"].AccountNumber
+
+	getBalance := func(accountNumber string) decimal.Decimal {
+		req := httptest.NewRequest("GET", fmt.Sprintf("/accounts/%s", accountNumber), nil)
+		var aResponse map[string]models.Account
+		w := performRequestAndGetResponse[map[string]models.Account](r, t)(req, &aResponse)
+		require.Equal(t, http.StatusOK, w.Code)
+		return aResponse["account"].Balance
+	}
+
+	type transactionResponse struct {
+		Transaction models.Transaction `json:"transaction"`
+		Error       string             `json:"error"`
+	}
+	post := func(path, body string) (int, transactionResponse) {
+		req := httptest.NewRequest("POST", path, bytes.NewBuffer([]byte(body)))
+		var response transactionResponse
+		w := performRequestAndGetResponse[transactionResponse](r, t)(req, &response)
+		return w.Code, response
+	}
+
+	code, _ := post("/transactions", fmt.Sprintf(`{"to":"%s","type":"deposit","amount":100,"reference":"deposit-1"}`, a1))
+	require.Equal(t, http.StatusOK, code)
+	code, _ = post("/transactions", fmt.Sprintf(`{"from":"%s","to":"%s","type":"transfer","amount":80,"reference":"transfer-1"}`, a1, a2))
+	require.Equal(t, http.StatusOK, code)
+
+	// refund part of the transfer, twice
+	code, refund := post("/transactions/transfer-1/refund", `{"amount":30,"reference":"refund-1"}`)
+	require.Equal(t, http.StatusOK, code)
+	require.Equal(t, "refund", refund.Transaction.Type)
+	require.Equal(t, int64(3000), *refund.Transaction.Amount)
+
+	code, _ = post("/transactions/transfer-1/refund", `{"amount":20,"reference":"refund-2"}`)
+	require.Equal(t, http.StatusOK, code)
+	require.Equal(t, "70", getBalance(a1).String())
+	require.Equal(t, "30", getBalance(a2).String())
+
+	// can't refund more than what's left of the original
+	code, response := post("/transactions/transfer-1/refund", `{"amount":30.01,"reference":"refund-3"}`)
+	require.Equal(t, http.StatusUnprocessableEntity, code)
+	require.Equal(t, "refund exceeds the refundable amount", response.Error)
+
+	// reversing moves back the remainder
+	code, reversal := post("/transactions/transfer-1/reverse", "")
+	require.Equal(t, http.StatusOK, code)
+	require.Equal(t, "transfer-1-reversal", reversal.Transaction.Reference)
+	require.Equal(t, int64(3000), *reversal.Transaction.Amount)
+	require.Equal(t, "100", getBalance(a1).String())
+	require.Equal(t, "0", getBalance(a2).String())
+
+	code, response = post("/transactions/transfer-1/reverse", `{"reference":"reversal-2"}`)
+	require.Equal(t, http.StatusUnprocessableEntity, code)
+	require.Equal(t, "transaction has already been fully reversed", response.Error)
+
+	code, _ = post("/transactions/refund-1/reverse", "")
+	require.Equal(t, http.StatusUnprocessableEntity, code)
+
+	// the original links to its reversals
+	req = httptest.NewRequest("GET", "/transactions/transfer-1", nil)
+	var detail transactionResponse
+	w = performRequestAndGetResponse[transactionResponse](r, t)(req, &detail)
+	require.Equal(t, http.StatusOK, w.Code)
+	require.Equal(t, "transfer", detail.Transaction.Type)
+	require.Len(t, detail.Transaction.Lines, 2)
+	require.Len(t, detail.Transaction.Reversals, 3)
+	for _, reversal := range detail.Transaction.Reversals {
+		require.Equal(t, detail.Transaction.ID, *reversal.OriginalTransactionID)
+	}
+
+	// reversing a deposit debits the customer and credits the genesis account back
+	code, _ = post("/transactions/deposit-1/reverse", "")
+	require.Equal(t, http.StatusOK, code)
+	require.Equal(t, "0", getBalance(a1).String())
+	require.Equal(t, "0", getBalance("000000000").String())
+
+	code, _ = post("/transactions/unknown/reverse", "")
+	require.Equal(t, http.StatusNotFound, code)
+}
+
+func TestWithdrawal(t *testing.T) {
+	_, r, _, _, teardown := setup(t)
+	defer teardown()
+
+	req := httptest.NewRequest("POST", "/users", bytes.NewBuffer([]byte(`{"email": "1@gmail.com"}'`)))
+	var uResponse map[string]models.User
+	w := performRequestAndGetResponse[map[string]models.User](r, t)(req, &uResponse)
+	require.Equal(t, http.StatusOK, w.Code)
+
+	req = httptest.NewRequest("POST", "/accounts", bytes.NewBuffer([]byte(fmt.Sprintf(`{"user_id": %d, "currency": "GBP"}`, uResponse["user"].ID))))
+	var aResponse map[string]models.Account
+	w = performRequestAndGetResponse[map[string]models.Account](r, t)(req, &aResponse)
+	require.Equal(t, http.StatusOK, w.Code)
+	account := aResponse["account"].AccountNumber
+
+	reqBody := fmt.Sprintf(`{"to":"%s","type":"deposit","amount":100,"reference":"%s"}`, account, pkg.CreateAccountNumber())
+	req = httptest.NewRequest("POST", "/transactions", bytes.NewBuffer([]byte(reqBody)))
+	var dResponse map[string]string
+	w = performRequestAndGetResponse[map[string]string](r, t)(req, &dResponse)
+	require.Equal(t, http.StatusOK, w.Code)
+
+	// withdraw 60, then try to withdraw another 60
+	withdrawal := fmt.Sprintf(`{"from":"%s","type":"withdrawal","amount":60,"reference":"withdrawal-1"}`, account)
+	req = httptest.NewRequest("POST", "/transactions", bytes.NewBuffer([]byte(withdrawal)))
+	var w1Response map[string]string
+	w = performRequestAndGetResponse[map[string]string](r, t)(req, &w1Response)
+	require.Equal(t, http.StatusOK, w.Code)
+
+	reqBody = fmt.Sprintf(`{"from":"%s","type":"withdrawal","amount":60,"reference":"withdrawal-2"}`, account)
+	req = httptest.NewRequest("POST", "/transactions", bytes.NewBuffer([]byte(reqBody)))
+	var w2Response map[string]string
+	w = performRequestAndGetResponse[map[string]string](r, t)(req, &w2Response)
+	require.Equal(t, http.StatusUnprocessableEntity, w.Code)
+	require.Equal(t, "insufficient balance", w2Response["error"])
+
+	// replaying the same reference is rejected
+	req = httptest.NewRequest("POST", "/transactions", bytes.NewBuffer([]byte(withdrawal)))
+	var w3Response map[string]string
+	w = performRequestAndGetResponse[map[string]string](r, t)(req, &w3Response)
+	require.Equal(t, http.StatusConflict, w.Code)
+
+	// withdrawals can't be made from system accounts
+	req = httptest.NewRequest("POST", "/transactions", bytes.NewBuffer([]byte(`{"from":"000000826","type":"withdrawal","amount":1,"reference":"withdrawal-4"}`)))
+	var w4Response map[string]string
+	w = performRequestAndGetResponse[map[string]string](r, t)(req, &w4Response)
+	require.Equal(t, http.StatusBadRequest, w.Code)
+
+	// nor can transfers, large amounts would skip the approval deposits need
+	for _, txType := range []string{"transfer", "fx_transfer"} {
+		reqBody = fmt.Sprintf(`{"from":"000000000","to":"%s","type":"%s","amount":5000000,"reference":"%s"}`, account, txType, pkg.CreateAccountNumber())
+		req = httptest.NewRequest("POST", "/transactions", bytes.NewBuffer([]byte(reqBody)))
+		var tResponse map[string]string
+		w = performRequestAndGetResponse[map[string]string](r, t)(req, &tResponse)
+		require.Equal(t, http.StatusBadRequest, w.Code, txType)
+		require.Equal(t, "action not allowed for this account number", tResponse["error"])
+	}
+
+	// the money left the system through the gbp genesis account
+	balances := map[string]string{
+		account:     "40",
+		"000000826": "-40",
+	}
+	for accountNumber, balance := range balances {
+		req = httptest.NewRequest("GET", fmt.Sprintf("/accounts/%s", accountNumber), nil)
+		var aResponse map[string]models.Account
+		w = performRequestAndGetResponse[map[string]models.Account](r, t)(req, &aResponse)
+		require.Equal(t, http.StatusOK, w.Code)
+		require.Equal(t, balance, aResponse["account"].Balance.String())
+	}
+}
+
+func TestAccountTransactionHistory(t *testing.T) {
+	_, r, _, _, teardown := setup(t)
+	defer teardown()
+
+	req := httptest.NewRequest("POST", "/users", bytes.NewBuffer([]byte(`{"email": "1@gmail.com"}'`)))
+	var uResponse map[string]models.User
+	w := performRequestAndGetResponse[map[string]models.User](r, t)(req, &uResponse)
+	require.Equal(t, http.StatusOK, w.Code)
+
+	reqBody := fmt.Sprintf(`{"user_id": %d}`, uResponse["user"].ID)
+	req = httptest.NewRequest("POST", "/accounts", bytes.NewBuffer([]byte(reqBody)))
+	var a1Response map[string]models.Account
+	w = performRequestAndGetResponse[map[string]models.Account](r, t)(req, &a1Response)
+	require.Equal(t, http.StatusOK, w.Code)
+	a1 := a1Response["account"].AccountNumber
+
+	req = httptest.NewRequest("POST", "/accounts", bytes.NewBuffer([]byte(reqBody)))
+	var a2Response map[string]models.Account
+	w = performRequestAndGetResponse[map[string]models.Account](r, t)(req, &a2Response)
+	require.Equal(t, http.StatusOK, w.Code)
+	a2 := a2Response["account"].AccountNumber
+
+	transactions := []string{
+		fmt.Sprintf(`{"to":"%s","type":"deposit","amount":100,"reference":"t1"}`, a1),
+		fmt.Sprintf(`{"from":"%s","to":"%s","type":"transfer","amount":10,"reference":"t2"}`, a1, a2),
+		fmt.Sprintf(`{"from":"%s","to":"%s","type":"transfer","amount":20,"reference":"t3"}`, a1, a2),
+		fmt.Sprintf(`{"from":"%s","to":"%s","type":"transfer","amount":5,"reference":"t4"}`, a2, a1),
+		fmt.Sprintf(`{"from":"%s","type":"withdrawal","amount":30,"reference":"t5"}`, a1),
+	}
+	for _, body := range transactions {
+		req = httptest.NewRequest("POST", "/transactions", bytes.NewBuffer([]byte(body)))
+		var tResponse map[string]string
+		w = performRequestAndGetResponse[map[string]string](r, t)(req, &tResponse)
+		require.Equal(t, http.StatusOK, w.Code)
+	}
+
+	type historyResponse struct {
+		Transactions []models.StatementLine `json:"transactions"`
+		NextCursor   string                 `json:"next_cursor"`
+	}
+	history := func(query string) historyResponse {
+		req := httptest.NewRequest("GET", fmt.Sprintf("/accounts/%s/transactions?%s", a1, query), nil)
+		var response historyResponse
+		w := performRequestAndGetResponse[historyResponse](r, t)(req, &response)
+		require.Equal(t, http.StatusOK, w.Code)
+		return response
+	}
+
+	// walk through every page, newest first
+	var lines []models.StatementLine
+	page := history("limit=2")
+	for {
+		lines = append(lines, page.Transactions...)
+		if page.NextCursor == "" {
+			break
+		}
+		page = history("limit=2&cursor=" + page.NextCursor)
+	}
+
+	require.Len(t, lines, 5)
+	expected := []struct {
+		reference      string
+		direction      string
+		amount         string
+		counterparty   string
+		runningBalance string
+	}{
+		{"t5", "debit", "30", "000000000", "45"},
+		{"t4", "credit", "5", a2, "75"},
+		{"t3", "debit", "20", a2, "70"},
+		{"t2", "debit", "10", a2, "90"},
+		{"t1", "credit", "100", "000000000", "100"},
+	}
+	for i, e := range expected {
+		require.Equal(t, e.reference, lines[i].Reference)
+		require.Equal(t, e.direction, lines[i].Direction)
+		require.Equal(t, e.amount, lines[i].Amount.String())
+		require.Equal(t, e.counterparty, lines[i].CounterpartyAccountNumber)
+		require.Equal(t, e.runningBalance, lines[i].RunningBalance.String())
+	}
+
+	// filters keep the running balance of the full history
+	page = history("direction=debit&min_amount=15")
+	require.Len(t, page.Transactions, 2)
+	require.Equal(t, "t5", page.Transactions[0].Reference)
+	require.Equal(t, "45", page.Transactions[0].RunningBalance.String())
+	require.Equal(t, "t3", page.Transactions[1].Reference)
+
+	page = history("max_amount=10&direction=credit")
+	require.Len(t, page.Transactions, 1)
+	require.Equal(t, "t4", page.Transactions[0].Reference)
+
+	page = history("from=2000-01-01&to=2001-01-01")
+	require.Len(t, page.Transactions, 0)
+
+	page = history("from=2000-01-01")
+	require.Len(t, page.Transactions, 5)
+
+	req = httptest.NewRequest("GET", fmt.Sprintf("/accounts/%s/transactions?direction=sideways", a1), nil)
+	var badResponse map[string]string
+	w = performRequestAndGetResponse[map[string]string](r, t)(req, &badResponse)
+	require.Equal(t, http.StatusBadRequest, w.Code)
+}
+
+func TestMaterializedBalances(t *testing.T) {
+	ctx, r, db, logger, teardown := setup(t)
+	defer teardown()
+
+	req := httptest.NewRequest("POST", "/users", bytes.NewBuffer([]byte(`{"email": "1@gmail.com"}'`)))
+	var uResponse map[string]models.User
+	w := performRequestAndGetResponse[map[string]models.User](r, t)(req, &uResponse)
+	require.Equal(t, http.StatusOK, w.Code)
+
+	req = httptest.NewRequest("POST", "/accounts", bytes.NewBuffer([]byte(fmt.Sprintf(`{"user_id": %d}`, uResponse["user"].ID))))
+	var aResponse map[string]models.Account
+	w = performRequestAndGetResponse[map[string]models.Account](r, t)(req, &aResponse)
+	require.Equal(t, http.StatusOK, w.Code)
+
+	for i := 0; i < 3; i++ {
+		reqBody := fmt.Sprintf(`{"to":"%s","type":"deposit","amount":10,"reference":"%s"}`, aResponse["account"].AccountNumber, pkg.CreateAccountNumber())
+		req = httptest.NewRequest("POST", "/transactions", bytes.NewBuffer([]byte(reqBody)))
+		var dResponse map[string]string
+		w = performRequestAndGetResponse[map[string]string](r, t)(req, &dResponse)
+		require.Equal(t, http.StatusOK, w.Code)
+	}
+
+	var balance, version int64
+	err := db.Instance().QueryRow("select balance, version from balances where account_id=$1;", aResponse["account"].ID).Scan(&balance, &version)
+	require.NoError(t, err)
+	require.Equal(t, int64(3000), balance)
+	require.Equal(t, int64(3), version)
+
+	tr := repos.NewTransactions(logger, db.Instance())
+	tx, err := tr.GetTx(ctx)
+	require.NoError(t, err)
+	drifts, err := tr.VerifyBalances(ctx, tx)
+	require.NoError(t, err)
+	require.Empty(t, drifts)
+	tx.Rollback()
+
+	// tamper with the materialized balance, the verification picks it up
+	_, err = db.Instance().Exec("update balances set balance = balance + 1 where account_id=$1;", aResponse["account"].ID)
+	require.NoError(t, err)
+
+	tx, err = tr.GetTx(ctx)
+	require.NoError(t, err)
+	drifts, err = tr.VerifyBalances(ctx, tx)
+	require.NoError(t, err)
+	tx.Rollback()
+	require.Len(t, drifts, 1)
+	require.Equal(t, aResponse["account"].AccountNumber, drifts[0].AccountNumber)
+	require.Equal(t, int64(3001), drifts[0].Materialized)
+	require.Equal(t, int64(3000), drifts[0].Computed)
+}
+
+func TestConcurrentTransfers(t *testing.T) {
+	ctx, r, db, logger, teardown := setup(t)
+	defer teardown()
+
+	req := httptest.NewRequest("POST", "/users", bytes.NewBuffer([]byte(`{"email": "1@gmail.com"}'`)))
+	var uResponse map[string]models.User
+	w := performRequestAndGetResponse[map[string]models.User](r, t)(req, &uResponse)
+	require.Equal(t, http.StatusOK, w.Code)
+
+	accounts := make([]models.Account, 2)
+	for i := range accounts {
+		req = httptest.NewRequest("POST", "/accounts", bytes.NewBuffer([]byte(fmt.Sprintf(`{"user_id": %d}`, uResponse["user"].ID))))
+		var aResponse map[string]models.Account
+		w = performRequestAndGetResponse[map[string]models.Account](r, t)(req, &aResponse)
+		require.Equal(t, http.StatusOK, w.Code)
+		accounts[i] = aResponse["account"]
+	}
+	a1, a2 := accounts[0].AccountNumber, accounts[1].AccountNumber
+
+	reqBody := fmt.Sprintf(`{"to":"%s","type":"deposit","amount":100,"reference":"%s"}`, a1, pkg.CreateAccountNumber())
+	req = httptest.NewRequest("POST", "/transactions", bytes.NewBuffer([]byte(reqBody)))
+	var dResponse map[string]string
+	w = performRequestAndGetResponse[map[string]string](r, t)(req, &dResponse)
+	require.Equal(t, http.StatusOK, w.Code)
+
+	// fires all the transfers at once and returns the response codes
+	transferConcurrently := func(transfers [][2]string) []int {
+		codes := make([]int, len(transfers))
+		var wg sync.WaitGroup
+		for i, transfer := range transfers {
+			wg.Add(1)
+			go func(i int, from, to string) {
+				defer wg.Done()
+				reqBody := fmt.Sprintf(`{"from":"%s","to":"%s","type":"transfer","amount":10,"reference":"%s"}`, from, to, pkg.CreateAccountNumber())
+				w := httptest.NewRecorder()
+				r.ServeHTTP(w, httptest.NewRequest("POST", "/transactions", bytes.NewBuffer([]byte(reqBody))))
+				codes[i] = w.Code
+			}(i, transfer[0], transfer[1])
+		}
+		wg.Wait()
+		return codes
+	}
+
+	getBalance := func(accountNumber string) decimal.Decimal {
+		req := httptest.NewRequest("GET", fmt.Sprintf("/accounts/%s", accountNumber), nil)
+		var response map[string]models.Account
+		w := performRequestAndGetResponse[map[string]models.Account](r, t)(req, &response)
+		require.Equal(t, http.StatusOK, w.Code)
+		return response["account"].Balance
+	}
+
+	// 30 transfers of 10 racing for a balance of 100, exactly 10 of them can go through
+	transfers := make([][2]string, 30)
+	for i := range transfers {
+		transfers[i] = [2]string{a1, a2}
+	}
+	succeeded := 0
+	for _, code := range transferConcurrently(transfers) {
+		require.Contains(t, []int{http.StatusOK, http.StatusUnprocessableEntity}, code)
+		if code == http.StatusOK {
+			succeeded++
+		}
+	}
+	require.Equal(t, 10, succeeded)
+	require.Equal(t, "0", getBalance(a1).String())
+	require.Equal(t, "100", getBalance(a2).String())
+
+	// transfers in both directions lock the same accounts, none of them may fail with anything but an insufficient balance
+	transfers = make([][2]string, 40)
+	for i := range transfers {
+		transfers[i] = [2]string{a2, a1}
+		if i%2 == 1 {
+			transfers[i] = [2]string{a1, a2}
+		}
+	}
+	for _, code := range transferConcurrently(transfers) {
+		require.Contains(t, []int{http.StatusOK, http.StatusUnprocessableEntity}, code)
+	}
+	b1, b2 := getBalance(a1), getBalance(a2)
+	require.False(t, b1.IsNegative())
+	require.False(t, b2.IsNegative())
+	require.Equal(t, "100", b1.Add(b2).String())
+
+	tr := repos.NewTransactions(logger, db.Instance())
+	tx, err := tr.GetTx(ctx)
+	require.NoError(t, err)
+	defer tx.Rollback()
+	drifts, err := tr.VerifyBalances(ctx, tx)
+	require.NoError(t, err)
+	require.Empty(t, drifts)
+}
+
+func TestPointInTimeBalances(t *testing.T) {
+	ctx, r, db, logger, teardown := setup(t)
+	defer teardown()
+
+	req := httptest.NewRequest("POST", "/users", bytes.NewBuffer([]byte(`{"email": "1@gmail.com"}'`)))
+	var uResponse map[string]models.User
+	w := performRequestAndGetResponse[map[string]models.User](r, t)(req, &uResponse)
+	require.Equal(t, http.StatusOK, w.Code)
+
+	req = httptest.NewRequest("POST", "/accounts", bytes.NewBuffer([]byte(fmt.Sprintf(`{"user_id": %d}`, uResponse["user"].ID))))
+	var aResponse map[string]models.Account
+	w = performRequestAndGetResponse[map[string]models.Account](r, t)(req, &aResponse)
+	require.Equal(t, http.StatusOK, w.Code)
+	a1 := aResponse["account"].AccountNumber
+
+	// deposit 10 on the 10th of january, 20 on the 20th and 30 today.
+	// lines can't be updated, so the trigger guarding them is lifted while they're backdated.
+	_, err := db.Instance().Exec("drop trigger prevent_transaction_lines_update;")
+	require.NoError(t, err)
+	postedAt := []time.Time{
+		time.Date(2024, 1, 10, 10, 0, 0, 0, time.UTC),
+		time.Date(2024, 1, 20, 10, 0, 0, 0, time.UTC),
+		{},
+	}
+	for i, at := range postedAt {
+		reference := pkg.CreateAccountNumber()
+		reqBody := fmt.Sprintf(`{"to":"%s","type":"deposit","amount":%d,"reference":"%s"}`, a1, (i+1)*10, reference)
+		req = httptest.NewRequest("POST", "/transactions", bytes.NewBuffer([]byte(reqBody)))
+		var dResponse map[string]string
+		w = performRequestAndGetResponse[map[string]string](r, t)(req, &dResponse)
+		require.Equal(t, http.StatusOK, w.Code)
+
+		if !at.IsZero() {
+			_, err := db.Instance().Exec("update transaction_lines set created_at=$1 where transaction_id=(select id from transactions where reference=$2);", at, reference)
+			require.NoError(t, err)
+		}
+	}
+
+	_, err = db.Instance().Exec(`CREATE TRIGGER prevent_transaction_lines_update
+		BEFORE UPDATE ON transaction_lines
+		BEGIN
+			SELECT RAISE(FAIL, 'Updates to transaction_lines are not allowed.');
+		END;`)
+	require.NoError(t, err)
+
+	balanceAsOf := func(asOf string) decimal.Decimal {
+		req := httptest.NewRequest("GET", fmt.Sprintf("/accounts/%s?as_of=%s", a1, asOf), nil)
+		var response struct {
+			Account models.Account `json:"account"`
+			AsOf    time.Time      `json:"as_of"`
+		}
+		w := performRequestAndGetResponse[struct {
+			Account models.Account `json:"account"`
+			AsOf    time.Time      `json:"as_of"`
+		}](r, t)(req, &response)
+		require.Equal(t, http.StatusOK, w.Code)
+		return response.Account.Balance
+	}
+
+	require.Equal(t, "0", balanceAsOf("2024-01-09").String())
+	require.Equal(t, "10", balanceAsOf("2024-01-10").String())
+	require.Equal(t, "0", balanceAsOf("2024-01-10T09:00:00Z").String())
+	require.Equal(t, "30", balanceAsOf("2024-01-31").String())
+
+	req = httptest.NewRequest("GET", fmt.Sprintf("/accounts/%s", a1), nil)
+	w = performRequestAndGetResponse[map[string]models.Account](r, t)(req, &aResponse)
+	require.Equal(t, http.StatusOK, w.Code)
+	require.Equal(t, "60", aResponse["account"].Balance.String())
+
+	type balancesResponse struct {
+		Currency string                  `json:"currency"`
+		Balances []*models.PeriodBalance `json:"balances"`
+	}
+	balances := func(query string) (*httptest.ResponseRecorder, balancesResponse) {
+		req := httptest.NewRequest("GET", fmt.Sprintf("/accounts/%s/balances?%s", a1, query), nil)
+		var response balancesResponse
+		w := performRequestAndGetResponse[balancesResponse](r, t)(req, &response)
+		return w, response
+	}
+
+	w, daily := balances("from=2024-01-09&to=2024-01-21&interval=day")
+	require.Equal(t, http.StatusOK, w.Code)
+	require.Equal(t, "USD", daily.Currency)
+	require.Len(t, daily.Balances, 13)
+	require.Equal(t, "0", daily.Balances[0].Balance.String())
+	require.Equal(t, "10", daily.Balances[1].Balance.String())
+	require.Equal(t, "10", daily.Balances[10].Balance.String())
+	require.Equal(t, "30", daily.Balances[11].Balance.String())
+	require.Equal(t, time.Date(2024, 1, 21, 0, 0, 0, 0, time.UTC), daily.Balances[11].PeriodEnd)
+
+	w, monthly := balances("from=2024-01-09&to=2024-02-01&interval=month")
+	require.Equal(t, http.StatusOK, w.Code)
+	require.Len(t, monthly.Balances, 2)
+	require.Equal(t, time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC), monthly.Balances[0].PeriodStart)
+	require.Equal(t, "30", monthly.Balances[0].Balance.String())
+	require.Equal(t, "30", monthly.Balances[1].Balance.String())
+
+	w, _ = balances("from=2024-01-09&to=2024-01-21&interval=hour")
+	require.Equal(t, http.StatusBadRequest, w.Code)
+	w, _ = balances("from=2020-01-01&to=2024-01-21")
+	require.Equal(t, http.StatusBadRequest, w.Code)
+
+	// snapshots are taken once per account, and point in time balances are computed off them
+	tr := repos.NewTransactions(logger, db.Instance())
+	snapshotAt := time.Date(2024, 1, 15, 0, 0, 0, 0, time.UTC)
+	snapshot := func() int {
+		tx, err := tr.GetTx(ctx)
+		require.NoError(t, err)
+		count, err := tr.CreateSnapshots(ctx, tx, snapshotAt)
+		require.NoError(t, err)
+		require.NoError(t, tx.Commit())
+		return count
+	}
+	require.NotZero(t, snapshot())
+	require.Zero(t, snapshot())
+
+	var snapshotted int64
+	err = db.Instance().QueryRow("select balance from balance_snapshots where account_id=$1 and snapshot_at=$2;", aResponse["account"].ID, snapshotAt).Scan(&snapshotted)
+	require.NoError(t, err)
+	require.Equal(t, int64(1000), snapshotted)
+
+	require.Equal(t, "30", balanceAsOf("2024-01-20").String())
+	_, err = db.Instance().Exec("update balance_snapshots set balance = balance + 100 where account_id=$1;", aResponse["account"].ID)
+	require.NoError(t, err)
+	require.Equal(t, "31", balanceAsOf("2024-01-20").String())
+	require.Equal(t, "11", balanceAsOf("2024-01-14").String())
+	require.Equal(t, "10", balanceAsOf("2024-01-13").String())
+}
+
+func TestDecimalAmounts(t *testing.T) {
+	_, r, _, _, teardown := setup(t)
+	defer teardown()
+
+	req := httptest.NewRequest("POST", "/users", bytes.NewBuffer([]byte(`{"email": "1@gmail.com"}'`)))
+	var uResponse map[string]models.User
+	w := performRequestAndGetResponse[map[string]models.User](r, t)(req, &uResponse)
+	require.Equal(t, http.StatusOK, w.Code)
+
+	accounts := map[string]string{}
+	for _, currency := range []string{"USD", "JPY"} {
+		req = httptest.NewRequest("POST", "/accounts", bytes.NewBuffer([]byte(fmt.Sprintf(`{"user_id": %d, "currency": "%s"}`, uResponse["user"].ID, currency))))
+		var aResponse map[string]models.Account
+		w = performRequestAndGetResponse[map[string]models.Account](r, t)(req, &aResponse)
+		require.Equal(t, http.StatusOK, w.Code)
+		accounts[currency] = aResponse["account"].AccountNumber
+	}
+
+	deposit := func(accountNumber, amount string) (*httptest.ResponseRecorder, map[string]string) {
+		reqBody := fmt.Sprintf(`{"to":"%s","type":"deposit","amount":%s,"reference":"%s"}`, accountNumber, amount, pkg.CreateAccountNumber())
+		req := httptest.NewRequest("POST", "/transactions", bytes.NewBuffer([]byte(reqBody)))
+		var response map[string]string
+		w := performRequestAndGetResponse[map[string]string](r, t)(req, &response)
+		return w, response
+	}
+
+	// amounts are accepted as json numbers or decimal strings, without float rounding
+	w, _ = deposit(accounts["USD"], "0.29")
+	require.Equal(t, http.StatusOK, w.Code)
+	w, _ = deposit(accounts["USD"], `"0.58"`)
+	require.Equal(t, http.StatusOK, w.Code)
+	w, _ = deposit(accounts["JPY"], `"1500"`)
+	require.Equal(t, http.StatusOK, w.Code)
+
+	for _, tc := range []struct{ account, amount string }{
+		{accounts["USD"], "0.001"},
+		{accounts["USD"], `"-5"`},
+		{accounts["USD"], "0"},
+		{accounts["JPY"], `"10.5"`},
+	} {
+		w, response := deposit(tc.account, tc.amount)
+		require.Equal(t, http.StatusBadRequest, w.Code, tc.amount)
+		require.NotEmpty(t, response["error"])
+	}
+
+	expected := map[string]string{
+		accounts["USD"]: "0.87",
+		accounts["JPY"]: "1500",
+	}
+	for accountNumber, balance := range expected {
+		req = httptest.NewRequest("GET", fmt.Sprintf("/accounts/%s", accountNumber), nil)
+		var aResponse map[string]models.Account
+		w = performRequestAndGetResponse[map[string]models.Account](r, t)(req, &aResponse)
+		require.Equal(t, http.StatusOK, w.Code)
+		require.Equal(t, balance, aResponse["account"].Balance.String())
+	}
+}
+
+func TestJournalEntries(t *testing.T) {
+	_, r, _, _, teardown := setup(t)
+	defer teardown()
+
+	req := httptest.NewRequest("POST", "/users", bytes.NewBuffer([]byte(`{"email": "1@gmail.com"}'`)))
+	var uResponse map[string]models.User
+	w := performRequestAndGetResponse[map[string]models.User](r, t)(req, &uResponse)
+	require.Equal(t, http.StatusOK, w.Code)
+
+	createAccount := func(currency string) string {
+		req := httptest.NewRequest("POST", "/accounts", bytes.NewBuffer([]byte(fmt.Sprintf(`{"user_id": %d, "currency": "%s"}`, uResponse["user"].ID, currency))))
+		var aResponse map[string]models.Account
+		w := performRequestAndGetResponse[map[string]models.Account](r, t)(req, &aResponse)
+		require.Equal(t, http.StatusOK, w.Code)
+		return aResponse["account"].AccountNumber
+	}
+	customer, merchant, fees, tax := createAccount("USD"), createAccount("USD"), createAccount("USD"), createAccount("USD")
+	eur1, eur2 := createAccount("EUR"), createAccount("EUR")
+
+	for account, amount := range map[string]int{customer: 100, eur1: 50} {
+		reqBody := fmt.Sprintf(`{"to":"%s","type":"deposit","amount":%d,"reference":"%s"}`, account, amount, pkg.CreateAccountNumber())
+		req = httptest.NewRequest("POST", "/transactions", bytes.NewBuffer([]byte(reqBody)))
+		var dResponse map[string]string
+		w = performRequestAndGetResponse[map[string]string](r, t)(req, &dResponse)
+		require.Equal(t, http.StatusOK, w.Code)
+	}
+
+	type journalResponse struct {
+		Transaction models.Transaction `json:"transaction"`
+		Error       string             `json:"error"`
+	}
+	post := func(reference string, legs ...string) (int, journalResponse) {
+		reqBody := fmt.Sprintf(`{"reference":"%s","legs":[%s]}`, reference, strings.Join(legs, ","))
+		req := httptest.NewRequest("POST", "/journal-entries", bytes.NewBuffer([]byte(reqBody)))
+		var response journalResponse
+		w := performRequestAndGetResponse[journalResponse](r, t)(req, &response)
+		return w.Code, response
+	}
+	leg := func(account, direction, amount string) string {
+		return fmt.Sprintf(`{"account":"%s","direction":"%s","amount":"%s"}`, account, direction, amount)
+	}
+	getBalance := func(accountNumber string) string {
+		req := httptest.NewRequest("GET", fmt.Sprintf("/accounts/%s", accountNumber), nil)
+		var response map[string]models.Account
+		w := performRequestAndGetResponse[map[string]models.Account](r, t)(req, &response)
+		require.Equal(t, http.StatusOK, w.Code)
+		return response["account"].Balance.String()
+	}
+
+	// a payment split between the merchant, fees and tax
+	code, response := post("payment-1",
+		leg(customer, "debit", "60"),
+		leg(merchant, "credit", "51"),
+		leg(fees, "credit", "6.5"),
+		leg(tax, "credit", "2.5"),
+	)
+	require.Equal(t, http.StatusOK, code, response.Error)
+	require.Equal(t, "journal", response.Transaction.Type)
+	require.Len(t, response.Transaction.Lines, 4)
+	require.Equal(t, "40", getBalance(customer))
+	require.Equal(t, "51", getBalance(merchant))
+	require.Equal(t, "6.5", getBalance(fees))
+	require.Equal(t, "2.5", getBalance(tax))
+
+	// the same account can appear in several legs, and each currency balances on its own
+	code, response = post("payment-2",
+		leg(merchant, "debit", "10"),
+		leg(merchant, "debit", "5"),
+		leg(customer, "credit", "15"),
+		leg(eur1, "debit", "20"),
+		leg(eur2, "credit", "20"),
+	)
+	require.Equal(t, http.StatusOK, code, response.Error)
+	require.Len(t, response.Transaction.Lines, 5)
+	require.Equal(t, "36", getBalance(merchant))
+	require.Equal(t, "55", getBalance(customer))
+	require.Equal(t, "20", getBalance(eur2))
+
+	req = httptest.NewRequest("GET", "/transactions/payment-2", nil)
+	var tResponse map[string]models.Transaction
+	w = performRequestAndGetResponse[map[string]models.Transaction](r, t)(req, &tResponse)
+	require.Equal(t, http.StatusOK, w.Code)
+	require.Len(t, tResponse["transaction"].Lines, 5)
+
+	code, response = post("unbalanced", leg(customer, "debit", "10"), leg(merchant, "credit", "9"))
+	require.Equal(t, http.StatusUnprocessableEntity, code)
+	require.Contains(t, response.Error, "USD")
+
+	code, _ = post("cross-currency", leg(customer, "debit", "10"), leg(eur2, "credit", "10"))
+	require.Equal(t, http.StatusUnprocessableEntity, code)
+
+	code, response = post("overdraft", leg(tax, "debit", "10"), leg(merchant, "credit", "10"))
+	require.Equal(t, http.StatusUnprocessableEntity, code)
+	require.Contains(t, response.Error, "insufficient balance")
+
+	code, _ = post("unknown", leg(customer, "debit", "10"), leg("123456789", "credit", "10"))
+	require.Equal(t, http.StatusUnprocessableEntity, code)
+
+	code, _ = post("single-leg", leg(customer, "debit", "10"))
+	require.Equal(t, http.StatusBadRequest, code)
+
+	// money can't be minted out of system accounts, that's what (approved) deposits are for
+	code, response = post("minted", leg("000000000", "debit", "5000000"), leg(customer, "credit", "5000000"))
+	require.Equal(t, http.StatusBadRequest, code)
+	require.Equal(t, "leg 0: system accounts can't be debited", response.Error)
+	code, _ = post("minted-fees", leg("000003840", "debit", "1"), leg(customer, "credit", "1"))
+	require.Equal(t, http.StatusBadRequest, code)
+
+	code, _ = post("payment-1", leg(customer, "debit", "1"), leg(merchant, "credit", "1"))
+	require.Equal(t, http.StatusConflict, code)
+	require.Equal(t, "55", getBalance(customer))
+}
+
+func TestTransactionFees(t *testing.T) {
+	_, r, _, _, teardown := setup(t)
+	defer teardown()
+
+	for _, rule := range []string{
+		`{"transaction_type":"transfer","currency":"USD","flat_fee":"0.50"}`,
+		`{"transaction_type":"transfer","currency":"USD","min_amount":"100","percentage_bps":100,"min_fee":"0.75","max_fee":"5"}`,
+		`{"transaction_type":"deposit","currency":"USD","flat_fee":"1"}`,
+	} {
+		req := httptest.NewRequest("POST", "/fee-rules", bytes.NewBuffer([]byte(rule)))
+		var fResponse map[string]models.FeeRule
+		w := performRequestAndGetResponse[map[string]models.FeeRule](r, t)(req, &fResponse)
+		require.Equal(t, http.StatusOK, w.Code)
+		require.Equal(t, "standard", fResponse["fee_rule"].AccountTier)
+	}
+
+	req := httptest.NewRequest("GET", "/fee-rules", nil)
+	var rulesResponse map[string][]models.FeeRule
+	w := performRequestAndGetResponse[map[string][]models.FeeRule](r, t)(req, &rulesResponse)
+	require.Equal(t, http.StatusOK, w.Code)
+	require.Len(t, rulesResponse["fee_rules"], 3)
+
+	req = httptest.NewRequest("POST", "/fee-rules", bytes.NewBuffer([]byte(`{"transaction_type":"transfer","currency":"USD","flat_fee":"-1"}`)))
+	var badResponse map[string]string
+	w = performRequestAndGetResponse[map[string]string](r, t)(req, &badResponse)
+	require.Equal(t, http.StatusBadRequest, w.Code)
+
+	req = httptest.NewRequest("POST", "/users", bytes.NewBuffer([]byte(`{"email": "1@gmail.com"}'`)))
+	var uResponse map[string]models.User
+	w = performRequestAndGetResponse[map[string]models.User](r, t)(req, &uResponse)
+	require.Equal(t, http.StatusOK, w.Code)
+
+	createAccount := func(tier string) string {
+		req := httptest.NewRequest("POST", "/accounts", bytes.NewBuffer([]byte(fmt.Sprintf(`{"user_id": %d, "tier": "%s"}`, uResponse["user"].ID, tier))))
+		var aResponse map[string]models.Account
+		w := performRequestAndGetResponse[map[string]models.Account](r, t)(req, &aResponse)
+		require.Equal(t, http.StatusOK, w.Code)
+		return aResponse["account"].AccountNumber
+	}
+	a1, a2, premium := createAccount(""), createAccount(""), createAccount("premium")
+
+	type transactionResponse struct {
+		Status string      `json:"status"`
+		Fee    *models.Fee `json:"fee"`
+		Error  string      `json:"error"`
+	}
+	transact := func(txType, from, to, amount string) (int, transactionResponse) {
+		reqBody := fmt.Sprintf(`{"from":"%s","to":"%s","type":"%s","amount":"%s","reference":"%s"}`, from, to, txType, amount, pkg.CreateAccountNumber())
+		req := httptest.NewRequest("POST", "/transactions", bytes.NewBuffer([]byte(reqBody)))
+		var response transactionResponse
+		w := performRequestAndGetResponse[transactionResponse](r, t)(req, &response)
+		return w.Code, response
+	}
+	getBalance := func(accountNumber string) string {
+		req := httptest.NewRequest("GET", fmt.Sprintf("/accounts/%s", accountNumber), nil)
+		var response map[string]models.Account
+		w := performRequestAndGetResponse[map[string]models.Account](r, t)(req, &response)
+		require.Equal(t, http.StatusOK, w.Code)
+		return response["account"].Balance.String()
+	}
+
+	// deposits are charged to the destination
+	code, response := transact("deposit", "", a1, "201")
+	require.Equal(t, http.StatusOK, code)
+	require.Equal(t, int64(100), response.Fee.Amount)
+	require.Equal(t, "200", getBalance(a1))
+
+	// the flat band
+	code, response = transact("transfer", a1, a2, "50")
+	require.Equal(t, http.StatusOK, code)
+	require.Equal(t, int64(50), response.Fee.Amount)
+	require.Equal(t, a1, response.Fee.AccountNumber)
+	require.Equal(t, "149.5", getBalance(a1))
+	require.Equal(t, "50", getBalance(a2))
+
+	// the percentage band, from 100 up
+	code, response = transact("transfer", a1, a2, "100")
+	require.Equal(t, http.StatusOK, code)
+	require.Equal(t, int64(100), response.Fee.Amount)
+	require.Equal(t, "48.5", getBalance(a1))
+
+	// the fee is part of the balance check
+	code, response = transact("transfer", a1, a2, "48.5")
+	require.Equal(t, http.StatusUnprocessableEntity, code)
+	require.Equal(t, "insufficient balance", response.Error)
+	code, _ = transact("transfer", a1, a2, "48")
+	require.Equal(t, http.StatusOK, code)
+	require.Equal(t, "0", getBalance(a1))
+
+	// the fee revenue account collected every fee
+	require.Equal(t, "3", getBalance("000003840"))
+
+	// tiers without a schedule aren't charged
+	code, _ = transact("transfer", a2, premium, "10")
+	require.Equal(t, http.StatusOK, code)
+	code, response = transact("transfer", premium, a2, "10")
+	require.Equal(t, http.StatusOK, code)
+	require.Nil(t, response.Fee)
+	require.Equal(t, "0", getBalance(premium))
+}
+
+func TestInterest(t *testing.T) {
+	ctx, r, db, logger, teardown := setup(t)
+	defer teardown()
+
+	req := httptest.NewRequest("POST", "/users", bytes.NewBuffer([]byte(`{"email": "1@gmail.com"}'`)))
+	var uResponse map[string]models.User
+	w := performRequestAndGetResponse[map[string]models.User](r, t)(req, &uResponse)
+	require.Equal(t, http.StatusOK, w.Code)
+
+	createAccount := func() string {
+		req := httptest.NewRequest("POST", "/accounts", bytes.NewBuffer([]byte(fmt.Sprintf(`{"user_id": %d}`, uResponse["user"].ID))))
+		var aResponse map[string]models.Account
+		w := performRequestAndGetResponse[map[string]models.Account](r, t)(req, &aResponse)
+		require.Equal(t, http.StatusOK, w.Code)
+		return aResponse["account"].AccountNumber
+	}
+	act365, thirty360 := createAccount(), createAccount()
+
+	// both accounts get 1000 on the 1st of january, backdated like in TestPointInTimeBalances.
+	_, err := db.Instance().Exec("drop trigger prevent_transaction_lines_update;")
+	require.NoError(t, err)
+	for _, accountNumber := range []string{act365, thirty360} {
+		reference := pkg.CreateAccountNumber()
+		reqBody := fmt.Sprintf(`{"to":"%s","type":"deposit","amount":1000,"reference":"%s"}`, accountNumber, reference)
+		req = httptest.NewRequest("POST", "/transactions", bytes.NewBuffer([]byte(reqBody)))
+		var dResponse map[string]string
+		w = performRequestAndGetResponse[map[string]string](r, t)(req, &dResponse)
+		require.Equal(t, http.StatusOK, w.Code)
+
+		_, err := db.Instance().Exec("update transaction_lines set created_at=$1 where transaction_id=(select id from transactions where reference=$2);", time.Date(2024, 1, 1, 10, 0, 0, 0, time.UTC), reference)
+		require.NoError(t, err)
+	}
+	_, err = db.Instance().Exec(`CREATE TRIGGER prevent_transaction_lines_update
+		BEFORE UPDATE ON transaction_lines
+		BEGIN
+			SELECT RAISE(FAIL, 'Updates to transaction_lines are not allowed.');
+		END;`)
+	require.NoError(t, err)
+
+	type interestResponse struct {
+		Interest models.InterestConfig `json:"interest"`
+		Accrued  decimal.Decimal       `json:"accrued"`
+		Error    string                `json:"error"`
+	}
+	interest := func(method, accountNumber, body string) (int, interestResponse) {
+		req := httptest.NewRequest(method, fmt.Sprintf("/accounts/%s/interest", accountNumber), bytes.NewBuffer([]byte(body)))
+		var response interestResponse
+		w := performRequestAndGetResponse[interestResponse](r, t)(req, &response)
+		return w.Code, response
+	}
+
+	code, _ := interest("GET", act365, "")
+	require.Equal(t, http.StatusNotFound, code)
+	code, _ = interest("PUT", act365, `{"apr":"3.65","day_count":"ACT/360"}`)
+	require.Equal(t, http.StatusBadRequest, code)
+	code, _ = interest("PUT", "000004840", `{"apr":"3.65"}`)
+	require.Equal(t, http.StatusBadRequest, code)
+
+	code, response := interest("PUT", act365, `{"apr":"3.65","effective_from":"2024-01-01"}`)
+	require.Equal(t, http.StatusOK, code)
+	require.Equal(t, pkg.ACT365, response.Interest.DayCount)
+	code, _ = interest("PUT", thirty360, `{"apr":3.6,"day_count":"30/360","effective_from":"2024-01-01"}`)
+	require.Equal(t, http.StatusOK, code)
+
+	ar := repos.NewAccount(logger, db.Instance())
+	tr := repos.NewTransactions(logger, db.Instance())
+	ir := repos.NewInterest(logger, db.Instance())
+	wr := repos.NewWebhooks(logger, db.Instance())
+
+	// days that haven't ended can't be accrued
+	_, err = services.AccrueInterest(ctx, logger, tr, ir, time.Now())
+	require.Error(t, err)
+
+	// accruing is idempotent per day
+	n, err := services.AccrueInterest(ctx, logger, tr, ir, time.Date(2024, 1, 31, 0, 0, 0, 0, time.UTC))
+	require.NoError(t, err)
+	require.Equal(t, 62, n)
+	n, err = services.AccrueInterest(ctx, logger, tr, ir, time.Date(2024, 1, 31, 0, 0, 0, 0, time.UTC))
+	require.NoError(t, err)
+	require.Zero(t, n)
+
+	// 1000 at 3.65% accrues 10 cents a day on ACT/365, and the 31st accrues nothing on 30/360
+	code, response = interest("GET", act365, "")
+	require.Equal(t, http.StatusOK, code)
+	require.Equal(t, "3.1", response.Accrued.String())
+	code, response = interest("GET", thirty360, "")
+	require.Equal(t, http.StatusOK, code)
+	require.Equal(t, "3", response.Accrued.String())
+
+	// january is capitalized once
+	february := time.Date(2024, 2, 1, 0, 0, 0, 0, time.UTC)
+	n, err = services.CapitalizeInterest(ctx, logger, ar, tr, ir, wr, february)
+	require.NoError(t, err)
+	require.Equal(t, 2, n)
+	n, err = services.CapitalizeInterest(ctx, logger, ar, tr, ir, wr, february)
+	require.NoError(t, err)
+	require.Zero(t, n)
+
+	getBalance := func(accountNumber string) string {
+		req := httptest.NewRequest("GET", fmt.Sprintf("/accounts/%s", accountNumber), nil)
+		var response map[string]models.Account
+		w := performRequestAndGetResponse[map[string]models.Account](r, t)(req, &response)
+		require.Equal(t, http.StatusOK, w.Code)
+		return response["account"].Balance.String()
+	}
+	require.Equal(t, "1003.1", getBalance(act365))
+	require.Equal(t, "1003", getBalance(thirty360))
+	require.Equal(t, "-6.1", getBalance("000004840"))
+
+	code, response = interest("GET", act365, "")
+	require.Equal(t, http.StatusOK, code)
+	require.Equal(t, "0", response.Accrued.String())
+
+	var interestTransactions int
+	err = db.Instance().QueryRow("select count(*) from transactions where type=$1;", services.Interest).Scan(&interestTransactions)
+	require.NoError(t, err)
+	require.Equal(t, 2, interestTransactions)
+}
+
+func TestInterestOnClosedAndFrozenAccounts(t *testing.T) {
+	ctx, r, db, logger, teardown := setup(t)
+	defer teardown()
+
+	req := httptest.NewRequest("POST", "/users", bytes.NewBuffer([]byte(`{"email": "1@gmail.com"}'`)))
+	var uResponse map[string]models.User
+	w := performRequestAndGetResponse[map[string]models.User](r, t)(req, &uResponse)
+	require.Equal(t, http.StatusOK, w.Code)
+
+	createAccount := func() string {
+		req := httptest.NewRequest("POST", "/accounts", bytes.NewBuffer([]byte(fmt.Sprintf(`{"user_id": %d}`, uResponse["user"].ID))))
+		var aResponse map[string]models.Account
+		w := performRequestAndGetResponse[map[string]models.Account](r, t)(req, &aResponse)
+		require.Equal(t, http.StatusOK, w.Code)
+		return aResponse["account"].AccountNumber
+	}
+	closing, frozen, savings := createAccount(), createAccount(), createAccount()
+
+	// both interest earning accounts get 1000 on the 1st of january, backdated like in TestInterest.
+	_, err := db.Instance().Exec("drop trigger prevent_transaction_lines_update;")
+	require.NoError(t, err)
+	for _, accountNumber := range []string{closing, frozen} {
+		reference := pkg.CreateAccountNumber()
+		reqBody := fmt.Sprintf(`{"to":"%s","type":"deposit","amount":1000,"reference":"%s"}`, accountNumber, reference)
+		req = httptest.NewRequest("POST", "/transactions", bytes.NewBuffer([]byte(reqBody)))
+		var dResponse map[string]string
+		w = performRequestAndGetResponse[map[string]string](r, t)(req, &dResponse)
+		require.Equal(t, http.StatusOK, w.Code)
+
+		_, err := db.Instance().Exec("update transaction_lines set created_at=$1 where transaction_id=(select id from transactions where reference=$2);", time.Date(2024, 1, 1, 10, 0, 0, 0, time.UTC), reference)
+		require.NoError(t, err)
+	}
+	_, err = db.Instance().Exec(`CREATE TRIGGER prevent_transaction_lines_update
+		BEFORE UPDATE ON transaction_lines
+		BEGIN
+			SELECT RAISE(FAIL, 'Updates to transaction_lines are not allowed.');
+		END;`)
+	require.NoError(t, err)
+
+	do := func(method, path, body string) (int, map[string]json.RawMessage) {
+		req := httptest.NewRequest(method, path, bytes.NewBuffer([]byte(body)))
+		var response map[string]json.RawMessage
+		w := performRequestAndGetResponse[map[string]json.RawMessage](r, t)(req, &response)
+		return w.Code, response
+	}
+	getBalance := func(accountNumber string) decimal.Decimal {
+		code, response := do("GET", fmt.Sprintf("/accounts/%s", accountNumber), "")
+		require.Equal(t, http.StatusOK, code)
+		var account models.Account
+		require.NoError(t, json.Unmarshal(response["account"], &account))
+		return account.Balance
+	}
+	getAccrued := func(accountNumber string) string {
+		code, response := do("GET", fmt.Sprintf("/accounts/%s/interest", accountNumber), "")
+		require.Equal(t, http.StatusOK, code)
+		var accrued decimal.Decimal
+		require.NoError(t, json.Unmarshal(response["accrued"], &accrued))
+		return accrued.String()
+	}
+
+	for _, accountNumber := range []string{closing, frozen} {
+		code, _ := do("PUT", fmt.Sprintf("/accounts/%s/interest", accountNumber), `{"apr":"3.65","effective_from":"2024-01-01"}`)
+		require.Equal(t, http.StatusOK, code)
+	}
+
+	ar := repos.NewAccount(logger, db.Instance())
+	tr := repos.NewTransactions(logger, db.Instance())
+	ir := repos.NewInterest(logger, db.Instance())
+	wr := repos.NewWebhooks(logger, db.Instance())
+
+	n, err := services.AccrueInterest(ctx, logger, tr, ir, time.Date(2024, 1, 31, 0, 0, 0, 0, time.UTC))
+	require.NoError(t, err)
+	require.Equal(t, 62, n)
+	require.Equal(t, "3.1", getAccrued(closing))
+
+	// closing the account accrues the days that have ended since, and capitalizes all of it before the sweep.
+	code, response := do("POST", fmt.Sprintf("/accounts/%s/close", closing), fmt.Sprintf(`{"reason":"moving","sweep_to":"%s"}`, savings))
+	require.Equal(t, http.StatusOK, code)
+	var interest, sweep models.Transaction
+	require.NoError(t, json.Unmarshal(response["interest"], &interest))
+	require.NoError(t, json.Unmarshal(response["sweep"], &sweep))
+	require.Equal(t, services.Interest, interest.Type)
+	require.Greater(t, *interest.Amount, int64(310))
+	require.Equal(t, int64(100000)+*interest.Amount, *sweep.Amount)
+	require.Equal(t, "0", getBalance(closing).String())
+	require.Equal(t, decimal.New(*sweep.Amount, -2).String(), getBalance(savings).String())
+	require.Equal(t, "0", getAccrued(closing))
+
+	// frozen accounts can't be credited, their interest stays pending until they're unfrozen.
+	code, _ = do("PUT", fmt.Sprintf("/accounts/%s/status", frozen), `{"status":"frozen","reason":"fraud"}`)
+	require.Equal(t, http.StatusOK, code)
+
+	february := time.Date(2024, 2, 1, 0, 0, 0, 0, time.UTC)
+	n, err = services.CapitalizeInterest(ctx, logger, ar, tr, ir, wr, february)
+	require.NoError(t, err)
+	require.Zero(t, n)
+	require.Equal(t, "1000", getBalance(frozen).String())
+	require.Equal(t, "3.1", getAccrued(frozen))
+
+	code, _ = do("PUT", fmt.Sprintf("/accounts/%s/status", frozen), `{"status":"active","reason":"cleared"}`)
+	require.Equal(t, http.StatusOK, code)
+
+	n, err = services.CapitalizeInterest(ctx, logger, ar, tr, ir, wr, february)
+	require.NoError(t, err)
+	require.Equal(t, 1, n)
+	require.Equal(t, "1003.1", getBalance(frozen).String())
+
+	// the closed account isn't accrued or credited anymore.
+	_, err = services.AccrueInterest(ctx, logger, tr, ir, time.Now().UTC().AddDate(0, 0, -1))
+	require.NoError(t, err)
+	n, err = services.CapitalizeInterest(ctx, logger, ar, tr, ir, wr, time.Now().UTC().AddDate(1, 0, 0))
+	require.NoError(t, err)
+	require.Equal(t, 1, n)
+	require.Equal(t, "0", getBalance(closing).String())
+	require.Equal(t, "0", getAccrued(closing))
+}
+
+func TestOverdraftLimits(t *testing.T) {
+	_, r, _, _, teardown := setup(t)
+	defer teardown()
+
+	req := httptest.NewRequest("POST", "/users", bytes.NewBuffer([]byte(`{"email": "1@gmail.com"}'`)))
+	var uResponse map[string]models.User
+	w := performRequestAndGetResponse[map[string]models.User](r, t)(req, &uResponse)
+	require.Equal(t, http.StatusOK, w.Code)
+
+	createAccount := func(accountType string) string {
+		req := httptest.NewRequest("POST", "/accounts", bytes.NewBuffer([]byte(fmt.Sprintf(`{"user_id": %d, "type": "%s"}`, uResponse["user"].ID, accountType))))
+		var aResponse map[string]models.Account
+		w := performRequestAndGetResponse[map[string]models.Account](r, t)(req, &aResponse)
+		require.Equal(t, http.StatusOK, w.Code)
+		return aResponse["account"].AccountNumber
+	}
+	a1, a2, creditLine := createAccount(""), createAccount(""), createAccount("credit_line")
+
+	req = httptest.NewRequest("POST", "/accounts", bytes.NewBuffer([]byte(fmt.Sprintf(`{"user_id": %d, "type": "loan"}`, uResponse["user"].ID))))
+	var badResponse map[string]string
+	w = performRequestAndGetResponse[map[string]string](r, t)(req, &badResponse)
+	require.Equal(t, http.StatusBadRequest, w.Code)
+
+	transact := func(txType, from, to, amount string) int {
+		reqBody := fmt.Sprintf(`{"from":"%s","to":"%s","type":"%s","amount":"%s","reference":"%s"}`, from, to, txType, amount, pkg.CreateAccountNumber())
+		req := httptest.NewRequest("POST", "/transactions", bytes.NewBuffer([]byte(reqBody)))
+		var response map[string]string
+		w := performRequestAndGetResponse[map[string]string](r, t)(req, &response)
+		return w.Code
+	}
+	getAccount := func(accountNumber string) models.Account {
+		req := httptest.NewRequest("GET", fmt.Sprintf("/accounts/%s", accountNumber), nil)
+		var response map[string]models.Account
+		w := performRequestAndGetResponse[map[string]models.Account](r, t)(req, &response)
+		require.Equal(t, http.StatusOK, w.Code)
+		return response["account"]
+	}
+	setLimit := func(accountNumber, body string) (int, *models.LimitChange) {
+		req := httptest.NewRequest("PUT", fmt.Sprintf("/accounts/%s/overdraft-limit", accountNumber), bytes.NewBuffer([]byte(body)))
+		type limitResponse struct {
+			LimitChange *models.LimitChange `json:"limit_change"`
+			Error       string              `json:"error"`
+		}
+		var response limitResponse
+		w := performRequestAndGetResponse[limitResponse](r, t)(req, &response)
+		return w.Code, response.LimitChange
+	}
+
+	require.Equal(t, http.StatusOK, transact("deposit", "", a1, "100"))
+	require.Equal(t, http.StatusUnprocessableEntity, transact("transfer", a1, a2, "150"))
+
+	code, _ := setLimit(a1, `{"limit":"100"}`)
+	require.Equal(t, http.StatusBadRequest, code)
+	code, _ = setLimit(a1, `{"limit":"-1","reason":"approved"}`)
+	require.Equal(t, http.StatusBadRequest, code)
+	code, _ = setLimit("000000840", `{"limit":"100","reason":"approved"}`)
+	require.Equal(t, http.StatusBadRequest, code)
+
+	code, change := setLimit(a1, `{"limit":"100","reason":"approved"}`)
+	require.Equal(t, http.StatusOK, code)
+	require.Equal(t, int64(0), change.PreviousLimit)
+	require.Equal(t, int64(10000), change.NewLimit)
+
+	account := getAccount(a1)
+	require.Equal(t, "deposit", account.Type)
+	require.Equal(t, "100", account.OverdraftLimit.String())
+	require.Equal(t, "100", account.Balance.String())
+	require.Equal(t, "200", account.AvailableBalance.String())
+
+	// the account can go overdrawn, up to its limit
+	require.Equal(t, http.StatusOK, transact("transfer", a1, a2, "150"))
+	require.Equal(t, http.StatusUnprocessableEntity, transact("transfer", a1, a2, "60"))
+	account = getAccount(a1)
+	require.Equal(t, "-50", account.Balance.String())
+	require.Equal(t, "50", account.AvailableBalance.String())
+
+	// lowering the limit below what's overdrawn blocks further debits
+	code, change = setLimit(a1, `{"limit":"20","reason":"risk review","changed_by":"risk@accounts.com"}`)
+	require.Equal(t, http.StatusOK, code)
+	require.Equal(t, int64(10000), change.PreviousLimit)
+	require.Equal(t, "-30", getAccount(a1).AvailableBalance.String())
+	require.Equal(t, http.StatusUnprocessableEntity, transact("transfer", a1, a2, "1"))
+	require.Equal(t, http.StatusOK, transact("transfer", a2, a1, "50"))
+	require.Equal(t, http.StatusOK, transact("transfer", a1, a2, "1"))
+
+	req = httptest.NewRequest("GET", fmt.Sprintf("/accounts/%s/overdraft-limit/changes", a1), nil)
+	var changesResponse map[string][]models.LimitChange
+	w = performRequestAndGetResponse[map[string][]models.LimitChange](r, t)(req, &changesResponse)
+	require.Equal(t, http.StatusOK, w.Code)
+	require.Len(t, changesResponse["limit_changes"], 2)
+	require.Equal(t, "risk review", changesResponse["limit_changes"][0].Reason)
+	// the change is made by whoever's authenticated, what the request says doesn't count
+	require.Empty(t, changesResponse["limit_changes"][0].ChangedBy)
+	require.Equal(t, int64(2000), changesResponse["limit_changes"][0].NewLimit)
+
+	// credit lines are drawn down to their credit limit
+	require.Equal(t, http.StatusUnprocessableEntity, transact("transfer", creditLine, a2, "1"))
+	code, _ = setLimit(creditLine, `{"limit":"500","reason":"credit approved"}`)
+	require.Equal(t, http.StatusOK, code)
+	require.Equal(t, http.StatusOK, transact("transfer", creditLine, a2, "200"))
+	require.Equal(t, http.StatusUnprocessableEntity, transact("withdrawal", creditLine, "", "301"))
+	account = getAccount(creditLine)
+	require.Equal(t, "credit_line", account.Type)
+	require.Equal(t, "-200", account.Balance.String())
+	require.Equal(t, "300", account.AvailableBalance.String())
+
+	// and repaid down to zero, they never hold money of their own
+	require.Equal(t, http.StatusOK, transact("deposit", "", creditLine, "150"))
+	require.Equal(t, http.StatusUnprocessableEntity, transact("deposit", "", creditLine, "60"))
+	require.Equal(t, http.StatusUnprocessableEntity, transact("transfer", a2, creditLine, "51"))
+	require.Equal(t, http.StatusOK, transact("transfer", a2, creditLine, "50"))
+	require.Equal(t, "0", getAccount(creditLine).Balance.String())
+	require.Equal(t, http.StatusUnprocessableEntity, transact("deposit", "", creditLine, "1"))
+
+	req = httptest.NewRequest("PUT", fmt.Sprintf("/accounts/%s/interest", creditLine), bytes.NewBuffer([]byte(`{"apr":"5"}`)))
+	w = performRequestAndGetResponse[map[string]string](r, t)(req, &badResponse)
+	require.Equal(t, http.StatusBadRequest, w.Code)
+}
+
+func TestAccountStatuses(t *testing.T) {
+	_, r, _, _, teardown := setup(t)
+	defer teardown()
+
+	req := httptest.NewRequest("POST", "/users", bytes.NewBuffer([]byte(`{"email": "1@gmail.com"}'`)))
+	var uResponse map[string]models.User
+	w := performRequestAndGetResponse[map[string]models.User](r, t)(req, &uResponse)
+	require.Equal(t, http.StatusOK, w.Code)
+
+	createAccount := func() string {
+		req := httptest.NewRequest("POST", "/accounts", bytes.NewBuffer([]byte(fmt.Sprintf(`{"user_id": %d}`, uResponse["user"].ID))))
+		var aResponse map[string]models.Account
+		w := performRequestAndGetResponse[map[string]models.Account](r, t)(req, &aResponse)
+		require.Equal(t, http.StatusOK, w.Code)
+		require.Equal(t, "active", aResponse["account"].Status)
+		return aResponse["account"].AccountNumber
+	}
+	a1, a2, a3, empty := createAccount(), createAccount(), createAccount(), createAccount()
+
+	type response struct {
+		StatusChange *models.StatusChange `json:"status_change"`
+		Sweep        *models.Transaction  `json:"sweep"`
+		Error        string               `json:"error"`
+	}
+	post := func(method, path, body string) (int, response) {
+		req := httptest.NewRequest(method, path, bytes.NewBuffer([]byte(body)))
+		var res response
+		w := performRequestAndGetResponse[response](r, t)(req, &res)
+		return w.Code, res
+	}
+	setStatus := func(accountNumber, status string) (int, response) {
+		return post("PUT", fmt.Sprintf("/accounts/%s/status", accountNumber), fmt.Sprintf(`{"status":"%s","reason":"ops"}`, status))
+	}
+	transact := func(txType, from, to, amount, reference string) (int, response) {
+		return post("POST", "/transactions", fmt.Sprintf(`{"from":"%s","to":"%s","type":"%s","amount":"%s","reference":"%s"}`, from, to, txType, amount, reference))
+	}
+	getBalance := func(accountNumber string) string {
+		req := httptest.NewRequest("GET", fmt.Sprintf("/accounts/%s", accountNumber), nil)
+		var response map[string]models.Account
+		w := performRequestAndGetResponse[map[string]models.Account](r, t)(req, &response)
+		require.Equal(t, http.StatusOK, w.Code)
+		return response["account"].Balance.String()
+	}
+
+	code, _ := transact("deposit", "", a1, "100", "deposit-1")
+	require.Equal(t, http.StatusOK, code)
+
+	code, _ = post("PUT", fmt.Sprintf("/accounts/%s/status", a1), `{"status":"frozen"}`)
+	require.Equal(t, http.StatusBadRequest, code)
+	code, _ = setStatus(a1, "closed")
+	require.Equal(t, http.StatusBadRequest, code)
+	code, _ = setStatus("000000840", "frozen")
+	require.Equal(t, http.StatusBadRequest, code)
+
+	// frozen accounts can't send nor receive
+	code, res := setStatus(a1, "frozen")
+	require.Equal(t, http.StatusOK, code)
+	require.Equal(t, "active", res.StatusChange.PreviousStatus)
+	code, res = transact("transfer", a1, a2, "10", pkg.CreateAccountNumber())
+	require.Equal(t, http.StatusUnprocessableEntity, code)
+	require.Equal(t, fmt.Sprintf("account %s can't be debited, it's frozen", a1), res.Error)
+	code, res = transact("deposit", "", a1, "10", pkg.CreateAccountNumber())
+	require.Equal(t, http.StatusUnprocessableEntity, code)
+	require.Equal(t, fmt.Sprintf("account %s can't be credited, it's frozen", a1), res.Error)
+	code, _ = post("POST", "/holds", fmt.Sprintf(`{"from":"%s","to":"%s","amount":10,"reference":"hold-1"}`, a1, a2))
+	require.Equal(t, http.StatusUnprocessableEntity, code)
+
+	// blocking a side only blocks that side
+	code, _ = setStatus(a1, "debit_blocked")
+	require.Equal(t, http.StatusOK, code)
+	code, _ = transact("deposit", "", a1, "10", pkg.CreateAccountNumber())
+	require.Equal(t, http.StatusOK, code)
+	code, _ = transact("transfer", a1, a2, "10", pkg.CreateAccountNumber())
+	require.Equal(t, http.StatusUnprocessableEntity, code)
+
+	code, _ = setStatus(a1, "credit_blocked")
+	require.Equal(t, http.StatusOK, code)
+	code, _ = transact("deposit", "", a1, "10", pkg.CreateAccountNumber())
+	require.Equal(t, http.StatusUnprocessableEntity, code)
+	code, _ = transact("transfer", a1, a2, "10", "transfer-1")
+	require.Equal(t, http.StatusOK, code)
+	code, _ = post("POST", "/journal-entries", fmt.Sprintf(`{"reference":"journal-1","legs":[{"account":"%s","direction":"debit","amount":"5"},{"account":"%s","direction":"credit","amount":"5"}]}`, a2, a1))
+	require.Equal(t, http.StatusUnprocessableEntity, code)
+
+	// holds can't be captured while the account is frozen, and keep it from being closed
+	code, _ = setStatus(a1, "active")
+	require.Equal(t, http.StatusOK, code)
+	code, _ = post("POST", "/holds", fmt.Sprintf(`{"from":"%s","to":"%s","amount":10,"reference":"hold-1"}`, a1, a2))
+	require.Equal(t, http.StatusOK, code)
+	code, _ = setStatus(a1, "frozen")
+	require.Equal(t, http.StatusOK, code)
+	code, _ = post("POST", "/holds/hold-1/capture", `{}`)
+	require.Equal(t, http.StatusUnprocessableEntity, code)
+	code, _ = setStatus(a1, "active")
+	require.Equal(t, http.StatusOK, code)
+
+	closeAccount := func(accountNumber, body string) (int, response) {
+		return post("POST", fmt.Sprintf("/accounts/%s/close", accountNumber), body)
+	}
+	code, res = closeAccount(a1, fmt.Sprintf(`{"reason":"customer request","sweep_to":"%s"}`, a3))
+	require.Equal(t, http.StatusUnprocessableEntity, code)
+	require.Contains(t, res.Error, "pending holds")
+	code, _ = post("POST", "/holds/hold-1/void", `{}`)
+	require.Equal(t, http.StatusOK, code)
+
+	// closing an account with a balance sweeps it
+	code, res = closeAccount(a1, `{"reason":"customer request"}`)
+	require.Equal(t, http.StatusUnprocessableEntity, code)
+	require.Contains(t, res.Error, "sweep_to")
+	code, res = closeAccount(a1, fmt.Sprintf(`{"reason":"customer request","sweep_to":"%s"}`, a3))
+	require.Equal(t, http.StatusOK, code)
+	require.Equal(t, "closed", res.StatusChange.NewStatus)
+	require.Equal(t, "sweep", res.Sweep.Type)
+	require.Equal(t, int64(10000), *res.Sweep.Amount)
+	require.Equal(t, "0", getBalance(a1))
+	require.Equal(t, "100", getBalance(a3))
+
+	// closed is final
+	code, res = transact("transfer", a3, a1, "10", pkg.CreateAccountNumber())
+	require.Equal(t, http.StatusUnprocessableEntity, code)
+	require.Equal(t, fmt.Sprintf("account %s can't be credited, it's closed", a1), res.Error)
+	code, _ = post("POST", "/transactions/transfer-1/refund", `{"amount":"5","reference":"refund-1"}`)
+	require.Equal(t, http.StatusUnprocessableEntity, code)
+	code, _ = setStatus(a1, "active")
+	require.Equal(t, http.StatusUnprocessableEntity, code)
+	code, _ = closeAccount(a1, `{"reason":"again"}`)
+	require.Equal(t, http.StatusUnprocessableEntity, code)
+
+	// an empty account closes without a sweep
+	code, res = closeAccount(empty, `{"reason":"unused"}`)
+	require.Equal(t, http.StatusOK, code)
+	require.Nil(t, res.Sweep)
+
+	req = httptest.NewRequest("GET", fmt.Sprintf("/accounts/%s/status/changes", a1), nil)
+	var changesResponse map[string][]models.StatusChange
+	w = performRequestAndGetResponse[map[string][]models.StatusChange](r, t)(req, &changesResponse)
+	require.Equal(t, http.StatusOK, w.Code)
+	require.Len(t, changesResponse["status_changes"], 7)
+	require.Equal(t, "closed", changesResponse["status_changes"][0].NewStatus)
+	require.Equal(t, "customer request", changesResponse["status_changes"][0].Reason)
+}
+
+func TestUserDeletionAndErasure(t *testing.T) {
+	_, r, db, _, teardown := setup(t)
+	defer teardown()
+
+	type userResponse struct {
+		User  *models.User `json:"user"`
+		Error string       `json:"error"`
+	}
+	do := func(method, path, body string) (int, userResponse) {
+		req := httptest.NewRequest(method, path, bytes.NewBuffer([]byte(body)))
+		var res userResponse
+		w := performRequestAndGetResponse[userResponse](r, t)(req, &res)
+		return w.Code, res
+	}
+
+	code, res := do("POST", "/users", `{"email": "1@gmail.com"}`)
+	require.Equal(t, http.StatusOK, code)
+	user := res.User
+
+	code, res = do("GET", fmt.Sprintf("/users/%d", user.ID), "")
+	require.Equal(t, http.StatusOK, code)
+	require.Equal(t, "1@gmail.com", res.User.Email)
+	code, _ = do("GET", "/users/1000", "")
+	require.Equal(t, http.StatusNotFound, code)
+
+	createAccount := func() string {
+		req := httptest.NewRequest("POST", "/accounts", bytes.NewBuffer([]byte(fmt.Sprintf(`{"user_id": %d}`, user.ID))))
+		var aResponse map[string]models.Account
+		w := performRequestAndGetResponse[map[string]models.Account](r, t)(req, &aResponse)
+		require.Equal(t, http.StatusOK, w.Code)
+		return aResponse["account"].AccountNumber
+	}
+	a1, a2 := createAccount(), createAccount()
+
+	reqBody := fmt.Sprintf(`{"to":"%s","type":"deposit","amount":100,"reference":"deposit-1"}`, a1)
+	req := httptest.NewRequest("POST", "/transactions", bytes.NewBuffer([]byte(reqBody)))
+	var dResponse map[string]string
+	w := performRequestAndGetResponse[map[string]string](r, t)(req, &dResponse)
+	require.Equal(t, http.StatusOK, w.Code)
+
+	// users with open accounts can't be deleted, and open accounts can't be deleted either
+	code, res = do("DELETE", fmt.Sprintf("/users/%d", user.ID), "")
+	require.Equal(t, http.StatusUnprocessableEntity, code)
+	code, _ = do("DELETE", fmt.Sprintf("/accounts/%s", a2), "")
+	require.Equal(t, http.StatusUnprocessableEntity, code)
+
+	// a closed account can be deleted, after which it's gone from the api
+	code, _ = do("POST", fmt.Sprintf("/accounts/%s/close", a2), `{"reason":"unused"}`)
+	require.Equal(t, http.StatusOK, code)
+	code, _ = do("DELETE", fmt.Sprintf("/accounts/%s", a2), "")
+	require.Equal(t, http.StatusOK, code)
+	code, _ = do("GET", fmt.Sprintf("/accounts/%s", a2), "")
+	require.Equal(t, http.StatusNotFound, code)
+
+	// erasing the user pseudonymizes it and deletes it along with its accounts
+	code, _ = do("POST", fmt.Sprintf("/users/%d/erase", user.ID), "")
+	require.Equal(t, http.StatusUnprocessableEntity, code)
+	code, _ = do("POST", fmt.Sprintf("/accounts/%s/close", a1), `{"reason":"gdpr request","sweep_to":"000000000"}`)
+	require.Equal(t, http.StatusOK, code)
+	code, res = do("POST", fmt.Sprintf("/users/%d/erase", user.ID), "")
+	require.Equal(t, http.StatusOK, code)
+	require.Equal(t, fmt.Sprintf("erased-%d@users.invalid", user.ID), res.User.Email)
+	require.NotNil(t, res.User.ErasedAt)
+	require.NotNil(t, res.User.DeletedAt)
+
+	code, _ = do("POST", fmt.Sprintf("/users/%d/erase", user.ID), "")
+	require.Equal(t, http.StatusNotFound, code)
+	code, _ = do("GET", fmt.Sprintf("/users/%d", user.ID), "")
+	require.Equal(t, http.StatusNotFound, code)
+	code, _ = do("DELETE", fmt.Sprintf("/users/%d", user.ID), "")
+	require.Equal(t, http.StatusNotFound, code)
+	code, _ = do("GET", fmt.Sprintf("/accounts/%s", a1), "")
+	require.Equal(t, http.StatusNotFound, code)
+	code, _ = do("POST", "/accounts", fmt.Sprintf(`{"user_id": %d}`, user.ID))
+	require.Equal(t, http.StatusNotFound, code)
+
+	// nothing personal is left, the email can be reused, and the ledger still balances
+	var count int
+	err := db.Instance().QueryRow("select count(*) from users where email=$1;", "1@gmail.com").Scan(&count)
+	require.NoError(t, err)
+	require.Zero(t, count)
+	code, _ = do("POST", "/users", `{"email": "1@gmail.com"}`)
+	require.Equal(t, http.StatusOK, code)
+
+	var lines, sum int64
+	err = db.Instance().QueryRow("select count(*), coalesce(sum(case when purpose = 'credit' then amount else -amount end), 0) from transaction_lines;").Scan(&lines, &sum)
+	require.NoError(t, err)
+	require.Equal(t, int64(4), lines)
+	require.Zero(t, sum)
+}
+
+func TestWebhooks(t *testing.T) {
+	ctx, r, db, logger, teardown := setup(t)
+	defer teardown()
+
+	type webhook struct {
+		ID   int             `json:"id"`
+		Type string          `json:"type"`
+		Data json.RawMessage `json:"data"`
+	}
+	var mu sync.Mutex
+	var secret string
+	var received []webhook
+	receiver := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		body, err := io.ReadAll(req.Body)
+		require.NoError(t, err)
+		mu.Lock()
+		defer mu.Unlock()
+		if err := pkg.VerifyWebhook(secret, req.Header.Get(pkg.WebhookSignatureHeader), body, time.Hour, time.Now()); err != nil {
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+		var event webhook
+		require.NoError(t, json.Unmarshal(body, &event))
+		received = append(received, event)
+	}))
+	defer receiver.Close()
+
+	failing := true
+	flaky := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		mu.Lock()
+		defer mu.Unlock()
+		if failing {
+			w.WriteHeader(http.StatusServiceUnavailable)
+		}
+	}))
+	defer flaky.Close()
+
+	type webhookResponse struct {
+		Endpoint   *models.WebhookEndpoint   `json:"endpoint"`
+		Endpoints  []*models.WebhookEndpoint `json:"endpoints"`
+		Delivery   *models.WebhookDelivery   `json:"delivery"`
+		Deliveries []*models.WebhookDelivery `json:"deliveries"`
+		Error      string                    `json:"error"`
+	}
+	do := func(method, path, body string) (int, webhookResponse) {
+		req := httptest.NewRequest(method, path, bytes.NewBuffer([]byte(body)))
+		var res webhookResponse
+		w := performRequestAndGetResponse[webhookResponse](r, t)(req, &res)
+		return w.Code, res
+	}
+
+	code, _ := do("POST", "/webhooks", `{"url":"not a url","events":["*"]}`)
+	require.Equal(t, http.StatusBadRequest, code)
+	code, _ = do("POST", "/webhooks", fmt.Sprintf(`{"url":"%s","events":["account.deleted"]}`, receiver.URL))
+	require.Equal(t, http.StatusBadRequest, code)
+
+	code, res := do("POST", "/webhooks", fmt.Sprintf(`{"url":"%s","events":["*"]}`, receiver.URL))
+	require.Equal(t, http.StatusOK, code)
+	require.True(t, strings.HasPrefix(res.Endpoint.Secret, "whsec_"))
+	secret = res.Endpoint.Secret
+	code, _ = do("POST", "/webhooks", fmt.Sprintf(`{"url":"%s","events":["account.created"]}`, flaky.URL))
+	require.Equal(t, http.StatusOK, code)
+
+	// secrets are only returned on creation
+	code, res = do("GET", "/webhooks", "")
+	require.Equal(t, http.StatusOK, code)
+	require.Len(t, res.Endpoints, 2)
+	require.Empty(t, res.Endpoints[0].Secret)
+
+	req := httptest.NewRequest("POST", "/users", bytes.NewBuffer([]byte(`{"email": "1@gmail.com"}`)))
+	var uResponse map[string]models.User
+	w := performRequestAndGetResponse[map[string]models.User](r, t)(req, &uResponse)
+	require.Equal(t, http.StatusOK, w.Code)
+
+	req = httptest.NewRequest("POST", "/accounts", bytes.NewBuffer([]byte(fmt.Sprintf(`{"user_id": %d}`, uResponse["user"].ID))))
+	var aResponse map[string]models.Account
+	w = performRequestAndGetResponse[map[string]models.Account](r, t)(req, &aResponse)
+	require.Equal(t, http.StatusOK, w.Code)
+	account := aResponse["account"].AccountNumber
+
+	transfer := func(body string) int {
+		req := httptest.NewRequest("POST", "/transactions", bytes.NewBuffer([]byte(body)))
+		var res map[string]any
+		return performRequestAndGetResponse[map[string]any](r, t)(req, &res).Code
+	}
+	require.Equal(t, http.StatusOK, transfer(fmt.Sprintf(`{"to":"%s","type":"deposit","amount":100,"reference":"deposit-1"}`, account)))
+	// a transaction that's rolled back doesn't publish anything
+	require.Equal(t, http.StatusUnprocessableEntity, transfer(fmt.Sprintf(`{"from":"%s","type":"withdrawal","amount":500,"reference":"withdrawal-1"}`, account)))
+
+	wr := repos.NewWebhooks(logger, db.Instance())
+	client := &http.Client{Timeout: 5 * time.Second}
+	now := time.Now().UTC()
+
+	n, err := services.DispatchWebhooks(ctx, logger, wr, client, now)
+	require.NoError(t, err)
+	require.Equal(t, 3, n)
+	require.Len(t, received, 3)
+	require.Equal(t, services.EventUserCreated, received[0].Type)
+	require.Equal(t, services.EventAccountCreated, received[1].Type)
+	require.Equal(t, services.EventTransactionPosted, received[2].Type)
+
+	// users' events carry no personal data, they outlive erasure
+	var created map[string]any
+	require.NoError(t, json.Unmarshal(received[0].Data, &created))
+	require.NotContains(t, created, "email")
+	require.NotZero(t, created["id"])
+
+	var posted models.Transaction
+	require.NoError(t, json.Unmarshal(received[2].Data, &posted))
+	require.Equal(t, "deposit-1", posted.Reference)
+	require.Len(t, posted.Lines, 2)
+	require.Equal(t, account, posted.Lines[1].AccountNumber)
+	require.Equal(t, int64(10000), posted.Lines[1].Amount)
+
+	// delivered events aren't delivered again
+	n, err = services.DispatchWebhooks(ctx, logger, wr, client, now)
+	require.NoError(t, err)
+	require.Zero(t, n)
+	require.Len(t, received, 3)
+
+	// the failing endpoint is retried with backoff, then dead lettered
+	code, res = do("GET", "/webhooks/deliveries?status=pending", "")
+	require.Equal(t, http.StatusOK, code)
+	require.Len(t, res.Deliveries, 1)
+	require.Equal(t, 1, res.Deliveries[0].Attempts)
+	require.True(t, res.Deliveries[0].NextAttemptAt.After(now))
+
+	for i := 0; i < 7; i++ {
+		code, res = do("GET", "/webhooks/deliveries?status=dead", "")
+		require.Equal(t, http.StatusOK, code)
+		require.Empty(t, res.Deliveries)
+
+		now = now.Add(24 * time.Hour)
+		n, err = services.DispatchWebhooks(ctx, logger, wr, client, now)
+		require.NoError(t, err)
+		require.Zero(t, n)
+	}
+	code, res = do("GET", "/webhooks/deliveries?status=dead", "")
+	require.Equal(t, http.StatusOK, code)
+	require.Len(t, res.Deliveries, 1)
+	dead := res.Deliveries[0]
+	require.Equal(t, 8, dead.Attempts)
+	require.Equal(t, "endpoint responded with 503", dead.LastError)
+
+	// once the endpoint is fixed, the dead delivery can be replayed
+	mu.Lock()
+	failing = false
+	mu.Unlock()
+	code, _ = do("POST", "/webhooks/deliveries/1000/replay", "")
+	require.Equal(t, http.StatusNotFound, code)
+	code, res = do("POST", fmt.Sprintf("/webhooks/deliveries/%d/replay", dead.ID), "")
+	require.Equal(t, http.StatusOK, code)
+	require.Equal(t, services.DeliveryPending, res.Delivery.Status)
+	require.Zero(t, res.Delivery.Attempts)
+
+	n, err = services.DispatchWebhooks(ctx, logger, wr, client, now)
+	require.NoError(t, err)
+	require.Equal(t, 1, n)
+	code, res = do("GET", "/webhooks/deliveries?status=delivered", "")
+	require.Equal(t, http.StatusOK, code)
+	require.Len(t, res.Deliveries, 4)
+	code, _ = do("GET", "/webhooks/deliveries?status=lost", "")
+	require.Equal(t, http.StatusBadRequest, code)
+}
+
+func TestLedgerHashChain(t *testing.T) {
+	ctx, r, db, logger, teardown := setup(t)
+	defer teardown()
+
+	tr := repos.NewTransactions(logger, db.Instance())
+	result, err := services.VerifyLedger(ctx, tr)
+	require.NoError(t, err)
+	require.Zero(t, result.Verified)
+	require.Nil(t, result.BrokenAt)
+
+	req := httptest.NewRequest("POST", "/users", bytes.NewBuffer([]byte(`{"email": "1@gmail.com"}`)))
+	var uResponse map[string]models.User
+	w := performRequestAndGetResponse[map[string]models.User](r, t)(req, &uResponse)
+	require.Equal(t, http.StatusOK, w.Code)
+
+	createAccount := func() models.Account {
+		req := httptest.NewRequest("POST", "/accounts", bytes.NewBuffer([]byte(fmt.Sprintf(`{"user_id": %d}`, uResponse["user"].ID))))
+		var aResponse map[string]models.Account
+		w := performRequestAndGetResponse[map[string]models.Account](r, t)(req, &aResponse)
+		require.Equal(t, http.StatusOK, w.Code)
+		return aResponse["account"]
+	}
+	account1, account2 := createAccount(), createAccount()
+	a1, a2 := account1.AccountNumber, account2.AccountNumber
+
+	for i, body := range []string{
+		fmt.Sprintf(`{"to":"%s","type":"deposit","amount":100,"reference":"deposit-1"}`, a1),
+		fmt.Sprintf(`{"from":"%s","to":"%s","type":"transfer","amount":40,"reference":"transfer-1"}`, a1, a2),
+		fmt.Sprintf(`{"from":"%s","type":"withdrawal","amount":10,"reference":"withdrawal-1"}`, a2),
+	} {
+		req := httptest.NewRequest("POST", "/transactions", bytes.NewBuffer([]byte(body)))
+		var res map[string]any
+		w := performRequestAndGetResponse[map[string]any](r, t)(req, &res)
+		require.Equal(t, http.StatusOK, w.Code, i)
+	}
+
+	result, err = services.VerifyLedger(ctx, tr)
+	require.NoError(t, err)
+	require.Equal(t, 6, result.Verified)
+	require.Nil(t, result.BrokenAt)
+
+	// lines are chained per account, a2's first line starts its own chain after a1's lines
+	var prevHash, a1Hash string
+	err = db.Instance().QueryRow("select prev_hash from transaction_lines where id=4;").Scan(&prevHash)
+	require.NoError(t, err)
+	require.Empty(t, prevHash)
+	err = db.Instance().QueryRow("select prev_hash from transaction_lines where id=3;").Scan(&prevHash)
+	require.NoError(t, err)
+	err = db.Instance().QueryRow("select hash from transaction_lines where id=2;").Scan(&a1Hash)
+	require.NoError(t, err)
+	require.Equal(t, a1Hash, prevHash)
+
+	// lines can't be updated nor deleted
+	_, err = db.Instance().Exec("update transaction_lines set amount=1 where id=1;")
+	require.Error(t, err)
+	_, err = db.Instance().Exec("delete from transaction_lines where id=6;")
+	require.Error(t, err)
+
+	// tampering with a line's content breaks its account's chain at that line
+	_, err = db.Instance().Exec("drop trigger prevent_transaction_lines_update;")
+	require.NoError(t, err)
+	_, err = db.Instance().Exec("update transaction_lines set amount=amount*10 where id=3;")
+	require.NoError(t, err)
+	result, err = services.VerifyLedger(ctx, tr)
+	require.NoError(t, err)
+	require.Equal(t, 3, result.Verified)
+	require.Equal(t, 3, *result.BrokenAt)
+	require.Equal(t, "line 3 doesn't match its hash", result.Reason)
+	_, err = db.Instance().Exec("update transaction_lines set amount=amount/10 where id=3;")
+	require.NoError(t, err)
+
+	// removing lines breaks the chain after them, or at its head when they're the last ones
+	_, err = db.Instance().Exec("drop trigger prevent_transaction_lines_delete;")
+	require.NoError(t, err)
+	_, err = db.Instance().Exec("delete from transaction_lines where id=5;")
+	require.NoError(t, err)
+	result, err = services.VerifyLedger(ctx, tr)
+	require.NoError(t, err)
+	require.Equal(t, 5, *result.BrokenAt)
+	require.Equal(t, fmt.Sprintf("account %d's chain head points to line 5, but the chain ends at line 4", account2.ID), result.Reason)
+
+	_, err = db.Instance().Exec("delete from transaction_lines where id=2;")
+	require.NoError(t, err)
+	result, err = services.VerifyLedger(ctx, tr)
+	require.NoError(t, err)
+	require.Equal(t, 3, *result.BrokenAt)
+	require.Equal(t, fmt.Sprintf("line 3 should start account %d's chain", account1.ID), result.Reason)
+}
+
+func TestIntegrityReport(t *testing.T) {
+	_, r, db, _, teardown := setup(t)
+	defer teardown()
+
+	type reportResponse struct {
+		Report *models.IntegrityReport `json:"report"`
+	}
+	integrity := func() *models.IntegrityReport {
+		req := httptest.NewRequest("GET", "/admin/integrity", nil)
+		var res reportResponse
+		w := performRequestAndGetResponse[reportResponse](r, t)(req, &res)
+		require.Equal(t, http.StatusOK, w.Code)
+		return res.Report
+	}
+
+	req := httptest.NewRequest("POST", "/users", bytes.NewBuffer([]byte(`{"email": "1@gmail.com"}`)))
+	var uResponse map[string]models.User
+	w := performRequestAndGetResponse[map[string]models.User](r, t)(req, &uResponse)
+	require.Equal(t, http.StatusOK, w.Code)
+
+	createAccount := func() models.Account {
+		req := httptest.NewRequest("POST", "/accounts", bytes.NewBuffer([]byte(fmt.Sprintf(`{"user_id": %d}`, uResponse["user"].ID))))
+		var aResponse map[string]models.Account
+		w := performRequestAndGetResponse[map[string]models.Account](r, t)(req, &aResponse)
+		require.Equal(t, http.StatusOK, w.Code)
+		return aResponse["account"]
+	}
+	a1, a2 := createAccount(), createAccount()
+
+	for _, body := range []string{
+		fmt.Sprintf(`{"to":"%s","type":"deposit","amount":100,"reference":"deposit-1"}`, a1.AccountNumber),
+		fmt.Sprintf(`{"from":"%s","to":"%s","type":"transfer","amount":40,"reference":"transfer-1"}`, a1.AccountNumber, a2.AccountNumber),
+	} {
+		req := httptest.NewRequest("POST", "/transactions", bytes.NewBuffer([]byte(body)))
+		var res map[string]any
+		w := performRequestAndGetResponse[map[string]any](r, t)(req, &res)
+		require.Equal(t, http.StatusOK, w.Code)
+	}
+
+	report := integrity()
+	require.True(t, report.OK)
+	require.Len(t, report.Accounts, 3)
+	require.Equal(t, &models.TrialBalanceLine{
+		AccountNumber: pkg.LegacyGenesisAccountNumber, AccountType: services.DepositAccount, Currency: "USD", Debits: 10000, Credits: 0, Balance: -10000,
+	}, report.Accounts[0])
+	for _, line := range report.Accounts[1:] {
+		switch line.AccountNumber {
+		case a1.AccountNumber:
+			require.Equal(t, int64(6000), line.Balance)
+		case a2.AccountNumber:
+			require.Equal(t, int64(4000), line.Balance)
+		default:
+			t.Fatalf("unexpected account %s", line.AccountNumber)
+		}
+	}
+	require.Equal(t, []*models.TrialBalanceLine{
+		{AccountType: services.DepositAccount, Currency: "USD", Debits: 4000, Credits: 14000, Balance: 10000},
+		{AccountType: "genesis", Currency: "USD", Debits: 10000, Credits: 0, Balance: -10000},
+	}, report.AccountTypes)
+	require.Equal(t, []*models.TrialBalanceLine{
+		{Currency: "USD", Debits: 14000, Credits: 14000, Balance: 0},
+	}, report.Currencies)
+	require.Empty(t, report.UnbalancedTransactions)
+	require.Empty(t, report.OrphanLines)
+	require.Empty(t, report.BalanceDrifts)
+
+	// a lone line breaks its transaction's balance and the account's materialized balance, one pointing nowhere is an orphan
+	_, err := db.Instance().Exec("insert into transaction_lines (transaction_id, account_id, amount, purpose) values (1, $1, 500, 'credit');", a2.ID)
+	require.NoError(t, err)
+	_, err = db.Instance().Exec("insert into transaction_lines (transaction_id, account_id, amount, purpose) values (1000, $1, 500, 'debit');", a1.ID)
+	require.NoError(t, err)
+
+	report = integrity()
+	require.False(t, report.OK)
+	require.Equal(t, []*models.UnbalancedTransaction{
+		{TransactionID: 1, Reference: "deposit-1", Currency: "USD", Debits: 10000, Credits: 10500},
+	}, report.UnbalancedTransactions)
+	require.Len(t, report.OrphanLines, 1)
+	require.Equal(t, 1000, report.OrphanLines[0].TransactionID)
+	require.Len(t, report.BalanceDrifts, 2)
+	require.Equal(t, int64(0), report.Currencies[0].Balance)
+
+	_, err = db.Instance().Exec("insert into transaction_lines (transaction_id, account_id, amount, purpose) values (2, $1, 1, 'credit');", a2.ID)
+	require.NoError(t, err)
+	report = integrity()
+	require.Equal(t, int64(1), report.Currencies[0].Balance)
+}
+
+func TestAPIKeys(t *testing.T) {
+	ctx, r, db, logger, teardown := setup(t)
+	defer teardown()
+
+	kr := repos.NewAPIKeys(logger, db.Instance())
+	r.Use(services.Authenticate(logger, kr, repos.NewRBAC(logger, db.Instance()), nil))
+	r.Methods("GET").Path("/whoami").HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		json.NewEncoder(w).Encode(map[string]any{"api_key": services.APIKeyFromContext(r.Context())})
+	})
+
+	tx, err := kr.GetTx(ctx)
+	require.NoError(t, err)
+	admin, err := services.CreateAPIKey(ctx, tx, kr, "admin", []string{services.ScopeAll}, false)
+	require.NoError(t, err)
+	require.NoError(t, tx.Commit())
+
+	type keyResponse struct {
+		APIKey     *models.APIKey   `json:"api_key"`
+		APIKeys    []*models.APIKey `json:"api_keys"`
+		RotatedKey *models.APIKey   `json:"rotated_key"`
+		Error      string           `json:"error"`
+	}
+	do := func(key, method, path, body string) (int, keyResponse) {
+		req := httptest.NewRequest(method, path, bytes.NewBuffer([]byte(body)))
+		if key != "" {
+			req.Header.Set("Authorization", "Bearer "+key)
+		}
+		var res keyResponse
+		w := performRequestAndGetResponse[keyResponse](r, t)(req, &res)
+		return w.Code, res
+	}
+
+	code, res := do("", "GET", "/api-keys", "")
+	require.Equal(t, http.StatusUnauthorized, code)
+	require.Equal(t, "missing api key", res.Error)
+	code, _ = do("ak_nope", "GET", "/api-keys", "")
+	require.Equal(t, http.StatusUnauthorized, code)
+
+	// the key is attached to the request's context
+	code, res = do(admin.Key, "GET", "/whoami", "")
+	require.Equal(t, http.StatusOK, code)
+	require.Equal(t, admin.ID, res.APIKey.ID)
+	require.Equal(t, admin.Key[:11], res.APIKey.Prefix)
+
+	code, _ = do(admin.Key, "POST", "/api-keys", `{"name":"reader","scopes":["accounts:delete"]}`)
+	require.Equal(t, http.StatusBadRequest, code)
+	code, res = do(admin.Key, "POST", "/api-keys", `{"name":"reader","scopes":["accounts:read"]}`)
+	require.Equal(t, http.StatusOK, code)
+	reader := res.APIKey
+	require.True(t, strings.HasPrefix(reader.Key, "ak_"))
+
+	code, res = do(admin.Key, "POST", "/users", `{"email": "1@gmail.com"}`)
+	require.Equal(t, http.StatusOK, code)
+	req := httptest.NewRequest("POST", "/accounts", bytes.NewBuffer([]byte(`{"user_id": 2}`)))
+	req.Header.Set("Authorization", "Bearer "+admin.Key)
+	var aResponse map[string]models.Account
+	w := performRequestAndGetResponse[map[string]models.Account](r, t)(req, &aResponse)
+	require.Equal(t, http.StatusOK, w.Code)
+	account := aResponse["account"].AccountNumber
+
+	// keys only reach the routes they're scoped to
+	code, _ = do(reader.Key, "GET", "/accounts/"+account, "")
+	require.Equal(t, http.StatusOK, code)
+	code, res = do(reader.Key, "POST", "/accounts", `{"user_id": 2}`)
+	require.Equal(t, http.StatusForbidden, code)
+	require.Equal(t, "api key lacks the 'accounts:write' scope", res.Error)
+	code, res = do(reader.Key, "POST", "/journal-entries", `{}`)
+	require.Equal(t, http.StatusForbidden, code)
+	require.Equal(t, "api key lacks the 'transactions:write' scope", res.Error)
+	code, res = do(reader.Key, "GET", "/admin/integrity", "")
+	require.Equal(t, http.StatusForbidden, code)
+	require.Equal(t, "api key lacks the 'admin' scope", res.Error)
+
+	// fee rules are managed with the fees scopes
+	code, res = do(admin.Key, "POST", "/api-keys", `{"name":"fees","scopes":["fees:write"]}`)
+	require.Equal(t, http.StatusOK, code)
+	feeWriter := res.APIKey
+	code, res = do(admin.Key, "POST", "/api-keys", `{"name":"fees-reader","scopes":["fees:read"]}`)
+	require.Equal(t, http.StatusOK, code)
+	feeReader := res.APIKey
+	rule := `{"transaction_type":"transfer","currency":"USD","flat_fee":"0.50"}`
+	code, _ = do(feeWriter.Key, "POST", "/fee-rules", rule)
+	require.Equal(t, http.StatusOK, code)
+	code, res = do(feeReader.Key, "POST", "/fee-rules", rule)
+	require.Equal(t, http.StatusForbidden, code)
+	require.Equal(t, "api key lacks the 'fees:write' scope", res.Error)
+	code, _ = do(feeReader.Key, "GET", "/fee-rules", "")
+	require.Equal(t, http.StatusOK, code)
+
+	// opening accounts doesn't let a key extend them credit
+	code, res = do(admin.Key, "POST", "/api-keys", `{"name":"onboarding","scopes":["accounts:write"]}`)
+	require.Equal(t, http.StatusOK, code)
+	onboarding := res.APIKey
+	code, res = do(admin.Key, "POST", "/api-keys", `{"name":"credit","scopes":["accounts:limits"]}`)
+	require.Equal(t, http.StatusOK, code)
+	credit := res.APIKey
+	limit := `{"limit":"100","reason":"approved"}`
+	code, res = do(onboarding.Key, "PUT", "/accounts/"+account+"/overdraft-limit", limit)
+	require.Equal(t, http.StatusForbidden, code)
+	require.Equal(t, "api key lacks the 'accounts:limits' scope", res.Error)
+	code, res = do(onboarding.Key, "PUT", "/accounts/"+account+"/interest", `{"apr":"5"}`)
+	require.Equal(t, http.StatusForbidden, code)
+	require.Equal(t, "api key lacks the 'accounts:limits' scope", res.Error)
+	code, _ = do(credit.Key, "PUT", "/accounts/"+account+"/overdraft-limit", limit)
+	require.Equal(t, http.StatusOK, code)
+	req = httptest.NewRequest("GET", "/accounts/"+account+"/overdraft-limit/changes", nil)
+	req.Header.Set("Authorization", "Bearer "+admin.Key)
+	var changesResponse map[string][]models.LimitChange
+	w = performRequestAndGetResponse[map[string][]models.LimitChange](r, t)(req, &changesResponse)
+	require.Equal(t, http.StatusOK, w.Code)
+	require.Equal(t, credit.Lineage, changesResponse["limit_changes"][0].ChangedBy)
+
+	// keys can't grant scopes they don't have
+	code, res = do(admin.Key, "POST", "/api-keys", `{"name":"keys","scopes":["api-keys:write"]}`)
+	require.Equal(t, http.StatusOK, code)
+	keys := res.APIKey
+	code, res = do(keys.Key, "POST", "/api-keys", `{"name":"root","scopes":["*"]}`)
+	require.Equal(t, http.StatusForbidden, code)
+	require.Equal(t, "can't grant the '*' scope, you don't have it", res.Error)
+
+	// nor get them by rotating a stronger key
+	code, res = do(keys.Key, "POST", fmt.Sprintf("/api-keys/%d/rotate", admin.ID), "")
+	require.Equal(t, http.StatusForbidden, code)
+	require.Equal(t, "can't rotate a key with the '*' scope, you don't have it", res.Error)
+	require.Nil(t, res.APIKey)
+	code, _ = do(admin.Key, "GET", "/api-keys", "")
+	require.Equal(t, http.StatusOK, code)
+
+	// and rotating someone else's key makes a key of their own, not one acting as the key's owner
+	code, res = do(admin.Key, "POST", "/api-keys", `{"name":"keys-and-fees","scopes":["api-keys:write","fees:read"]}`)
+	require.Equal(t, http.StatusOK, code)
+	rotator := res.APIKey
+	code, res = do(rotator.Key, "POST", fmt.Sprintf("/api-keys/%d/rotate", feeReader.ID), "")
+	require.Equal(t, http.StatusOK, code)
+	require.Equal(t, rotator.Lineage+"/api_key:"+res.APIKey.Prefix, res.APIKey.Lineage)
+
+	// rotating with a grace period keeps the old key working until it expires
+	code, res = do(admin.Key, "POST", fmt.Sprintf("/api-keys/%d/rotate", reader.ID), `{"grace_seconds":60}`)
+	require.Equal(t, http.StatusOK, code)
+	rotated := res.APIKey
+	require.Equal(t, []string{"accounts:read"}, rotated.Scopes)
+	require.NotNil(t, res.RotatedKey.ExpiresAt)
+	code, _ = do(rotated.Key, "GET", "/accounts/"+account, "")
+	require.Equal(t, http.StatusOK, code)
+	code, _ = do(reader.Key, "GET", "/accounts/"+account, "")
+	require.Equal(t, http.StatusOK, code)
+
+	// rotating without one, or revoking, disables the old key right away
+	code, res = do(admin.Key, "POST", fmt.Sprintf("/api-keys/%d/rotate", rotated.ID), "")
+	require.Equal(t, http.StatusOK, code)
+	code, _ = do(rotated.Key, "GET", "/accounts/"+account, "")
+	require.Equal(t, http.StatusUnauthorized, code)
+	code, _ = do(res.APIKey.Key, "GET", "/accounts/"+account, "")
+	require.Equal(t, http.StatusOK, code)
+
+	code, _ = do(admin.Key, "DELETE", fmt.Sprintf("/api-keys/%d", reader.ID), "")
+	require.Equal(t, http.StatusOK, code)
+	code, _ = do(reader.Key, "GET", "/accounts/"+account, "")
+	require.Equal(t, http.StatusUnauthorized, code)
+	code, _ = do(admin.Key, "DELETE", fmt.Sprintf("/api-keys/%d", reader.ID), "")
+	require.Equal(t, http.StatusUnprocessableEntity, code)
+	code, _ = do(admin.Key, "DELETE", "/api-keys/1000", "")
+	require.Equal(t, http.StatusNotFound, code)
+
+	// keys are listed without their secret
+	code, res = do(admin.Key, "GET", "/api-keys", "")
+	require.Equal(t, http.StatusOK, code)
+	require.Len(t, res.APIKeys, 11)
+	for _, key := range res.APIKeys {
+		require.Empty(t, key.Key)
+		require.Empty(t, key.Hash)
+	}
+}
+
+// jwtIssuer returns a verifier for the tokens it signs, and helpers signing tokens with the given claims or for a user with roles.
+func jwtIssuer(t *testing.T) (*pkg.JWTVerifier, func(claims map[string]any) string, func(sub string, roles ...string) string) {
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	require.NoError(t, err)
+	jwks := fmt.Sprintf(`{"keys":[{"kid":"k1","kty":"RSA","use":"sig","n":"%s","e":"%s"}]}`,
+		base64.RawURLEncoding.EncodeToString(key.N.Bytes()),
+		base64.RawURLEncoding.EncodeToString(big.NewInt(int64(key.E)).Bytes()))
+	verifier, err := pkg.NewJWTVerifier([]byte(jwks), "https://id.example.com", "accounts")
+	require.NoError(t, err)
+
+	sign := func(claims map[string]any) string {
+		header, _ := json.Marshal(map[string]string{"alg": "RS256", "kid": "k1", "typ": "JWT"})
+		payload, _ := json.Marshal(claims)
+		unsigned := base64.RawURLEncoding.EncodeToString(header) + "." + base64.RawURLEncoding.EncodeToString(payload)
+		digest := sha256.Sum256([]byte(unsigned))
+		signature, err := rsa.SignPKCS1v15(rand.Reader, key, crypto.SHA256, digest[:])
+		require.NoError(t, err)
+		return unsigned + "." + base64.RawURLEncoding.EncodeToString(signature)
+	}
+	token := func(sub string, roles ...string) string {
+		return sign(map[string]any{"sub": sub, "iss": "https://id.example.com", "aud": []string{"accounts"}, "exp": time.Now().Add(time.Hour).Unix(), "roles": roles})
+	}
+	return verifier, sign, token
+}
+
+// authedRequests returns a helper making requests with the given bearer token, decoding their json response.
+func authedRequests(t *testing.T, r *mux.Router) func(token, method, path, body string) (int, map[string]any) {
+	return func(token, method, path, body string) (int, map[string]any) {
+		req := httptest.NewRequest(method, path, bytes.NewBuffer([]byte(body)))
+		req.Header.Set("Authorization", "Bearer "+token)
+		var res map[string]any
+		w := performRequestAndGetResponse[map[string]any](r, t)(req, &res)
+		return w.Code, res
+	}
+}
+
+func TestJWTAuth(t *testing.T) {
+	ctx, r, db, logger, teardown := setup(t)
+	defer teardown()
+
+	verifier, sign, token := jwtIssuer(t)
+	kr := repos.NewAPIKeys(logger, db.Instance())
+	r.Use(services.Authenticate(logger, kr, repos.NewRBAC(logger, db.Instance()), verifier))
+	do := authedRequests(t, r)
+
+	tx, err := kr.GetTx(ctx)
+	require.NoError(t, err)
+	apiKey, err := services.CreateAPIKey(ctx, tx, kr, "admin", []string{services.ScopeAll}, false)
+	require.NoError(t, err)
+	require.NoError(t, tx.Commit())
+
+	admin := token("1", services.RoleAdmin)
+	alice, bob := token("2"), token("3")
+	for _, email := range []string{"alice@gmail.com", "bob@gmail.com"} {
+		code, _ := do(admin, "POST", "/users", fmt.Sprintf(`{"email": "%s"}`, email))
+		require.Equal(t, http.StatusOK, code)
+	}
+
+	// users open accounts for themselves only
+	code, res := do(alice, "POST", "/accounts", `{"user_id": 2}`)
+	require.Equal(t, http.StatusOK, code)
+	aliceAccount := res["account"].(map[string]any)["account_number"].(string)
+	code, _ = do(alice, "POST", "/accounts", `{"user_id": 3}`)
+	require.Equal(t, http.StatusForbidden, code)
+	code, res = do(bob, "POST", "/accounts", `{"user_id": 3}`)
+	require.Equal(t, http.StatusOK, code)
+	bobAccount := res["account"].(map[string]any)["account_number"].(string)
+
+	// users can't deposit, admins & api keys can
+	code, _ = do(alice, "POST", "/transactions", fmt.Sprintf(`{"to":"%s","type":"deposit","amount":100,"reference":"%s"}`, aliceAccount, pkg.CreateAccountNumber()))
+	require.Equal(t, http.StatusForbidden, code)
+	code, _ = do(admin, "POST", "/transactions", fmt.Sprintf(`{"to":"%s","type":"deposit","amount":100,"reference":"%s"}`, aliceAccount, pkg.CreateAccountNumber()))
+	require.Equal(t, http.StatusOK, code)
+	code, _ = do(apiKey.Key, "POST", "/transactions", fmt.Sprintf(`{"to":"%s","type":"deposit","amount":100,"reference":"%s"}`, bobAccount, pkg.CreateAccountNumber()))
+	require.Equal(t, http.StatusOK, code)
+
+	// users only debit their own accounts
+	code, res = do(bob, "POST", "/transactions", fmt.Sprintf(`{"from":"%s","to":"%s","type":"transfer","amount":10,"reference":"%s"}`, aliceAccount, bobAccount, pkg.CreateAccountNumber()))
+	require.Equal(t, http.StatusForbidden, code)
+	require.Equal(t, "you can only move money out of your own accounts", res["error"])
+	reference := pkg.CreateAccountNumber()
+	code, _ = do(alice, "POST", "/transactions", fmt.Sprintf(`{"from":"%s","to":"%s","type":"transfer","amount":10,"reference":"%s"}`, aliceAccount, bobAccount, reference))
+	require.Equal(t, http.StatusOK, code)
+
+	// and only read their own accounts, users & the transactions that touch them
+	code, _ = do(alice, "GET", "/accounts/"+aliceAccount, "")
+	require.Equal(t, http.StatusOK, code)
+	code, _ = do(alice, "GET", "/accounts/"+bobAccount, "")
+	require.Equal(t, http.StatusNotFound, code)
+	code, _ = do(alice, "GET", "/accounts/"+bobAccount+"/transactions", "")
+	require.Equal(t, http.StatusNotFound, code)
+	code, _ = do(admin, "GET", "/accounts/"+bobAccount, "")
+	require.Equal(t, http.StatusOK, code)
+	code, _ = do(alice, "GET", "/users/2", "")
+	require.Equal(t, http.StatusOK, code)
+	code, _ = do(alice, "GET", "/users/3", "")
+	require.Equal(t, http.StatusNotFound, code)
+	code, _ = do(bob, "GET", "/transactions/"+reference, "")
+	require.Equal(t, http.StatusOK, code)
+	code, _ = do(token("4"), "GET", "/transactions/"+reference, "")
+	require.Equal(t, http.StatusNotFound, code)
+
+	// the other routes need a role granting them
+	code, res = do(alice, "GET", "/admin/integrity", "")
+	require.Equal(t, http.StatusForbidden, code)
+	require.Equal(t, "user lacks the 'admin' permission", res["error"])
+	code, _ = do(alice, "POST", "/accounts/"+aliceAccount+"/close", "")
+	require.Equal(t, http.StatusForbidden, code)
+	code, _ = do(admin, "GET", "/admin/integrity", "")
+	require.Equal(t, http.StatusOK, code)
+
+	// tokens must be signed by the jwks, for this issuer & audience, and not expired
+	other, err := rsa.GenerateKey(rand.Reader, 2048)
+	require.NoError(t, err)
+	parts := strings.Split(alice, ".")
+	digest := sha256.Sum256([]byte(parts[0] + "." + parts[1]))
+	forged, err := rsa.SignPKCS1v15(rand.Reader, other, crypto.SHA256, digest[:])
+	require.NoError(t, err)
+	for _, invalid := range []string{
+		parts[0] + "." + parts[1] + "." + base64.RawURLEncoding.EncodeToString(forged),
+		sign(map[string]any{"sub": "2", "iss": "https://id.example.com", "aud": "accounts", "exp": time.Now().Add(-time.Minute).Unix()}),
+		sign(map[string]any{"sub": "2", "iss": "https://evil.example.com", "aud": "accounts", "exp": time.Now().Add(time.Hour).Unix()}),
+		sign(map[string]any{"sub": "2", "iss": "https://id.example.com", "aud": "payments", "exp": time.Now().Add(time.Hour).Unix()}),
+		sign(map[string]any{"sub": "alice", "iss": "https://id.example.com", "aud": "accounts", "exp": time.Now().Add(time.Hour).Unix()}),
+	} {
+		code, res = do(invalid, "GET", "/accounts/"+aliceAccount, "")
+		require.Equal(t, http.StatusUnauthorized, code)
+		require.Equal(t, "invalid token", res["error"])
+	}
+}
+
+func TestRBAC(t *testing.T) {
+	_, r, db, logger, teardown := setup(t)
+	defer teardown()
+
+	verifier, _, token := jwtIssuer(t)
+	r.Use(services.Authenticate(logger, repos.NewAPIKeys(logger, db.Instance()), repos.NewRBAC(logger, db.Instance()), verifier))
+	do := authedRequests(t, r)
+
+	admin := token("1", services.RoleAdmin)
+	customer, operator, support, checker := token("2"), token("3"), token("4"), token("5")
+	for i := 2; i <= 5; i++ {
+		code, _ := do(admin, "POST", "/users", fmt.Sprintf(`{"email": "%d@gmail.com"}`, i))
+		require.Equal(t, http.StatusOK, code)
+	}
+
+	// bindings are managed by admins
+	for user, role := range map[int]string{3: "operator", 4: "support", 5: "operator"} {
+		code, _ := do(admin, "POST", "/rbac/bindings", fmt.Sprintf(`{"user_id": %d, "role": "%s"}`, user, role))
+		require.Equal(t, http.StatusOK, code)
+	}
+	code, _ := do(admin, "POST", "/rbac/bindings", `{"user_id": 3, "role": "operator"}`)
+	require.Equal(t, http.StatusConflict, code)
+	code, _ = do(admin, "POST", "/rbac/bindings", `{"user_id": 3, "role": "janitor"}`)
+	require.Equal(t, http.StatusNotFound, code)
+	code, res := do(operator, "POST", "/rbac/bindings", `{"user_id": 3, "role": "admin"}`)
+	require.Equal(t, http.StatusForbidden, code)
+	require.Equal(t, "user lacks the 'rbac:write' permission", res["error"])
+	code, res = do(admin, "GET", "/rbac/bindings?user_id=4", "")
+	require.Equal(t, http.StatusOK, code)
+	bindings := res["bindings"].([]any)
+	require.Len(t, bindings, 1)
+	supportBinding := bindings[0].(map[string]any)
+	require.Equal(t, "support", supportBinding["role"])
+
+	// custom roles only take known permissions
+	code, _ = do(admin, "POST", "/rbac/roles", `{"name": "auditor", "permissions": ["ledger:audit"]}`)
+	require.Equal(t, http.StatusBadRequest, code)
+	code, _ = do(admin, "POST", "/rbac/roles", `{"name": "auditor", "permissions": ["admin", "transactions:read"]}`)
+	require.Equal(t, http.StatusOK, code)
+	code, res = do(admin, "GET", "/rbac/roles", "")
+	require.Equal(t, http.StatusOK, code)
+	require.Len(t, res["roles"], 4)
+
+	code, res = do(customer, "POST", "/accounts", `{"user_id": 2}`)
+	require.Equal(t, http.StatusOK, code)
+	account := res["account"].(map[string]any)["account_number"].(string)
+
+	// support staff read any user & account, but can't move money or freeze accounts
+	code, _ = do(support, "GET", "/users/2", "")
+	require.Equal(t, http.StatusOK, code)
+	code, _ = do(support, "GET", "/accounts/"+account, "")
+	require.Equal(t, http.StatusOK, code)
+	code, _ = do(support, "POST", "/transactions", fmt.Sprintf(`{"to":"%s","type":"deposit","amount":100,"reference":"%s"}`, account, pkg.CreateAccountNumber()))
+	require.Equal(t, http.StatusForbidden, code)
+	code, res = do(support, "PUT", "/accounts/"+account+"/status", `{"status": "frozen", "reason": "fraud"}`)
+	require.Equal(t, http.StatusForbidden, code)
+	require.Equal(t, "user lacks the 'accounts:freeze' permission", res["error"])
+
+	// operators deposit, reverse & freeze
+	reference := pkg.CreateAccountNumber()
+	code, _ = do(operator, "POST", "/transactions", fmt.Sprintf(`{"to":"%s","type":"deposit","amount":100,"reference":"%s"}`, account, reference))
+	require.Equal(t, http.StatusOK, code)
+	code, _ = do(operator, "POST", "/transactions/"+reference+"/reverse", fmt.Sprintf(`{"reference":"%s"}`, pkg.CreateAccountNumber()))
+	require.Equal(t, http.StatusOK, code)
+	code, _ = do(operator, "PUT", "/accounts/"+account+"/status", `{"status": "active", "reason": "review"}`)
+	require.Equal(t, http.StatusOK, code)
+
+	// but can't extend credit
+	code, res = do(operator, "PUT", "/accounts/"+account+"/overdraft-limit", `{"limit":"100","reason":"approved"}`)
+	require.Equal(t, http.StatusForbidden, code)
+	require.Equal(t, "user lacks the 'accounts:limits' permission", res["error"])
+
+	balance := func() string {
+		code, res := do(admin, "GET", "/accounts/"+account, "")
+		require.Equal(t, http.StatusOK, code)
+		return res["account"].(map[string]any)["balance"].(string)
+	}
+	require.Equal(t, "0", balance())
+
+	// high-value deposits wait for a second operator
+	code, res = do(operator, "POST", "/transactions", fmt.Sprintf(`{"to":"%s","type":"deposit","amount":10000,"reference":"%s"}`, account, pkg.CreateAccountNumber()))
+	require.Equal(t, http.StatusAccepted, code)
+	approval := res["approval"].(map[string]any)
+	require.Equal(t, services.ApprovalPending, approval["status"])
+	require.Equal(t, "user:3", approval["maker"])
+	require.Equal(t, "0", balance())
+
+	approvalPath := fmt.Sprintf("/approvals/%v", approval["id"])
+	code, _ = do(operator, "POST", approvalPath+"/approve", "")
+	require.Equal(t, http.StatusForbidden, code)
+	code, _ = do(support, "POST", approvalPath+"/approve", "")
+	require.Equal(t, http.StatusForbidden, code)
+	code, _ = do(checker, "POST", approvalPath+"/approve", "")
+	require.Equal(t, http.StatusOK, code)
+	require.Equal(t, "10000", balance())
+	code, _ = do(checker, "POST", approvalPath+"/approve", "")
+	require.Equal(t, http.StatusUnprocessableEntity, code)
+
+	code, res = do(operator, "POST", "/transactions", fmt.Sprintf(`{"to":"%s","type":"deposit","amount":25000,"reference":"%s"}`, account, pkg.CreateAccountNumber()))
+	require.Equal(t, http.StatusAccepted, code)
+	code, _ = do(checker, "POST", fmt.Sprintf("/approvals/%v/reject", res["approval"].(map[string]any)["id"]), "")
+	require.Equal(t, http.StatusOK, code)
+	require.Equal(t, "10000", balance())
+
+	code, res = do(checker, "GET", "/approvals?status=approved", "")
+	require.Equal(t, http.StatusOK, code)
+	approvals := res["approvals"].([]any)
+	require.Len(t, approvals, 1)
+	require.Equal(t, "user:5", approvals[0].(map[string]any)["checker"])
+	code, res = do(checker, "GET", "/approvals?status=rejected", "")
+	require.Equal(t, http.StatusOK, code)
+	require.Len(t, res["approvals"], 1)
+
+	// users without a role only get their own accounts
+	code, _ = do(customer, "POST", "/transactions", fmt.Sprintf(`{"to":"%s","type":"deposit","amount":10000,"reference":"%s"}`, account, pkg.CreateAccountNumber()))
+	require.Equal(t, http.StatusForbidden, code)
+	code, _ = do(customer, "GET", "/approvals", "")
+	require.Equal(t, http.StatusForbidden, code)
+
+	// and unbinding a role takes its permissions away
+	code, _ = do(admin, "DELETE", fmt.Sprintf("/rbac/bindings/%v", supportBinding["id"]), "")
+	require.Equal(t, http.StatusOK, code)
+	code, _ = do(support, "GET", "/users/2", "")
+	require.Equal(t, http.StatusNotFound, code)
+	code, _ = do(admin, "DELETE", fmt.Sprintf("/rbac/bindings/%v", supportBinding["id"]), "")
+	require.Equal(t, http.StatusNotFound, code)
+
+	// users can't grant api keys more than their roles grant them
+	code, _ = do(admin, "POST", "/rbac/roles", `{"name": "key-manager", "permissions": ["api-keys:write", "accounts:read"]}`)
+	require.Equal(t, http.StatusOK, code)
+	code, _ = do(admin, "POST", "/rbac/bindings", `{"user_id": 4, "role": "key-manager"}`)
+	require.Equal(t, http.StatusOK, code)
+	code, res = do(support, "POST", "/api-keys", `{"name":"root","scopes":["*"]}`)
+	require.Equal(t, http.StatusForbidden, code)
+	require.Equal(t, "can't grant the '*' scope, you don't have it", res["error"])
+	code, res = do(support, "POST", "/api-keys", `{"name":"reader","scopes":["accounts:read"]}`)
+	require.Equal(t, http.StatusOK, code)
+	require.Equal(t, "user:4/api_key:"+res["api_key"].(map[string]any)["prefix"].(string), res["api_key"].(map[string]any)["lineage"])
+}
+
+func TestApprovalsByAPIKeys(t *testing.T) {
+	ctx, r, db, logger, teardown := setup(t)
+	defer teardown()
+
+	kr := repos.NewAPIKeys(logger, db.Instance())
+	r.Use(services.Authenticate(logger, kr, repos.NewRBAC(logger, db.Instance()), nil))
+	do := authedRequests(t, r)
+
+	tx, err := kr.GetTx(ctx)
+	require.NoError(t, err)
+	admin, err := services.CreateAPIKey(ctx, tx, kr, "admin", []string{services.ScopeAll}, false)
+	require.NoError(t, err)
+	checker, err := services.CreateAPIKey(ctx, tx, kr, "checker", []string{"approvals:write"}, false)
+	require.NoError(t, err)
+	require.NoError(t, tx.Commit())
+
+	code, res := do(admin.Key, "POST", "/api-keys", `{"name":"maker","scopes":["transactions:write","approvals:write","api-keys:write"]}`)
+	require.Equal(t, http.StatusOK, code)
+	maker := res["api_key"].(map[string]any)
+	require.Equal(t, admin.Lineage+"/api_key:"+maker["prefix"].(string), maker["lineage"])
+
+	code, _ = do(admin.Key, "POST", "/users", `{"email": "1@gmail.com"}`)
+	require.Equal(t, http.StatusOK, code)
+	code, res = do(admin.Key, "POST", "/accounts", `{"user_id": 1}`)
+	require.Equal(t, http.StatusOK, code)
+	account := res["account"].(map[string]any)["account_number"]
+
+	code, res = do(maker["key"].(string), "POST", "/transactions", fmt.Sprintf(`{"to":"%s","type":"deposit","amount":10000,"reference":"%s"}`, account, pkg.CreateAccountNumber()))
+	require.Equal(t, http.StatusAccepted, code)
+	approval := res["approval"].(map[string]any)
+	require.Equal(t, maker["lineage"], approval["maker"])
+	approvalPath := fmt.Sprintf("/approvals/%v/approve", approval["id"])
+
+	// rotating their key doesn't make the maker someone else
+	code, res = do(maker["key"].(string), "POST", fmt.Sprintf("/api-keys/%v/rotate", maker["id"]), "")
+	require.Equal(t, http.StatusOK, code)
+	rotated := res["api_key"].(map[string]any)
+	require.Equal(t, maker["lineage"], rotated["lineage"])
+	code, res = do(rotated["key"].(string), "POST", approvalPath, "")
+	require.Equal(t, http.StatusForbidden, code)
+	require.Equal(t, "approvals need someone other than whoever requested them", res["error"])
+
+	// and neither do the keys they issue, nor the key that issued theirs
+	code, res = do(rotated["key"].(string), "POST", "/api-keys", `{"name":"accomplice","scopes":["approvals:write"]}`)
+	require.Equal(t, http.StatusOK, code)
+	code, _ = do(res["api_key"].(map[string]any)["key"].(string), "POST", approvalPath, "")
+	require.Equal(t, http.StatusForbidden, code)
+	code, _ = do(admin.Key, "POST", approvalPath, "")
+	require.Equal(t, http.StatusForbidden, code)
+
+	code, _ = do(checker.Key, "POST", approvalPath, "")
+	require.Equal(t, http.StatusOK, code)
+}
+
+func TestRateLimit(t *testing.T) {
+	stores := map[string]func(logger *slog.Logger, db *database.DB) services.RateLimitStore{
+		"memory": func(*slog.Logger, *database.DB) services.RateLimitStore { return services.NewMemoryRateLimitStore() },
+		"db": func(logger *slog.Logger, db *database.DB) services.RateLimitStore {
+			return repos.NewRateLimits(logger, db.Instance())
+		},
+	}
+	for name, store := range stores {
+		t.Run(name, func(t *testing.T) {
+			ctx, r, db, logger, teardown := setup(t)
+			defer teardown()
+
+			kr := repos.NewAPIKeys(logger, db.Instance())
+			limiter := store(logger, db)
+			limits := services.RateLimits{
+				Default:      pkg.RateLimit{PerMinute: 60, Burst: 3},
+				Transactions: pkg.RateLimit{PerMinute: 60, Burst: 1},
+				IP:           pkg.RateLimit{PerMinute: 60, Burst: 10},
+			}
+			r.Use(services.RateLimitIPs(logger, limiter, limits))
+			r.Use(services.Authenticate(logger, kr, repos.NewRBAC(logger, db.Instance()), nil))
+			r.Use(services.RateLimit(logger, limiter, limits))
+			r.Path("/").Methods(http.MethodGet).HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				w.Write([]byte(`{}`))
+			})
+
+			tx, err := kr.GetTx(ctx)
+			require.NoError(t, err)
+			first, err := services.CreateAPIKey(ctx, tx, kr, "first", []string{services.ScopeAll}, false)
+			require.NoError(t, err)
+			second, err := services.CreateAPIKey(ctx, tx, kr, "second", []string{services.ScopeAll}, false)
+			require.NoError(t, err)
+			require.NoError(t, tx.Commit())
+
+			doFrom := func(ip, token, method, path string) *httptest.ResponseRecorder {
+				req := httptest.NewRequest(method, path, bytes.NewBuffer([]byte(`{}`)))
+				req.RemoteAddr = ip + ":1234"
+				if token != "" {
+					req.Header.Set("Authorization", "Bearer "+token)
+				}
+				w := httptest.NewRecorder()
+				r.ServeHTTP(w, req)
+				return w
+			}
+			do := func(token, method, path string) *httptest.ResponseRecorder {
+				return doFrom("192.0.2.1", token, method, path)
+			}
+
+			// each key gets its own bucket
+			for i := 0; i < 3; i++ {
+				require.Equal(t, http.StatusOK, do(first.Key, "GET", "/api-keys").Code)
+			}
+			w := do(first.Key, "GET", "/api-keys")
+			require.Equal(t, http.StatusTooManyRequests, w.Code)
+			require.Equal(t, "1", w.Header().Get("Retry-After"))
+			require.Equal(t, http.StatusOK, do(second.Key, "GET", "/api-keys").Code)
+
+			// posting transactions has a limit of its own
+			require.NotEqual(t, http.StatusTooManyRequests, do(second.Key, "POST", "/transactions").Code)
+			require.Equal(t, http.StatusTooManyRequests, do(second.Key, "POST", "/transactions").Code)
+			require.Equal(t, http.StatusOK, do(second.Key, "GET", "/api-keys").Code)
+
+			// anonymous clients are limited by ip
+			for i := 0; i < 10; i++ {
+				require.Equal(t, http.StatusOK, doFrom("192.0.2.2", "", "GET", "/").Code)
+			}
+			require.Equal(t, http.StatusTooManyRequests, doFrom("192.0.2.2", "", "GET", "/").Code)
+
+			// and so are requests with bad credentials, before they're looked up
+			for i := 0; i < 10; i++ {
+				require.Equal(t, http.StatusUnauthorized, doFrom("192.0.2.3", "ak_guess", "GET", "/api-keys").Code)
+			}
+			require.Equal(t, http.StatusTooManyRequests, doFrom("192.0.2.3", "ak_guess", "GET", "/api-keys").Code)
+			require.Equal(t, http.StatusTooManyRequests, doFrom("192.0.2.3", "", "GET", "/api-keys").Code)
+			require.Equal(t, http.StatusOK, doFrom("192.0.2.4", second.Key, "GET", "/api-keys").Code)
+		})
+	}
+}
+
+func TestRequestSigning(t *testing.T) {
+	ctx, r, db, logger, teardown := setup(t)
+	defer teardown()
+
+	kr := repos.NewAPIKeys(logger, db.Instance())
+	r.Use(services.Authenticate(logger, kr, repos.NewRBAC(logger, db.Instance()), nil))
+	r.Use(services.VerifySignatures(logger, repos.NewNonces(logger, db.Instance())))
+
+	tx, err := kr.GetTx(ctx)
+	require.NoError(t, err)
+	admin, err := services.CreateAPIKey(ctx, tx, kr, "admin", []string{services.ScopeAll}, false)
+	require.NoError(t, err)
+	require.NoError(t, tx.Commit())
+
+	request := func(key, method, path, body string) *http.Request {
+		req := httptest.NewRequest(method, path, bytes.NewBuffer([]byte(body)))
+		req.Header.Set("Authorization", "Bearer "+key)
+		return req
+	}
+	do := func(req *http.Request) (int, map[string]any) {
+		var res map[string]any
+		w := performRequestAndGetResponse[map[string]any](r, t)(req, &res)
+		return w.Code, res
+	}
+
+	code, res := do(request(admin.Key, "POST", "/api-keys", `{"name":"gateway","scopes":["*"],"signed":true}`))
+	require.Equal(t, http.StatusOK, code)
+	gateway := res["api_key"].(map[string]any)
+	require.Equal(t, true, gateway["signed"])
+	secret := res["signing_secret"].(string)
+	key := gateway["key"].(string)
+
+	code, _ = do(request(admin.Key, "POST", "/users", `{"email": "1@gmail.com"}`))
+	require.Equal(t, http.StatusOK, code)
+	code, res = do(request(admin.Key, "POST", "/accounts", `{"user_id": 2}`))
+	require.Equal(t, http.StatusOK, code)
+	deposit := fmt.Sprintf(`{"to":"%s","type":"deposit","amount":100,"reference":"%s"}`, res["account"].(map[string]any)["account_number"], pkg.CreateAccountNumber())
+
+	// the signed key's requests must be signed, the other keys' don't need to be
+	code, res = do(request(key, "POST", "/transactions", deposit))
+	require.Equal(t, http.StatusUnauthorized, code)
+	require.Equal(t, "invalid signature, request isn't signed", res["error"])
+
+	signed := request(key, "POST", "/transactions", deposit)
+	require.NoError(t, pkg.SignRequest(signed, secret, time.Now()))
+	replay := request(key, "POST", "/transactions", deposit)
+	replay.Header = signed.Header.Clone()
+	code, _ = do(signed)
+	require.Equal(t, http.StatusOK, code)
+
+	// and can't be replayed, tampered with or signed too long ago
+	code, res = do(replay)
+	require.Equal(t, http.StatusUnauthorized, code)
+	require.Equal(t, "invalid signature, nonce already used", res["error"])
+
+	original := request(key, "POST", "/transactions", deposit)
+	require.NoError(t, pkg.SignRequest(original, secret, time.Now()))
+	tampered := request(key, "POST", "/transactions", strings.Replace(deposit, "100", "100000", 1))
+	tampered.Header = original.Header.Clone()
+	code, res = do(tampered)
+	require.Equal(t, http.StatusUnauthorized, code)
+	require.Equal(t, "invalid signature, signature mismatch", res["error"])
+
+	stale := request(key, "GET", "/api-keys", "")
+	require.NoError(t, pkg.SignRequest(stale, secret, time.Now().Add(-10*time.Minute)))
+	code, _ = do(stale)
+	require.Equal(t, http.StatusUnauthorized, code)
+
+	wrong := request(key, "GET", "/api-keys", "")
+	require.NoError(t, pkg.SignRequest(wrong, "sig_nope", time.Now()))
+	code, _ = do(wrong)
+	require.Equal(t, http.StatusUnauthorized, code)
+
+	// rotating a signed key signs the new one with a new secret
+	code, res = do(request(admin.Key, "POST", fmt.Sprintf("/api-keys/%v/rotate", gateway["id"]), ""))
+	require.Equal(t, http.StatusOK, code)
+	rotated := res["api_key"].(map[string]any)["key"].(string)
+	require.NotEqual(t, secret, res["signing_secret"])
+	get := request(rotated, "GET", "/api-keys", "")
+	require.NoError(t, pkg.SignRequest(get, res["signing_secret"].(string), time.Now()))
+	code, res = do(get)
+	require.Equal(t, http.StatusOK, code)
+
+	// secrets aren't listed
+	for _, k := range res["api_keys"].([]any) {
+		require.NotContains(t, k, "signing_secret")
+	}
+}
+
+func TestIdempotency(t *testing.T) {
+	ctx, r, db, logger, teardown := setup(t)
+	defer teardown()
+
+	kr := repos.NewAPIKeys(logger, db.Instance())
+	ir := repos.NewIdempotency(logger, db.Instance())
+	r.Use(services.Authenticate(logger, kr, repos.NewRBAC(logger, db.Instance()), nil))
+	r.Use(services.Idempotency(logger, ir))
+
+	tx, err := kr.GetTx(ctx)
+	require.NoError(t, err)
+	first, err := services.CreateAPIKey(ctx, tx, kr, "first", []string{services.ScopeAll}, false)
+	require.NoError(t, err)
+	second, err := services.CreateAPIKey(ctx, tx, kr, "second", []string{services.ScopeAll}, false)
+	require.NoError(t, err)
+	require.NoError(t, tx.Commit())
+
+	do := func(token, idempotencyKey, method, path, body string) (*httptest.ResponseRecorder, map[string]any) {
+		req := httptest.NewRequest(method, path, bytes.NewBuffer([]byte(body)))
+		req.Header.Set("Authorization", "Bearer "+token)
+		if idempotencyKey != "" {
+			req.Header.Set(services.IdempotencyKeyHeader, idempotencyKey)
+		}
+		var res map[string]any
+		w := performRequestAndGetResponse[map[string]any](r, t)(req, &res)
+		return w, res
+	}
+
+	// retries get the original response again, without creating anything
+	w, user := do(first.Key, "user-1", "POST", "/users", `{"email": "1@gmail.com"}`)
+	require.Equal(t, http.StatusOK, w.Code)
+	require.Empty(t, w.Header().Get(services.IdempotentReplayedHeader))
+	w, res := do(first.Key, "user-1", "POST", "/users", `{"email": "1@gmail.com"}`)
+	require.Equal(t, http.StatusOK, w.Code)
+	require.Equal(t, "true", w.Header().Get(services.IdempotentReplayedHeader))
+	require.Equal(t, user, res)
+
+	w, account := do(first.Key, "account-1", "POST", "/accounts", `{"user_id": 1}`)
+	require.Equal(t, http.StatusOK, w.Code)
+	w, res = do(first.Key, "account-1", "POST", "/accounts", `{"user_id": 1}`)
+	require.Equal(t, http.StatusOK, w.Code)
+	require.Equal(t, account, res)
+	accountNumber := account["account"].(map[string]any)["account_number"]
+
+	deposit := fmt.Sprintf(`{"to":"%s","type":"deposit","amount":100,"reference":"%s"}`, accountNumber, pkg.CreateAccountNumber())
+	w, transaction := do(first.Key, "deposit-1", "POST", "/transactions", deposit)
+	require.Equal(t, http.StatusOK, w.Code)
+	w, res = do(first.Key, "deposit-1", "POST", "/transactions", deposit)
+	require.Equal(t, http.StatusOK, w.Code)
+	require.Equal(t, "true", w.Header().Get(services.IdempotentReplayedHeader))
+	require.Equal(t, transaction, res)
+
+	// without a key, a repeated reference is still a conflict
+	w, res = do(first.Key, "", "POST", "/transactions", deposit)
+	require.Equal(t, http.StatusConflict, w.Code)
+
+	w, res = do(first.Key, "", "GET", fmt.Sprintf("/accounts/%s/transactions", accountNumber), "")
+	require.Equal(t, http.StatusOK, w.Code)
+	require.Len(t, res["transactions"], 1)
+
+	// reusing a key for a different request is refused
+	w, res = do(first.Key, "deposit-1", "POST", "/transactions", strings.Replace(deposit, "100", "200", 1))
+	require.Equal(t, http.StatusUnprocessableEntity, w.Code)
+	require.Equal(t, "idempotency key was already used for a different request", res["error"])
+	w, _ = do(first.Key, "deposit-1", "POST", "/users", `{"email": "2@gmail.com"}`)
+	require.Equal(t, http.StatusUnprocessableEntity, w.Code)
+
+	// failed requests are replayed too, they'd fail the same way again
+	w, res = do(first.Key, "user-2", "POST", "/users", `{"email": ""}`)
+	require.Equal(t, http.StatusBadRequest, w.Code)
+	w, replayed := do(first.Key, "user-2", "POST", "/users", `{"email": ""}`)
+	require.Equal(t, http.StatusBadRequest, w.Code)
+	require.Equal(t, "true", w.Header().Get(services.IdempotentReplayedHeader))
+	require.Equal(t, res, replayed)
+
+	// keys are each client's own
+	w, res = do(second.Key, "user-1", "POST", "/users", `{"email": "1@gmail.com"}`)
+	require.Equal(t, http.StatusBadRequest, w.Code)
+	require.Equal(t, "email already taken", res["error"])
+	require.Empty(t, w.Header().Get(services.IdempotentReplayedHeader))
+
+	// a retry while the original is still in progress is a conflict
+	w, _ = do(second.Key, "user-3", "POST", "/users", `{"email": "3@gmail.com"}`)
+	require.Equal(t, http.StatusOK, w.Code)
+	_, err = db.Instance().Exec("update idempotency_keys set status=$1 where idempotency_key='user-3';", services.IdempotencyInProgress)
+	require.NoError(t, err)
+	w, res = do(second.Key, "user-3", "POST", "/users", `{"email": "3@gmail.com"}`)
+	require.Equal(t, http.StatusConflict, w.Code)
+	require.Equal(t, "a request with this idempotency key is still in progress", res["error"])
+
+	// keys are forgotten once they expire
+	used, err := ir.Reserve(ctx, &models.IdempotencyKey{Client: second.Lineage, Key: "user-4", Fingerprint: "fingerprint", Status: services.IdempotencyInProgress}, time.Now().Add(time.Hour), time.Now())
+	require.NoError(t, err)
+	require.Nil(t, used)
+	w, _ = do(second.Key, "user-3", "POST", "/users", `{"email": "4@gmail.com"}`)
+	require.Equal(t, http.StatusOK, w.Code)
+
+	// keys left in progress by a request that died with its process are given up after a while
+	w, _ = do(second.Key, "user-5", "POST", "/users", `{"email": "5@gmail.com"}`)
+	require.Equal(t, http.StatusOK, w.Code)
+	_, err = db.Instance().Exec("delete from users where email='5@gmail.com';")
+	require.NoError(t, err)
+	_, err = db.Instance().Exec("update idempotency_keys set status=$1, response_code=0, response_body='' where idempotency_key='user-5';", services.IdempotencyInProgress)
+	require.NoError(t, err)
+	w, _ = do(second.Key, "user-5", "POST", "/users", `{"email": "5@gmail.com"}`)
+	require.Equal(t, http.StatusConflict, w.Code)
+	_, err = db.Instance().Exec("update idempotency_keys set created_at=$1 where idempotency_key='user-5';", time.Now().UTC().Add(-2*services.IdempotencyKeyAbandonedAfter))
+	require.NoError(t, err)
+	w, res = do(second.Key, "user-5", "POST", "/users", `{"email": "5@gmail.com"}`)
+	require.Equal(t, http.StatusOK, w.Code)
+	require.Empty(t, w.Header().Get(services.IdempotentReplayedHeader))
+	require.Equal(t, "5@gmail.com", res["user"].(map[string]any)["email"])
+
+	// erasing a user erases their email from the responses kept for replaying too
+	erased := fmt.Sprintf("erased-%v@users.invalid", res["user"].(map[string]any)["id"])
+	w, _ = do(second.Key, "", "POST", fmt.Sprintf("/users/%v/erase", res["user"].(map[string]any)["id"]), "")
+	require.Equal(t, http.StatusOK, w.Code)
+	var kept int
+	err = db.Instance().QueryRow("select count(*) from idempotency_keys where response_body like '%5@gmail.com%';").Scan(&kept)
+	require.NoError(t, err)
+	require.Zero(t, kept)
+	w, res = do(second.Key, "user-5", "POST", "/users", `{"email": "5@gmail.com"}`)
+	require.Equal(t, http.StatusOK, w.Code)
+	require.Equal(t, "true", w.Header().Get(services.IdempotentReplayedHeader))
+	require.Equal(t, erased, res["user"].(map[string]any)["email"])
+
+	// only the creating routes honour keys
+	w, _ = do(first.Key, "user-1", "GET", "/api-keys", "")
+	require.Equal(t, http.StatusOK, w.Code)
+	require.Empty(t, w.Header().Get(services.IdempotentReplayedHeader))
 }
@@ -0,0 +1,467 @@
+package services
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"time"
+
+	"github.com/gorilla/mux"
+	"github.com/gwuah/accounts/internal/models"
+	"github.com/gwuah/accounts/internal/repos"
+	"github.com/gwuah/accounts/pkg"
+	"github.com/shopspring/decimal"
+)
+
+type InterestRepository interface {
+	GetTx(ctx context.Context) (*sql.Tx, error)
+	SaveConfig(ctx context.Context, tx *sql.Tx, c *models.InterestConfig) error
+	GetConfig(ctx context.Context, tx *sql.Tx, accountID int) (*models.InterestConfig, error)
+	GetConfigs(ctx context.Context, tx *sql.Tx) ([]*models.InterestConfig, error)
+	GetLastAccrualDate(ctx context.Context, tx *sql.Tx, accountID int) (*time.Time, error)
+	CreateAccrual(ctx context.Context, tx *sql.Tx, a *models.InterestAccrual) (bool, error)
+	GetPendingAccruals(ctx context.Context, tx *sql.Tx, accountID int, before time.Time) ([]*models.InterestAccrual, error)
+	MarkPosted(ctx context.Context, tx *sql.Tx, accountID int, before time.Time, transactionID int) error
+}
+
+type setInterestRequest struct {
+	// APR is a percentage, eg. 4.5 for 4.5% a year.
+	APR      decimal.Decimal `json:"apr"`
+	DayCount string          `json:"day_count"`
+	// EffectiveFrom is the first day the account accrues interest, today when it's omitted.
+	EffectiveFrom string `json:"effective_from"`
+}
+
+func (r setInterestRequest) validate() error {
+	if r.APR.IsNegative() || r.APR.GreaterThan(decimal.New(100, 0)) {
+		return errors.New("'apr' must be between 0 and 100")
+	}
+	if r.DayCount != "" && !pkg.IsDayCountConvention(r.DayCount) {
+		return fmt.Errorf("'day_count' must be either '%s' or '%s'", pkg.ACT365, pkg.Thirty360)
+	}
+	if r.EffectiveFrom != "" {
+		if _, err := time.Parse(time.DateOnly, r.EffectiveFrom); err != nil {
+			return errors.New("'effective_from' must be a date (2006-01-02)")
+		}
+	}
+	return nil
+}
+
+func setInterest(global *slog.Logger, accountRepo AccountRepository, interestRepo InterestRepository) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		logger := global.With("entity", "interest")
+		accountNumber := mux.Vars(r)["accountNumber"]
+
+		var req setInterestRequest
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			logger.Error("error reading request", "err", err)
+			writeBadRequest(w, err)
+			return
+		}
+		if err := req.validate(); err != nil {
+			logger.Error("error validating request", "err", err)
+			writeBadRequest(w, err)
+			return
+		}
+		if pkg.IsSystemAccountNumber(accountNumber) {
+			writeBadRequest(w, errors.New("action not allowed for this account number"))
+			return
+		}
+
+		config := &models.InterestConfig{
+			APR:           req.APR,
+			DayCount:      req.DayCount,
+			EffectiveFrom: time.Now().UTC().Truncate(24 * time.Hour),
+		}
+		if config.DayCount == "" {
+			config.DayCount = pkg.ACT365
+		}
+		if req.EffectiveFrom != "" {
+			config.EffectiveFrom, _ = time.Parse(time.DateOnly, req.EffectiveFrom)
+		}
+
+		tx, err := interestRepo.GetTx(r.Context())
+		if err != nil {
+			logger.Error("failed to acquire db transaction", "err", err)
+			writeInternalServer(w, "failed to set interest")
+			return
+		}
+
+		accounts, err := accountRepo.GetAccounts(r.Context(), tx, []string{accountNumber})
+		if err != nil {
+			tx.Rollback()
+			logger.Error("failed to get accounts", "err", err)
+			writeInternalServer(w, "failed to set interest")
+			return
+		}
+		account := getAccountByAccountNumber(accounts, accountNumber)
+		if account == nil {
+			tx.Rollback()
+			writeNotFound(w, "account not found")
+			return
+		}
+		if account.Type == CreditLineAccount {
+			tx.Rollback()
+			writeBadRequest(w, errors.New("credit lines don't earn interest"))
+			return
+		}
+		config.AccountID = account.ID
+
+		err = interestRepo.SaveConfig(r.Context(), tx, config)
+		if err != nil {
+			tx.Rollback()
+			logger.Error("failed to save interest config", "err", err)
+			writeInternalServer(w, "failed to set interest")
+			return
+		}
+
+		err = tx.Commit()
+		if err != nil {
+			logger.Error("failed to commit db transaction", "err", err)
+			writeInternalServer(w, "failed to set interest")
+			return
+		}
+
+		writeOk(w, map[string]interface{}{
+			"interest": config,
+		})
+	}
+}
+
+func getInterest(global *slog.Logger, accountRepo AccountRepository, interestRepo InterestRepository) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		logger := global.With("entity", "interest")
+		accountNumber := mux.Vars(r)["accountNumber"]
+
+		tx, err := interestRepo.GetTx(r.Context())
+		if err != nil {
+			logger.Error("failed to acquire db transaction", "err", err)
+			writeInternalServer(w, "failed to get interest")
+			return
+		}
+		defer tx.Rollback()
+
+		accounts, err := accountRepo.GetAccounts(r.Context(), tx, []string{accountNumber})
+		if err != nil {
+			logger.Error("failed to get accounts", "err", err)
+			writeInternalServer(w, "failed to get interest")
+			return
+		}
+		account := getAccountByAccountNumber(accounts, accountNumber)
+		if account == nil || !canAccess(r.Context(), account.UserID) {
+			writeNotFound(w, "account not found")
+			return
+		}
+
+		config, err := interestRepo.GetConfig(r.Context(), tx, account.ID)
+		if err != nil {
+			logger.Error("failed to get interest config", "err", err)
+			writeInternalServer(w, "failed to get interest")
+			return
+		}
+		if config == nil {
+			writeNotFound(w, "account doesn't earn interest")
+			return
+		}
+
+		currency, err := pkg.GetCurrency(account.Currency)
+		if err != nil {
+			logger.Error("account has unsupported currency", "err", err)
+			writeInternalServer(w, "failed to get interest")
+			return
+		}
+
+		// everything accrued so far that hasn't been posted yet.
+		pending, err := interestRepo.GetPendingAccruals(r.Context(), tx, account.ID, time.Now().UTC())
+		if err != nil {
+			logger.Error("failed to get pending accruals", "err", err)
+			writeInternalServer(w, "failed to get interest")
+			return
+		}
+		accrued := decimal.Zero
+		for _, accrual := range pending {
+			accrued = accrued.Add(accrual.Amount)
+		}
+
+		writeOk(w, map[string]interface{}{
+			"interest": config,
+			"accrued":  accrued.Shift(-currency.Exponent),
+		})
+	}
+}
+
+// AccrueInterest accrues interest on every account that earns it, for each day up to & including until that it hasn't accrued yet.
+// A day accrues on the account's balance at the end of that day, so only days that have ended can be accrued.
+// Accruing is idempotent, each account accrues at most once per day. It returns the number of accruals created.
+func AccrueInterest(ctx context.Context, logger *slog.Logger, transactionRepo TransactionRepository, interestRepo InterestRepository, until time.Time) (int, error) {
+	until = until.UTC().Truncate(24 * time.Hour)
+	if !until.Before(time.Now().UTC().Truncate(24 * time.Hour)) {
+		return 0, fmt.Errorf("can't accrue interest for %s, the day hasn't ended yet", until.Format(time.DateOnly))
+	}
+
+	tx, err := interestRepo.GetTx(ctx)
+	if err != nil {
+		return 0, err
+	}
+	configs, err := interestRepo.GetConfigs(ctx, tx)
+	tx.Rollback()
+	if err != nil {
+		return 0, err
+	}
+
+	created := 0
+	for _, config := range configs {
+		n, err := accrueAccountInterest(ctx, transactionRepo, interestRepo, config, until)
+		created += n
+		if err != nil {
+			return created, fmt.Errorf("failed to accrue interest of account %d. %w", config.AccountID, err)
+		}
+	}
+
+	if created > 0 {
+		logger.Info("interest accrued", "accruals", created, "until", until.Format(time.DateOnly))
+	}
+	return created, nil
+}
+
+func accrueAccountInterest(ctx context.Context, transactionRepo TransactionRepository, interestRepo InterestRepository, config *models.InterestConfig, until time.Time) (int, error) {
+	tx, err := interestRepo.GetTx(ctx)
+	if err != nil {
+		return 0, err
+	}
+
+	from := config.EffectiveFrom.UTC().Truncate(24 * time.Hour)
+	last, err := interestRepo.GetLastAccrualDate(ctx, tx, config.AccountID)
+	if err != nil {
+		tx.Rollback()
+		return 0, err
+	}
+	if last != nil && !last.UTC().Before(from) {
+		from = last.UTC().AddDate(0, 0, 1)
+	}
+
+	created := 0
+	for day := from; !day.After(until); day = day.AddDate(0, 0, 1) {
+		balance, err := transactionRepo.GetBalanceAt(ctx, tx, config.AccountID, day.AddDate(0, 0, 1))
+		if err != nil {
+			tx.Rollback()
+			return 0, err
+		}
+
+		// negative balances don't earn interest, the day is still recorded so it isn't accrued again.
+		amount := decimal.Zero
+		if balance.Ledger > 0 {
+			amount = pkg.DailyInterest(balance.Ledger, config.APR, config.DayCount, day)
+		}
+
+		ok, err := interestRepo.CreateAccrual(ctx, tx, &models.InterestAccrual{
+			AccountID:   config.AccountID,
+			AccrualDate: day,
+			Balance:     balance.Ledger,
+			APR:         config.APR,
+			DayCount:    config.DayCount,
+			Amount:      amount,
+		})
+		if err != nil {
+			tx.Rollback()
+			return 0, err
+		}
+		if ok {
+			created++
+		}
+	}
+
+	return created, tx.Commit()
+}
+
+// CapitalizeInterest posts the interest every account accrued before the given day (typically the first of a month),
+// as a transaction from its currency's interest expense account. Accruals are summed up and then rounded to the currency's minor units,
+// an account whose accruals round to nothing keeps them pending until the next capitalization, and so does an account that can't be credited,
+// eg. a frozen one. It returns the number of transactions posted.
+func CapitalizeInterest(ctx context.Context, logger *slog.Logger, accountRepo AccountRepository, transactionRepo TransactionRepository, interestRepo InterestRepository, webhookRepo WebhookRepository, before time.Time) (int, error) {
+	before = before.UTC().Truncate(24 * time.Hour)
+
+	tx, err := interestRepo.GetTx(ctx)
+	if err != nil {
+		return 0, err
+	}
+	pending, err := interestRepo.GetPendingAccruals(ctx, tx, 0, before)
+	tx.Rollback()
+	if err != nil {
+		return 0, err
+	}
+
+	// accruals come ordered by account, so each account's accruals are contiguous.
+	posted := 0
+	for start := 0; start < len(pending); {
+		end := start
+		for end < len(pending) && pending[end].AccountID == pending[start].AccountID {
+			end++
+		}
+
+		ok, err := postInterest(ctx, accountRepo, transactionRepo, interestRepo, webhookRepo, pending[start:end], before)
+		if err != nil {
+			return posted, fmt.Errorf("failed to capitalize interest of account %s. %w", pending[start].AccountNumber, err)
+		}
+		if ok {
+			posted++
+		}
+		start = end
+	}
+
+	if posted > 0 {
+		logger.Info("interest capitalized", "transactions", posted, "before", before.Format(time.DateOnly))
+	}
+	return posted, nil
+}
+
+// accrueAccount accrues the account's interest for the days that have ended, if it earns any. It's for accounts about to stop
+// earning interest, ie. being closed, which can't wait for the next run of AccrueInterest.
+func accrueAccount(ctx context.Context, accountRepo AccountRepository, transactionRepo TransactionRepository, interestRepo InterestRepository, accountNumber string) error {
+	tx, err := interestRepo.GetTx(ctx)
+	if err != nil {
+		return err
+	}
+	accounts, err := accountRepo.GetAccounts(ctx, tx, []string{accountNumber})
+	if err != nil {
+		tx.Rollback()
+		return err
+	}
+	account := getAccountByAccountNumber(accounts, accountNumber)
+	if account == nil || account.Status == AccountClosed {
+		tx.Rollback()
+		return nil
+	}
+	config, err := interestRepo.GetConfig(ctx, tx, account.ID)
+	tx.Rollback()
+	if err != nil || config == nil {
+		return err
+	}
+
+	yesterday := time.Now().UTC().Add(-snapshotDelay).Truncate(24*time.Hour).AddDate(0, 0, -1)
+	_, err = accrueAccountInterest(ctx, transactionRepo, interestRepo, config, yesterday)
+	return err
+}
+
+func postInterest(ctx context.Context, accountRepo AccountRepository, transactionRepo TransactionRepository, interestRepo InterestRepository, webhookRepo WebhookRepository, accruals []*models.InterestAccrual, before time.Time) (bool, error) {
+	tx, err := transactionRepo.GetTx(ctx)
+	if err != nil {
+		return false, err
+	}
+
+	transaction, _, err := capitalizeAccruals(ctx, tx, accountRepo, transactionRepo, interestRepo, webhookRepo, accruals, before)
+	if err != nil || transaction == nil {
+		tx.Rollback()
+		return false, err
+	}
+	return true, tx.Commit()
+}
+
+// capitalizeAccruals posts the account's accruals in tx, returning the transaction it posted. It posts nothing if they round to nothing,
+// or returns why when the account can't be credited, eg. it's frozen, the accruals then stay pending until it can.
+func capitalizeAccruals(ctx context.Context, tx *sql.Tx, accountRepo AccountRepository, transactionRepo TransactionRepository, interestRepo InterestRepository, webhookRepo WebhookRepository, accruals []*models.InterestAccrual, before time.Time) (*models.Transaction, string, error) {
+	first, last := accruals[0], accruals[len(accruals)-1]
+
+	total := decimal.Zero
+	for _, accrual := range accruals {
+		total = total.Add(accrual.Amount)
+	}
+	amount := total.Round(0).IntPart()
+	if amount <= 0 {
+		return nil, "", nil
+	}
+
+	currency, err := pkg.GetCurrency(first.Currency)
+	if err != nil {
+		return nil, "", err
+	}
+
+	expenseAccountNumber := pkg.SystemAccountNumber(pkg.InterestExpenseRole, currency)
+	accounts, err := accountRepo.GetAccounts(ctx, tx, []string{expenseAccountNumber})
+	if err != nil {
+		return nil, "", err
+	}
+	expense := getAccountByAccountNumber(accounts, expenseAccountNumber)
+	if expense == nil {
+		return nil, "", fmt.Errorf("missing interest expense account for %s", currency.Code)
+	}
+
+	lines := []*models.TransactionLine{
+		{AccountID: expense.ID, Amount: amount, Purpose: string(repos.DEBIT)},
+		{AccountID: first.AccountID, Amount: amount, Purpose: string(repos.CREDIT)},
+	}
+	err = transactionRepo.LockAccounts(ctx, tx, lineAccountIDs(lines))
+	if err != nil {
+		return nil, "", err
+	}
+	reason, err := checkStatuses(ctx, tx, accountRepo, lines)
+	if err != nil || reason != "" {
+		return nil, reason, err
+	}
+
+	// the reference is unique per account & last day accrued, the accruals being marked as posted in the same db transaction.
+	transaction := &models.Transaction{
+		Reference:            fmt.Sprintf("interest-%s-%s", first.AccountNumber, last.AccrualDate.UTC().Format(time.DateOnly)),
+		Type:                 Interest,
+		Amount:               &amount,
+		SourceAccountID:      &expense.ID,
+		DestinationAccountID: &first.AccountID,
+	}
+	err = transactionRepo.Create(ctx, tx, transaction)
+	if err != nil {
+		return nil, "", err
+	}
+	for _, line := range lines {
+		line.TransactionID = transaction.ID
+		err = transactionRepo.CreateTransactionLine(ctx, tx, line)
+		if err != nil {
+			return nil, "", err
+		}
+	}
+
+	err = interestRepo.MarkPosted(ctx, tx, first.AccountID, before, transaction.ID)
+	if err != nil {
+		return nil, "", err
+	}
+
+	err = publishTransaction(ctx, tx, transactionRepo, webhookRepo, transaction)
+	if err != nil {
+		return nil, "", err
+	}
+	return transaction, "", nil
+}
+
+// RunInterest accrues the days that have ended and capitalizes the months that have ended, every interval until ctx is done.
+func RunInterest(ctx context.Context, logger *slog.Logger, accountRepo AccountRepository, transactionRepo TransactionRepository, interestRepo InterestRepository, webhookRepo WebhookRepository, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case now := <-ticker.C:
+			today := now.UTC().Add(-snapshotDelay).Truncate(24 * time.Hour)
+			_, err := AccrueInterest(ctx, logger, transactionRepo, interestRepo, today.AddDate(0, 0, -1))
+			if err != nil {
+				logger.Error("failed to accrue interest", "err", err)
+				continue
+			}
+
+			month := time.Date(today.Year(), today.Month(), 1, 0, 0, 0, 0, time.UTC)
+			_, err = CapitalizeInterest(ctx, logger, accountRepo, transactionRepo, interestRepo, webhookRepo, month)
+			if err != nil {
+				logger.Error("failed to capitalize interest", "err", err)
+			}
+		}
+	}
+}
+
+func AddInterestRoutes(logger *slog.Logger, r *mux.Router, accountRepo AccountRepository, interestRepo InterestRepository) {
+	r.Methods("PUT").Path("/accounts/{accountNumber}/interest").HandlerFunc(setInterest(logger, accountRepo, interestRepo))
+	r.Methods("GET").Path("/accounts/{accountNumber}/interest").HandlerFunc(getInterest(logger, accountRepo, interestRepo))
+}
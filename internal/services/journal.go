@@ -0,0 +1,256 @@
+package services
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"sort"
+
+	"github.com/gorilla/mux"
+	"github.com/gwuah/accounts/internal/models"
+	"github.com/gwuah/accounts/internal/repos"
+	"github.com/gwuah/accounts/pkg"
+	"github.com/shopspring/decimal"
+)
+
+const maxJournalLegs = 100
+
+type journalLeg struct {
+	Account   string          `json:"account"`
+	Direction string          `json:"direction"`
+	Amount    decimal.Decimal `json:"amount"`
+}
+
+type createJournalEntryRequest struct {
+	Reference string       `json:"reference"`
+	Legs      []journalLeg `json:"legs"`
+}
+
+func (r createJournalEntryRequest) validate() error {
+	if r.Reference == "" {
+		return errors.New("'reference' is required, can't be empty")
+	}
+	if len(r.Legs) < 2 {
+		return errors.New("a journal entry needs at least 2 legs")
+	}
+	if len(r.Legs) > maxJournalLegs {
+		return fmt.Errorf("a journal entry can't have more than %d legs", maxJournalLegs)
+	}
+	for i, leg := range r.Legs {
+		if leg.Account == "" {
+			return fmt.Errorf("leg %d: 'account' is required", i)
+		}
+		if leg.Direction != string(repos.DEBIT) && leg.Direction != string(repos.CREDIT) {
+			return fmt.Errorf("leg %d: 'direction' must be either 'debit' or 'credit'", i)
+		}
+		if !leg.Amount.IsPositive() {
+			return fmt.Errorf("leg %d: amount is required. (positive value)", i)
+		}
+		// money only comes out of system accounts through deposits, which are approved when they're large.
+		if leg.Direction == string(repos.DEBIT) && pkg.IsSystemAccountNumber(leg.Account) {
+			return fmt.Errorf("leg %d: system accounts can't be debited", i)
+		}
+	}
+	return nil
+}
+
+// createJournalEntry posts a compound transaction, made of any number of debit & credit legs.
+// The legs have to balance within each currency, and they're posted atomically under a single reference.
+func createJournalEntry(global *slog.Logger, accountRepo AccountRepository, transactionRepo TransactionRepository, webhookRepo WebhookRepository) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		logger := global.With("entity", "journal_entries")
+
+		var req createJournalEntryRequest
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			logger.Error("error reading request", "err", err)
+			writeBadRequest(w, err)
+			return
+		}
+		if err := req.validate(); err != nil {
+			logger.Error("error validating request", "err", err)
+			writeBadRequest(w, err)
+			return
+		}
+
+		tx, err := transactionRepo.GetTx(r.Context())
+		if err != nil {
+			logger.Error("failed to acquire db transaction", "err", err)
+			writeInternalServer(w, "failed to create journal entry")
+			return
+		}
+
+		var accountNumbers []string
+		for _, leg := range req.Legs {
+			accountNumbers = append(accountNumbers, leg.Account)
+		}
+
+		accounts, err := accountRepo.GetAccounts(r.Context(), tx, accountNumbers)
+		if err != nil {
+			tx.Rollback()
+			logger.Error("failed to get accounts", "err", err)
+			writeInternalServer(w, "failed to create journal entry")
+			return
+		}
+
+		// net is what each currency's legs add up to.
+		net := map[string]int64{}
+		lines := make([]*models.TransactionLine, 0, len(req.Legs))
+		for i, leg := range req.Legs {
+			account := getAccountByAccountNumber(accounts, leg.Account)
+			if account == nil {
+				tx.Rollback()
+				writeUnprocessableEntity(w, fmt.Sprintf("leg %d: account %s not found", i, leg.Account))
+				return
+			}
+
+			currency, err := pkg.GetCurrency(account.Currency)
+			if err != nil {
+				tx.Rollback()
+				logger.Error("account has unsupported currency", "err", err)
+				writeInternalServer(w, "failed to create journal entry")
+				return
+			}
+
+			amount, err := pkg.ConvertToMinor(leg.Amount, currency)
+			if err != nil {
+				tx.Rollback()
+				writeBadRequest(w, fmt.Errorf("leg %d: %w", i, err))
+				return
+			}
+
+			if leg.Direction == string(repos.DEBIT) {
+				net[currency.Code] -= amount
+			} else {
+				net[currency.Code] += amount
+			}
+
+			lines = append(lines, &models.TransactionLine{
+				AccountID:     account.ID,
+				AccountNumber: account.AccountNumber,
+				Currency:      currency.Code,
+				Amount:        amount,
+				Purpose:       leg.Direction,
+			})
+		}
+
+		var unbalanced []string
+		for code, sum := range net {
+			if sum != 0 {
+				unbalanced = append(unbalanced, code)
+			}
+		}
+		if len(unbalanced) > 0 {
+			tx.Rollback()
+			sort.Strings(unbalanced)
+			writeUnprocessableEntity(w, fmt.Sprintf("debits and credits don't balance for %v", unbalanced))
+			return
+		}
+
+		transaction := &models.Transaction{
+			Reference: req.Reference,
+			Type:      JournalEntry,
+		}
+		err = transactionRepo.Create(r.Context(), tx, transaction)
+		if err != nil {
+			tx.Rollback()
+			if isUniqueViolation(err, "transactions", "reference") {
+				writeConflict(w, "duplicate transaction request")
+				return
+			}
+			logger.Error("failed to create journal entry transaction", "err", err)
+			writeInternalServer(w, "failed to create journal entry")
+			return
+		}
+
+		err = transactionRepo.LockAccounts(r.Context(), tx, lineAccountIDs(lines))
+		if err != nil {
+			tx.Rollback()
+			logger.Error("failed to lock accounts", "err", err)
+			writeInternalServer(w, "failed to create journal entry")
+			return
+		}
+
+		reason, err := checkStatuses(r.Context(), tx, accountRepo, lines)
+		if err != nil {
+			tx.Rollback()
+			logger.Error("failed to check account statuses", "err", err)
+			writeInternalServer(w, "failed to create journal entry")
+			return
+		}
+		if reason != "" {
+			tx.Rollback()
+			writeUnprocessableEntity(w, reason)
+			return
+		}
+
+		reason, err = checkCreditLines(r.Context(), tx, accountRepo, transactionRepo, lines)
+		if err != nil {
+			tx.Rollback()
+			logger.Error("failed to check credit lines", "err", err)
+			writeInternalServer(w, "failed to create journal entry")
+			return
+		}
+		if reason != "" {
+			tx.Rollback()
+			writeUnprocessableEntity(w, reason)
+			return
+		}
+
+		// accounts that end up debited need to be able to afford it.
+		debited := netDebits(lines)
+		for _, account := range accounts {
+			if debited[account.ID] <= 0 {
+				continue
+			}
+			balance, err := transactionRepo.GetBalanceForUpdate(r.Context(), tx, account.ID)
+			if err != nil {
+				tx.Rollback()
+				logger.Error("failed to get balance", "err", err)
+				writeInternalServer(w, "failed to create journal entry")
+				return
+			}
+			if balance.Available < debited[account.ID] {
+				tx.Rollback()
+				writeUnprocessableEntity(w, fmt.Sprintf("insufficient balance on account %s", account.AccountNumber))
+				return
+			}
+		}
+
+		for _, line := range lines {
+			line.TransactionID = transaction.ID
+			err = transactionRepo.CreateTransactionLine(r.Context(), tx, line)
+			if err != nil {
+				tx.Rollback()
+				logger.Error("failed to create transaction line", "err", err, "purpose", line.Purpose)
+				writeInternalServer(w, "failed to create journal entry")
+				return
+			}
+		}
+
+		err = publishTransaction(r.Context(), tx, transactionRepo, webhookRepo, transaction)
+		if err != nil {
+			tx.Rollback()
+			logger.Error("failed to publish event", "err", err)
+			writeInternalServer(w, "failed to create journal entry")
+			return
+		}
+
+		err = tx.Commit()
+		if err != nil {
+			logger.Error("failed to commit db transaction", "err", err)
+			writeInternalServer(w, "failed to create journal entry")
+			return
+		}
+
+		transaction.Lines = lines
+		writeOk(w, map[string]interface{}{
+			"transaction": transaction,
+		})
+	}
+}
+
+func AddJournalEntryRoutes(logger *slog.Logger, r *mux.Router, accountRepo AccountRepository, transactionRepo TransactionRepository, webhookRepo WebhookRepository) {
+	r.Methods("POST").Path("/journal-entries").HandlerFunc(createJournalEntry(logger, accountRepo, transactionRepo, webhookRepo))
+}
@@ -0,0 +1,206 @@
+package services
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"sort"
+
+	"github.com/gorilla/mux"
+	"github.com/gwuah/accounts/internal/models"
+	"github.com/gwuah/accounts/pkg"
+)
+
+const chainPageSize = 1000
+
+// VerifyLedger walks every account's hash chain from its first line to its head, recomputing every line's hash.
+// It stops at the first broken link: a line whose content doesn't match its hash, a line that doesn't point to the
+// one before it on its account (a line was removed or inserted), or a head that doesn't point to its account's last line
+// (lines were removed at the end). Lines posted while it runs are after the heads it started from, they're left for the next run.
+func VerifyLedger(ctx context.Context, transactionRepo TransactionRepository) (*models.LedgerVerification, error) {
+	tx, err := transactionRepo.GetTx(ctx)
+	if err != nil {
+		return nil, err
+	}
+	defer tx.Rollback()
+
+	heads, err := transactionRepo.GetChainHeads(ctx, tx)
+	if err != nil {
+		return nil, err
+	}
+	headsByAccount := make(map[int]*models.ChainHead, len(heads))
+	for _, head := range heads {
+		headsByAccount[head.AccountID] = head
+	}
+
+	result := &models.LedgerVerification{}
+	broken := func(lineID int, reason string, args ...any) (*models.LedgerVerification, error) {
+		result.BrokenAt = &lineID
+		result.Reason = fmt.Sprintf(reason, args...)
+		return result, nil
+	}
+
+	// ended checks the chain walked ends at its account's head, it returns the reason it doesn't.
+	ended := func(head *models.ChainHead, lastID int, lastHash string) string {
+		if lastID != head.LineID {
+			return fmt.Sprintf("account %d's chain head points to line %d, but the chain ends at line %d", head.AccountID, head.LineID, lastID)
+		}
+		if lastHash != head.Hash {
+			return fmt.Sprintf("account %d's chain head doesn't match line %d's hash", head.AccountID, head.LineID)
+		}
+		return ""
+	}
+
+	walked := map[int]bool{}
+	var head *models.ChainHead
+	prevID, prevHash := 0, ""
+	afterAccountID, afterID := 0, 0
+	for {
+		lines, err := transactionRepo.GetChainLines(ctx, tx, afterAccountID, afterID, chainPageSize)
+		if err != nil {
+			return nil, err
+		}
+
+		for _, line := range lines {
+			afterAccountID, afterID = line.AccountID, line.ID
+
+			lineHead := headsByAccount[line.AccountID]
+			if lineHead == nil || line.ID > lineHead.LineID {
+				continue
+			}
+			if lineHead != head {
+				if head != nil {
+					if reason := ended(head, prevID, prevHash); reason != "" {
+						return broken(head.LineID, reason)
+					}
+				}
+				head, prevID, prevHash = lineHead, 0, ""
+				walked[head.AccountID] = true
+			}
+
+			if line.PrevHash != prevHash {
+				if prevID == 0 {
+					return broken(line.ID, "line %d should start account %d's chain", line.ID, line.AccountID)
+				}
+				return broken(line.ID, "line %d doesn't point to line %d before it", line.ID, prevID)
+			}
+			if pkg.LineHash(line.PrevHash, line.TransactionID, line.AccountID, line.Amount, line.Purpose, line.CreatedAt) != line.Hash {
+				return broken(line.ID, "line %d doesn't match its hash", line.ID)
+			}
+			prevID, prevHash = line.ID, line.Hash
+			result.Verified++
+		}
+
+		if len(lines) < chainPageSize {
+			break
+		}
+	}
+
+	if head != nil {
+		if reason := ended(head, prevID, prevHash); reason != "" {
+			return broken(head.LineID, reason)
+		}
+	}
+	// accounts whose lines were all removed.
+	for _, head := range heads {
+		if !walked[head.AccountID] && head.LineID != 0 {
+			return broken(head.LineID, ended(head, 0, ""))
+		}
+	}
+	return result, nil
+}
+
+// CheckIntegrity produces a trial balance of the ledger, per account, per account type and per currency, and looks for
+// transactions whose debits & credits don't add up, lines that lost their transaction or account, and materialized balances that
+// drifted from their lines. Every currency's accounts, genesis included, must sum up to zero.
+func CheckIntegrity(ctx context.Context, transactionRepo TransactionRepository) (*models.IntegrityReport, error) {
+	tx, err := transactionRepo.GetTx(ctx)
+	if err != nil {
+		return nil, err
+	}
+	defer tx.Rollback()
+
+	report := &models.IntegrityReport{}
+	report.Accounts, err = transactionRepo.GetTrialBalance(ctx, tx)
+	if err != nil {
+		return nil, err
+	}
+	report.UnbalancedTransactions, err = transactionRepo.GetUnbalancedTransactions(ctx, tx)
+	if err != nil {
+		return nil, err
+	}
+	report.OrphanLines, err = transactionRepo.GetOrphanLines(ctx, tx)
+	if err != nil {
+		return nil, err
+	}
+	report.BalanceDrifts, err = transactionRepo.VerifyBalances(ctx, tx)
+	if err != nil {
+		return nil, err
+	}
+
+	report.AccountTypes = groupTrialBalance(report.Accounts, func(l *models.TrialBalanceLine) string {
+		if pkg.IsSystemAccountNumber(l.AccountNumber) {
+			return pkg.SystemAccountRole(l.AccountNumber).Name()
+		}
+		return l.AccountType
+	})
+	report.Currencies = groupTrialBalance(report.Accounts, func(l *models.TrialBalanceLine) string {
+		return ""
+	})
+
+	report.OK = len(report.UnbalancedTransactions) == 0 && len(report.OrphanLines) == 0 && len(report.BalanceDrifts) == 0
+	for _, total := range report.Currencies {
+		if total.Balance != 0 {
+			report.OK = false
+		}
+	}
+	return report, nil
+}
+
+// groupTrialBalance sums up the accounts' lines per currency & group, ordered by currency then group.
+func groupTrialBalance(accounts []*models.TrialBalanceLine, group func(*models.TrialBalanceLine) string) []*models.TrialBalanceLine {
+	var out []*models.TrialBalanceLine
+	groups := map[[2]string]*models.TrialBalanceLine{}
+	for _, account := range accounts {
+		key := [2]string{account.Currency, group(account)}
+		g, ok := groups[key]
+		if !ok {
+			g = &models.TrialBalanceLine{Currency: key[0], AccountType: key[1]}
+			groups[key] = g
+			out = append(out, g)
+		}
+		g.Debits += account.Debits
+		g.Credits += account.Credits
+		g.Balance += account.Balance
+	}
+
+	sort.Slice(out, func(i, j int) bool {
+		if out[i].Currency != out[j].Currency {
+			return out[i].Currency < out[j].Currency
+		}
+		return out[i].AccountType < out[j].AccountType
+	})
+	return out
+}
+
+func getIntegrityReport(global *slog.Logger, transactionRepo TransactionRepository) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		logger := global.With("entity", "ledger")
+
+		report, err := CheckIntegrity(r.Context(), transactionRepo)
+		if err != nil {
+			logger.Error("failed to check ledger integrity", "err", err)
+			writeInternalServer(w, "failed to check ledger integrity")
+			return
+		}
+
+		writeOk(w, map[string]interface{}{
+			"report": report,
+		})
+	}
+}
+
+func AddLedgerRoutes(logger *slog.Logger, r *mux.Router, transactionRepo TransactionRepository) {
+	r.Methods("GET").Path("/admin/integrity").HandlerFunc(getIntegrityReport(logger, transactionRepo))
+}
@@ -0,0 +1,139 @@
+package services
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"math"
+	"net"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/gorilla/mux"
+	"github.com/gwuah/accounts/pkg"
+)
+
+// RateLimitStore keeps the rate limits' buckets, by key.
+type RateLimitStore interface {
+	// Take takes a token from the key's bucket. When there's none, it returns how long until there's one.
+	Take(ctx context.Context, key string, limit pkg.RateLimit, now time.Time) (bool, time.Duration, error)
+}
+
+// RateLimits are the limits every client gets, with a separate, usually lower, one for posting transactions.
+// IP is the limit of every ip, whoever its requests are made by, which guessing credentials is limited by too.
+type RateLimits struct {
+	Default      pkg.RateLimit
+	Transactions pkg.RateLimit
+	IP           pkg.RateLimit
+}
+
+type bucket struct {
+	tokens float64
+	last   time.Time
+	limit  pkg.RateLimit
+}
+
+// memoryRateLimitStore keeps the buckets in memory, so each instance of the service limits clients on its own.
+type memoryRateLimitStore struct {
+	mu        sync.Mutex
+	buckets   map[string]*bucket
+	lastSweep time.Time
+}
+
+func NewMemoryRateLimitStore() *memoryRateLimitStore {
+	return &memoryRateLimitStore{buckets: map[string]*bucket{}}
+}
+
+func (s *memoryRateLimitStore) Take(ctx context.Context, key string, limit pkg.RateLimit, now time.Time) (bool, time.Duration, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	// buckets that have been idle long enough to refill are the same as new ones, so they're dropped every now and then.
+	if now.Sub(s.lastSweep) > time.Minute {
+		for k, b := range s.buckets {
+			if tokens, _, _ := b.limit.Take(b.tokens, b.last, now); tokens >= float64(b.limit.Burst-1) {
+				delete(s.buckets, k)
+			}
+		}
+		s.lastSweep = now
+	}
+
+	b, ok := s.buckets[key]
+	if !ok {
+		b = &bucket{tokens: float64(limit.Burst), last: now}
+		s.buckets[key] = b
+	}
+	tokens, ok, wait := limit.Take(b.tokens, b.last, now)
+	b.tokens, b.last, b.limit = tokens, now, limit
+	return ok, wait, nil
+}
+
+// clientIP returns the ip the request comes from.
+func clientIP(r *http.Request) string {
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		return r.RemoteAddr
+	}
+	return host
+}
+
+// RateLimitIPs is a mux middleware that limits how often each ip calls the service. It must come before Authenticate,
+// so requests with missing or invalid credentials are counted, and turned away before their credentials are looked up.
+func RateLimitIPs(global *slog.Logger, store RateLimitStore, limits RateLimits) mux.MiddlewareFunc {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			if takeRateLimitToken(w, r, global.With("entity", "rate_limits"), store, "ip:"+clientIP(r), limits.IP) {
+				next.ServeHTTP(w, r)
+			}
+		})
+	}
+}
+
+// RateLimit is a mux middleware that limits how often each client, ie. api key or user, calls the service.
+// It must come after Authenticate, to know who the client is, anonymous requests are only limited by RateLimitIPs.
+// Clients over their limit get a 429 with a Retry-After header.
+// Requests go through when the store fails, an outage of the limiter shouldn't be an outage of the service.
+func RateLimit(global *slog.Logger, store RateLimitStore, limits RateLimits) mux.MiddlewareFunc {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			client := principalName(PrincipalFromContext(r.Context()))
+			if client == "" {
+				next.ServeHTTP(w, r)
+				return
+			}
+
+			limit, key := limits.Default, client
+			if route := mux.CurrentRoute(r); route != nil && r.Method == http.MethodPost {
+				if template, _ := route.GetPathTemplate(); template == "/transactions" {
+					limit, key = limits.Transactions, client+":transactions"
+				}
+			}
+			if takeRateLimitToken(w, r, global.With("entity", "rate_limits"), store, key, limit) {
+				next.ServeHTTP(w, r)
+			}
+		})
+	}
+}
+
+// takeRateLimitToken takes a token from the key's bucket, responding with a 429 when there's none.
+// It reports whether the request can go through, which it can when the limit is off or the store fails.
+func takeRateLimitToken(w http.ResponseWriter, r *http.Request, logger *slog.Logger, store RateLimitStore, key string, limit pkg.RateLimit) bool {
+	if !limit.Enabled() {
+		return true
+	}
+
+	ok, wait, err := store.Take(r.Context(), key, limit, time.Now())
+	if err != nil {
+		logger.Error("failed to take rate limit token", "err", err, "key", key)
+		return true
+	}
+	if !ok {
+		logger.Warn("rate limited", "key", key)
+		w.Header().Set("Retry-After", strconv.Itoa(int(math.Ceil(wait.Seconds()))))
+		writeTooManyRequests(w, fmt.Sprintf("rate limit of %d requests a minute exceeded", limit.PerMinute))
+		return false
+	}
+	return true
+}
@@ -0,0 +1,332 @@
+package services
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"slices"
+	"strings"
+
+	"github.com/gorilla/mux"
+	"github.com/gwuah/accounts/internal/models"
+)
+
+type RBACRepository interface {
+	GetTx(ctx context.Context) (*sql.Tx, error)
+	GetRoles(ctx context.Context, tx *sql.Tx, name string) ([]*models.Role, error)
+	CreateRole(ctx context.Context, tx *sql.Tx, role *models.Role) error
+	GetPermissions(ctx context.Context, tx *sql.Tx, userID int) ([]string, error)
+	CreateBinding(ctx context.Context, tx *sql.Tx, b *models.RoleBinding) (bool, error)
+	GetBindings(ctx context.Context, tx *sql.Tx, userID int) ([]*models.RoleBinding, error)
+	DeleteBinding(ctx context.Context, tx *sql.Tx, id int) (*models.RoleBinding, error)
+}
+
+// permissionOverrides are the routes whose permission is finer than their scope, as "<method> <path template>".
+// Every other route needs the same permission as the scope an api key needs for it, eg. "accounts:read" or "accounts:limits".
+var permissionOverrides = map[string]string{
+	"PUT /accounts/{accountNumber}/status":   "accounts:freeze",
+	"POST /accounts/{accountNumber}/close":   "accounts:freeze",
+	"POST /transactions/{reference}/reverse": "transactions:reverse",
+	"POST /transactions/{reference}/refund":  "transactions:reverse",
+}
+
+// routePermission returns the permission a user's roles must grant to call the request's route.
+func routePermission(r *http.Request, template string) string {
+	if permission, ok := permissionOverrides[r.Method+" "+template]; ok {
+		return permission
+	}
+	return requiredScope(r, template)
+}
+
+func validPermission(permission string) bool {
+	for _, override := range permissionOverrides {
+		if permission == override {
+			return true
+		}
+	}
+	return validScope(permission)
+}
+
+func hasPermission(permissions []string, permission string) bool {
+	return slices.Contains(permissions, ScopeAll) || slices.Contains(permissions, permission)
+}
+
+// userPermissions returns the permissions granted to the user by their roles.
+func userPermissions(ctx context.Context, rbacRepo RBACRepository, userID int) ([]string, error) {
+	tx, err := rbacRepo.GetTx(ctx)
+	if err != nil {
+		return nil, err
+	}
+	defer tx.Rollback()
+
+	return rbacRepo.GetPermissions(ctx, tx, userID)
+}
+
+func getRoles(global *slog.Logger, rbacRepo RBACRepository) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		logger := global.With("entity", "rbac")
+
+		tx, err := rbacRepo.GetTx(r.Context())
+		if err != nil {
+			logger.Error("failed to acquire db transaction", "err", err)
+			writeInternalServer(w, "failed to get roles")
+			return
+		}
+		defer tx.Rollback()
+
+		roles, err := rbacRepo.GetRoles(r.Context(), tx, "")
+		if err != nil {
+			logger.Error("failed to get roles", "err", err)
+			writeInternalServer(w, "failed to get roles")
+			return
+		}
+
+		writeOk(w, map[string]interface{}{
+			"roles": roles,
+		})
+	}
+}
+
+type createRoleRequest struct {
+	Name        string   `json:"name"`
+	Permissions []string `json:"permissions"`
+}
+
+func (r createRoleRequest) validate() error {
+	if strings.TrimSpace(r.Name) == "" {
+		return errors.New("'name' is required, can't be empty")
+	}
+	if len(r.Permissions) == 0 {
+		return errors.New("'permissions' is required, can't be empty")
+	}
+	for _, permission := range r.Permissions {
+		if !validPermission(permission) {
+			return fmt.Errorf("'%s' isn't a permission", permission)
+		}
+	}
+	return nil
+}
+
+func createRole(global *slog.Logger, rbacRepo RBACRepository) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		logger := global.With("entity", "rbac")
+
+		var req createRoleRequest
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			logger.Error("error reading request", "err", err)
+			writeBadRequest(w, err)
+			return
+		}
+		if err := req.validate(); err != nil {
+			logger.Error("error validating request", "err", err)
+			writeBadRequest(w, err)
+			return
+		}
+
+		tx, err := rbacRepo.GetTx(r.Context())
+		if err != nil {
+			logger.Error("failed to acquire db transaction", "err", err)
+			writeInternalServer(w, "failed to create role")
+			return
+		}
+
+		role := &models.Role{Name: req.Name, Permissions: req.Permissions}
+		err = rbacRepo.CreateRole(r.Context(), tx, role)
+		if err != nil {
+			tx.Rollback()
+			if isUniqueViolation(err, "roles", "name") {
+				writeConflict(w, "role already exists")
+				return
+			}
+			logger.Error("failed to create role", "err", err)
+			writeInternalServer(w, "failed to create role")
+			return
+		}
+
+		err = tx.Commit()
+		if err != nil {
+			logger.Error("failed to commit db transaction", "err", err)
+			writeInternalServer(w, "failed to create role")
+			return
+		}
+
+		writeOk(w, map[string]interface{}{
+			"role": role,
+		})
+	}
+}
+
+type createBindingRequest struct {
+	UserID int    `json:"user_id"`
+	Role   string `json:"role"`
+}
+
+func (r createBindingRequest) validate() error {
+	if r.UserID <= 0 {
+		return errors.New("'user_id' is required")
+	}
+	if strings.TrimSpace(r.Role) == "" {
+		return errors.New("'role' is required, can't be empty")
+	}
+	return nil
+}
+
+func createBinding(global *slog.Logger, rbacRepo RBACRepository, userRepo UserRepository) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		logger := global.With("entity", "rbac")
+
+		var req createBindingRequest
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			logger.Error("error reading request", "err", err)
+			writeBadRequest(w, err)
+			return
+		}
+		if err := req.validate(); err != nil {
+			logger.Error("error validating request", "err", err)
+			writeBadRequest(w, err)
+			return
+		}
+
+		tx, err := rbacRepo.GetTx(r.Context())
+		if err != nil {
+			logger.Error("failed to acquire db transaction", "err", err)
+			writeInternalServer(w, "failed to create role binding")
+			return
+		}
+
+		user, err := userRepo.GetByID(r.Context(), tx, req.UserID)
+		if err != nil {
+			tx.Rollback()
+			logger.Error("failed to get user", "err", err)
+			writeInternalServer(w, "failed to create role binding")
+			return
+		}
+		if user == nil {
+			tx.Rollback()
+			writeNotFound(w, "user not found")
+			return
+		}
+
+		roles, err := rbacRepo.GetRoles(r.Context(), tx, req.Role)
+		if err != nil {
+			tx.Rollback()
+			logger.Error("failed to get role", "err", err)
+			writeInternalServer(w, "failed to create role binding")
+			return
+		}
+		if len(roles) == 0 {
+			tx.Rollback()
+			writeNotFound(w, "role not found")
+			return
+		}
+
+		binding := &models.RoleBinding{RoleID: roles[0].ID, Role: roles[0].Name, UserID: user.ID}
+		created, err := rbacRepo.CreateBinding(r.Context(), tx, binding)
+		if err != nil {
+			tx.Rollback()
+			logger.Error("failed to create role binding", "err", err)
+			writeInternalServer(w, "failed to create role binding")
+			return
+		}
+		if !created {
+			tx.Rollback()
+			writeConflict(w, "user already has the role")
+			return
+		}
+
+		err = tx.Commit()
+		if err != nil {
+			logger.Error("failed to commit db transaction", "err", err)
+			writeInternalServer(w, "failed to create role binding")
+			return
+		}
+
+		writeOk(w, map[string]interface{}{
+			"binding": binding,
+		})
+	}
+}
+
+func getBindings(global *slog.Logger, rbacRepo RBACRepository) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		logger := global.With("entity", "rbac")
+
+		userID := 0
+		if v := r.URL.Query().Get("user_id"); v != "" {
+			userID = stringToInt(v)
+			if userID <= 0 {
+				writeBadRequest(w, errors.New("'user_id' must be a user id"))
+				return
+			}
+		}
+
+		tx, err := rbacRepo.GetTx(r.Context())
+		if err != nil {
+			logger.Error("failed to acquire db transaction", "err", err)
+			writeInternalServer(w, "failed to get role bindings")
+			return
+		}
+		defer tx.Rollback()
+
+		bindings, err := rbacRepo.GetBindings(r.Context(), tx, userID)
+		if err != nil {
+			logger.Error("failed to get role bindings", "err", err)
+			writeInternalServer(w, "failed to get role bindings")
+			return
+		}
+
+		writeOk(w, map[string]interface{}{
+			"bindings": bindings,
+		})
+	}
+}
+
+func deleteBinding(global *slog.Logger, rbacRepo RBACRepository) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		logger := global.With("entity", "rbac")
+		id := stringToInt(mux.Vars(r)["id"])
+
+		tx, err := rbacRepo.GetTx(r.Context())
+		if err != nil {
+			logger.Error("failed to acquire db transaction", "err", err)
+			writeInternalServer(w, "failed to delete role binding")
+			return
+		}
+
+		binding, err := rbacRepo.DeleteBinding(r.Context(), tx, id)
+		if err != nil {
+			tx.Rollback()
+			logger.Error("failed to delete role binding", "err", err)
+			writeInternalServer(w, "failed to delete role binding")
+			return
+		}
+		if binding == nil {
+			tx.Rollback()
+			writeNotFound(w, "role binding not found")
+			return
+		}
+
+		err = tx.Commit()
+		if err != nil {
+			logger.Error("failed to commit db transaction", "err", err)
+			writeInternalServer(w, "failed to delete role binding")
+			return
+		}
+
+		writeOk(w, map[string]interface{}{
+			"binding": binding,
+		})
+	}
+}
+
+func AddRBACRoutes(logger *slog.Logger, r *mux.Router, rbacRepo RBACRepository, userRepo UserRepository) {
+	r.Methods("GET").Path("/rbac/roles").HandlerFunc(getRoles(logger, rbacRepo))
+	r.Methods("POST").Path("/rbac/roles").HandlerFunc(createRole(logger, rbacRepo))
+	r.Methods("POST").Path("/rbac/bindings").HandlerFunc(createBinding(logger, rbacRepo, userRepo))
+	r.Methods("GET").Path("/rbac/bindings").HandlerFunc(getBindings(logger, rbacRepo))
+	r.Methods("DELETE").Path("/rbac/bindings/{id}").HandlerFunc(deleteBinding(logger, rbacRepo))
+}
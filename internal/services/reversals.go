@@ -0,0 +1,294 @@
+package services
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+
+	"github.com/gorilla/mux"
+	"github.com/gwuah/accounts/internal/models"
+	"github.com/gwuah/accounts/internal/repos"
+	"github.com/gwuah/accounts/pkg"
+	"github.com/shopspring/decimal"
+)
+
+type compensateTransactionRequest struct {
+	Amount    decimal.Decimal `json:"amount"`
+	Reference string          `json:"reference"`
+}
+
+func (r compensateTransactionRequest) validate(kind string) error {
+	if r.Amount.IsNegative() {
+		return errors.New("amount can't be negative")
+	}
+	if kind == Refund {
+		if r.Amount.IsZero() {
+			return errors.New("amount is required. (positive value)")
+		}
+		if r.Reference == "" {
+			return errors.New("'reference' is required, can't be empty")
+		}
+	}
+	if kind == Reversal && !r.Amount.IsZero() {
+		return errors.New("reversals are for the full amount, use a refund instead")
+	}
+	return nil
+}
+
+// compensateTransaction posts a reversal or refund of a transaction, since posted lines can't be edited.
+//
+// A reversal undoes whatever is left of the original: if nothing has been refunded yet, every line is mirrored (fx legs included),
+// otherwise the remaining principal is moved back. A refund moves part of the principal back from the destination to the source.
+// Either way, the original can never be compensated for more than its amount.
+func compensateTransaction(global *slog.Logger, accountRepo AccountRepository, transactionRepo TransactionRepository, webhookRepo WebhookRepository, kind string) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		logger := global.With("entity", "transactions")
+		reference := mux.Vars(r)["reference"]
+
+		// the body is optional for reversals.
+		var req compensateTransactionRequest
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil && err != io.EOF {
+			logger.Error("error reading request", "err", err)
+			writeBadRequest(w, err)
+			return
+		}
+		if err := req.validate(kind); err != nil {
+			logger.Error("error validating request", "err", err)
+			writeBadRequest(w, err)
+			return
+		}
+		if req.Reference == "" {
+			req.Reference = fmt.Sprintf("%s-reversal", reference)
+		}
+
+		tx, err := transactionRepo.GetTx(r.Context())
+		if err != nil {
+			logger.Error("failed to acquire db transaction", "err", err)
+			writeInternalServer(w, fmt.Sprintf("failed to create %s", kind))
+			return
+		}
+
+		original, err := transactionRepo.GetByReference(r.Context(), tx, reference)
+		if err != nil {
+			tx.Rollback()
+			logger.Error("failed to get transaction", "err", err)
+			writeInternalServer(w, fmt.Sprintf("failed to create %s", kind))
+			return
+		}
+		if original == nil {
+			tx.Rollback()
+			writeNotFound(w, "transaction not found")
+			return
+		}
+		if original.Type == Reversal || original.Type == Refund {
+			tx.Rollback()
+			writeUnprocessableEntity(w, "reversals and refunds can't be reversed")
+			return
+		}
+		if original.Amount == nil || original.SourceAccountID == nil || original.DestinationAccountID == nil {
+			tx.Rollback()
+			writeUnprocessableEntity(w, "transaction can't be reversed")
+			return
+		}
+
+		lines, err := transactionRepo.GetLines(r.Context(), tx, original.ID)
+		if err != nil {
+			tx.Rollback()
+			logger.Error("failed to get transaction lines", "err", err)
+			writeInternalServer(w, fmt.Sprintf("failed to create %s", kind))
+			return
+		}
+
+		// compensating lines only touch the original's accounts, locking them also keeps concurrent refunds from exceeding the refundable amount.
+		err = transactionRepo.LockAccounts(r.Context(), tx, lineAccountIDs(lines))
+		if err != nil {
+			tx.Rollback()
+			logger.Error("failed to lock accounts", "err", err)
+			writeInternalServer(w, fmt.Sprintf("failed to create %s", kind))
+			return
+		}
+
+		reversals, err := transactionRepo.GetReversals(r.Context(), tx, original.ID)
+		if err != nil {
+			tx.Rollback()
+			logger.Error("failed to get transaction reversals", "err", err)
+			writeInternalServer(w, fmt.Sprintf("failed to create %s", kind))
+			return
+		}
+
+		reversed := int64(0)
+		for _, reversal := range reversals {
+			reversed += *reversal.Amount
+		}
+		remaining := *original.Amount - reversed
+		if remaining <= 0 {
+			tx.Rollback()
+			writeUnprocessableEntity(w, "transaction has already been fully reversed")
+			return
+		}
+
+		source := getLineByAccountID(lines, *original.SourceAccountID)
+		destination := getLineByAccountID(lines, *original.DestinationAccountID)
+
+		amount := remaining
+		if kind == Refund {
+			if source.Currency != destination.Currency {
+				tx.Rollback()
+				writeUnprocessableEntity(w, "fx transfers can only be reversed in full")
+				return
+			}
+			currency, err := pkg.GetCurrency(source.Currency)
+			if err != nil {
+				tx.Rollback()
+				logger.Error("account has unsupported currency", "err", err)
+				writeInternalServer(w, fmt.Sprintf("failed to create %s", kind))
+				return
+			}
+			amount, err = pkg.ConvertToMinor(req.Amount, currency)
+			if err != nil {
+				tx.Rollback()
+				writeBadRequest(w, err)
+				return
+			}
+			if amount > remaining {
+				tx.Rollback()
+				writeUnprocessableEntity(w, "refund exceeds the refundable amount")
+				return
+			}
+		}
+
+		transaction := &models.Transaction{
+			Reference:             req.Reference,
+			Type:                  kind,
+			Amount:                &amount,
+			SourceAccountID:       original.DestinationAccountID,
+			DestinationAccountID:  original.SourceAccountID,
+			OriginalTransactionID: &original.ID,
+		}
+
+		var compensating []*models.TransactionLine
+		if kind == Reversal && reversed == 0 {
+			for _, line := range lines {
+				compensating = append(compensating, &models.TransactionLine{
+					AccountID:     line.AccountID,
+					AccountNumber: line.AccountNumber,
+					Currency:      line.Currency,
+					Amount:        line.Amount,
+					Purpose:       string(oppositePurpose(line.Purpose)),
+				})
+			}
+		} else {
+			compensating = []*models.TransactionLine{
+				{AccountID: destination.AccountID, AccountNumber: destination.AccountNumber, Currency: destination.Currency, Amount: amount, Purpose: string(repos.DEBIT)},
+				{AccountID: source.AccountID, AccountNumber: source.AccountNumber, Currency: source.Currency, Amount: amount, Purpose: string(repos.CREDIT)},
+			}
+		}
+
+		reason, err := checkStatuses(r.Context(), tx, accountRepo, compensating)
+		if err != nil {
+			tx.Rollback()
+			logger.Error("failed to check account statuses", "err", err)
+			writeInternalServer(w, fmt.Sprintf("failed to create %s", kind))
+			return
+		}
+		if reason != "" {
+			tx.Rollback()
+			writeUnprocessableEntity(w, reason)
+			return
+		}
+
+		reason, err = checkCreditLines(r.Context(), tx, accountRepo, transactionRepo, compensating)
+		if err != nil {
+			tx.Rollback()
+			logger.Error("failed to check credit lines", "err", err)
+			writeInternalServer(w, fmt.Sprintf("failed to create %s", kind))
+			return
+		}
+		if reason != "" {
+			tx.Rollback()
+			writeUnprocessableEntity(w, reason)
+			return
+		}
+
+		// accounts that are debited to compensate need to be able to afford it, except for system accounts.
+		for _, line := range compensating {
+			if line.Purpose != string(repos.DEBIT) || pkg.IsSystemAccountNumber(line.AccountNumber) {
+				continue
+			}
+			balance, err := transactionRepo.GetBalanceForUpdate(r.Context(), tx, line.AccountID)
+			if err != nil {
+				tx.Rollback()
+				logger.Error("failed to get balance", "err", err)
+				writeInternalServer(w, fmt.Sprintf("failed to create %s", kind))
+				return
+			}
+			if balance.Available < line.Amount {
+				tx.Rollback()
+				writeUnprocessableEntity(w, "insufficient balance")
+				return
+			}
+		}
+
+		err = transactionRepo.Create(r.Context(), tx, transaction)
+		if err != nil {
+			tx.Rollback()
+			if isUniqueViolation(err, "transactions", "reference") {
+				writeConflict(w, "duplicate transaction request")
+				return
+			}
+			logger.Error("failed to create transaction", "err", err)
+			writeInternalServer(w, fmt.Sprintf("failed to create %s", kind))
+			return
+		}
+
+		for _, line := range compensating {
+			line.TransactionID = transaction.ID
+			err = transactionRepo.CreateTransactionLine(r.Context(), tx, line)
+			if err != nil {
+				tx.Rollback()
+				logger.Error("failed to create transaction line", "err", err, "purpose", line.Purpose)
+				writeInternalServer(w, fmt.Sprintf("failed to create %s", kind))
+				return
+			}
+		}
+
+		err = publishTransaction(r.Context(), tx, transactionRepo, webhookRepo, transaction)
+		if err != nil {
+			tx.Rollback()
+			logger.Error("failed to publish event", "err", err)
+			writeInternalServer(w, fmt.Sprintf("failed to create %s", kind))
+			return
+		}
+
+		err = tx.Commit()
+		if err != nil {
+			logger.Error("failed to commit db transaction", "err", err)
+			writeInternalServer(w, fmt.Sprintf("failed to create %s", kind))
+			return
+		}
+
+		transaction.Lines = compensating
+		writeOk(w, map[string]interface{}{
+			"transaction": transaction,
+		})
+	}
+}
+
+func getLineByAccountID(lines []*models.TransactionLine, accountID int) *models.TransactionLine {
+	for _, line := range lines {
+		if line.AccountID == accountID {
+			return line
+		}
+	}
+	return nil
+}
+
+func oppositePurpose(purpose string) repos.TransactionPurpose {
+	if purpose == string(repos.DEBIT) {
+		return repos.CREDIT
+	}
+	return repos.DEBIT
+}
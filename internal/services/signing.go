@@ -0,0 +1,69 @@
+package services
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"time"
+
+	"github.com/gorilla/mux"
+	"github.com/gwuah/accounts/pkg"
+)
+
+// SignatureTolerance is how far a signed request's timestamp can be from the service's clock, either way.
+const SignatureTolerance = 5 * time.Minute
+
+// NonceStore remembers the nonces of signed requests, to catch replayed ones.
+type NonceStore interface {
+	// Use records the nonce until it expires. It returns false if it's already been used.
+	Use(ctx context.Context, nonce string, expiresAt, now time.Time) (bool, error)
+}
+
+// VerifySignatures is a mux middleware that checks the requests of signed api keys, see pkg.SignRequest.
+// It must come after Authenticate, to know the key. Requests of other keys & users go through as they are.
+func VerifySignatures(global *slog.Logger, nonceStore NonceStore) mux.MiddlewareFunc {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			logger := global.With("entity", "signatures")
+
+			key := APIKeyFromContext(r.Context())
+			if key == nil || !key.Signed {
+				next.ServeHTTP(w, r)
+				return
+			}
+
+			body, err := io.ReadAll(r.Body)
+			if err != nil {
+				writeBadRequest(w, err)
+				return
+			}
+			r.Body = io.NopCloser(bytes.NewReader(body))
+
+			now := time.Now()
+			nonce, err := pkg.VerifyRequest(key.SigningSecret, r, body, SignatureTolerance, now)
+			if err != nil {
+				logger.Warn("invalid request signature", "api_key", key.Prefix, "err", err)
+				writeUnauthorized(w, fmt.Sprintf("invalid signature, %s", err))
+				return
+			}
+
+			// nonces only need remembering for as long as their request's timestamp would be accepted.
+			fresh, err := nonceStore.Use(r.Context(), fmt.Sprintf("%d:%s", key.ID, nonce), now.Add(2*SignatureTolerance), now)
+			if err != nil {
+				logger.Error("failed to record nonce", "err", err)
+				writeInternalServer(w, "failed to verify signature")
+				return
+			}
+			if !fresh {
+				logger.Warn("replayed request", "api_key", key.Prefix, "nonce", nonce)
+				writeUnauthorized(w, "invalid signature, nonce already used")
+				return
+			}
+
+			next.ServeHTTP(w, r)
+		})
+	}
+}
@@ -0,0 +1,522 @@
+package services
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"time"
+
+	"github.com/gorilla/mux"
+	"github.com/gwuah/accounts/internal/models"
+	"github.com/gwuah/accounts/internal/repos"
+	"github.com/gwuah/accounts/pkg"
+)
+
+const (
+	AccountActive        = "active"
+	AccountFrozen        = "frozen"
+	AccountDebitBlocked  = "debit_blocked"
+	AccountCreditBlocked = "credit_blocked"
+	// AccountClosed is final, accounts are only closed through the close flow and never reopened.
+	AccountClosed = "closed"
+)
+
+func canDebit(status string) bool {
+	return status == AccountActive || status == AccountCreditBlocked
+}
+
+func canCredit(status string) bool {
+	return status == AccountActive || status == AccountDebitBlocked
+}
+
+// checkStatuses returns why the lines can't be posted given the status of their accounts, or "" if they can.
+// It must be called once the accounts are locked: statuses are read again then, so an account can't be frozen or closed
+// between this check & the lines being posted, status changes locking the account too.
+func checkStatuses(ctx context.Context, tx *sql.Tx, accountRepo AccountRepository, lines []*models.TransactionLine) (string, error) {
+	accounts, err := accountRepo.GetAccountsByID(ctx, tx, lineAccountIDs(lines))
+	if err != nil {
+		return "", err
+	}
+
+	for _, line := range lines {
+		for _, account := range accounts {
+			if account.ID != line.AccountID {
+				continue
+			}
+			if line.Purpose == string(repos.DEBIT) && !canDebit(account.Status) {
+				return fmt.Sprintf("account %s can't be debited, it's %s", account.AccountNumber, account.Status), nil
+			}
+			if line.Purpose == string(repos.CREDIT) && !canCredit(account.Status) {
+				return fmt.Sprintf("account %s can't be credited, it's %s", account.AccountNumber, account.Status), nil
+			}
+		}
+	}
+	return "", nil
+}
+
+type setAccountStatusRequest struct {
+	Status string `json:"status"`
+	Reason string `json:"reason"`
+}
+
+func (r setAccountStatusRequest) validate() error {
+	switch r.Status {
+	case AccountActive, AccountFrozen, AccountDebitBlocked, AccountCreditBlocked:
+	case AccountClosed:
+		return errors.New("accounts are closed with POST /accounts/{accountNumber}/close")
+	default:
+		return fmt.Errorf("'status' must be one of '%s', '%s', '%s' or '%s'", AccountActive, AccountFrozen, AccountDebitBlocked, AccountCreditBlocked)
+	}
+	if r.Reason == "" {
+		return errors.New("'reason' is required, can't be empty")
+	}
+	return nil
+}
+
+// setAccountStatus freezes, unfreezes or blocks one side of an account. Transitions are free, except out of closed.
+func setAccountStatus(global *slog.Logger, accountRepo AccountRepository, transactionRepo TransactionRepository) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		logger := global.With("entity", "accounts")
+		accountNumber := mux.Vars(r)["accountNumber"]
+
+		var req setAccountStatusRequest
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			logger.Error("error reading request", "err", err)
+			writeBadRequest(w, err)
+			return
+		}
+		if err := req.validate(); err != nil {
+			logger.Error("error validating request", "err", err)
+			writeBadRequest(w, err)
+			return
+		}
+		if pkg.IsSystemAccountNumber(accountNumber) {
+			writeBadRequest(w, errors.New("action not allowed for this account number"))
+			return
+		}
+
+		tx, err := accountRepo.GetTx(r.Context())
+		if err != nil {
+			logger.Error("failed to acquire db transaction", "err", err)
+			writeInternalServer(w, "failed to set account status")
+			return
+		}
+
+		accounts, err := accountRepo.GetAccounts(r.Context(), tx, []string{accountNumber})
+		if err != nil {
+			tx.Rollback()
+			logger.Error("failed to get accounts", "err", err)
+			writeInternalServer(w, "failed to set account status")
+			return
+		}
+		account := getAccountByAccountNumber(accounts, accountNumber)
+		if account == nil {
+			tx.Rollback()
+			writeNotFound(w, "account not found")
+			return
+		}
+
+		// transactions in flight hold the account's lock, the new status applies to the ones after them.
+		err = transactionRepo.LockAccounts(r.Context(), tx, []int{account.ID})
+		if err != nil {
+			tx.Rollback()
+			logger.Error("failed to lock accounts", "err", err)
+			writeInternalServer(w, "failed to set account status")
+			return
+		}
+
+		change := &models.StatusChange{
+			AccountID: account.ID,
+			NewStatus: req.Status,
+			Reason:    req.Reason,
+		}
+		err = accountRepo.SetStatus(r.Context(), tx, change)
+		if err != nil {
+			tx.Rollback()
+			logger.Error("failed to set account status", "err", err)
+			writeInternalServer(w, "failed to set account status")
+			return
+		}
+		if change.PreviousStatus == AccountClosed {
+			tx.Rollback()
+			writeUnprocessableEntity(w, "account is closed")
+			return
+		}
+
+		err = tx.Commit()
+		if err != nil {
+			logger.Error("failed to commit db transaction", "err", err)
+			writeInternalServer(w, "failed to set account status")
+			return
+		}
+
+		writeOk(w, map[string]interface{}{
+			"status_change": change,
+		})
+	}
+}
+
+type closeAccountRequest struct {
+	Reason string `json:"reason"`
+	// SweepTo is the account the remaining balance is moved to, required unless the balance is zero.
+	SweepTo string `json:"sweep_to"`
+}
+
+func (r closeAccountRequest) validate() error {
+	if r.Reason == "" {
+		return errors.New("'reason' is required, can't be empty")
+	}
+	return nil
+}
+
+// closeAccount closes an account for good. The account has to be settled: no pending holds, not overdrawn,
+// and either a zero balance or an account to sweep the remainder to, in the same currency. Interest accrued until the closure is
+// capitalized first, so it's swept too. The capitalization, the sweep & the closure are atomic.
+func closeAccount(global *slog.Logger, accountRepo AccountRepository, transactionRepo TransactionRepository, interestRepo InterestRepository, webhookRepo WebhookRepository) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		logger := global.With("entity", "accounts")
+		accountNumber := mux.Vars(r)["accountNumber"]
+
+		var req closeAccountRequest
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			logger.Error("error reading request", "err", err)
+			writeBadRequest(w, err)
+			return
+		}
+		if err := req.validate(); err != nil {
+			logger.Error("error validating request", "err", err)
+			writeBadRequest(w, err)
+			return
+		}
+		if pkg.IsSystemAccountNumber(accountNumber) {
+			writeBadRequest(w, errors.New("action not allowed for this account number"))
+			return
+		}
+		if req.SweepTo == accountNumber {
+			writeBadRequest(w, errors.New("can't sweep an account to itself"))
+			return
+		}
+
+		err := accrueAccount(r.Context(), accountRepo, transactionRepo, interestRepo, accountNumber)
+		if err != nil {
+			logger.Error("failed to accrue interest", "err", err)
+			writeInternalServer(w, "failed to close account")
+			return
+		}
+
+		tx, err := transactionRepo.GetTx(r.Context())
+		if err != nil {
+			logger.Error("failed to acquire db transaction", "err", err)
+			writeInternalServer(w, "failed to close account")
+			return
+		}
+
+		accountNumbers := []string{accountNumber}
+		if req.SweepTo != "" {
+			accountNumbers = append(accountNumbers, req.SweepTo)
+		}
+		accounts, err := accountRepo.GetAccounts(r.Context(), tx, accountNumbers)
+		if err != nil {
+			tx.Rollback()
+			logger.Error("failed to get accounts", "err", err)
+			writeInternalServer(w, "failed to close account")
+			return
+		}
+		account := getAccountByAccountNumber(accounts, accountNumber)
+		if account == nil {
+			tx.Rollback()
+			writeNotFound(w, "account not found")
+			return
+		}
+
+		lockIDs := []int{account.ID}
+		var sweepTo *models.Account
+		if req.SweepTo != "" {
+			sweepTo = getAccountByAccountNumber(accounts, req.SweepTo)
+			if sweepTo == nil {
+				tx.Rollback()
+				writeUnprocessableEntity(w, fmt.Sprintf("account %s not found", req.SweepTo))
+				return
+			}
+			if sweepTo.Currency != account.Currency {
+				tx.Rollback()
+				writeUnprocessableEntity(w, fmt.Sprintf("can't sweep a %s account to a %s account", account.Currency, sweepTo.Currency))
+				return
+			}
+			lockIDs = append(lockIDs, sweepTo.ID)
+		}
+
+		err = transactionRepo.LockAccounts(r.Context(), tx, lockIDs)
+		if err != nil {
+			tx.Rollback()
+			logger.Error("failed to lock accounts", "err", err)
+			writeInternalServer(w, "failed to close account")
+			return
+		}
+
+		// closed accounts can't be credited, so all the pending interest is paid out now or never.
+		tomorrow := time.Now().UTC().Truncate(24*time.Hour).AddDate(0, 0, 1)
+		pending, err := interestRepo.GetPendingAccruals(r.Context(), tx, account.ID, tomorrow)
+		if err != nil {
+			tx.Rollback()
+			logger.Error("failed to get pending accruals", "err", err)
+			writeInternalServer(w, "failed to close account")
+			return
+		}
+		var interest *models.Transaction
+		if len(pending) > 0 {
+			var reason string
+			interest, reason, err = capitalizeAccruals(r.Context(), tx, accountRepo, transactionRepo, interestRepo, webhookRepo, pending, tomorrow)
+			if err != nil {
+				tx.Rollback()
+				logger.Error("failed to capitalize interest", "err", err)
+				writeInternalServer(w, "failed to close account")
+				return
+			}
+			if reason != "" {
+				tx.Rollback()
+				writeUnprocessableEntity(w, reason)
+				return
+			}
+		}
+
+		balance, err := transactionRepo.GetBalanceForUpdate(r.Context(), tx, account.ID)
+		if err != nil {
+			tx.Rollback()
+			logger.Error("failed to get balance", "err", err)
+			writeInternalServer(w, "failed to close account")
+			return
+		}
+		if balance.Held > 0 {
+			tx.Rollback()
+			writeUnprocessableEntity(w, "account has pending holds, they must be captured or voided first")
+			return
+		}
+		if balance.Ledger < 0 {
+			tx.Rollback()
+			writeUnprocessableEntity(w, "account is overdrawn, it must be settled first")
+			return
+		}
+		if balance.Ledger > 0 && sweepTo == nil {
+			tx.Rollback()
+			writeUnprocessableEntity(w, "account has a balance, 'sweep_to' is required to move it")
+			return
+		}
+
+		var sweep *models.Transaction
+		if balance.Ledger > 0 {
+			amount := balance.Ledger
+			sweep = &models.Transaction{
+				Reference:            fmt.Sprintf("close-%s", account.AccountNumber),
+				Type:                 Sweep,
+				Amount:               &amount,
+				SourceAccountID:      &account.ID,
+				DestinationAccountID: &sweepTo.ID,
+			}
+			lines := []*models.TransactionLine{
+				{AccountID: account.ID, AccountNumber: account.AccountNumber, Currency: account.Currency, Amount: amount, Purpose: string(repos.DEBIT)},
+				{AccountID: sweepTo.ID, AccountNumber: sweepTo.AccountNumber, Currency: sweepTo.Currency, Amount: amount, Purpose: string(repos.CREDIT)},
+			}
+
+			reason, err := checkStatuses(r.Context(), tx, accountRepo, lines)
+			if err != nil {
+				tx.Rollback()
+				logger.Error("failed to check account statuses", "err", err)
+				writeInternalServer(w, "failed to close account")
+				return
+			}
+			if reason != "" {
+				tx.Rollback()
+				writeUnprocessableEntity(w, reason)
+				return
+			}
+
+			reason, err = checkCreditLines(r.Context(), tx, accountRepo, transactionRepo, lines)
+			if err != nil {
+				tx.Rollback()
+				logger.Error("failed to check credit lines", "err", err)
+				writeInternalServer(w, "failed to close account")
+				return
+			}
+			if reason != "" {
+				tx.Rollback()
+				writeUnprocessableEntity(w, reason)
+				return
+			}
+
+			err = transactionRepo.Create(r.Context(), tx, sweep)
+			if err != nil {
+				tx.Rollback()
+				logger.Error("failed to create sweep transaction", "err", err)
+				writeInternalServer(w, "failed to close account")
+				return
+			}
+			for _, line := range lines {
+				line.TransactionID = sweep.ID
+				err = transactionRepo.CreateTransactionLine(r.Context(), tx, line)
+				if err != nil {
+					tx.Rollback()
+					logger.Error("failed to create transaction line", "err", err, "purpose", line.Purpose)
+					writeInternalServer(w, "failed to close account")
+					return
+				}
+			}
+
+			err = publishTransaction(r.Context(), tx, transactionRepo, webhookRepo, sweep)
+			if err != nil {
+				tx.Rollback()
+				logger.Error("failed to publish event", "err", err)
+				writeInternalServer(w, "failed to close account")
+				return
+			}
+			sweep.Lines = lines
+		}
+
+		change := &models.StatusChange{
+			AccountID: account.ID,
+			NewStatus: AccountClosed,
+			Reason:    req.Reason,
+		}
+		err = accountRepo.SetStatus(r.Context(), tx, change)
+		if err != nil {
+			tx.Rollback()
+			logger.Error("failed to set account status", "err", err)
+			writeInternalServer(w, "failed to close account")
+			return
+		}
+		if change.PreviousStatus == AccountClosed {
+			tx.Rollback()
+			writeUnprocessableEntity(w, "account is already closed")
+			return
+		}
+
+		err = tx.Commit()
+		if err != nil {
+			logger.Error("failed to commit db transaction", "err", err)
+			writeInternalServer(w, "failed to close account")
+			return
+		}
+
+		response := map[string]interface{}{
+			"status_change": change,
+		}
+		if interest != nil {
+			response["interest"] = interest
+		}
+		if sweep != nil {
+			response["sweep"] = sweep
+		}
+		writeOk(w, response)
+	}
+}
+
+func getStatusChanges(global *slog.Logger, accountRepo AccountRepository) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		logger := global.With("entity", "accounts")
+		accountNumber := mux.Vars(r)["accountNumber"]
+
+		tx, err := accountRepo.GetTx(r.Context())
+		if err != nil {
+			logger.Error("failed to acquire db transaction", "err", err)
+			writeInternalServer(w, "failed to get status changes")
+			return
+		}
+		defer tx.Rollback()
+
+		accounts, err := accountRepo.GetAccounts(r.Context(), tx, []string{accountNumber})
+		if err != nil {
+			logger.Error("failed to get accounts", "err", err)
+			writeInternalServer(w, "failed to get status changes")
+			return
+		}
+		account := getAccountByAccountNumber(accounts, accountNumber)
+		if account == nil {
+			writeNotFound(w, "account not found")
+			return
+		}
+
+		changes, err := accountRepo.GetStatusChanges(r.Context(), tx, account.ID)
+		if err != nil {
+			logger.Error("failed to get status changes", "err", err)
+			writeInternalServer(w, "failed to get status changes")
+			return
+		}
+		if changes == nil {
+			changes = []*models.StatusChange{}
+		}
+
+		writeOk(w, map[string]interface{}{
+			"status_changes": changes,
+		})
+	}
+}
+
+// deleteAccount soft deletes an account. Only closed accounts can be deleted, their lines stay in the ledger.
+func deleteAccount(global *slog.Logger, accountRepo AccountRepository) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		logger := global.With("entity", "accounts")
+		accountNumber := mux.Vars(r)["accountNumber"]
+
+		if pkg.IsSystemAccountNumber(accountNumber) {
+			writeBadRequest(w, errors.New("action not allowed for this account number"))
+			return
+		}
+
+		tx, err := accountRepo.GetTx(r.Context())
+		if err != nil {
+			logger.Error("failed to acquire db transaction", "err", err)
+			writeInternalServer(w, "failed to delete account")
+			return
+		}
+
+		accounts, err := accountRepo.GetAccounts(r.Context(), tx, []string{accountNumber})
+		if err != nil {
+			tx.Rollback()
+			logger.Error("failed to get accounts", "err", err)
+			writeInternalServer(w, "failed to delete account")
+			return
+		}
+		account := getAccountByAccountNumber(accounts, accountNumber)
+		if account == nil {
+			tx.Rollback()
+			writeNotFound(w, "account not found")
+			return
+		}
+		if account.Status != AccountClosed {
+			tx.Rollback()
+			writeUnprocessableEntity(w, "only closed accounts can be deleted")
+			return
+		}
+
+		err = accountRepo.Delete(r.Context(), tx, []int{account.ID})
+		if err != nil {
+			tx.Rollback()
+			logger.Error("failed to delete account", "err", err)
+			writeInternalServer(w, "failed to delete account")
+			return
+		}
+
+		err = tx.Commit()
+		if err != nil {
+			logger.Error("failed to commit db transaction", "err", err)
+			writeInternalServer(w, "failed to delete account")
+			return
+		}
+
+		writeOk(w, map[string]interface{}{
+			"account_number": account.AccountNumber,
+			"deleted":        true,
+		})
+	}
+}
+
+func AddAccountStatusRoutes(logger *slog.Logger, r *mux.Router, accountRepo AccountRepository, transactionRepo TransactionRepository, interestRepo InterestRepository, webhookRepo WebhookRepository) {
+	r.Methods("PUT").Path("/accounts/{accountNumber}/status").HandlerFunc(setAccountStatus(logger, accountRepo, transactionRepo))
+	r.Methods("GET").Path("/accounts/{accountNumber}/status/changes").HandlerFunc(getStatusChanges(logger, accountRepo))
+	r.Methods("POST").Path("/accounts/{accountNumber}/close").HandlerFunc(closeAccount(logger, accountRepo, transactionRepo, interestRepo, webhookRepo))
+	r.Methods("DELETE").Path("/accounts/{accountNumber}").HandlerFunc(deleteAccount(logger, accountRepo))
+}
@@ -5,35 +5,62 @@ import (
 	"database/sql"
 	"encoding/json"
 	"errors"
+	"fmt"
 	"log/slog"
 	"net/http"
-	"strings"
+	"time"
 
 	"github.com/gorilla/mux"
 	"github.com/gwuah/accounts/internal/models"
 	"github.com/gwuah/accounts/internal/repos"
 	"github.com/gwuah/accounts/pkg"
+	"github.com/shopspring/decimal"
 )
 
 const (
-	Deposit              string = "deposit"
-	Transfer             string = "transfer"
-	GenesisAccountNumber string = "000000000"
+	Deposit    string = "deposit"
+	Withdrawal string = "withdrawal"
+	Transfer   string = "transfer"
+	FXTransfer string = "fx_transfer"
+	Capture    string = "capture"
+	Reversal   string = "reversal"
+	Refund     string = "refund"
+	// JournalEntry is a compound transaction, made of any number of legs.
+	JournalEntry string = "journal"
+	// Interest capitalizes the interest an account accrued, paid from the interest expense account.
+	Interest string = "interest"
+	// Sweep moves what's left on an account that's being closed to another account.
+	Sweep string = "sweep"
 )
 
 type TransactionRepository interface {
 	GetTx(ctx context.Context) (*sql.Tx, error)
 	Create(ctx context.Context, tx *sql.Tx, t *models.Transaction) error
 	CreateTransactionLine(ctx context.Context, tx *sql.Tx, t *models.TransactionLine) error
-	GetBalance(ctx context.Context, tx *sql.Tx, accountID int) (int64, error)
+	GetBalance(ctx context.Context, tx *sql.Tx, accountID int) (*models.Balance, error)
+	GetBalanceForUpdate(ctx context.Context, tx *sql.Tx, accountID int) (*models.Balance, error)
+	GetByReference(ctx context.Context, tx *sql.Tx, reference string) (*models.Transaction, error)
+	GetLines(ctx context.Context, tx *sql.Tx, transactionID int) ([]*models.TransactionLine, error)
+	GetReversals(ctx context.Context, tx *sql.Tx, transactionID int) ([]*models.Transaction, error)
+	GetHistory(ctx context.Context, tx *sql.Tx, accountID int, filter repos.HistoryFilter) ([]*models.StatementLine, error)
+	VerifyBalances(ctx context.Context, tx *sql.Tx) ([]*models.BalanceDrift, error)
+	LockAccounts(ctx context.Context, tx *sql.Tx, accountIDs []int) error
+	GetBalanceAt(ctx context.Context, tx *sql.Tx, accountID int, at time.Time) (*models.Balance, error)
+	CreateSnapshots(ctx context.Context, tx *sql.Tx, at time.Time) (int, error)
+	GetChainHeads(ctx context.Context, tx *sql.Tx) ([]*models.ChainHead, error)
+	GetChainLines(ctx context.Context, tx *sql.Tx, afterAccountID, afterID, limit int) ([]*models.TransactionLine, error)
+	GetTrialBalance(ctx context.Context, tx *sql.Tx) ([]*models.TrialBalanceLine, error)
+	GetUnbalancedTransactions(ctx context.Context, tx *sql.Tx) ([]*models.UnbalancedTransaction, error)
+	GetOrphanLines(ctx context.Context, tx *sql.Tx) ([]*models.TransactionLine, error)
 }
 
 type createTransactionRequest struct {
-	From      string  `json:"from"`
-	To        string  `json:"to"`
-	Type      string  `json:"type"`
-	Amount    float64 `json:"amount"`
-	Reference string  `json:"reference"`
+	From string `json:"from"`
+	To   string `json:"to"`
+	Type string `json:"type"`
+	// Amount is in major units, either as a json number or a decimal string (eg. "10.25").
+	Amount    decimal.Decimal `json:"amount"`
+	Reference string          `json:"reference"`
 }
 
 func (r createTransactionRequest) validate() error {
@@ -42,24 +69,35 @@ func (r createTransactionRequest) validate() error {
 		if r.To == "" {
 			return errors.New("destination account is required for 'deposit'")
 		}
-		if r.To == GenesisAccountNumber {
+		if pkg.IsSystemAccountNumber(r.To) {
 			return errors.New("action not allowed for this account number")
 		}
-	case Transfer:
+	case Withdrawal:
+		if r.From == "" {
+			return errors.New("origin account is required for 'withdrawal'")
+		}
+		if pkg.IsSystemAccountNumber(r.From) {
+			return errors.New("action not allowed for this account number")
+		}
+	case Transfer, FXTransfer:
 		if r.From == "" || r.To == "" {
-			return errors.New("origin/destination accounts are required for 'transfer'")
+			return fmt.Errorf("origin/destination accounts are required for '%s'", r.Type)
+		}
+		// money only comes out of system accounts through deposits, which are approved when they're large.
+		if pkg.IsSystemAccountNumber(r.From) {
+			return errors.New("action not allowed for this account number")
 		}
 	default:
 		return errors.New("transaction 'type' is required")
 	}
-	if r.Amount == 0 {
-		return errors.New("amount is required. (non-zero value)")
+	if !r.Amount.IsPositive() {
+		return errors.New("amount is required. (positive value)")
 	}
 
 	return nil
 }
 
-func createTransaction(global *slog.Logger, accountRepo AccountRepository, userRepo UserRepository, transactionRepo TransactionRepository) http.HandlerFunc {
+func createTransaction(global *slog.Logger, accountRepo AccountRepository, userRepo UserRepository, transactionRepo TransactionRepository, fxRepo FXRepository, feeRepo FeeRepository, webhookRepo WebhookRepository, approvalRepo ApprovalRepository) http.HandlerFunc {
 	return func(w http.ResponseWriter, r *http.Request) {
 		logger := global.With("entity", "transactions")
 
@@ -75,123 +113,380 @@ func createTransaction(global *slog.Logger, accountRepo AccountRepository, userR
 			return
 		}
 
-		// check if user exists, before creating account (very important validation)
-
-		transaction := &models.Transaction{
-			Reference: req.Reference,
+		// high-value deposits are held until someone other than whoever made them approves them.
+		// users restricted to their own accounts can't deposit at all, so they're turned away right away.
+		if req.Type == Deposit && req.Amount.GreaterThanOrEqual(DepositApprovalThreshold) {
+			if !PrincipalFromContext(r.Context()).unrestricted() {
+				writeForbidden(w, "you can only move money out of your own accounts")
+				return
+			}
+			requestApproval(w, r, logger, approvalRepo, DepositAction, req)
+			return
 		}
 
-		tx, err := transactionRepo.GetTx(r.Context())
+		postTransaction(r.Context(), w, logger, accountRepo, transactionRepo, fxRepo, feeRepo, webhookRepo, req, nil)
+	}
+}
+
+// postTransaction posts the transaction & writes the response. beforeCommit, if set, runs in the transaction's db transaction last,
+// the transaction is then rolled back when it errors or returns why it can't go through.
+func postTransaction(ctx context.Context, w http.ResponseWriter, logger *slog.Logger, accountRepo AccountRepository, transactionRepo TransactionRepository, fxRepo FXRepository, feeRepo FeeRepository, webhookRepo WebhookRepository, req createTransactionRequest, beforeCommit func(tx *sql.Tx) (string, error)) {
+	transaction := &models.Transaction{
+		Reference: req.Reference,
+	}
+
+	tx, err := transactionRepo.GetTx(ctx)
+	if err != nil {
+		logger.Error("failed to acquire db transaction", "err", err)
+		writeInternalServer(w, "failed to create transaction")
+		return
+	}
+
+	accountNumbers := []string{req.From, req.To}
+	switch req.Type {
+	case Deposit:
+		accountNumbers = []string{req.To}
+	case Withdrawal:
+		accountNumbers = []string{req.From}
+	}
+
+	accounts, err := accountRepo.GetAccounts(ctx, tx, accountNumbers)
+	if err != nil {
+		tx.Rollback()
+		logger.Error("failed to get accounts", "err", err)
+		writeInternalServer(w, "failed to create transaction")
+		return
+	}
+
+	// a deposit is like any transfer, except we debit the genesis account of the destination's currency.
+	// a withdrawal is the other way round, we credit the genesis account of the origin's currency, cashing the money out of the system.
+	if (req.Type == Deposit || req.Type == Withdrawal) && len(accounts) == 1 {
+		currency, err := pkg.GetCurrency(accounts[0].Currency)
 		if err != nil {
-			logger.Error("failed to acquire db transaction", "err", err)
+			tx.Rollback()
+			logger.Error("account has unsupported currency", "err", err)
 			writeInternalServer(w, "failed to create transaction")
 			return
 		}
 
-		// a deposit is like any transfer, except we debit the genesis account, with id 0
+		genesisAccountNumber := pkg.GenesisAccountNumber(currency)
 		if req.Type == Deposit {
-			req.From = GenesisAccountNumber
+			req.From = genesisAccountNumber
+		} else {
+			req.To = genesisAccountNumber
 		}
 
-		accounts, err := accountRepo.GetAccounts(r.Context(), tx, []string{
-			req.From,
-			req.To,
-		})
+		genesis, err := accountRepo.GetAccounts(ctx, tx, []string{genesisAccountNumber})
 		if err != nil {
-			logger.Error("failed to get accounts", "err", err)
+			tx.Rollback()
+			logger.Error("failed to get genesis account", "err", err)
 			writeInternalServer(w, "failed to create transaction")
 			return
 		}
+		accounts = append(accounts, genesis...)
+	}
 
-		if len(accounts) != 2 {
-			logger.Error("uneven number of accounts", "err", err, "count", len(accounts))
-			writeInternalServer(w, "failed to create transaction")
+	if len(accounts) != 2 {
+		tx.Rollback()
+		logger.Error("uneven number of accounts", "err", err, "count", len(accounts))
+		writeInternalServer(w, "failed to create transaction")
+		return
+	}
+
+	from := getAccountByAccountNumber(accounts, req.From)
+	to := getAccountByAccountNumber(accounts, req.To)
+
+	// users can only debit their own accounts, which also keeps them from making deposits, as those debit the genesis account.
+	if !canAccess(ctx, from.UserID) {
+		tx.Rollback()
+		writeForbidden(w, "you can only move money out of your own accounts")
+		return
+	}
+
+	if req.Type == FXTransfer && from.Currency == to.Currency {
+		tx.Rollback()
+		writeBadRequest(w, errors.New("fx transfers require accounts of different currencies"))
+		return
+	}
+	if req.Type != FXTransfer && from.Currency != to.Currency {
+		tx.Rollback()
+		writeBadRequest(w, fmt.Errorf("can't transfer between %s and %s accounts", from.Currency, to.Currency))
+		return
+	}
+
+	currency, err := pkg.GetCurrency(from.Currency)
+	if err != nil {
+		tx.Rollback()
+		logger.Error("account has unsupported currency", "err", err)
+		writeInternalServer(w, "failed to create transaction")
+		return
+	}
+	amount, err := pkg.ConvertToMinor(req.Amount, currency)
+	if err != nil {
+		tx.Rollback()
+		writeBadRequest(w, err)
+		return
+	}
+
+	transaction.Type = req.Type
+	transaction.Amount = &amount
+	transaction.SourceAccountID = &from.ID
+	transaction.DestinationAccountID = &to.ID
+
+	err = transactionRepo.Create(ctx, tx, transaction)
+	if err != nil {
+		tx.Rollback()
+		if isUniqueViolation(err, "transactions", "reference") {
+			writeConflict(w, "duplicate transaction request")
 			return
 		}
+		logger.Error("failed to create payment transaction", "err", err)
+		writeInternalServer(w, "failed to create transaction")
+		return
+	}
 
-		err = transactionRepo.Create(r.Context(), tx, transaction)
+	lines := []*models.TransactionLine{
+		{
+			TransactionID: transaction.ID,
+			AccountID:     from.ID,
+			Amount:        amount,
+			Purpose:       string(repos.DEBIT),
+		},
+		{
+			TransactionID: transaction.ID,
+			AccountID:     to.ID,
+			Amount:        amount,
+			Purpose:       string(repos.CREDIT),
+		},
+	}
+
+	// fx transfers don't move money directly between the two accounts, they go through the fx position accounts.
+	var conversion *models.FXConversion
+	if req.Type == FXTransfer {
+		lines, conversion, err = buildFXLines(ctx, tx, accountRepo, fxRepo, transaction, from, to, amount)
 		if err != nil {
 			tx.Rollback()
-			if strings.Contains(err.Error(), "duplicate key value") && strings.Contains(err.Error(), "transactions_reference_key") {
-				w.Header().Set("Content-Type", "application/json; charset=utf-8")
-				w.WriteHeader(http.StatusConflict)
-				json.NewEncoder(w).Encode(map[string]interface{}{
-					"error": "duplicate transaction request",
-				})
+			if errors.Is(err, errNoFXRate) || errors.Is(err, errAmountTooSmall) {
+				writeUnprocessableEntity(w, err.Error())
 				return
 			}
-			logger.Error("failed to create payment transaction", "err", err)
+			logger.Error("failed to build fx transaction lines", "err", err)
 			writeInternalServer(w, "failed to create transaction")
 			return
 		}
+	}
 
-		// before performing this debit/credit, we need to verify if the origin account has enough balance for this transaction.
-		// we however exclude the genesis account, which has an account number of 0000000000, since it's a special account that only hold risks.
-		if req.From != GenesisAccountNumber {
-			account := getAccountByAccountNumber(accounts, req.From)
-			balance, err := transactionRepo.GetBalance(r.Context(), tx, account.ID)
-			if err != nil {
-				tx.Rollback()
-				logger.Error("failed to get balance", "err", err)
-				writeInternalServer(w, "failed to create transaction")
-				return
-			}
+	// the fee is paid by the customer's side of the transaction, so the destination for deposits and the origin for everything else.
+	payer := from
+	if req.Type == Deposit {
+		payer = to
+	}
+	feeLines, fee, err := buildFeeLines(ctx, tx, accountRepo, feeRepo, transaction, payer, amount)
+	if err != nil {
+		tx.Rollback()
+		logger.Error("failed to build fee lines", "err", err)
+		writeInternalServer(w, "failed to create transaction")
+		return
+	}
+	lines = append(lines, feeLines...)
 
-			if balance < pkg.ConvertToCents(req.Amount) {
-				tx.Rollback()
-				w.Header().Set("Content-Type", "application/json; charset=utf-8")
-				w.WriteHeader(http.StatusUnprocessableEntity)
-				json.NewEncoder(w).Encode(map[string]interface{}{
-					"error": "insufficient balance",
-				})
-				return
-			}
+	// concurrent transactions from the same account would otherwise all pass the balance check below before any of them posts.
+	// so we lock every account the transaction touches first, the balance check then sees every transaction committed before ours.
+	err = transactionRepo.LockAccounts(ctx, tx, lineAccountIDs(lines))
+	if err != nil {
+		tx.Rollback()
+		logger.Error("failed to lock accounts", "err", err)
+		writeInternalServer(w, "failed to create transaction")
+		return
+	}
 
-		}
+	reason, err := checkStatuses(ctx, tx, accountRepo, lines)
+	if err != nil {
+		tx.Rollback()
+		logger.Error("failed to check account statuses", "err", err)
+		writeInternalServer(w, "failed to create transaction")
+		return
+	}
+	if reason != "" {
+		tx.Rollback()
+		writeUnprocessableEntity(w, reason)
+		return
+	}
 
-		debit := models.TransactionLine{
-			TransactionID: transaction.ID,
-			AccountID:     getAccountByAccountNumber(accounts, req.From).ID,
-			Amount:        pkg.ConvertToCents(req.Amount),
-			Purpose:       string(repos.DEBIT),
+	reason, err = checkCreditLines(ctx, tx, accountRepo, transactionRepo, lines)
+	if err != nil {
+		tx.Rollback()
+		logger.Error("failed to check credit lines", "err", err)
+		writeInternalServer(w, "failed to create transaction")
+		return
+	}
+	if reason != "" {
+		tx.Rollback()
+		writeUnprocessableEntity(w, reason)
+		return
+	}
+
+	// before performing this debit/credit, we need to verify if the accounts debited have enough available balance (ie. net of pending holds, plus their overdraft limit) for this transaction, fees included.
+	// we however exclude the genesis accounts, since they're special accounts that only hold risks.
+	debited := netDebits(lines)
+	for _, account := range []*models.Account{from, to} {
+		if debited[account.ID] <= 0 || pkg.IsGenesisAccountNumber(account.AccountNumber) {
+			continue
+		}
+		balance, err := transactionRepo.GetBalanceForUpdate(ctx, tx, account.ID)
+		if err != nil {
+			tx.Rollback()
+			logger.Error("failed to get balance", "err", err)
+			writeInternalServer(w, "failed to create transaction")
+			return
 		}
 
-		credit := models.TransactionLine{
-			TransactionID: transaction.ID,
-			AccountID:     getAccountByAccountNumber(accounts, req.To).ID,
-			Amount:        pkg.ConvertToCents(req.Amount),
-			Purpose:       string(repos.CREDIT),
+		if balance.Available < debited[account.ID] {
+			tx.Rollback()
+			writeUnprocessableEntity(w, "insufficient balance")
+			return
 		}
+	}
 
-		err = transactionRepo.CreateTransactionLine(r.Context(), tx, &debit)
+	for _, line := range lines {
+		err = transactionRepo.CreateTransactionLine(ctx, tx, line)
 		if err != nil {
 			tx.Rollback()
-			logger.Error("failed to create debit transaction", "err", err)
+			logger.Error("failed to create transaction line", "err", err, "purpose", line.Purpose)
 			writeInternalServer(w, "failed to create transaction")
 			return
 		}
+	}
 
-		err = transactionRepo.CreateTransactionLine(r.Context(), tx, &credit)
+	if conversion != nil {
+		err = fxRepo.CreateConversion(ctx, tx, conversion)
 		if err != nil {
 			tx.Rollback()
-			logger.Error("failed to create credit transaction", "err", err)
+			logger.Error("failed to create fx conversion", "err", err)
 			writeInternalServer(w, "failed to create transaction")
 			return
 		}
+	}
 
-		err = tx.Commit()
+	err = publishTransaction(ctx, tx, transactionRepo, webhookRepo, transaction)
+	if err != nil {
+		tx.Rollback()
+		logger.Error("failed to publish event", "err", err)
+		writeInternalServer(w, "failed to create transaction")
+		return
+	}
+
+	if beforeCommit != nil {
+		reason, err := beforeCommit(tx)
 		if err != nil {
-			logger.Error("failed to commit db transaction", "err", err)
+			tx.Rollback()
+			logger.Error("failed to run pre-commit check", "err", err)
 			writeInternalServer(w, "failed to create transaction")
 			return
 		}
+		if reason != "" {
+			tx.Rollback()
+			writeConflict(w, reason)
+			return
+		}
+	}
+
+	err = tx.Commit()
+	if err != nil {
+		logger.Error("failed to commit db transaction", "err", err)
+		writeInternalServer(w, "failed to create transaction")
+		return
+	}
+
+	response := map[string]interface{}{
+		"status": "ok",
+	}
+	if conversion != nil {
+		response["conversion"] = conversion
+	}
+	if fee != nil {
+		response["fee"] = fee
+	}
+	writeOk(w, response)
+}
+
+func getTransaction(global *slog.Logger, accountRepo AccountRepository, transactionRepo TransactionRepository) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		logger := global.With("entity", "transactions")
+		reference := mux.Vars(r)["reference"]
+
+		tx, err := transactionRepo.GetTx(r.Context())
+		if err != nil {
+			logger.Error("failed to acquire db transaction", "err", err)
+			writeInternalServer(w, "failed to get transaction")
+			return
+		}
+		defer tx.Rollback()
+
+		transaction, err := transactionRepo.GetByReference(r.Context(), tx, reference)
+		if err != nil {
+			logger.Error("failed to get transaction", "err", err)
+			writeInternalServer(w, "failed to get transaction")
+			return
+		}
+		if transaction == nil {
+			writeNotFound(w, "transaction not found")
+			return
+		}
+
+		transaction.Lines, err = transactionRepo.GetLines(r.Context(), tx, transaction.ID)
+		if err != nil {
+			logger.Error("failed to get transaction lines", "err", err)
+			writeInternalServer(w, "failed to get transaction")
+			return
+		}
+
+		// users only see the transactions that touch one of their accounts.
+		visible, err := canAccessLines(r.Context(), tx, accountRepo, transaction.Lines)
+		if err != nil {
+			logger.Error("failed to get transaction accounts", "err", err)
+			writeInternalServer(w, "failed to get transaction")
+			return
+		}
+		if !visible {
+			writeNotFound(w, "transaction not found")
+			return
+		}
+
+		transaction.Reversals, err = transactionRepo.GetReversals(r.Context(), tx, transaction.ID)
+		if err != nil {
+			logger.Error("failed to get transaction reversals", "err", err)
+			writeInternalServer(w, "failed to get transaction")
+			return
+		}
 
 		writeOk(w, map[string]interface{}{
-			"status": "ok",
+			"transaction": transaction,
 		})
 	}
 }
 
+// netDebits returns what each account is debited overall by the lines, net of what it's credited.
+func netDebits(lines []*models.TransactionLine) map[int]int64 {
+	debited := map[int]int64{}
+	for _, line := range lines {
+		if line.Purpose == string(repos.DEBIT) {
+			debited[line.AccountID] += line.Amount
+		} else {
+			debited[line.AccountID] -= line.Amount
+		}
+	}
+	return debited
+}
+
+func lineAccountIDs(lines []*models.TransactionLine) []int {
+	ids := make([]int, 0, len(lines))
+	for _, line := range lines {
+		ids = append(ids, line.AccountID)
+	}
+	return ids
+}
+
 func getAccountByAccountNumber(accounts []*models.Account, accountNumber string) *models.Account {
 	for _, acc := range accounts {
 		if acc.AccountNumber == accountNumber {
@@ -201,6 +496,31 @@ func getAccountByAccountNumber(accounts []*models.Account, accountNumber string)
 	return nil
 }
 
-func AddTransactionRoutes(logger *slog.Logger, r *mux.Router, accountRepo AccountRepository, userRepo UserRepository, transactionRepo TransactionRepository) {
-	r.Methods("POST").Path("/transactions").HandlerFunc(createTransaction(logger, accountRepo, userRepo, transactionRepo))
+func AddTransactionRoutes(logger *slog.Logger, r *mux.Router, accountRepo AccountRepository, userRepo UserRepository, transactionRepo TransactionRepository, fxRepo FXRepository, feeRepo FeeRepository, webhookRepo WebhookRepository, approvalRepo ApprovalRepository) {
+	r.Methods("POST").Path("/transactions").HandlerFunc(createTransaction(logger, accountRepo, userRepo, transactionRepo, fxRepo, feeRepo, webhookRepo, approvalRepo))
+	r.Methods("GET").Path("/transactions/{reference}").HandlerFunc(getTransaction(logger, accountRepo, transactionRepo))
+	r.Methods("POST").Path("/transactions/{reference}/reverse").HandlerFunc(compensateTransaction(logger, accountRepo, transactionRepo, webhookRepo, Reversal))
+	r.Methods("POST").Path("/transactions/{reference}/refund").HandlerFunc(compensateTransaction(logger, accountRepo, transactionRepo, webhookRepo, Refund))
+}
+
+// canAccessLines reports whether the request may see a transaction with the given lines, ie. whether it can access one of their accounts.
+func canAccessLines(ctx context.Context, tx *sql.Tx, accountRepo AccountRepository, lines []*models.TransactionLine) (bool, error) {
+	if PrincipalFromContext(ctx).unrestricted() {
+		return true, nil
+	}
+
+	ids := make([]int, 0, len(lines))
+	for _, line := range lines {
+		ids = append(ids, line.AccountID)
+	}
+	accounts, err := accountRepo.GetAccountsByID(ctx, tx, ids)
+	if err != nil {
+		return false, err
+	}
+	for _, account := range accounts {
+		if canAccess(ctx, account.UserID) {
+			return true, nil
+		}
+	}
+	return false, nil
 }
@@ -5,6 +5,7 @@ import (
 	"database/sql"
 	"encoding/json"
 	"errors"
+	"fmt"
 	"log/slog"
 	"net/http"
 	"strconv"
@@ -18,6 +19,8 @@ type UserRepository interface {
 	GetTx(ctx context.Context) (*sql.Tx, error)
 	Create(ctx context.Context, tx *sql.Tx, u *models.User) error
 	GetByID(ctx context.Context, tx *sql.Tx, userID int) (*models.User, error)
+	Delete(ctx context.Context, tx *sql.Tx, userID int) (*models.User, error)
+	Erase(ctx context.Context, tx *sql.Tx, userID int) (*models.User, error)
 }
 
 type createUserRequest struct {
@@ -37,6 +40,15 @@ func stringToInt(s string) int {
 	return intValue
 }
 
+// isUniqueViolation reports whether err was caused by a unique constraint on table.column, on either postgres or sqlite.
+func isUniqueViolation(err error, table, column string) bool {
+	msg := err.Error()
+	if strings.Contains(msg, "duplicate key value") && strings.Contains(msg, fmt.Sprintf("%s_%s_key", table, column)) {
+		return true
+	}
+	return strings.Contains(msg, fmt.Sprintf("UNIQUE constraint failed: %s.%s", table, column))
+}
+
 func writeBadRequest(w http.ResponseWriter, err error) {
 	if err == nil {
 		return
@@ -56,13 +68,67 @@ func writeInternalServer(w http.ResponseWriter, msg string) {
 	})
 }
 
+func writeUnauthorized(w http.ResponseWriter, msg string) {
+	w.Header().Set("Content-Type", "application/json; charset=utf-8")
+	w.WriteHeader(http.StatusUnauthorized)
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"error": msg,
+	})
+}
+
+func writeForbidden(w http.ResponseWriter, msg string) {
+	w.Header().Set("Content-Type", "application/json; charset=utf-8")
+	w.WriteHeader(http.StatusForbidden)
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"error": msg,
+	})
+}
+
+func writeNotFound(w http.ResponseWriter, msg string) {
+	w.Header().Set("Content-Type", "application/json; charset=utf-8")
+	w.WriteHeader(http.StatusNotFound)
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"error": msg,
+	})
+}
+
+func writeConflict(w http.ResponseWriter, msg string) {
+	w.Header().Set("Content-Type", "application/json; charset=utf-8")
+	w.WriteHeader(http.StatusConflict)
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"error": msg,
+	})
+}
+
+func writeUnprocessableEntity(w http.ResponseWriter, msg string) {
+	w.Header().Set("Content-Type", "application/json; charset=utf-8")
+	w.WriteHeader(http.StatusUnprocessableEntity)
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"error": msg,
+	})
+}
+
+func writeTooManyRequests(w http.ResponseWriter, msg string) {
+	w.Header().Set("Content-Type", "application/json; charset=utf-8")
+	w.WriteHeader(http.StatusTooManyRequests)
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"error": msg,
+	})
+}
+
+func writeAccepted(w http.ResponseWriter, data map[string]interface{}) {
+	w.Header().Set("Content-Type", "application/json; charset=utf-8")
+	w.WriteHeader(http.StatusAccepted)
+	json.NewEncoder(w).Encode(data)
+}
+
 func writeOk(w http.ResponseWriter, data map[string]interface{}) {
 	w.Header().Set("Content-Type", "application/json; charset=utf-8")
 	w.WriteHeader(http.StatusOK)
 	json.NewEncoder(w).Encode(data)
 }
 
-func createUser(global *slog.Logger, userRepo UserRepository) http.HandlerFunc {
+func createUser(global *slog.Logger, userRepo UserRepository, webhookRepo WebhookRepository) http.HandlerFunc {
 	return func(w http.ResponseWriter, r *http.Request) {
 		logger := global.With("entity", "users")
 
@@ -91,7 +157,7 @@ func createUser(global *slog.Logger, userRepo UserRepository) http.HandlerFunc {
 		err = userRepo.Create(r.Context(), tx, user)
 		if err != nil {
 			tx.Rollback()
-			if strings.Contains(err.Error(), "duplicate key value") && strings.Contains(err.Error(), "users_email_key") {
+			if isUniqueViolation(err, "users", "email") {
 				writeBadRequest(w, errors.New("email already taken"))
 				return
 			}
@@ -100,6 +166,14 @@ func createUser(global *slog.Logger, userRepo UserRepository) http.HandlerFunc {
 			return
 		}
 
+		err = publishEvent(r.Context(), tx, webhookRepo, EventUserCreated, userEvent{ID: user.ID, CreatedAt: user.CreatedAt})
+		if err != nil {
+			tx.Rollback()
+			logger.Error("failed to publish event", "err", err)
+			writeInternalServer(w, "failed to create user")
+			return
+		}
+
 		err = tx.Commit()
 		if err != nil {
 			logger.Error("failed to commit db transaction", "err", err)
@@ -124,6 +198,7 @@ func findUser(global *slog.Logger, userRepo UserRepository, accountRepo AccountR
 			writeInternalServer(w, "failed to get user")
 			return
 		}
+		defer tx.Rollback()
 
 		user, err := userRepo.GetByID(r.Context(), tx, stringToInt(id))
 		if err != nil {
@@ -131,6 +206,132 @@ func findUser(global *slog.Logger, userRepo UserRepository, accountRepo AccountR
 			writeInternalServer(w, "failed to get user")
 			return
 		}
+		if user == nil || !canAccess(r.Context(), user.ID) {
+			writeNotFound(w, "user not found")
+			return
+		}
+
+		writeOk(w, map[string]interface{}{
+			"user": user,
+		})
+	}
+}
+
+// deleteUserAccounts soft deletes the user's accounts, as part of deleting the user.
+// Only closed accounts can be deleted, so the user's money is never left behind. It returns why it can't, or "".
+func deleteUserAccounts(ctx context.Context, tx *sql.Tx, accountRepo AccountRepository, userID int) (string, error) {
+	accounts, err := accountRepo.GetByUserID(ctx, tx, userID)
+	if err != nil {
+		return "", err
+	}
+
+	ids := make([]int, 0, len(accounts))
+	for _, account := range accounts {
+		if account.Status != AccountClosed {
+			return fmt.Sprintf("account %s isn't closed, the user's accounts must be closed first", account.AccountNumber), nil
+		}
+		ids = append(ids, account.ID)
+	}
+	return "", accountRepo.Delete(ctx, tx, ids)
+}
+
+func deleteUser(global *slog.Logger, userRepo UserRepository, accountRepo AccountRepository) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		logger := global.With("entity", "users")
+		id := stringToInt(mux.Vars(r)["id"])
+
+		tx, err := userRepo.GetTx(r.Context())
+		if err != nil {
+			logger.Error("failed to acquire db transaction", "err", err)
+			writeInternalServer(w, "failed to delete user")
+			return
+		}
+
+		reason, err := deleteUserAccounts(r.Context(), tx, accountRepo, id)
+		if err != nil {
+			tx.Rollback()
+			logger.Error("failed to delete user accounts", "err", err)
+			writeInternalServer(w, "failed to delete user")
+			return
+		}
+		if reason != "" {
+			tx.Rollback()
+			writeUnprocessableEntity(w, reason)
+			return
+		}
+
+		user, err := userRepo.Delete(r.Context(), tx, id)
+		if err != nil {
+			tx.Rollback()
+			logger.Error("failed to delete user", "err", err)
+			writeInternalServer(w, "failed to delete user")
+			return
+		}
+		if user == nil {
+			tx.Rollback()
+			writeNotFound(w, "user not found")
+			return
+		}
+
+		err = tx.Commit()
+		if err != nil {
+			logger.Error("failed to commit db transaction", "err", err)
+			writeInternalServer(w, "failed to delete user")
+			return
+		}
+
+		writeOk(w, map[string]interface{}{
+			"user": user,
+		})
+	}
+}
+
+// eraseUser handles GDPR erasure requests: the user's personal data is pseudonymized and the user deleted.
+// Ledger lines only reference accounts by id, they're left untouched so every balance still adds up.
+func eraseUser(global *slog.Logger, userRepo UserRepository, accountRepo AccountRepository) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		logger := global.With("entity", "users")
+		id := stringToInt(mux.Vars(r)["id"])
+
+		tx, err := userRepo.GetTx(r.Context())
+		if err != nil {
+			logger.Error("failed to acquire db transaction", "err", err)
+			writeInternalServer(w, "failed to erase user")
+			return
+		}
+
+		reason, err := deleteUserAccounts(r.Context(), tx, accountRepo, id)
+		if err != nil {
+			tx.Rollback()
+			logger.Error("failed to delete user accounts", "err", err)
+			writeInternalServer(w, "failed to erase user")
+			return
+		}
+		if reason != "" {
+			tx.Rollback()
+			writeUnprocessableEntity(w, reason)
+			return
+		}
+
+		user, err := userRepo.Erase(r.Context(), tx, id)
+		if err != nil {
+			tx.Rollback()
+			logger.Error("failed to erase user", "err", err)
+			writeInternalServer(w, "failed to erase user")
+			return
+		}
+		if user == nil {
+			tx.Rollback()
+			writeNotFound(w, "user not found or already erased")
+			return
+		}
+
+		err = tx.Commit()
+		if err != nil {
+			logger.Error("failed to commit db transaction", "err", err)
+			writeInternalServer(w, "failed to erase user")
+			return
+		}
 
 		writeOk(w, map[string]interface{}{
 			"user": user,
@@ -138,7 +339,9 @@ func findUser(global *slog.Logger, userRepo UserRepository, accountRepo AccountR
 	}
 }
 
-func AddUserRoutes(logger *slog.Logger, r *mux.Router, accountRepo AccountRepository, userRepo UserRepository) {
+func AddUserRoutes(logger *slog.Logger, r *mux.Router, accountRepo AccountRepository, userRepo UserRepository, webhookRepo WebhookRepository) {
 	r.Methods("GET").Path("/users/{id}").HandlerFunc(findUser(logger, userRepo, accountRepo))
-	r.Methods("POST").Path("/users").HandlerFunc(createUser(logger, userRepo))
+	r.Methods("POST").Path("/users").HandlerFunc(createUser(logger, userRepo, webhookRepo))
+	r.Methods("DELETE").Path("/users/{id}").HandlerFunc(deleteUser(logger, userRepo, accountRepo))
+	r.Methods("POST").Path("/users/{id}/erase").HandlerFunc(eraseUser(logger, userRepo, accountRepo))
 }
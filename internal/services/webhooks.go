@@ -0,0 +1,421 @@
+package services
+
+import (
+	"bytes"
+	"context"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"net/url"
+	"slices"
+	"strings"
+	"time"
+
+	"github.com/gorilla/mux"
+	"github.com/gwuah/accounts/internal/models"
+	"github.com/gwuah/accounts/pkg"
+)
+
+const (
+	EventTransactionPosted = "transaction.posted"
+	EventAccountCreated    = "account.created"
+	EventUserCreated       = "user.created"
+
+	// allEvents subscribes an endpoint to every event, including the ones added later.
+	allEvents = "*"
+)
+
+var events = []string{EventTransactionPosted, EventAccountCreated, EventUserCreated}
+
+const (
+	DeliveryPending   = "pending"
+	DeliveryDelivered = "delivered"
+	DeliveryDead      = "dead"
+)
+
+const (
+	// a failed delivery is retried after retryBackoff, doubling after every attempt, until it's dead lettered after maxDeliveryAttempts.
+	retryBackoff        = 30 * time.Second
+	maxDeliveryAttempts = 8
+	dispatchBatchSize   = 100
+)
+
+type WebhookRepository interface {
+	GetTx(ctx context.Context) (*sql.Tx, error)
+	CreateEndpoint(ctx context.Context, tx *sql.Tx, e *models.WebhookEndpoint) error
+	GetEndpoints(ctx context.Context, tx *sql.Tx) ([]*models.WebhookEndpoint, error)
+	CreateEvent(ctx context.Context, tx *sql.Tx, e *models.Event) error
+	GetUndispatchedEvents(ctx context.Context, tx *sql.Tx, limit int) ([]*models.Event, error)
+	MarkDispatched(ctx context.Context, tx *sql.Tx, eventID int) error
+	CreateDelivery(ctx context.Context, tx *sql.Tx, d *models.WebhookDelivery) error
+	GetDueDeliveries(ctx context.Context, tx *sql.Tx, now time.Time, limit int) ([]*models.WebhookDelivery, error)
+	UpdateDelivery(ctx context.Context, tx *sql.Tx, d *models.WebhookDelivery) error
+	GetDeliveries(ctx context.Context, tx *sql.Tx, status string) ([]*models.WebhookDelivery, error)
+	ReplayDelivery(ctx context.Context, tx *sql.Tx, id int, now time.Time) (*models.WebhookDelivery, error)
+}
+
+// publishEvent writes an event to the outbox, in the db transaction of the change it describes.
+func publishEvent(ctx context.Context, tx *sql.Tx, webhookRepo WebhookRepository, eventType string, data any) error {
+	payload, err := json.Marshal(data)
+	if err != nil {
+		return fmt.Errorf("failed to marshal %s event. %w", eventType, err)
+	}
+	return webhookRepo.CreateEvent(ctx, tx, &models.Event{Type: eventType, Payload: payload})
+}
+
+// userEvent is what events tell about a user. Events outlive erasure, they're listed & replayed for as long as they're kept,
+// so they carry no personal data. Receivers fetch the user when they need more.
+type userEvent struct {
+	ID        int       `json:"id"`
+	CreatedAt time.Time `json:"created_at"`
+}
+
+// publishTransaction publishes a transaction.posted event, with the lines the transaction posted.
+// It must be called after the lines are created, they're read back so the event has their account numbers.
+func publishTransaction(ctx context.Context, tx *sql.Tx, transactionRepo TransactionRepository, webhookRepo WebhookRepository, transaction *models.Transaction) error {
+	lines, err := transactionRepo.GetLines(ctx, tx, transaction.ID)
+	if err != nil {
+		return err
+	}
+
+	event := *transaction
+	event.Lines = lines
+	return publishEvent(ctx, tx, webhookRepo, EventTransactionPosted, &event)
+}
+
+func subscribes(endpoint *models.WebhookEndpoint, eventType string) bool {
+	return slices.Contains(endpoint.Events, allEvents) || slices.Contains(endpoint.Events, eventType)
+}
+
+// DispatchWebhooks fans the outbox's new events out to the endpoints subscribed to them, then attempts the deliveries that are due.
+// Deliveries are at least once: receivers should use the event id to ignore the ones they've already processed.
+// It returns the number of deliveries that succeeded.
+func DispatchWebhooks(ctx context.Context, logger *slog.Logger, webhookRepo WebhookRepository, client *http.Client, now time.Time) (int, error) {
+	if err := fanOutEvents(ctx, webhookRepo, now); err != nil {
+		return 0, fmt.Errorf("failed to fan out events. %w", err)
+	}
+
+	tx, err := webhookRepo.GetTx(ctx)
+	if err != nil {
+		return 0, err
+	}
+	due, err := webhookRepo.GetDueDeliveries(ctx, tx, now, dispatchBatchSize)
+	tx.Rollback()
+	if err != nil {
+		return 0, err
+	}
+
+	delivered := 0
+	for _, delivery := range due {
+		err := deliver(ctx, client, delivery, now)
+		delivery.Attempts++
+		switch {
+		case err == nil:
+			delivery.Status = DeliveryDelivered
+			delivery.LastError = ""
+			delivery.DeliveredAt = &now
+			delivered++
+		case delivery.Attempts >= maxDeliveryAttempts:
+			delivery.Status = DeliveryDead
+			delivery.LastError = err.Error()
+			logger.Error("webhook delivery dead lettered", "delivery", delivery.ID, "url", delivery.URL, "err", err)
+		default:
+			delivery.LastError = err.Error()
+			delivery.NextAttemptAt = now.Add(retryBackoff << (delivery.Attempts - 1))
+		}
+
+		tx, err := webhookRepo.GetTx(ctx)
+		if err != nil {
+			return delivered, err
+		}
+		if err := webhookRepo.UpdateDelivery(ctx, tx, delivery); err != nil {
+			tx.Rollback()
+			return delivered, fmt.Errorf("failed to update delivery %d. %w", delivery.ID, err)
+		}
+		if err := tx.Commit(); err != nil {
+			return delivered, err
+		}
+	}
+
+	return delivered, nil
+}
+
+func fanOutEvents(ctx context.Context, webhookRepo WebhookRepository, now time.Time) error {
+	tx, err := webhookRepo.GetTx(ctx)
+	if err != nil {
+		return err
+	}
+
+	pending, err := webhookRepo.GetUndispatchedEvents(ctx, tx, dispatchBatchSize)
+	if err != nil {
+		tx.Rollback()
+		return err
+	}
+	if len(pending) == 0 {
+		tx.Rollback()
+		return nil
+	}
+
+	endpoints, err := webhookRepo.GetEndpoints(ctx, tx)
+	if err != nil {
+		tx.Rollback()
+		return err
+	}
+
+	for _, event := range pending {
+		for _, endpoint := range endpoints {
+			if !subscribes(endpoint, event.Type) {
+				continue
+			}
+			err := webhookRepo.CreateDelivery(ctx, tx, &models.WebhookDelivery{
+				EventID:       event.ID,
+				EndpointID:    endpoint.ID,
+				Status:        DeliveryPending,
+				NextAttemptAt: now,
+			})
+			if err != nil {
+				tx.Rollback()
+				return err
+			}
+		}
+
+		if err := webhookRepo.MarkDispatched(ctx, tx, event.ID); err != nil {
+			tx.Rollback()
+			return err
+		}
+	}
+
+	return tx.Commit()
+}
+
+// deliver posts the delivery's event to its endpoint, signed with the endpoint's secret. Any 2xx response is a success.
+func deliver(ctx context.Context, client *http.Client, delivery *models.WebhookDelivery, now time.Time) error {
+	body, err := json.Marshal(delivery.Event)
+	if err != nil {
+		return err
+	}
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, delivery.URL, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set(pkg.WebhookSignatureHeader, pkg.SignWebhook(delivery.Secret, now, body))
+
+	resp, err := client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	io.Copy(io.Discard, resp.Body)
+
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return fmt.Errorf("endpoint responded with %d", resp.StatusCode)
+	}
+	return nil
+}
+
+// RunWebhooks dispatches webhooks every interval until ctx is done.
+func RunWebhooks(ctx context.Context, logger *slog.Logger, webhookRepo WebhookRepository, client *http.Client, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case now := <-ticker.C:
+			_, err := DispatchWebhooks(ctx, logger, webhookRepo, client, now.UTC())
+			if err != nil {
+				logger.Error("failed to dispatch webhooks", "err", err)
+			}
+		}
+	}
+}
+
+type createWebhookEndpointRequest struct {
+	URL    string   `json:"url"`
+	Events []string `json:"events"`
+}
+
+func (r createWebhookEndpointRequest) validate() error {
+	u, err := url.Parse(r.URL)
+	if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+		return errors.New("'url' must be an absolute http(s) url")
+	}
+	if len(r.Events) == 0 {
+		return fmt.Errorf("'events' is required, use [\"%s\"] to subscribe to every event", allEvents)
+	}
+	for _, event := range r.Events {
+		if event != allEvents && !slices.Contains(events, event) {
+			return fmt.Errorf("'events' must be one of %s or %s", strings.Join(events, ", "), allEvents)
+		}
+	}
+	return nil
+}
+
+func createWebhookEndpoint(global *slog.Logger, webhookRepo WebhookRepository) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		logger := global.With("entity", "webhooks")
+
+		var req createWebhookEndpointRequest
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			logger.Error("error reading request", "err", err)
+			writeBadRequest(w, err)
+			return
+		}
+		if err := req.validate(); err != nil {
+			logger.Error("error validating request", "err", err)
+			writeBadRequest(w, err)
+			return
+		}
+
+		secret, err := pkg.NewWebhookSecret()
+		if err != nil {
+			logger.Error("failed to generate webhook secret", "err", err)
+			writeInternalServer(w, "failed to create webhook endpoint")
+			return
+		}
+
+		tx, err := webhookRepo.GetTx(r.Context())
+		if err != nil {
+			logger.Error("failed to acquire db transaction", "err", err)
+			writeInternalServer(w, "failed to create webhook endpoint")
+			return
+		}
+
+		endpoint := &models.WebhookEndpoint{
+			URL:    req.URL,
+			Secret: secret,
+			Events: req.Events,
+		}
+		err = webhookRepo.CreateEndpoint(r.Context(), tx, endpoint)
+		if err != nil {
+			tx.Rollback()
+			logger.Error("failed to create webhook endpoint", "err", err)
+			writeInternalServer(w, "failed to create webhook endpoint")
+			return
+		}
+
+		err = tx.Commit()
+		if err != nil {
+			logger.Error("failed to commit db transaction", "err", err)
+			writeInternalServer(w, "failed to create webhook endpoint")
+			return
+		}
+
+		// the secret is only ever returned here, the endpoint needs it to verify the deliveries' signatures.
+		writeOk(w, map[string]interface{}{
+			"endpoint": endpoint,
+		})
+	}
+}
+
+func getWebhookEndpoints(global *slog.Logger, webhookRepo WebhookRepository) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		logger := global.With("entity", "webhooks")
+
+		tx, err := webhookRepo.GetTx(r.Context())
+		if err != nil {
+			logger.Error("failed to acquire db transaction", "err", err)
+			writeInternalServer(w, "failed to get webhook endpoints")
+			return
+		}
+		defer tx.Rollback()
+
+		endpoints, err := webhookRepo.GetEndpoints(r.Context(), tx)
+		if err != nil {
+			logger.Error("failed to get webhook endpoints", "err", err)
+			writeInternalServer(w, "failed to get webhook endpoints")
+			return
+		}
+		for _, endpoint := range endpoints {
+			endpoint.Secret = ""
+		}
+
+		writeOk(w, map[string]interface{}{
+			"endpoints": endpoints,
+		})
+	}
+}
+
+func getWebhookDeliveries(global *slog.Logger, webhookRepo WebhookRepository) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		logger := global.With("entity", "webhooks")
+
+		status := r.URL.Query().Get("status")
+		if status != "" && status != DeliveryPending && status != DeliveryDelivered && status != DeliveryDead {
+			writeBadRequest(w, fmt.Errorf("'status' must be one of %s, %s or %s", DeliveryPending, DeliveryDelivered, DeliveryDead))
+			return
+		}
+
+		tx, err := webhookRepo.GetTx(r.Context())
+		if err != nil {
+			logger.Error("failed to acquire db transaction", "err", err)
+			writeInternalServer(w, "failed to get webhook deliveries")
+			return
+		}
+		defer tx.Rollback()
+
+		deliveries, err := webhookRepo.GetDeliveries(r.Context(), tx, status)
+		if err != nil {
+			logger.Error("failed to get webhook deliveries", "err", err)
+			writeInternalServer(w, "failed to get webhook deliveries")
+			return
+		}
+
+		writeOk(w, map[string]interface{}{
+			"deliveries": deliveries,
+		})
+	}
+}
+
+// replayWebhookDelivery queues a delivery again, typically a dead lettered one once its endpoint is fixed.
+func replayWebhookDelivery(global *slog.Logger, webhookRepo WebhookRepository) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		logger := global.With("entity", "webhooks")
+		id := stringToInt(mux.Vars(r)["id"])
+
+		tx, err := webhookRepo.GetTx(r.Context())
+		if err != nil {
+			logger.Error("failed to acquire db transaction", "err", err)
+			writeInternalServer(w, "failed to replay webhook delivery")
+			return
+		}
+
+		delivery, err := webhookRepo.ReplayDelivery(r.Context(), tx, id, time.Now().UTC())
+		if err != nil {
+			tx.Rollback()
+			logger.Error("failed to replay webhook delivery", "err", err)
+			writeInternalServer(w, "failed to replay webhook delivery")
+			return
+		}
+		if delivery == nil {
+			tx.Rollback()
+			writeNotFound(w, "webhook delivery not found")
+			return
+		}
+
+		err = tx.Commit()
+		if err != nil {
+			logger.Error("failed to commit db transaction", "err", err)
+			writeInternalServer(w, "failed to replay webhook delivery")
+			return
+		}
+
+		writeOk(w, map[string]interface{}{
+			"delivery": delivery,
+		})
+	}
+}
+
+func AddWebhookRoutes(logger *slog.Logger, r *mux.Router, webhookRepo WebhookRepository) {
+	r.Methods("POST").Path("/webhooks").HandlerFunc(createWebhookEndpoint(logger, webhookRepo))
+	r.Methods("GET").Path("/webhooks").HandlerFunc(getWebhookEndpoints(logger, webhookRepo))
+	r.Methods("GET").Path("/webhooks/deliveries").HandlerFunc(getWebhookDeliveries(logger, webhookRepo))
+	r.Methods("POST").Path("/webhooks/deliveries/{id}/replay").HandlerFunc(replayWebhookDelivery(logger, webhookRepo))
+}
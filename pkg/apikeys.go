@@ -0,0 +1,28 @@
+package pkg
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+)
+
+const (
+	apiKeyPrefix = "ak_"
+	// APIKeyPrefixLength is how much of a key is kept in the clear, to tell keys apart.
+	APIKeyPrefixLength = len(apiKeyPrefix) + 8
+)
+
+// NewAPIKey returns a random api key. Only its hash is stored, the key itself is shown once.
+func NewAPIKey() (string, error) {
+	b := make([]byte, 32)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	return apiKeyPrefix + hex.EncodeToString(b), nil
+}
+
+// HashAPIKey returns the hash keys are stored & looked up by. Keys are random, so a plain sha256 is enough.
+func HashAPIKey(key string) string {
+	sum := sha256.Sum256([]byte(key))
+	return hex.EncodeToString(sum[:])
+}
@@ -0,0 +1,17 @@
+package pkg
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"time"
+)
+
+// LineHash returns the hash chaining a transaction line to the line before it. It covers the line's content
+// and the previous line's hash, so altering, removing or reordering any line changes every hash after it.
+// The first line of the chain has an empty previous hash.
+func LineHash(prevHash string, transactionID, accountID int, amount int64, purpose string, createdAt time.Time) string {
+	content := fmt.Sprintf("%s|%d|%d|%d|%s|%s", prevHash, transactionID, accountID, amount, purpose, createdAt.UTC().Format(time.RFC3339Nano))
+	sum := sha256.Sum256([]byte(content))
+	return hex.EncodeToString(sum[:])
+}
@@ -0,0 +1,21 @@
+package pkg_test
+
+import (
+	"testing"
+	"time"
+
+	"github.com/gwuah/accounts/pkg"
+	"github.com/stretchr/testify/require"
+)
+
+func TestLineHash(t *testing.T) {
+	at := time.Date(2024, 1, 1, 10, 0, 0, 123456000, time.UTC)
+	first := pkg.LineHash("", 1, 2, 1000, "credit", at)
+	require.Len(t, first, 64)
+	require.Equal(t, first, pkg.LineHash("", 1, 2, 1000, "credit", at.In(time.FixedZone("GMT+1", 3600))))
+
+	require.NotEqual(t, first, pkg.LineHash("", 1, 2, 1001, "credit", at))
+	require.NotEqual(t, first, pkg.LineHash("", 1, 2, 1000, "debit", at))
+	require.NotEqual(t, first, pkg.LineHash("", 1, 2, 1000, "credit", at.Add(time.Microsecond)))
+	require.NotEqual(t, pkg.LineHash(first, 1, 3, 1000, "debit", at), pkg.LineHash("", 1, 3, 1000, "debit", at))
+}
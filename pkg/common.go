@@ -4,20 +4,85 @@ import (
 	"crypto/rand"
 	"fmt"
 	"math/big"
+	"strings"
+)
+
+// AccountRole identifies what a system account is used for.
+// System accounts live in the reserved 000xxxxxx range of account numbers: the middle
+// three digits are the role and the last three the currency's ISO 4217 numeric code.
+type AccountRole string
+
+const (
+	GenesisRole    AccountRole = "000"
+	FXPositionRole AccountRole = "001"
+	FXRevenueRole  AccountRole = "002"
+	FeeRevenueRole AccountRole = "003"
+	// InterestExpenseRole accounts fund the interest paid out on customer accounts.
+	InterestExpenseRole AccountRole = "004"
 
-	"github.com/shopspring/decimal"
+	// LegacyGenesisAccountNumber is the USD genesis account, which predates multi-currency support.
+	LegacyGenesisAccountNumber = "000000000"
+
+	systemAccountPrefix = "000"
+	systemAccountRange  = 1e6
 )
 
-func ConvertToCents(v float64) int64 {
-	return int64(v * 100)
+// CreateAccountNumber generates a customer account number.
+// Numbers in the system account range are never handed out.
+func CreateAccountNumber() string {
+	n, _ := rand.Int(rand.Reader, big.NewInt(1e9-systemAccountRange))
+	return fmt.Sprintf("%09d", n.Int64()+systemAccountRange)
 }
 
-func ConvertToUnit(v int64) float64 {
-	f, _ := decimal.NewFromInt(v).DivRound(decimal.NewFromInt(100), 2).Float64()
-	return f
+var roleNames = map[AccountRole]string{
+	GenesisRole:         "genesis",
+	FXPositionRole:      "fx_position",
+	FXRevenueRole:       "fx_revenue",
+	FeeRevenueRole:      "fee_revenue",
+	InterestExpenseRole: "interest_expense",
 }
 
-func CreateAccountNumber() string {
-	n, _ := rand.Int(rand.Reader, big.NewInt(1e9))
-	return fmt.Sprintf("%09d", n.Int64())
+// Name returns what the role is called in reports, eg. "fee_revenue".
+func (r AccountRole) Name() string {
+	if name, ok := roleNames[r]; ok {
+		return name
+	}
+	return "system"
+}
+
+// SystemAccountRole returns the role of a system account, from its account number.
+func SystemAccountRole(accountNumber string) AccountRole {
+	if accountNumber == LegacyGenesisAccountNumber {
+		return GenesisRole
+	}
+	return AccountRole(accountNumber[len(systemAccountPrefix) : len(systemAccountPrefix)+3])
+}
+
+// SystemAccountRoles returns the roles every currency has a system account for.
+func SystemAccountRoles() []AccountRole {
+	return []AccountRole{GenesisRole, FXPositionRole, FXRevenueRole, FeeRevenueRole, InterestExpenseRole}
+}
+
+func SystemAccountNumber(role AccountRole, c Currency) string {
+	if role == GenesisRole && c.Code == USD {
+		return LegacyGenesisAccountNumber
+	}
+	return systemAccountPrefix + string(role) + c.Numeric
+}
+
+func GenesisAccountNumber(c Currency) string {
+	return SystemAccountNumber(GenesisRole, c)
+}
+
+func IsSystemAccountNumber(accountNumber string) bool {
+	return len(accountNumber) == 9 && strings.HasPrefix(accountNumber, systemAccountPrefix)
+}
+
+func IsGenesisAccountNumber(accountNumber string) bool {
+	for _, c := range currencies {
+		if GenesisAccountNumber(c) == accountNumber {
+			return true
+		}
+	}
+	return false
 }
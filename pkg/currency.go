@@ -0,0 +1,78 @@
+package pkg
+
+import (
+	"errors"
+	"fmt"
+	"sort"
+	"strings"
+
+	"github.com/shopspring/decimal"
+)
+
+const (
+	USD = "USD"
+
+	DefaultCurrency = USD
+)
+
+// Currency describes an ISO 4217 currency. Exponent is the number of minor units
+// (digits after the decimal point) the currency uses, which is also the precision
+// we store its amounts in.
+type Currency struct {
+	Code     string `json:"code"`
+	Numeric  string `json:"numeric"`
+	Exponent int32  `json:"exponent"`
+}
+
+var currencies = map[string]Currency{
+	"USD": {Code: "USD", Numeric: "840", Exponent: 2},
+	"EUR": {Code: "EUR", Numeric: "978", Exponent: 2},
+	"GBP": {Code: "GBP", Numeric: "826", Exponent: 2},
+	"CHF": {Code: "CHF", Numeric: "756", Exponent: 2},
+	"CAD": {Code: "CAD", Numeric: "124", Exponent: 2},
+	"GHS": {Code: "GHS", Numeric: "936", Exponent: 2},
+	"NGN": {Code: "NGN", Numeric: "566", Exponent: 2},
+	"KES": {Code: "KES", Numeric: "404", Exponent: 2},
+	"JPY": {Code: "JPY", Numeric: "392", Exponent: 0},
+	"KRW": {Code: "KRW", Numeric: "410", Exponent: 0},
+	"KWD": {Code: "KWD", Numeric: "414", Exponent: 3},
+	"BHD": {Code: "BHD", Numeric: "048", Exponent: 3},
+}
+
+func GetCurrency(code string) (Currency, error) {
+	c, ok := currencies[strings.ToUpper(strings.TrimSpace(code))]
+	if !ok {
+		return Currency{}, fmt.Errorf("unsupported currency '%s'", code)
+	}
+	return c, nil
+}
+
+// Currencies returns every supported currency, ordered by code.
+func Currencies() []Currency {
+	out := make([]Currency, 0, len(currencies))
+	for _, c := range currencies {
+		out = append(out, c)
+	}
+	sort.Slice(out, func(i, j int) bool {
+		return out[i].Code < out[j].Code
+	})
+	return out
+}
+
+// ConvertToMinor converts an amount in major units (eg. dollars) into the currency's minor units (eg. cents).
+// Amounts that are more precise than the currency allows (eg. 0.001 USD) are rejected rather than rounded.
+func ConvertToMinor(v decimal.Decimal, c Currency) (int64, error) {
+	minor := v.Shift(c.Exponent)
+	if !minor.IsInteger() {
+		return 0, fmt.Errorf("%s amounts can't have more than %d decimal places", c.Code, c.Exponent)
+	}
+	if !minor.BigInt().IsInt64() {
+		return 0, errors.New("amount is too large")
+	}
+	return minor.IntPart(), nil
+}
+
+// ConvertToMajor converts an amount in the currency's minor units back into major units.
+func ConvertToMajor(v int64, c Currency) decimal.Decimal {
+	return decimal.New(v, -c.Exponent)
+}
@@ -0,0 +1,102 @@
+package pkg_test
+
+import (
+	"testing"
+
+	"github.com/gwuah/accounts/pkg"
+	"github.com/shopspring/decimal"
+	"github.com/stretchr/testify/require"
+)
+
+func TestConvertToMinor(t *testing.T) {
+	type TestCase struct {
+		input    string
+		currency string
+		output   int64
+	}
+
+	cases := []TestCase{
+		{
+			input:    "14.58",
+			currency: "USD",
+			output:   1458,
+		},
+		{
+			input:    "0.29",
+			currency: "USD",
+			output:   29,
+		},
+		{
+			input:    "1458",
+			currency: "JPY",
+			output:   1458,
+		},
+		{
+			input:    "1.234",
+			currency: "KWD",
+			output:   1234,
+		},
+	}
+
+	for _, tc := range cases {
+		c, err := pkg.GetCurrency(tc.currency)
+		require.NoError(t, err)
+		minor, err := pkg.ConvertToMinor(decimal.RequireFromString(tc.input), c)
+		require.NoError(t, err)
+		require.Equal(t, tc.output, minor)
+		require.Equal(t, tc.input, pkg.ConvertToMajor(tc.output, c).String())
+	}
+
+	// amounts more precise than the currency are rejected
+	usd, _ := pkg.GetCurrency("USD")
+	_, err := pkg.ConvertToMinor(decimal.RequireFromString("0.001"), usd)
+	require.Error(t, err)
+	jpy, _ := pkg.GetCurrency("JPY")
+	_, err = pkg.ConvertToMinor(decimal.RequireFromString("10.5"), jpy)
+	require.Error(t, err)
+	_, err = pkg.ConvertToMinor(decimal.RequireFromString("1e30"), usd)
+	require.Error(t, err)
+}
+
+func TestGetCurrency(t *testing.T) {
+	c, err := pkg.GetCurrency("eur")
+	require.NoError(t, err)
+	require.Equal(t, "EUR", c.Code)
+
+	_, err = pkg.GetCurrency("XYZ")
+	require.Error(t, err)
+}
+
+func TestSystemAccountNumbers(t *testing.T) {
+	usd, _ := pkg.GetCurrency("USD")
+	eur, _ := pkg.GetCurrency("EUR")
+
+	require.Equal(t, pkg.LegacyGenesisAccountNumber, pkg.GenesisAccountNumber(usd))
+	require.Equal(t, "000000978", pkg.GenesisAccountNumber(eur))
+	require.True(t, pkg.IsGenesisAccountNumber("000000978"))
+	require.True(t, pkg.IsSystemAccountNumber("000000978"))
+
+	for i := 0; i < 1000; i++ {
+		require.False(t, pkg.IsSystemAccountNumber(pkg.CreateAccountNumber()))
+	}
+}
+
+func TestConvertCurrency(t *testing.T) {
+	usd, _ := pkg.GetCurrency("USD")
+	eur, _ := pkg.GetCurrency("EUR")
+	jpy, _ := pkg.GetCurrency("JPY")
+
+	converted, spread := pkg.ConvertCurrency(10000, usd, eur, decimal.RequireFromString("0.92"), 0)
+	require.Equal(t, int64(9200), converted)
+	require.Equal(t, int64(0), spread)
+
+	// 1% spread
+	converted, spread = pkg.ConvertCurrency(10000, usd, eur, decimal.RequireFromString("0.92"), 100)
+	require.Equal(t, int64(9108), converted)
+	require.Equal(t, int64(92), spread)
+
+	// 1.23 USD -> JPY at 151.37, the leftover fraction of a yen goes to the spread
+	converted, spread = pkg.ConvertCurrency(123, usd, jpy, decimal.RequireFromString("151.37"), 0)
+	require.Equal(t, int64(186), converted)
+	require.Equal(t, int64(0), spread)
+}
@@ -0,0 +1,20 @@
+package pkg
+
+import (
+	"github.com/shopspring/decimal"
+)
+
+// CalculateFee computes the fee on an amount, in minor units: a flat part plus a percentage (in basis points),
+// rounded half up and then held within [minFee, maxFee]. A zero maxFee means the fee isn't capped.
+func CalculateFee(amount, flat, percentageBps, minFee, maxFee int64) int64 {
+	percentage := decimal.New(amount, 0).Mul(decimal.New(percentageBps, 0)).Div(decimal.New(basisPoints, 0)).Round(0).IntPart()
+
+	fee := flat + percentage
+	if fee < minFee {
+		fee = minFee
+	}
+	if maxFee > 0 && fee > maxFee {
+		fee = maxFee
+	}
+	return fee
+}
@@ -0,0 +1,29 @@
+package pkg_test
+
+import (
+	"testing"
+
+	"github.com/gwuah/accounts/pkg"
+	"github.com/stretchr/testify/require"
+)
+
+func TestCalculateFee(t *testing.T) {
+	type TestCase struct {
+		amount, flat, bps, min, max int64
+		output                      int64
+	}
+
+	cases := []TestCase{
+		{amount: 10000, flat: 50, output: 50},
+		{amount: 10000, bps: 150, output: 150},
+		{amount: 10000, flat: 25, bps: 150, output: 175},
+		{amount: 333, bps: 150, output: 5},
+		{amount: 100, bps: 150, min: 30, output: 30},
+		{amount: 1000000, bps: 150, max: 1000, output: 1000},
+		{amount: 1000000, bps: 150, output: 15000},
+	}
+
+	for _, tc := range cases {
+		require.Equal(t, tc.output, pkg.CalculateFee(tc.amount, tc.flat, tc.bps, tc.min, tc.max))
+	}
+}
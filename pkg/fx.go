@@ -0,0 +1,19 @@
+package pkg
+
+import (
+	"github.com/shopspring/decimal"
+)
+
+const basisPoints = 10000
+
+// ConvertCurrency converts an amount in the source currency's minor units into the destination currency's minor units.
+// The spread (in basis points) is taken off the converted amount and returned separately, so it can be booked as revenue.
+// Converted amounts are always rounded down, the fraction of a minor unit lost to rounding goes to the spread.
+func ConvertCurrency(amount int64, from, to Currency, rate decimal.Decimal, spreadBps int64) (converted int64, spread int64) {
+	gross := decimal.New(amount, -from.Exponent).Mul(rate)
+	net := gross.Mul(decimal.New(basisPoints-spreadBps, 0)).Div(decimal.New(basisPoints, 0))
+
+	grossMinor := gross.Shift(to.Exponent).Floor().IntPart()
+	converted = net.Shift(to.Exponent).Floor().IntPart()
+	return converted, grossMinor - converted
+}
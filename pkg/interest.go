@@ -0,0 +1,42 @@
+package pkg
+
+import (
+	"time"
+
+	"github.com/shopspring/decimal"
+)
+
+// Day count conventions decide how much of a year's interest a single day accrues.
+const (
+	// ACT365 accrues every calendar day as 1/365th of a year, leap years included.
+	ACT365 = "ACT/365"
+	// Thirty360 treats every month as 30 days of a 360 day year: the 31st accrues nothing
+	// and the last day of february accrues the days february is short of 30.
+	Thirty360 = "30/360"
+)
+
+func IsDayCountConvention(convention string) bool {
+	return convention == ACT365 || convention == Thirty360
+}
+
+// DayCountFraction returns the fraction of a year the given day accrues under the convention.
+func DayCountFraction(convention string, day time.Time) decimal.Decimal {
+	if convention != Thirty360 {
+		return decimal.New(1, 0).Div(decimal.New(365, 0))
+	}
+
+	days := int64(1)
+	switch {
+	case day.Day() == 31:
+		days = 0
+	case day.Month() == time.February && day.AddDate(0, 0, 1).Month() == time.March:
+		days = int64(31 - day.Day())
+	}
+	return decimal.New(days, 0).Div(decimal.New(360, 0))
+}
+
+// DailyInterest returns the interest a balance accrues in a day at the given APR (a percentage), in fractions of minor units.
+// Fractions are kept so daily accruals can be summed up before they're rounded, once they're posted.
+func DailyInterest(balance int64, apr decimal.Decimal, convention string, day time.Time) decimal.Decimal {
+	return decimal.New(balance, 0).Mul(apr).Div(decimal.New(100, 0)).Mul(DayCountFraction(convention, day)).Round(10)
+}
@@ -0,0 +1,33 @@
+package pkg_test
+
+import (
+	"testing"
+	"time"
+
+	"github.com/gwuah/accounts/pkg"
+	"github.com/shopspring/decimal"
+	"github.com/stretchr/testify/require"
+)
+
+func TestDailyInterest(t *testing.T) {
+	sum := func(convention string, from, to time.Time) decimal.Decimal {
+		total := decimal.Zero
+		for day := from; day.Before(to); day = day.AddDate(0, 0, 1) {
+			total = total.Add(pkg.DailyInterest(100000, decimal.RequireFromString("3.6"), convention, day))
+		}
+		return total
+	}
+	date := func(year int, month time.Month, day int) time.Time {
+		return time.Date(year, month, day, 0, 0, 0, 0, time.UTC)
+	}
+
+	// 30/360 accrues every month as 30 days, whatever its length
+	for _, month := range []time.Time{date(2023, 1, 1), date(2023, 2, 1), date(2024, 2, 1), date(2024, 4, 1)} {
+		require.Equal(t, "300", sum(pkg.Thirty360, month, month.AddDate(0, 1, 0)).Round(4).String(), month)
+	}
+	require.Equal(t, "3600", sum(pkg.Thirty360, date(2023, 1, 1), date(2024, 1, 1)).Round(4).String())
+
+	// ACT/365 accrues calendar days
+	require.Equal(t, "3600", sum(pkg.ACT365, date(2023, 1, 1), date(2024, 1, 1)).Round(4).String())
+	require.Equal(t, "310", pkg.DailyInterest(100000, decimal.RequireFromString("3.65"), pkg.ACT365, date(2024, 1, 1)).Mul(decimal.New(31, 0)).String())
+}
@@ -0,0 +1,31 @@
+package pkg
+
+import (
+	"math"
+	"time"
+)
+
+// RateLimit is a token bucket, refilled at PerMinute tokens a minute up to Burst. A request takes a token.
+type RateLimit struct {
+	PerMinute int
+	Burst     int
+}
+
+// Enabled reports whether the limit applies, a limit without a rate or a burst lets everything through.
+func (l RateLimit) Enabled() bool {
+	return l.PerMinute > 0 && l.Burst > 0
+}
+
+// Take takes a token from a bucket that held tokens at last, after refilling it up to now.
+// It returns the tokens left, whether one was taken and, when there was none, how long until there's one.
+func (l RateLimit) Take(tokens float64, last, now time.Time) (float64, bool, time.Duration) {
+	perSecond := float64(l.PerMinute) / 60
+	if elapsed := now.Sub(last).Seconds(); elapsed > 0 {
+		tokens = math.Min(float64(l.Burst), tokens+elapsed*perSecond)
+	}
+	if tokens >= 1 {
+		return tokens - 1, true, 0
+	}
+	wait := time.Duration(math.Ceil((1 - tokens) / perSecond * float64(time.Second)))
+	return tokens, false, wait
+}
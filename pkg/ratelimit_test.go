@@ -0,0 +1,36 @@
+package pkg_test
+
+import (
+	"testing"
+	"time"
+
+	"github.com/gwuah/accounts/pkg"
+	"github.com/stretchr/testify/require"
+)
+
+func TestRateLimit(t *testing.T) {
+	limit := pkg.RateLimit{PerMinute: 60, Burst: 2}
+	now := time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)
+
+	// a full bucket serves its burst right away
+	tokens, ok, _ := limit.Take(2, now, now)
+	require.True(t, ok)
+	tokens, ok, _ = limit.Take(tokens, now, now)
+	require.True(t, ok)
+	tokens, ok, wait := limit.Take(tokens, now, now)
+	require.False(t, ok)
+	require.Equal(t, time.Second, wait)
+
+	// and refills at its rate, never above its burst
+	half := now.Add(500 * time.Millisecond)
+	tokens, ok, wait = limit.Take(tokens, now, half)
+	require.False(t, ok)
+	require.Equal(t, 500*time.Millisecond, wait)
+	_, ok, _ = limit.Take(tokens, half, now.Add(time.Second))
+	require.True(t, ok)
+	tokens, _, _ = limit.Take(0, now, now.Add(time.Hour))
+	require.Equal(t, float64(1), tokens)
+
+	require.False(t, pkg.RateLimit{}.Enabled())
+	require.True(t, limit.Enabled())
+}
@@ -0,0 +1,19 @@
+package pkg
+
+// Role is a named set of permissions that can be bound to users.
+type Role struct {
+	Name        string
+	Permissions []string
+}
+
+// DefaultRoles returns the roles every deployment starts with. Operators run the back office, support staff only read.
+func DefaultRoles() []Role {
+	return []Role{
+		{Name: "admin", Permissions: []string{"*"}},
+		{Name: "operator", Permissions: []string{
+			"users:read", "accounts:read", "accounts:freeze", "transactions:read", "transactions:write", "transactions:reverse",
+			"holds:read", "approvals:read", "approvals:write",
+		}},
+		{Name: "support", Permissions: []string{"users:read", "accounts:read", "transactions:read", "holds:read"}},
+	}
+}
@@ -0,0 +1,38 @@
+package pkg_test
+
+import (
+	"io"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gwuah/accounts/pkg"
+	"github.com/stretchr/testify/require"
+)
+
+func TestRequestSignature(t *testing.T) {
+	now := time.Now()
+	req := httptest.NewRequest("POST", "/transactions?dry=1", strings.NewReader(`{"amount":10}`))
+	require.NoError(t, pkg.SignRequest(req, "secret", now))
+
+	// the body is still there to be sent
+	body, err := io.ReadAll(req.Body)
+	require.NoError(t, err)
+	require.Equal(t, `{"amount":10}`, string(body))
+
+	nonce, err := pkg.VerifyRequest("secret", req, body, 5*time.Minute, now.Add(time.Minute))
+	require.NoError(t, err)
+	require.Equal(t, req.Header.Get(pkg.SignatureNonceHeader), nonce)
+
+	_, err = pkg.VerifyRequest("other", req, body, 5*time.Minute, now)
+	require.Error(t, err)
+	_, err = pkg.VerifyRequest("secret", req, []byte(`{"amount":1000}`), 5*time.Minute, now)
+	require.Error(t, err)
+	_, err = pkg.VerifyRequest("secret", req, body, 5*time.Minute, now.Add(10*time.Minute))
+	require.Error(t, err)
+
+	req.URL.Path = "/holds"
+	_, err = pkg.VerifyRequest("secret", req, body, 5*time.Minute, now)
+	require.Error(t, err)
+}
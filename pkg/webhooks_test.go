@@ -0,0 +1,24 @@
+package pkg_test
+
+import (
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gwuah/accounts/pkg"
+	"github.com/stretchr/testify/require"
+)
+
+func TestWebhookSignature(t *testing.T) {
+	body := []byte(`{"type":"transaction.posted"}`)
+	at := time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)
+
+	header := pkg.SignWebhook("secret", at, body)
+	require.True(t, strings.HasPrefix(header, "t=1704067200,v1="))
+	require.NoError(t, pkg.VerifyWebhook("secret", header, body, 5*time.Minute, at.Add(time.Minute)))
+
+	require.EqualError(t, pkg.VerifyWebhook("other", header, body, 5*time.Minute, at), "signature mismatch")
+	require.EqualError(t, pkg.VerifyWebhook("secret", header, []byte(`{}`), 5*time.Minute, at), "signature mismatch")
+	require.EqualError(t, pkg.VerifyWebhook("secret", header, body, 5*time.Minute, at.Add(time.Hour)), "signature expired")
+	require.EqualError(t, pkg.VerifyWebhook("secret", "v1=abc", body, 5*time.Minute, at), "malformed signature")
+}